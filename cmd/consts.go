@@ -20,6 +20,11 @@ const (
 	defFileServerPassword	= "admin"
 	defSkipTlsVerify		= false
 	defFsUseTls				= false
+	defMailServerPort		= 25
+	defMailFrom				= "submit@localhost"
+	defPasswordResetNotifier	= "email"
+	defOidcGroupsClaim			= "groups"
+	defOidcAutoProvision		= false
 
 	flagConfigFile        	= "config-file"
 	flagDbDir             	= "db-dir"
@@ -39,4 +44,25 @@ const (
 	flagTrustedCaFile		= "trusted-ca-file"
 	flagSkipTlsVerify		= "skip-tls-verify"
 	flagFsUseTls			= "fs-use-tls"
+	flagMailServerHost		= "mail-server-host"
+	flagMailServerPort		= "mail-server-port"
+	flagMailServerUser		= "mail-server-user"
+	flagMailServerPassword	= "mail-server-password"
+	flagMailFrom			= "mail-from"
+	flagPasswordResetNotifier	= "password-reset-notifier"
+	flagMaxUserLoginFailures	= "max-user-login-failures"
+	flagMaxIpLoginFailures		= "max-ip-login-failures"
+	flagLoginFailureBaseDelay	= "login-failure-base-delay"
+	flagLoginLockoutDuration	= "login-lockout-duration"
+	flagOidcIssuer				= "oidc-issuer"
+	flagOidcClientId			= "oidc-client-id"
+	flagOidcClientSecret		= "oidc-client-secret"
+	flagOidcRedirectUrl			= "oidc-redirect-url"
+	flagOidcScopes				= "oidc-scopes"
+	flagOidcAutoProvision		= "oidc-auto-provision"
+	flagOidcUserNameClaim		= "oidc-user-name-claim"
+	flagOidcGroupsClaim			= "oidc-groups-claim"
+	flagOidcGroupRoles			= "oidc-group-roles"
+	flagOidcGroupStudentCourses	= "oidc-group-student-courses"
+	flagOidcGroupStaffCourses	= "oidc-group-staff-courses"
 )
@@ -5,8 +5,11 @@ import (
 	"context"
 	"fmt"
 	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/courses"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/DAv10195/submit_server/fs"
+	"github.com/DAv10195/submit_server/mail"
+	"github.com/DAv10195/submit_server/oidc"
 	"github.com/DAv10195/submit_server/path"
 	"github.com/DAv10195/submit_server/server"
 	"github.com/DAv10195/submit_server/session"
@@ -70,7 +73,7 @@ func newStartCommand(ctx context.Context, args []string) *cobra.Command {
 			if err := db.InitDB(dir); err != nil {
 				return err
 			}
-			fsPwd, err := handleConfigEncryption(viper.GetString(flagFileServerPassword), configFilePath)
+			fsPwd, err := handleConfigEncryption(viper.GetString(flagFileServerPassword), flagFileServerPassword, configFilePath)
 			if err != nil {
 				return err
 			}
@@ -78,14 +81,80 @@ func newStartCommand(ctx context.Context, args []string) *cobra.Command {
 			if err := fs.Init(viper.GetString(flagFileServerHost), viper.GetInt(flagFileServerPort), viper.GetString(flagFileServerUser), fsPwd, viper.GetBool(flagFsUseTls), viper.GetString(flagTrustedCaFile), viper.GetBool(flagSkipTlsVerify)); err != nil {
 				return err
 			}
+			// initialize the mail transport if a mail server is configured
+			if mailHost := viper.GetString(flagMailServerHost); mailHost != "" {
+				mailPwd := viper.GetString(flagMailServerPassword)
+				if mailPwd != "" {
+					encryptedMailPwd, err := handleConfigEncryption(mailPwd, flagMailServerPassword, configFilePath)
+					if err != nil {
+						return err
+					}
+					if mailPwd, err = db.Decrypt(encryptedMailPwd); err != nil {
+						return err
+					}
+				}
+				mail.Init(mailHost, viper.GetInt(flagMailServerPort), viper.GetString(flagMailServerUser), mailPwd, viper.GetString(flagMailFrom))
+			}
+			// set how password reset tokens are delivered to users
+			if err := server.SetPasswordResetNotifier(viper.GetString(flagPasswordResetNotifier)); err != nil {
+				return err
+			}
+			// configure the protection against brute forcing passwords
+			server.SetLoginProtection(&server.LoginProtectionConfig{
+				MaxUserFailures:	viper.GetInt(flagMaxUserLoginFailures),
+				MaxIpFailures:		viper.GetInt(flagMaxIpLoginFailures),
+				BaseDelay:			viper.GetDuration(flagLoginFailureBaseDelay),
+				LockoutDuration:	viper.GetDuration(flagLoginLockoutDuration),
+			})
 			// initialize the session management
 			if err := session.Init(dir); err != nil {
 				return err
 			}
+			// enable single sign-on if an OpenID Connect provider is configured
+			if issuer := viper.GetString(flagOidcIssuer); issuer != "" {
+				clientSecret := viper.GetString(flagOidcClientSecret)
+				if clientSecret != "" {
+					encryptedClientSecret, err := handleConfigEncryption(clientSecret, flagOidcClientSecret, configFilePath)
+					if err != nil {
+						return err
+					}
+					if clientSecret, err = db.Decrypt(encryptedClientSecret); err != nil {
+						return err
+					}
+				}
+				provider, err := oidc.NewProvider(&oidc.Config{
+					Issuer:			issuer,
+					ClientId:		viper.GetString(flagOidcClientId),
+					ClientSecret:	clientSecret,
+					RedirectUrl:	viper.GetString(flagOidcRedirectUrl),
+					Scopes:			viper.GetStringSlice(flagOidcScopes),
+				}, nil)
+				if err != nil {
+					return err
+				}
+				if err := server.SetSso(provider, &server.SsoConfig{
+					AutoProvision:			viper.GetBool(flagOidcAutoProvision),
+					UserNameClaim:			viper.GetString(flagOidcUserNameClaim),
+					GroupsClaim:			viper.GetString(flagOidcGroupsClaim),
+					GroupRoles:				viper.GetStringMapString(flagOidcGroupRoles),
+					GroupStudentCourses:	viper.GetStringMapString(flagOidcGroupStudentCourses),
+					GroupStaffCourses:		viper.GetStringMapString(flagOidcGroupStaffCourses),
+				}); err != nil {
+					return err
+				}
+			}
 			// make sure the default admin user exists
 			if err := users.InitDefaultAdmin(); err != nil {
 				return err
 			}
+			// give courses created before courses had announcements their message box
+			if err := courses.InitMessageBoxes(); err != nil {
+				return err
+			}
+			// index elements which were written before they could be searched
+			if err := server.BuildSearchIndex(); err != nil {
+				return err
+			}
 			// run the server
 			tlsConf, err := server.GetTlsConfig(viper.GetString(flagTlsCertFile), viper.GetString(flagTlsKeyFile))
 			if err != nil {
@@ -140,6 +209,17 @@ func newStartCommand(ctx context.Context, args []string) *cobra.Command {
 	viper.SetDefault(flagFileServerPassword, defFileServerPassword)
 	viper.SetDefault(flagSkipTlsVerify, defSkipTlsVerify)
 	viper.SetDefault(flagFsUseTls, defFsUseTls)
+	viper.SetDefault(flagMailServerPort, defMailServerPort)
+	viper.SetDefault(flagMailFrom, defMailFrom)
+	viper.SetDefault(flagPasswordResetNotifier, defPasswordResetNotifier)
+	viper.SetDefault(flagMaxUserLoginFailures, server.DefMaxUserLoginFailures)
+	viper.SetDefault(flagMaxIpLoginFailures, server.DefMaxIpLoginFailures)
+	viper.SetDefault(flagLoginFailureBaseDelay, server.DefLoginFailureBaseDelay)
+	viper.SetDefault(flagLoginLockoutDuration, server.DefLoginLockoutDuration)
+	viper.SetDefault(flagOidcScopes, []string{"profile", "email"})
+	viper.SetDefault(flagOidcAutoProvision, defOidcAutoProvision)
+	viper.SetDefault(flagOidcUserNameClaim, server.DefSsoUserNameClaim)
+	viper.SetDefault(flagOidcGroupsClaim, defOidcGroupsClaim)
 	startCmd.Flags().AddFlagSet(configFlagSet)
 	startCmd.Flags().Int(flagLogFileMaxBackups, viper.GetInt(flagLogFileMaxBackups), "maximum number of log file rotations")
 	startCmd.Flags().Int(flagLogFileMaxSize, viper.GetInt(flagLogFileMaxSize), "maximum size of the log file before it's rotated")
@@ -158,6 +238,27 @@ func newStartCommand(ctx context.Context, args []string) *cobra.Command {
 	startCmd.Flags().Bool(flagSkipTlsVerify, viper.GetBool(flagSkipTlsVerify), "skip tls verification")
 	startCmd.Flags().String(flagTrustedCaFile, viper.GetString(flagTrustedCaFile), "trusted ca bundle path")
 	startCmd.Flags().Bool(flagFsUseTls, viper.GetBool(flagFsUseTls), "use tls when accessing submit file server")
+	startCmd.Flags().String(flagMailServerHost, viper.GetString(flagMailServerHost), "smtp server hostname (or ip address). Email notifications are disabled if not specified")
+	startCmd.Flags().Int(flagMailServerPort, viper.GetInt(flagMailServerPort), "smtp server port")
+	startCmd.Flags().String(flagMailServerUser, viper.GetString(flagMailServerUser), "user to be used when authenticating against the smtp server")
+	startCmd.Flags().String(flagMailServerPassword, viper.GetString(flagMailServerPassword), "password to be used when authenticating against the smtp server")
+	startCmd.Flags().String(flagMailFrom, viper.GetString(flagMailFrom), "address email notifications are sent from")
+	startCmd.Flags().String(flagPasswordResetNotifier, viper.GetString(flagPasswordResetNotifier), "how password reset tokens are delivered to users [email, log]")
+	startCmd.Flags().Int(flagMaxUserLoginFailures, viper.GetInt(flagMaxUserLoginFailures), "number of failed login attempts after which a user is locked out")
+	startCmd.Flags().Int(flagMaxIpLoginFailures, viper.GetInt(flagMaxIpLoginFailures), "number of failed login attempts after which an ip address is locked out")
+	startCmd.Flags().Duration(flagLoginFailureBaseDelay, viper.GetDuration(flagLoginFailureBaseDelay), "delay after repeated failed login attempts, doubled with each further failure")
+	startCmd.Flags().Duration(flagLoginLockoutDuration, viper.GetDuration(flagLoginLockoutDuration), "duration of lockouts due to failed login attempts")
+	startCmd.Flags().String(flagOidcIssuer, viper.GetString(flagOidcIssuer), "issuer url of an OpenID Connect provider for single sign-on. Single sign-on is disabled if not specified")
+	startCmd.Flags().String(flagOidcClientId, viper.GetString(flagOidcClientId), "client id of the submit server at the OpenID Connect provider")
+	startCmd.Flags().String(flagOidcClientSecret, viper.GetString(flagOidcClientSecret), "client secret of the submit server at the OpenID Connect provider")
+	startCmd.Flags().String(flagOidcRedirectUrl, viper.GetString(flagOidcRedirectUrl), "url the OpenID Connect provider redirects users back to (the /sso/oidc/callback path of the submit server)")
+	startCmd.Flags().StringSlice(flagOidcScopes, viper.GetStringSlice(flagOidcScopes), "scopes requested from the OpenID Connect provider in addition to openid")
+	startCmd.Flags().Bool(flagOidcAutoProvision, viper.GetBool(flagOidcAutoProvision), "create users logging in with single sign-on for the first time?")
+	startCmd.Flags().String(flagOidcUserNameClaim, viper.GetString(flagOidcUserNameClaim), "id token claim holding the user name of provisioned users. Users are identified by the subject of their id tokens")
+	startCmd.Flags().String(flagOidcGroupsClaim, viper.GetString(flagOidcGroupsClaim), "id token claim holding the groups of the user")
+	startCmd.Flags().StringToString(flagOidcGroupRoles, viper.GetStringMapString(flagOidcGroupRoles), "groups mapped to the roles granted to their members [std_user, secretary]")
+	startCmd.Flags().StringToString(flagOidcGroupStudentCourses, viper.GetStringMapString(flagOidcGroupStudentCourses), "groups mapped to the course (number:year) their members are students in")
+	startCmd.Flags().StringToString(flagOidcGroupStaffCourses, viper.GetStringMapString(flagOidcGroupStaffCourses), "groups mapped to the course (number:year) their members are staff members in")
 	if err := viper.ReadInConfig(); err != nil && !os.IsNotExist(err) {
 		setupErr = err
 	}
@@ -165,7 +266,7 @@ func newStartCommand(ctx context.Context, args []string) *cobra.Command {
 }
 
 // encrypt passwords if they are not encrypted yet
-func handleConfigEncryption(pwd, configFilePath string) (string, error) {
+func handleConfigEncryption(pwd, pwdFlag, configFilePath string) (string, error) {
 	var writeToConfRequired bool
 	var err error
 	var encryptedPassword string
@@ -189,8 +290,8 @@ func handleConfigEncryption(pwd, configFilePath string) (string, error) {
 				return "", err
 			}
 			for i := 0; i < len(confLines); i++ {
-				if strings.Contains(confLines[i], flagFileServerPassword) {
-					confLines[i] = fmt.Sprintf("%s: %s%s", flagFileServerPassword, encryptedPrefix, encryptedPassword)
+				if strings.Contains(confLines[i], pwdFlag) {
+					confLines[i] = fmt.Sprintf("%s: %s%s", pwdFlag, encryptedPrefix, encryptedPassword)
 				}
 			}
 			if err = writeConfLines(confLines, configFilePath); err != nil {
@@ -7,40 +7,143 @@ import (
 	"github.com/boltdb/bolt"
 )
 
-// update (or create, if they don't exist yet) the given elements in the DB
-func Update(asUser string, elements ...IBucketElement) error {
-	if len(elements) == 0 {
-		return nil
+// write the given element in the given transaction, returning the event describing the write
+func put(tx *bolt.Tx, asUser string, element IBucketElement) (*Event, error) {
+	bucket := element.Bucket()
+	dbBucket := tx.Bucket(bucket)
+	if dbBucket == nil {
+		err := &ErrBucketNotFound{string(bucket)}
+		logger.WithError(err).Errorf("error updating \"%s\" bucket", string(bucket))
+		return nil, err
 	}
-	return db.Update(func (tx *bolt.Tx) error {
-		for _, element := range elements {
-			bucket := element.Bucket()
-			dbBucket := tx.Bucket(bucket)
-			if dbBucket == nil {
-				err := &ErrBucketNotFound{string(bucket)}
-				logger.WithError(err).Errorf("error updating \"%s\" bucket", string(bucket))
-				return err
-			}
-			key := element.Key()
-			if dbBucket.Get(key) == nil {
-				logger.Debugf("inserting element with key = \"%s\" into \"%s\" bucket", string(key), string(bucket))
-				element.MarkInsert(asUser)
-			} else {
-				logger.Debugf("updating element with key = \"%s\" in \"%s\" bucket", string(key), string(bucket))
-				element.MarkUpdate(asUser)
+	key := element.Key()
+	event := &Event{Bucket: string(bucket), Key: string(key), AsUser: asUser}
+	if previous := dbBucket.Get(key); previous == nil {
+		logger.Debugf("inserting element with key = \"%s\" into \"%s\" bucket", string(key), string(bucket))
+		element.MarkInsert(asUser)
+		event.Action = Inserted
+	} else {
+		logger.Debugf("updating element with key = \"%s\" in \"%s\" bucket", string(key), string(bucket))
+		element.MarkUpdate(asUser)
+		event.Action = Updated
+		event.Previous = copyBytes(previous)
+	}
+	objectBytes, err := json.Marshal(element)
+	if err != nil {
+		logger.WithError(err).Errorf("error updating key = \"%s\" in \"%s\" bucket", string(key), string(bucket))
+		return nil, err
+	}
+	if err := dbBucket.Put(key, objectBytes); err != nil {
+		logger.WithError(err).Errorf("error updating key = \"%s\" in \"%s\" bucket", string(key), string(bucket))
+		return nil, err
+	}
+	if searchable, ok := element.(ISearchable); ok {
+		if searchIndex := tx.Bucket([]byte(SearchIndex)); searchIndex != nil {
+			if err := index(searchIndex, searchable); err != nil {
+				logger.WithError(err).Errorf("error indexing key = \"%s\" in \"%s\" bucket", string(key), string(bucket))
+				return nil, err
 			}
-			objectBytes, err := json.Marshal(element)
+		}
+	}
+	event.Data = objectBytes
+	return event, nil
+}
+
+// write the given elements in a single transaction, returning the events describing the writes
+func update(asUser string, elements []IBucketElement) ([]*Event, error) {
+	var events []*Event
+	if err := db.Update(func (tx *bolt.Tx) error {
+		for _, element := range elements {
+			event, err := put(tx, asUser, element)
 			if err != nil {
-				logger.WithError(err).Errorf("error updating key = \"%s\" in \"%s\" bucket", string(key), string(bucket))
 				return err
 			}
-			if err := dbBucket.Put(key, objectBytes); err != nil {
-				logger.WithError(err).Errorf("error updating key = \"%s\" in \"%s\" bucket", string(key), string(bucket))
+			events = append(events, event)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// update (or create, if they don't exist yet) the given elements in the DB
+func Update(asUser string, elements ...IBucketElement) error {
+	if len(elements) == 0 {
+		return nil
+	}
+	events, err := update(asUser, elements)
+	if err != nil {
+		return err
+	}
+	publish(events)
+	return nil
+}
+
+// update (or create, if they don't exist yet) the given elements in the DB without publishing events, for frequent
+// bookkeeping writes which are of no interest to subscribers
+func UpdateWithoutEvents(asUser string, elements ...IBucketElement) error {
+	if len(elements) == 0 {
+		return nil
+	}
+	_, err := update(asUser, elements)
+	return err
+}
+
+// load the given element from the DB (if it exists), change it with the given function and write it back, all in a
+// single transaction so concurrent changes of the element aren't lost. Nothing is written if the function fails
+func Modify(asUser string, element IBucketElement, modify func() error) error {
+	var event *Event
+	if err := db.Update(func (tx *bolt.Tx) error {
+		dbBucket := tx.Bucket(element.Bucket())
+		if dbBucket == nil {
+			err := &ErrBucketNotFound{string(element.Bucket())}
+			logger.WithError(err).Errorf("error updating \"%s\" bucket", string(element.Bucket()))
+			return err
+		}
+		if current := dbBucket.Get(element.Key()); current != nil {
+			if err := json.Unmarshal(current, element); err != nil {
 				return err
 			}
 		}
-		return nil
-	})
+		if err := modify(); err != nil {
+			return err
+		}
+		var err error
+		event, err = put(tx, asUser, element)
+		return err
+	}); err != nil {
+		return err
+	}
+	publish([]*Event{event})
+	return nil
+}
+
+// delete the given key (if it exists) from the given bucket in the given transaction, returning the event describing
+// the deletion (nil if the key doesn't exist)
+func remove(tx *bolt.Tx, bucket, key []byte) (*Event, error) {
+	dbBucket := tx.Bucket(bucket)
+	if dbBucket == nil {
+		err := &ErrBucketNotFound{string(bucket)}
+		logger.WithError(err).Errorf("error deleting keys from \"%s\" bucket", string(bucket))
+		return nil, err
+	}
+	previous := dbBucket.Get(key)
+	if previous == nil {
+		return nil, nil
+	}
+	event := &Event{Action: Deleted, Bucket: string(bucket), Key: string(key), Previous: copyBytes(previous)}
+	if err := dbBucket.Delete(key); err != nil {
+		logger.WithError(err).Errorf("error deleting key = \"%s\" from \"%s\" bucket", string(key), string(bucket))
+		return nil, err
+	}
+	if searchIndex := tx.Bucket([]byte(SearchIndex)); searchIndex != nil {
+		if err := unindex(searchIndex, string(bucket), string(key)); err != nil {
+			logger.WithError(err).Errorf("error unindexing key = \"%s\" from \"%s\" bucket", string(key), string(bucket))
+			return nil, err
+		}
+	}
+	return event, nil
 }
 
 // delete the given elements (if they exist) from the DB
@@ -48,23 +151,57 @@ func Delete(elements ...IBucketElement) error {
 	if len(elements) == 0 {
 		return nil
 	}
-	return db.Update(func (tx *bolt.Tx) error {
+	var events []*Event
+	if err := db.Update(func (tx *bolt.Tx) error {
 		for _, element := range elements {
-			bucket := element.Bucket()
-			dbBucket := tx.Bucket(bucket)
-			if dbBucket == nil {
-				err := &ErrBucketNotFound{string(bucket)}
-				logger.WithError(err).Errorf("error deleting elements from \"%s\" bucket", string(bucket))
+			event, err := remove(tx, element.Bucket(), element.Key())
+			if err != nil {
 				return err
 			}
-			key := element.Key()
-			if err := dbBucket.Delete(key); err != nil {
-				logger.WithError(err).Errorf("error deleting key = \"%s\" from \"%s\" bucket", string(key), string(bucket))
-				return err
+			if event != nil {
+				events = append(events, event)
 			}
 		}
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+	publish(events)
+	return nil
+}
+
+// load the given element from the DB and delete it if the given function approves, all in a single transaction so
+// the element is deleted at most once even when it's taken concurrently. Returns an ErrKeyNotFoundInBucket error if
+// the element doesn't exist
+func DeleteIf(element IBucketElement, approve func() (bool, error)) error {
+	var event *Event
+	if err := db.Update(func (tx *bolt.Tx) error {
+		dbBucket := tx.Bucket(element.Bucket())
+		if dbBucket == nil {
+			err := &ErrBucketNotFound{string(element.Bucket())}
+			logger.WithError(err).Errorf("error deleting elements from \"%s\" bucket", string(element.Bucket()))
+			return err
+		}
+		current := dbBucket.Get(element.Key())
+		if current == nil {
+			return &ErrKeyNotFoundInBucket{Bucket: string(element.Bucket()), Key: string(element.Key())}
+		}
+		if err := json.Unmarshal(current, element); err != nil {
+			return err
+		}
+		approved, err := approve()
+		if err != nil || !approved {
+			return err
+		}
+		event, err = remove(tx, element.Bucket(), element.Key())
+		return err
+	}); err != nil {
+		return err
+	}
+	if event != nil {
+		publish([]*Event{event})
+	}
+	return nil
 }
 
 // delete the given keys from the given bucket
@@ -72,21 +209,23 @@ func DeleteKeysFromBucket(bucket []byte, keys ...[]byte) error {
 	if len(keys) == 0 {
 		return nil
 	}
-	return db.Update(func (tx *bolt.Tx) error {
-		dbBucket := tx.Bucket(bucket)
-		if dbBucket == nil {
-			err := &ErrBucketNotFound{string(bucket)}
-			logger.WithError(err).Errorf("error deleting keys from \"%s\" bucket", string(bucket))
-			return err
-		}
+	var events []*Event
+	if err := db.Update(func (tx *bolt.Tx) error {
 		for _, key := range keys {
-			if err := dbBucket.Delete(key); err != nil {
-				logger.WithError(err).Errorf("error deleting key = \"%s\" from \"%s\" bucket", string(key), string(bucket))
+			event, err := remove(tx, bucket, key)
+			if err != nil {
 				return err
 			}
+			if event != nil {
+				events = append(events, event)
+			}
 		}
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+	publish(events)
+	return nil
 }
 
 // determines if the given key exists in the given bucket
@@ -138,6 +277,27 @@ func QueryBucket(bucket []byte, process BucketElementProcessingFunc) error {
 	})
 }
 
+// given a bucket, a key prefix and a processing function, process the elements in that bucket whose keys start with
+// the prefix, without going over the rest of the bucket
+func QueryBucketWithPrefix(bucket, prefix []byte, process BucketElementProcessingFunc) error {
+	return db.View(func (tx *bolt.Tx) error {
+		dbBucket := tx.Bucket(bucket)
+		if dbBucket == nil {
+			err := &ErrBucketNotFound{string(bucket)}
+			logger.WithError(err).Errorf("error querying \"%s\" bucket", string(bucket))
+			return err
+		}
+		dbCursor := dbBucket.Cursor()
+		for elementKey, elementBytes := dbCursor.Seek(prefix); elementKey != nil && bytes.HasPrefix(elementKey, prefix); elementKey, elementBytes = dbCursor.Next() {
+			if err := process(elementKey, elementBytes); err != nil {
+				logger.WithError(err).Errorf("error querying \"%s\" bucket", string(bucket))
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // given a bucket and a key, return the bytes of the data assigned with that key
 func GetFromBucket(bucket, key []byte) ([]byte, error) {
 	var data bytes.Buffer
@@ -131,4 +131,158 @@ func TestQueryAndGet(t *testing.T) {
 	if mockElement.Field != mockElementFromDb2.Field {
 		t.Fatalf("expected get to return the same element but it didn't")
 	}
+	// only the elements whose keys start with the prefix are queried
+	for _, field := range []string{"a:1", "a:2", "b:1"} {
+		if err := Update(System, &mockBucketElement{Field: field}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	if err := QueryBucketWithPrefix(mockElement.Bucket(), []byte("a:"), func (key, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "a:1" || keys[1] != "a:2" {
+		t.Fatalf("expected the prefix query to return a:1 and a:2 but got %v", keys)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dbPath, err := setDbWithMockBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(){
+		if err := os.Remove(dbPath); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	var events []*Event
+	unsubscribe := Subscribe(func (event *Event) {
+		events = append(events, event)
+	})
+	mockElement := &mockBucketElement{Field: mock}
+	if err := Update(System, mockElement); err != nil {
+		t.Fatal(err)
+	}
+	if err := Update(mock, mockElement); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(mockElement); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(mockElement); err != nil { // deleting an element which doesn't exist shouldn't publish events
+		t.Fatal(err)
+	}
+	if err := UpdateWithoutEvents(System, mockElement); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := KeyExistsInBucket(mockElement.Bucket(), mockElement.Key()); err != nil || !exists {
+		t.Fatal("expected the element to be written without publishing events")
+	}
+	unsubscribe()
+	if err := Update(System, mockElement); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events to be published but got %d", len(events))
+	}
+	expected := []struct{
+		action		int
+		asUser		string
+		data		bool
+		previous	bool
+	}{
+		{Inserted, System, true, false},
+		{Updated, mock, true, true},
+		{Deleted, "", false, true},
+	}
+	for i, e := range expected {
+		event := events[i]
+		if event.Action != e.action || event.AsUser != e.asUser || event.Bucket != mock || event.Key != mock ||
+			(event.Data != nil) != e.data || (event.Previous != nil) != e.previous {
+			t.Fatalf("unexpected event #%d: %+v", i, event)
+		}
+	}
+}
+
+func TestModify(t *testing.T) {
+	dbPath, err := setDbWithMockBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(){
+		if err := os.Remove(dbPath); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	stored := &mockBucketElement{Field: mock}
+	if err := Update(System, stored); err != nil {
+		t.Fatal(err)
+	}
+	// the element is loaded before it's changed
+	modified := &mockBucketElement{Field: mock}
+	if err := Modify(mock, modified, func() error {
+		if modified.CreatedBy != System {
+			return fmt.Errorf("expected the stored element to be loaded, got %+v", modified)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if modified.UpdatedBy != mock {
+		t.Fatal("expected the element to be written back")
+	}
+	// nothing is written if the change fails
+	if err := Modify(System, &mockBucketElement{Field: fmt.Sprintf("%s1", mock)}, func() error {
+		return fmt.Errorf("failure")
+	}); err == nil {
+		t.Fatal("expected the error of the change to be returned")
+	}
+	if exists, err := KeyExistsInBucket([]byte(mock), []byte(fmt.Sprintf("%s1", mock))); err != nil || exists {
+		t.Fatal("expected nothing to be written when the change fails")
+	}
+}
+
+func TestDeleteIf(t *testing.T) {
+	dbPath, err := setDbWithMockBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(){
+		if err := os.Remove(dbPath); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := Update(System, &mockBucketElement{Field: mock}); err != nil {
+		t.Fatal(err)
+	}
+	// the element is loaded before deciding whether to delete it
+	loaded := &mockBucketElement{Field: mock}
+	if err := DeleteIf(loaded, func() (bool, error) {
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.CreatedBy != System {
+		t.Fatalf("expected the stored element to be loaded, got %+v", loaded)
+	}
+	if exists, err := KeyExistsInBucket([]byte(mock), []byte(mock)); err != nil || !exists {
+		t.Fatal("expected the element to be kept when the deletion isn't approved")
+	}
+	if err := DeleteIf(&mockBucketElement{Field: mock}, func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := KeyExistsInBucket([]byte(mock), []byte(mock)); err != nil || exists {
+		t.Fatal("expected the element to be deleted when the deletion is approved")
+	}
+	if err := DeleteIf(&mockBucketElement{Field: mock}, func() (bool, error) {
+		return true, nil
+	}); err == nil {
+		t.Fatal("expected deleting an element which doesn't exist to fail")
+	}
 }
@@ -24,4 +24,12 @@ const (
 	Agents						= "agents"
 	Tasks						= "tasks"
 	TaskResponses				= "task_responses"
+	Emails						= "emails"
+	Jobs						= "jobs"
+	PasswordResetTokens			= "password_reset_tokens"
+	Sessions					= "sessions"
+	LoginAttempts				= "login_attempts"
+	AuditEvents					= "audit_events"
+	ForumPosts					= "forum_posts"
+	SearchIndex					= "search_index"
 )
@@ -0,0 +1,68 @@
+package db
+
+import "sync"
+
+// possible event action values
+const (
+	Inserted	= iota
+	Updated		= iota
+	Deleted		= iota
+)
+
+// an event describing a write to the DB. Events are published to subscribers after the write is committed
+type Event struct {
+	Action		int
+	Bucket		string
+	Key			string
+	AsUser		string
+	// the bytes of the element after the write (nil when deleted)
+	Data		[]byte
+	// the bytes of the element before the write (nil when inserted)
+	Previous	[]byte
+}
+
+// a function handling events published by the DB. Handlers are invoked synchronously by the writing goroutine, so
+// they should return quickly and must not modify the given event
+type EventHandler func(*Event)
+
+var subscribers = make(map[int]EventHandler)
+var nextSubscriberId int
+var subscribersMutex = &sync.RWMutex{}
+
+// subscribe the given handler to events published by the DB. Returns a function for unsubscribing the handler
+func Subscribe(handler EventHandler) func() {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	id := nextSubscriberId
+	nextSubscriberId++
+	subscribers[id] = handler
+	return func() {
+		subscribersMutex.Lock()
+		defer subscribersMutex.Unlock()
+		delete(subscribers, id)
+	}
+}
+
+// publish the given events to all subscribers
+func publish(events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+	subscribersMutex.RLock()
+	defer subscribersMutex.RUnlock()
+	for _, handler := range subscribers {
+		for _, event := range events {
+			handler(event)
+		}
+	}
+}
+
+// copy bytes returned by bolt, which are valid only during the transaction
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
@@ -8,7 +8,7 @@ import (
 	"path/filepath"
 )
 
-var buckets = []string{Courses, Users, AssignmentInstances, AssignmentDefinitions, MessageBoxes, Messages, Tests, Appeals, Agents, Tasks, TaskResponses}
+var buckets = []string{Courses, Users, AssignmentInstances, AssignmentDefinitions, MessageBoxes, Messages, Tests, Appeals, Agents, Tasks, TaskResponses, Emails, Jobs, PasswordResetTokens, Sessions, LoginAttempts, AuditEvents, ForumPosts, SearchIndex}
 
 var db *bolt.DB
 
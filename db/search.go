@@ -0,0 +1,174 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// prefixes of the keys in the search index bucket. Term keys map a term to an element containing it
+// ("terms:<term>:<bucket>:<key>") and doc keys hold the terms an element was indexed with ("docs:<bucket>:<key>"),
+// so an element can be removed from the index without knowing its contents
+const (
+	searchTermsPrefix	= "terms"
+	searchDocsPrefix	= "docs"
+)
+
+// implementors of this interface are elements that can be found by full-text search. The index is maintained when the
+// elements are updated or deleted
+type ISearchable interface {
+	IBucketElement
+	// get the text the element should be found by
+	SearchText() string
+}
+
+// an element found by full-text search
+type SearchHit struct {
+	Bucket	string
+	Key		string
+}
+
+// split the given text into lower case terms of letters and digits, without duplicates
+func Tokenize(text string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, term := range strings.FieldsFunc(strings.ToLower(text), func (r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func searchDocKey(bucket, key string) []byte {
+	return []byte(strings.Join([]string{searchDocsPrefix, bucket, key}, KeySeparator))
+}
+
+func searchTermKey(term, bucket, key string) []byte {
+	return []byte(strings.Join([]string{searchTermsPrefix, term, bucket, key}, KeySeparator))
+}
+
+// remove the element with the given bucket and key from the search index
+func unindex(searchIndex *bolt.Bucket, bucket, key string) error {
+	docKey := searchDocKey(bucket, key)
+	termsBytes := searchIndex.Get(docKey)
+	if termsBytes == nil {
+		return nil
+	}
+	var terms []string
+	if err := json.Unmarshal(termsBytes, &terms); err != nil {
+		return err
+	}
+	for _, term := range terms {
+		if err := searchIndex.Delete(searchTermKey(term, bucket, key)); err != nil {
+			return err
+		}
+	}
+	return searchIndex.Delete(docKey)
+}
+
+// replace the terms of the given element in the search index
+func index(searchIndex *bolt.Bucket, element ISearchable) error {
+	bucket, key := string(element.Bucket()), string(element.Key())
+	if err := unindex(searchIndex, bucket, key); err != nil {
+		return err
+	}
+	terms := Tokenize(element.SearchText())
+	if len(terms) == 0 {
+		return nil
+	}
+	for _, term := range terms {
+		if err := searchIndex.Put(searchTermKey(term, bucket, key), []byte{}); err != nil {
+			return err
+		}
+	}
+	termsBytes, err := json.Marshal(terms)
+	if err != nil {
+		return err
+	}
+	return searchIndex.Put(searchDocKey(bucket, key), termsBytes)
+}
+
+// index all elements in the given bucket, decoding each of them into the element returned by the given function. Used
+// for elements written before they were searchable
+func IndexBucket(bucket string, newElement func() ISearchable) error {
+	return db.Update(func (tx *bolt.Tx) error {
+		dbBucket, searchIndex := tx.Bucket([]byte(bucket)), tx.Bucket([]byte(SearchIndex))
+		if dbBucket == nil {
+			return &ErrBucketNotFound{bucket}
+		}
+		if searchIndex == nil {
+			return &ErrBucketNotFound{SearchIndex}
+		}
+		return dbBucket.ForEach(func (_ []byte, elementBytes []byte) error {
+			element := newElement()
+			if err := json.Unmarshal(elementBytes, element); err != nil {
+				return err
+			}
+			return index(searchIndex, element)
+		})
+	})
+}
+
+// return the elements containing all terms of the given query, each of them as a whole term or as the prefix of a term.
+// If buckets are given, only elements in them are returned. Hits are ordered by bucket and key
+func Search(query string, buckets ...string) ([]*SearchHit, error) {
+	queryTerms := Tokenize(query)
+	if len(queryTerms) == 0 {
+		return nil, nil
+	}
+	inBuckets := make(map[string]bool)
+	for _, bucket := range buckets {
+		inBuckets[bucket] = true
+	}
+	var matches map[string]*SearchHit
+	if err := db.View(func (tx *bolt.Tx) error {
+		searchIndex := tx.Bucket([]byte(SearchIndex))
+		if searchIndex == nil {
+			err := &ErrBucketNotFound{SearchIndex}
+			logger.WithError(err).Error("error searching")
+			return err
+		}
+		for _, queryTerm := range queryTerms {
+			termMatches := make(map[string]*SearchHit)
+			prefix := []byte(strings.Join([]string{searchTermsPrefix, queryTerm}, KeySeparator))
+			cursor := searchIndex.Cursor()
+			for termKey, _ := cursor.Seek(prefix); termKey != nil && bytes.HasPrefix(termKey, prefix); termKey, _ = cursor.Next() {
+				// terms never contain the separator, so the rest of the key is the bucket followed by the element key
+				split := strings.SplitN(string(termKey[len(searchTermsPrefix) + len(KeySeparator):]), KeySeparator, 3)
+				if len(split) != 3 || (len(inBuckets) > 0 && !inBuckets[split[1]]) {
+					continue
+				}
+				docId := strings.Join(split[1:], KeySeparator)
+				if matches != nil && matches[docId] == nil {
+					continue
+				}
+				termMatches[docId] = &SearchHit{Bucket: split[1], Key: split[2]}
+			}
+			matches = termMatches
+			if len(matches) == 0 {
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	hits := make([]*SearchHit, 0, len(matches))
+	for _, hit := range matches {
+		hits = append(hits, hit)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Bucket == hits[j].Bucket {
+			return hits[i].Key < hits[j].Key
+		}
+		return hits[i].Bucket < hits[j].Bucket
+	})
+	return hits, nil
+}
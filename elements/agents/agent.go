@@ -1,17 +1,36 @@
 package agents
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	commons "github.com/DAv10195/submit_commons"
 	"github.com/DAv10195/submit_server/db"
 	"time"
 )
 
+// length in bytes of the salt of agent credentials
+const credentialSaltLength = 16
+
 // possible status values
 const (
 	Up 		= iota
 	Down	= iota
 )
 
+// possible registration state values. Legacy agents were enrolled before agents had to be approved, so they're
+// trusted without a credential until an admin approves (issuing a credential to them), disables or revokes them
+const (
+	Legacy		= iota
+	Pending		= iota
+	Approved	= iota
+	Draining	= iota
+	Disabled	= iota
+	Revoked		= iota
+)
+
 // agent
 type Agent struct {
 	db.ABucketElement
@@ -22,6 +41,9 @@ type Agent struct {
 	OsType			string		`json:"os_type"`
 	Architecture	string		`json:"architecture"`
 	Status			int			`json:"status"`
+	State			int			`json:"state"`
+	Credential		string		`json:"credential"`
+	CredentialSalt	string		`json:"credential_salt"`
 	NumRunningTasks	int			`json:"num_running_tasks"`
 	LastKeepalive	time.Time	`json:"last_keepalive"`
 }
@@ -34,6 +56,54 @@ func (a *Agent) Bucket() []byte {
 	return []byte(db.Agents)
 }
 
+func hashCredential(salt, credential string) string {
+	hash := sha256.Sum256([]byte(salt + credential))
+	return hex.EncodeToString(hash[:])
+}
+
+// generate a new credential for the agent, store only its salted hash and return the credential itself
+func (a *Agent) NewCredential() (string, error) {
+	saltBytes := make([]byte, credentialSaltLength)
+	if _, err := rand.Read(saltBytes); err != nil {
+		return "", err
+	}
+	credential := commons.GenerateUniqueId()
+	a.CredentialSalt = hex.EncodeToString(saltBytes)
+	a.Credential = hashCredential(a.CredentialSalt, credential)
+	return credential, nil
+}
+
+// returns a boolean indicating if the given credential is the one issued to the agent
+func (a *Agent) VerifyCredential(credential string) bool {
+	if a.Credential == "" || credential == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashCredential(a.CredentialSalt, credential)), []byte(a.Credential)) == 1
+}
+
+// returns a boolean indicating if the agent can run tasks: it's approved or was enrolled before agents were approved
+func (a *Agent) IsApproved() bool {
+	return a.State == Approved || a.State == Legacy
+}
+
+// register a new agent with the given id, bound to the given user. The agent is pending approval
+func Register(agentId, user string, withDbUpdate bool) (*Agent, error) {
+	exists, err := db.KeyExistsInBucket([]byte(db.Agents), []byte(agentId))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, &db.ErrKeyExistsInBucket{Bucket: db.Agents, Key: agentId}
+	}
+	agent := &Agent{ID: agentId, User: user, Status: Down, State: Pending}
+	if withDbUpdate {
+		if err := db.Update(user, agent); err != nil {
+			return nil, err
+		}
+	}
+	return agent, nil
+}
+
 // return the agent represented by the given agent id if that agent exists
 func Get(agentId string) (*Agent, error) {
 	agentBytes, err := db.GetFromBucket([]byte(db.Agents), []byte(agentId))
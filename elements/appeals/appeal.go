@@ -2,22 +2,67 @@ package appeals
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/messages"
+	"time"
 )
 
 // possible appeal state values
 const (
-	Open 	= iota
-	Closed 	= iota
+	Open 		= iota
+	Closed 		= iota
+	Escalated	= iota
 )
 
+// possible appeal categories
+const (
+	CategoryGradingError	= "grading_error"
+	CategoryTestIssue		= "test_issue"
+	CategoryMissingCredit	= "missing_credit"
+	CategoryOther			= "other"
+)
+
+var Categories = containers.NewStringSet()
+
+// possible appeal resolution outcomes
+const (
+	OutcomeAccepted				= "accepted"
+	OutcomePartiallyAccepted	= "partially_accepted"
+	OutcomeRejected				= "rejected"
+)
+
+var Outcomes = containers.NewStringSet()
+
+func init() {
+	Categories.Add(CategoryGradingError, CategoryTestIssue, CategoryMissingCredit, CategoryOther)
+	Outcomes.Add(OutcomeAccepted, OutcomePartiallyAccepted, OutcomeRejected)
+}
+
+// the resolution of an appeal
+type Resolution struct {
+	Outcome			string		`json:"outcome"`
+	PreviousGrade	int			`json:"previous_grade"`
+	Grade			int			`json:"grade"`
+	Comment			string		`json:"comment"`
+	ResolvedBy		string		`json:"resolved_by"`
+	ResolvedByRole	string		`json:"resolved_by_role"`
+	ResolvedOn		time.Time	`json:"resolved_on"`
+}
+
 // appeal
 type Appeal struct {
 	db.ABucketElement
-	AssignmentInstance	string	`json:"assignment_instance"`
-	State				int		`json:"state"`
-	MessageBox			string	`json:"message_box"`
+	AssignmentInstance	string			`json:"assignment_instance"`
+	State				int				`json:"state"`
+	MessageBox			string			`json:"message_box"`
+	Category			string			`json:"category"`
+	RequestedChange		string			`json:"requested_change"`
+	AssignedTo			string			`json:"assigned_to"`
+	Resolution			*Resolution		`json:"resolution"`
+	EscalatedTo			string			`json:"escalated_to"`
+	History				[]*Transition	`json:"history"`
 }
 
 func Get(id string) (*Appeal, error) {
@@ -44,8 +89,13 @@ func Delete(appeal *Appeal) error {
 	return db.Delete(appeal)
 }
 
-// create a new appeal
-func New(assInst string, asUser string, withDbUpdate bool) (*Appeal, error) {
+// create a new appeal with the given category and requested change
+func New(assInst, category, requestedChange string, asUser string, withDbUpdate bool) (*Appeal, error) {
+	if category == "" {
+		category = CategoryOther
+	} else if !Categories.Contains(category) {
+		return nil, fmt.Errorf("invalid appeal category: %s", category)
+	}
 	exists, err := db.KeyExistsInBucket([]byte(db.AssignmentInstances), []byte(assInst))
 	if err != nil {
 		return nil, err
@@ -60,7 +110,8 @@ func New(assInst string, asUser string, withDbUpdate bool) (*Appeal, error) {
 	if exists {
 		return nil, &db.ErrKeyExistsInBucket{Bucket: db.Appeals, Key: assInst}
 	}
-	appeal := &Appeal{AssignmentInstance: assInst, State: Open}
+	appeal := &Appeal{AssignmentInstance: assInst, State: Open, Category: category, RequestedChange: requestedChange}
+	appeal.record(ActionCreate, Open, &Actor{UserName: asUser}, "")
 	if withDbUpdate {
 		mBox := messages.NewMessageBox()
 		appeal.MessageBox = mBox.ID
@@ -0,0 +1,27 @@
+package appeals
+
+import "fmt"
+
+type ErrInvalidResolution struct {
+	Message	string
+}
+
+func (e *ErrInvalidResolution) Error() string {
+	return fmt.Sprintf("invalid appeal resolution: %s", e.Message)
+}
+
+type ErrInvalidTransition struct {
+	Message	string
+}
+
+func (e *ErrInvalidTransition) Error() string {
+	return fmt.Sprintf("invalid appeal state transition: %s", e.Message)
+}
+
+type ErrTransitionForbidden struct {
+	Message	string
+}
+
+func (e *ErrTransitionForbidden) Error() string {
+	return fmt.Sprintf("forbidden appeal state transition: %s", e.Message)
+}
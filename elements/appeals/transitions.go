@@ -0,0 +1,184 @@
+package appeals
+
+import (
+	"fmt"
+	"time"
+)
+
+// possible appeal state transition actions
+const (
+	ActionCreate	= "create"
+	ActionReopen	= "reopen"
+	ActionClose		= "close"
+	ActionResolve	= "resolve"
+	ActionEscalate	= "escalate"
+)
+
+// possible kinds of actors performing appeal state transitions
+const (
+	ActorStudent			= "student"
+	ActorTeachingAssistant	= "ta"
+	ActorLecturer			= "lecturer"
+	ActorAdmin				= "admin"
+)
+
+// number of times the owner of an appeal can reopen it
+const MaxStudentReopens = 1
+
+// the states each action can be performed in and the state it leads to
+var transitions = map[string]struct{
+	from	[]int
+	to		int
+}{
+	ActionReopen:	{[]int{Closed}, Open},
+	ActionClose:	{[]int{Open, Escalated}, Closed},
+	ActionResolve:	{[]int{Open, Escalated}, Closed},
+	ActionEscalate:	{[]int{Closed}, Escalated},
+}
+
+// the user performing an appeal state transition and the kind of that user in the course of the appeal
+type Actor struct {
+	UserName	string
+	Kind		string
+}
+
+// a state transition of an appeal
+type Transition struct {
+	Action		string		`json:"action"`
+	From		int			`json:"from"`
+	To			int			`json:"to"`
+	By			string		`json:"by"`
+	Role		string		`json:"role,omitempty"`
+	At			time.Time	`json:"at"`
+	Comment		string		`json:"comment,omitempty"`
+}
+
+// the number of times the appeal was reopened by its owner
+func (a *Appeal) studentReopens() int {
+	reopens := 0
+	for _, t := range a.History {
+		if t.Action == ActionReopen && t.Role == ActorStudent {
+			reopens++
+		}
+	}
+	return reopens
+}
+
+// check if the given actor can perform the given action in the current state of the appeal, returning the state the
+// action leads to. Once an appeal is escalated, only the lecturer it was escalated to and admins can change it
+func (a *Appeal) checkTransition(action string, actor *Actor) (int, error) {
+	transition, ok := transitions[action]
+	if !ok {
+		return 0, &ErrInvalidTransition{fmt.Sprintf("unknown action '%s'", action)}
+	}
+	validFrom := false
+	for _, from := range transition.from {
+		validFrom = validFrom || a.State == from
+	}
+	if !validFrom {
+		return 0, &ErrInvalidTransition{fmt.Sprintf("can't %s an appeal in state %d", action, a.State)}
+	}
+	if a.EscalatedTo != "" && actor.Kind != ActorAdmin && actor.UserName != a.EscalatedTo {
+		return 0, &ErrTransitionForbidden{fmt.Sprintf("appeal was escalated to \"%s\"", a.EscalatedTo)}
+	}
+	switch action {
+		case ActionReopen:
+			if actor.Kind == ActorStudent && a.studentReopens() >= MaxStudentReopens {
+				return 0, &ErrTransitionForbidden{fmt.Sprintf("an appeal can be reopened by its owner only %d time(s)", MaxStudentReopens)}
+			}
+		case ActionClose, ActionResolve:
+			if actor.Kind == ActorStudent {
+				return 0, &ErrTransitionForbidden{fmt.Sprintf("only staff members can %s an appeal", action)}
+			}
+		case ActionEscalate:
+			if actor.Kind != ActorStudent && actor.Kind != ActorAdmin {
+				return 0, &ErrTransitionForbidden{"only the owner of an appeal can escalate it"}
+			}
+			if a.Resolution == nil || a.Resolution.Outcome != OutcomeRejected || a.Resolution.ResolvedByRole != ActorTeachingAssistant {
+				return 0, &ErrInvalidTransition{"only appeals rejected by a teaching assistant can be escalated"}
+			}
+	}
+	return transition.to, nil
+}
+
+// record a transition of the appeal to the given state
+func (a *Appeal) record(action string, to int, actor *Actor, comment string) {
+	a.History = append(a.History, &Transition{Action: action, From: a.State, To: to, By: actor.UserName, Role: actor.Kind, At: time.Now().UTC(),
+		Comment: comment})
+	a.State = to
+}
+
+// perform the given action, which doesn't require any additional data, on the appeal. Reopening the appeal discards
+// its resolution, so it has to be resolved again before it can be escalated
+func (a *Appeal) Transition(action string, actor *Actor, comment string) error {
+	if action == ActionResolve || action == ActionEscalate {
+		return &ErrInvalidTransition{fmt.Sprintf("action '%s' requires additional data", action)}
+	}
+	to, err := a.checkTransition(action, actor)
+	if err != nil {
+		return err
+	}
+	a.record(action, to, actor, comment)
+	if action == ActionReopen {
+		a.Resolution = nil
+	}
+	return nil
+}
+
+// resolve the appeal with the given outcome, closing it. The given grade is the grade of the appealed assignment
+// instance after the resolution and the current grade is the grade before it. Accepted appeals have to change the
+// grade, which must be between 0 and 100, while rejected appeals must leave it unchanged
+func (a *Appeal) Resolve(outcome string, currentGrade, grade int, comment string, actor *Actor) error {
+	to, err := a.checkTransition(ActionResolve, actor)
+	if err != nil {
+		return err
+	}
+	if !Outcomes.Contains(outcome) {
+		return &ErrInvalidResolution{fmt.Sprintf("invalid outcome '%s'", outcome)}
+	}
+	if grade < 0 || grade > 100 {
+		return &ErrInvalidResolution{fmt.Sprintf("grade (%d) is not >= 0 ^ <= 100", grade)}
+	}
+	if outcome == OutcomeRejected && grade != currentGrade {
+		return &ErrInvalidResolution{"rejecting an appeal can't change the grade"}
+	}
+	if outcome != OutcomeRejected && grade == currentGrade {
+		return &ErrInvalidResolution{fmt.Sprintf("an appeal which is %s must change the grade", outcome)}
+	}
+	a.record(ActionResolve, to, actor, comment)
+	a.Resolution = &Resolution{Outcome: outcome, PreviousGrade: currentGrade, Grade: grade, Comment: comment, ResolvedBy: actor.UserName,
+		ResolvedByRole: actor.Kind, ResolvedOn: a.History[len(a.History) - 1].At}
+	return nil
+}
+
+// escalate the appeal to the given lecturer, who is assigned to handle it from now on
+func (a *Appeal) Escalate(lecturer, comment string, actor *Actor) error {
+	to, err := a.checkTransition(ActionEscalate, actor)
+	if err != nil {
+		return err
+	}
+	if lecturer == "" {
+		return &ErrInvalidTransition{"the course has no lecturer to escalate the appeal to"}
+	}
+	a.record(ActionEscalate, to, actor, comment)
+	a.EscalatedTo, a.AssignedTo = lecturer, lecturer
+	return nil
+}
+
+// return the time since which the appeal is waiting for a response of the staff (zero if it isn't waiting), given the
+// time of the last response of the staff in its message box (zero if there's none)
+func (a *Appeal) WaitingSince(lastStaffResponse time.Time) time.Time {
+	if a.State == Closed {
+		return time.Time{}
+	}
+	// the last transition is the one which opened or escalated the appeal. Appeals created before transitions were
+	// recorded are waiting since they were created
+	since := a.CreatedOn
+	if len(a.History) > 0 {
+		since = a.History[len(a.History) - 1].At
+	}
+	if lastStaffResponse.After(since) {
+		return lastStaffResponse
+	}
+	return since
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/DAv10195/submit_commons/containers"
 	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/forum"
 	"github.com/DAv10195/submit_server/elements/tests"
 	"github.com/DAv10195/submit_server/fs"
 	"strings"
@@ -19,6 +20,24 @@ const (
 	Published	= iota
 )
 
+// possible automatic grading state values
+const (
+	AutoGradeNone		= iota
+	AutoGradeScheduled	= iota
+	AutoGradeInProgress	= iota
+	AutoGradeDone		= iota
+)
+
+// progress of the automatic grading of an assignment definition
+type AutoGradeStatus struct {
+	State			int	`json:"state"`
+	Instances		int	`json:"instances"`
+	NotSubmitted	int	`json:"not_submitted"`
+	TasksCreated	int	`json:"tasks_created"`
+	TasksDone		int	`json:"tasks_done"`
+	TasksFailed		int	`json:"tasks_failed"`
+}
+
 // assignment definition
 type AssignmentDef struct {
 	db.ABucketElement
@@ -28,6 +47,38 @@ type AssignmentDef struct {
 	State			int						`json:"state"`
 	Files			*containers.StringSet	`json:"files"`
 	RequiredFiles 	*containers.StringSet	`json:"required_files"`
+	PublishAt		time.Time				`json:"publish_at"`
+	AutoGradeAt		time.Time				`json:"auto_grade_at"`
+	Status			AutoGradeStatus			`json:"status"`
+	// number of days after an instance is graded during which its owner can appeal. Zero means no limit
+	AppealWindowDays	int						`json:"appeal_window_days"`
+	// whether instances which weren't submitted by their due date are graded with 0
+	ZeroGradeMissing	bool					`json:"zero_grade_missing"`
+}
+
+// validate and set the publication and automatic grading times of the assignment definition and update its automatic
+// grading state accordingly. Zero times mean no scheduled publication or automatic grading. The publication time of a
+// published def and the automatic grading time of a def which is already being graded are left untouched
+func (a *AssignmentDef) SetSchedule(publishAt time.Time, autoGradeAt time.Time) error {
+	if !publishAt.IsZero() && a.State == Draft && !publishAt.Before(a.DueBy) {
+		return errors.New("given publish at time is not before the due by time")
+	}
+	if !autoGradeAt.IsZero() && autoGradeAt.Before(a.DueBy) {
+		return errors.New("given auto grade at time is before the due by time")
+	}
+	if a.State == Draft {
+		a.PublishAt = publishAt
+	}
+	// once automatic grading started its time can't be changed anymore
+	if a.Status.State == AutoGradeNone || a.Status.State == AutoGradeScheduled {
+		a.AutoGradeAt = autoGradeAt
+		if autoGradeAt.IsZero() {
+			a.Status.State = AutoGradeNone
+		} else {
+			a.Status.State = AutoGradeScheduled
+		}
+	}
+	return nil
 }
 
 // get ass def by id
@@ -43,7 +94,7 @@ func GetDef(id string) (*AssignmentDef, error) {
 	return ass, nil
 }
 
-// delete the assignment definition, instances, relevant tests and files
+// delete the assignment definition, instances, relevant tests, forum and files
 func DeleteDef(ass *AssignmentDef, withFsUpdate bool) error {
 	var instToDel []*AssignmentInstance
 	if err := db.QueryBucket([]byte(db.AssignmentInstances), func(_, elemBytes []byte) error {
@@ -81,6 +132,9 @@ func DeleteDef(ass *AssignmentDef, withFsUpdate bool) error {
 			return err
 		}
 	}
+	if err := forum.DeleteForum(string(ass.Key())); err != nil {
+		return err
+	}
 	if err := db.Delete(ass); err != nil {
 		return err
 	}
@@ -116,17 +170,12 @@ func NewDef(course string, dueBy time.Time, name string, asUser string, withDbUp
 	if dueBy.Before(time.Now().UTC()) {
 		return nil, errors.New("given due by time is before current UTC time")
 	}
+	ass := &AssignmentDef{Course: course, DueBy: dueBy, Name: name, State: Draft, Files: containers.NewStringSet(), RequiredFiles: containers.NewStringSet()}
 	if withFsUpdate {
-		split := strings.Split(course, db.KeySeparator)
-		if len(split) != 2 {
-			return nil, fmt.Errorf("invalid course key ('%s')", course)
-		}
-		// each ass def should also have a test folder, so create the entire hierarchy down to the tests folder and the ass folder will be created on the way
-		if err := fs.GetClient().UploadTextToFS(strings.Join([]string{db.Courses, split[0], split[1], name, "tests", submithttp.FsPlaceHolderFileName}, "/"), []byte("")); err != nil {
+		if err := ass.CreateFsFolder(); err != nil {
 			return nil, err
 		}
 	}
-	ass := &AssignmentDef{Course: course, DueBy: dueBy, Name: name, State: Draft, Files: containers.NewStringSet(), RequiredFiles: containers.NewStringSet()}
 	if withDbUpdate {
 		if err := db.Update(asUser, ass); err != nil {
 			return nil, err
@@ -135,6 +184,16 @@ func NewDef(course string, dueBy time.Time, name string, asUser string, withDbUp
 	return ass, nil
 }
 
+// create the folder of the ass def on the file server
+func (a *AssignmentDef) CreateFsFolder() error {
+	split := strings.Split(a.Course, db.KeySeparator)
+	if len(split) != 2 {
+		return fmt.Errorf("invalid course key ('%s')", a.Course)
+	}
+	// each ass def should also have a test folder, so create the entire hierarchy down to the tests folder and the ass folder will be created on the way
+	return fs.GetClient().UploadTextToFS(strings.Join([]string{db.Courses, split[0], split[1], a.Name, "tests", submithttp.FsPlaceHolderFileName}, "/"), []byte(""))
+}
+
 func (a *AssignmentDef) Key() []byte {
 	return []byte(fmt.Sprintf("%s%s%s", a.Course, db.KeySeparator, a.Name))
 }
@@ -142,3 +201,8 @@ func (a *AssignmentDef) Key() []byte {
 func (a *AssignmentDef) Bucket() []byte {
 	return []byte(db.AssignmentDefinitions)
 }
+
+// assignment defs are found by their name and the number and year of their course
+func (a *AssignmentDef) SearchText() string {
+	return fmt.Sprintf("%s %s", a.Name, a.Course)
+}
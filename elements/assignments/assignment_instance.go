@@ -30,6 +30,16 @@ type AssignmentInstance struct {
 	DueBy			time.Time				`json:"due_by"`
 	MarkedAsCopy	bool					`json:"copy"`
 	Grade			int						`json:"grade"`
+	ReminderSent	bool					`json:"reminder_sent"`
+	Archived		bool					`json:"archived"`
+	GradedOn		time.Time				`json:"graded_on"`
+}
+
+// grade the assignment instance with the given grade, recording when the grade was released
+func (a *AssignmentInstance) SetGrade(grade int) {
+	a.Grade = grade
+	a.State = Graded
+	a.GradedOn = time.Now().UTC()
 }
 
 // get ass instance by id
@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"encoding/json"
+	commons "github.com/DAv10195/submit_commons"
+	"github.com/DAv10195/submit_server/db"
+)
+
+// possible audit event types
+const (
+	UserLockedOut	= "user_locked_out"
+	IpLockedOut		= "ip_locked_out"
+	LockoutCleared	= "lockout_cleared"
+	UserProvisioned	= "user_provisioned"
+	SsoLoginDenied	= "sso_login_denied"
+)
+
+// an event recorded in the audit trail. The user who caused the event and the time it happened at are kept in the
+// created by and created on fields
+type Event struct {
+	db.ABucketElement
+	ID			string	`json:"id"`
+	Type		string	`json:"type"`
+	UserName	string	`json:"user_name"`
+	IP			string	`json:"ip"`
+	Details		string	`json:"details"`
+}
+
+func (e *Event) Key() []byte {
+	return []byte(e.ID)
+}
+
+func (e *Event) Bucket() []byte {
+	return []byte(db.AuditEvents)
+}
+
+// get audit event by id
+func Get(id string) (*Event, error) {
+	eventBytes, err := db.GetFromBucket([]byte(db.AuditEvents), []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	event := &Event{}
+	if err := json.Unmarshal(eventBytes, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// record an event of the given type about the given user and ip address in the audit trail
+func Log(eventType, userName, ip, details, asUser string) (*Event, error) {
+	event := &Event{ID: commons.GenerateUniqueId(), Type: eventType, UserName: userName, IP: ip, Details: details}
+	if err := db.Update(asUser, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
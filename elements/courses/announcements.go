@@ -0,0 +1,81 @@
+package courses
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/users"
+)
+
+// possible announcement audience values
+const (
+	AudienceAll			= "all"
+	AudienceStudents	= "students"
+	AudienceStaff		= "staff"
+)
+
+var Audiences = containers.NewStringSet()
+
+func init() {
+	Audiences.Add(AudienceAll, AudienceStudents, AudienceStaff)
+}
+
+// return the users an announcement to the given audience is visible to, or nil if it's visible to every user enrolled
+// in the course. If an assignment name is given, the announcement targets the students who haven't submitted that
+// assignment yet. Staff members can see all of the announcements of their course
+func (c *Course) AnnouncementRecipients(audience, notSubmitted string) (*containers.StringSet, error) {
+	if audience == "" {
+		audience = AudienceAll
+	}
+	if !Audiences.Contains(audience) {
+		return nil, fmt.Errorf("invalid announcement audience: %s", audience)
+	}
+	if audience == AudienceAll && notSubmitted == "" {
+		return nil, nil
+	}
+	courseKey := string(c.Key())
+	var assDefKey string
+	if notSubmitted != "" {
+		if audience == AudienceStaff {
+			return nil, fmt.Errorf("announcements to students who haven't submitted an assignment can't target the staff")
+		}
+		assDefKey = fmt.Sprintf("%s%s%s", courseKey, db.KeySeparator, notSubmitted)
+		if _, err := assignments.GetDef(assDefKey); err != nil {
+			return nil, err
+		}
+	}
+	recipients := containers.NewStringSet()
+	var students []string
+	if err := db.QueryBucket([]byte(db.Users), func(_, elemBytes []byte) error {
+		user := &users.User{}
+		if err := json.Unmarshal(elemBytes, user); err != nil {
+			return err
+		}
+		if user.CoursesAsStaff != nil && user.CoursesAsStaff.Contains(courseKey) {
+			recipients.Add(user.UserName)
+		} else if audience != AudienceStaff && user.CoursesAsStudent != nil && user.CoursesAsStudent.Contains(courseKey) {
+			students = append(students, user.UserName)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for _, student := range students {
+		if assDefKey != "" {
+			assInst, err := assignments.GetInstance(fmt.Sprintf("%s%s%s", assDefKey, db.KeySeparator, student))
+			if err != nil {
+				if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+					continue
+				}
+				return nil, err
+			}
+			if assInst.State != assignments.Assigned {
+				continue
+			}
+		}
+		recipients.Add(student)
+	}
+	return recipients, nil
+}
@@ -8,6 +8,7 @@ import (
 	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/messages"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/DAv10195/submit_server/fs"
 	"time"
@@ -20,6 +21,11 @@ type Course struct {
 	Year        			int                		`json:"year"`
 	Name            		string                	`json:"name"`
 	Files					*containers.StringSet	`json:"files"`
+	StaffRoles				map[string]string		`json:"staff_roles"`
+	// the lecturer escalated appeals are assigned to
+	AppealsLecturer			string					`json:"appeals_lecturer"`
+	// the message box of the announcements of the course
+	MessageBox				string					`json:"message_box"`
 }
 
 func (c *Course) Key() []byte {
@@ -30,6 +36,11 @@ func (c *Course) Bucket() []byte {
 	return []byte(db.Courses)
 }
 
+// courses are found by their number and name
+func (c *Course) SearchText() string {
+	return fmt.Sprintf("%d %s", c.Number, c.Name)
+}
+
 // create a new course with the given number and name
 func NewCourse(number int, name string, asUser string, withDbUpdate bool, withFsUpdate bool) (*Course, error) {
 	if number <= 0 {
@@ -53,16 +64,18 @@ func NewCourse(number int, name string, asUser string, withDbUpdate bool, withFs
 			return nil, err
 		}
 	}
-	course := &Course{Number: number, Year: year, Name: name, Files: containers.NewStringSet()}
+	course := &Course{Number: number, Year: year, Name: name, Files: containers.NewStringSet(), StaffRoles: make(map[string]string)}
 	if withDbUpdate {
-		if err := db.Update(asUser, course); err != nil {
+		box := messages.NewMessageBox()
+		course.MessageBox = box.ID
+		if err := db.Update(asUser, course, box); err != nil {
 			return nil, err
 		}
 	}
 	return course, nil
 }
 
-// delete the course and the assignment definitions
+// delete the course, its announcements and the assignment definitions
 func Delete(course *Course, withFsUpdate bool) error {
 	var defsToDel []*assignments.AssignmentDef
 	if err := db.QueryBucket([]byte(db.AssignmentDefinitions), func(_, elemBytes []byte) error {
@@ -82,6 +95,15 @@ func Delete(course *Course, withFsUpdate bool) error {
 			return err
 		}
 	}
+	if course.MessageBox != "" {
+		box, err := messages.Get(course.MessageBox)
+		if err != nil {
+			return err
+		}
+		if err := messages.Delete(box); err != nil {
+			return err
+		}
+	}
 	if err := db.Delete(course); err != nil {
 		return err
 	}
@@ -126,3 +148,23 @@ func Get(id string) (*Course, error) {
 	}
 	return course, nil
 }
+
+// create the announcements message box of courses created before courses had one
+func InitMessageBoxes() error {
+	var toUpdate []db.IBucketElement
+	if err := db.QueryBucket([]byte(db.Courses), func(_, elemBytes []byte) error {
+		course := &Course{}
+		if err := json.Unmarshal(elemBytes, course); err != nil {
+			return err
+		}
+		if course.MessageBox == "" {
+			box := messages.NewMessageBox()
+			course.MessageBox = box.ID
+			toUpdate = append(toUpdate, course, box)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return db.Update(db.System, toUpdate...)
+}
@@ -0,0 +1,60 @@
+package courses
+
+import "fmt"
+
+// possible course staff role values
+const (
+	Lecturer			= "lecturer"
+	TeachingAssistant	= "ta"
+	Grader				= "grader"
+	Observer			= "observer"
+)
+
+// possible course permission values
+const (
+	PublishAssignment	= "publish_assignment"
+	EditTests			= "edit_tests"
+	Grade				= "grade"
+	ViewCopies			= "view_copies"
+	HandleAppeals		= "handle_appeals"
+	ManageRoster		= "manage_roster"
+	PostAnnouncements	= "post_announcements"
+	ModerateForum		= "moderate_forum"
+)
+
+// permissions granted to each course staff role
+var RolePermissions = map[string][]string{
+	Lecturer:			{PublishAssignment, EditTests, Grade, ViewCopies, HandleAppeals, ManageRoster, PostAnnouncements, ModerateForum},
+	TeachingAssistant:	{EditTests, Grade, ViewCopies, HandleAppeals, PostAnnouncements, ModerateForum},
+	Grader:				{Grade},
+	Observer:			{},
+}
+
+// return the course role of the staff member with the given user name. Staff members without an explicit role are
+// lecturers
+func (c *Course) StaffRole(userName string) string {
+	if role, ok := c.StaffRoles[userName]; ok {
+		return role
+	}
+	return Lecturer
+}
+
+// check if the staff member with the given user name has the given permission in the course
+func (c *Course) HasPermission(userName, permission string) bool {
+	for _, p := range RolePermissions[c.StaffRole(userName)] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// validate the staff roles of the course
+func (c *Course) ValidateStaffRoles() error {
+	for userName, role := range c.StaffRoles {
+		if _, ok := RolePermissions[role]; !ok {
+			return fmt.Errorf("invalid course role for '%s': %s", userName, role)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package emails
+
+import (
+	"encoding/json"
+	commons "github.com/DAv10195/submit_commons"
+	"github.com/DAv10195/submit_server/db"
+	"time"
+)
+
+// an email waiting to be delivered
+type Email struct {
+	db.ABucketElement
+	ID				string		`json:"id"`
+	UserName		string		`json:"user_name"`
+	To				string		`json:"to"`
+	Subject			string		`json:"subject"`
+	Body			string		`json:"body"`
+	Digest			bool		`json:"digest"`
+	Attempts		int			`json:"attempts"`
+	NextAttempt		time.Time	`json:"next_attempt"`
+	LastError		string		`json:"last_error"`
+}
+
+func (e *Email) Key() []byte {
+	return []byte(e.ID)
+}
+
+func (e *Email) Bucket() []byte {
+	return []byte(db.Emails)
+}
+
+// get email by id
+func Get(id string) (*Email, error) {
+	emailBytes, err := db.GetFromBucket([]byte(db.Emails), []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	email := &Email{}
+	if err := json.Unmarshal(emailBytes, email); err != nil {
+		return nil, err
+	}
+	return email, nil
+}
+
+// create a new email to the given user. If digest is true, then the email will be delivered as part of a daily digest
+func New(userName, to, subject, body string, digest bool, asUser string, withDbUpdate bool) (*Email, error) {
+	email := &Email{
+		ID:				commons.GenerateUniqueId(),
+		UserName:		userName,
+		To:				to,
+		Subject:		subject,
+		Body:			body,
+		Digest:			digest,
+		NextAttempt:	time.Now().UTC(),
+	}
+	if withDbUpdate {
+		if err := db.Update(asUser, email); err != nil {
+			return nil, err
+		}
+	}
+	return email, nil
+}
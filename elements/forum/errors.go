@@ -0,0 +1,11 @@
+package forum
+
+import "fmt"
+
+type ErrInvalidPost struct {
+	Message	string
+}
+
+func (e *ErrInvalidPost) Error() string {
+	return fmt.Sprintf("invalid forum post: %s", e.Message)
+}
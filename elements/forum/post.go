@@ -0,0 +1,232 @@
+package forum
+
+import (
+	"encoding/json"
+	commons "github.com/DAv10195/submit_commons"
+	"github.com/DAv10195/submit_server/db"
+	"sort"
+	"strings"
+)
+
+// a question in the forum of an assignment or an answer to such a question
+type Post struct {
+	db.ABucketElement
+	ID				string	`json:"id"`
+	AssignmentDef	string	`json:"assignment_def"`
+	// the id of the question answered by the post (empty for questions)
+	Question		string	`json:"question"`
+	Author			string	`json:"author"`
+	// anonymous posts hide their author from other students, but not from the staff
+	Anonymous		bool	`json:"anonymous"`
+	Title			string	`json:"title"`
+	Text			string	`json:"text"`
+	Pinned			bool	`json:"pinned"`
+	Official		bool	`json:"official"`
+	// questions with an official answer are answered
+	Answered		bool	`json:"answered"`
+}
+
+func (p *Post) Key() []byte {
+	return []byte(p.ID)
+}
+
+func (p *Post) Bucket() []byte {
+	return []byte(db.ForumPosts)
+}
+
+// posts are found by their title and text, but not by their author, who may be anonymous
+func (p *Post) SearchText() string {
+	return strings.Join([]string{p.Title, p.Text}, " ")
+}
+
+// check if the post is a question
+func (p *Post) IsQuestion() bool {
+	return p.Question == ""
+}
+
+// check if the title or text of the post contain the given query, ignoring case
+func (p *Post) Matches(query string) bool {
+	query = strings.ToLower(query)
+	return strings.Contains(strings.ToLower(p.Title), query) || strings.Contains(strings.ToLower(p.Text), query)
+}
+
+// get post by id
+func Get(id string) (*Post, error) {
+	postBytes, err := db.GetFromBucket([]byte(db.ForumPosts), []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	post := &Post{}
+	if err := json.Unmarshal(postBytes, post); err != nil {
+		return nil, err
+	}
+	return post, nil
+}
+
+// create a new question in the forum of the given assignment definition
+func NewQuestion(assDef, author, title, text string, anonymous, withDbUpdate bool) (*Post, error) {
+	if title == "" {
+		return nil, &ErrInvalidPost{"question must have a title"}
+	}
+	question := &Post{ID: commons.GenerateUniqueId(), AssignmentDef: assDef, Author: author, Title: title, Text: text, Anonymous: anonymous}
+	if withDbUpdate {
+		if err := db.Update(author, question); err != nil {
+			return nil, err
+		}
+	}
+	return question, nil
+}
+
+// create a new answer to the given question
+func NewAnswer(question *Post, author, text string, anonymous, withDbUpdate bool) (*Post, error) {
+	if !question.IsQuestion() {
+		return nil, &ErrInvalidPost{"answers can only be posted to questions"}
+	}
+	if text == "" {
+		return nil, &ErrInvalidPost{"answer must have a text"}
+	}
+	answer := &Post{ID: commons.GenerateUniqueId(), AssignmentDef: question.AssignmentDef, Question: question.ID, Author: author, Text: text,
+		Anonymous: anonymous}
+	if withDbUpdate {
+		if err := db.Update(author, answer); err != nil {
+			return nil, err
+		}
+	}
+	return answer, nil
+}
+
+// return the posts matching the given filter, ordered by creation time
+func query(filter func(*Post) bool) ([]*Post, error) {
+	var posts []*Post
+	if err := db.QueryBucket([]byte(db.ForumPosts), func(_, elemBytes []byte) error {
+		post := &Post{}
+		if err := json.Unmarshal(elemBytes, post); err != nil {
+			return err
+		}
+		if filter(post) {
+			posts = append(posts, post)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].CreatedOn.Before(posts[j].CreatedOn)
+	})
+	return posts, nil
+}
+
+// return the questions in the forum of the given assignment definition, pinned questions first and then the newest
+func ListQuestions(assDef string) ([]*Post, error) {
+	questions, err := query(func(p *Post) bool {
+		return p.AssignmentDef == assDef && p.IsQuestion()
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(questions, func(i, j int) bool {
+		if questions[i].Pinned != questions[j].Pinned {
+			return questions[i].Pinned
+		}
+		return questions[i].CreatedOn.After(questions[j].CreatedOn)
+	})
+	return questions, nil
+}
+
+// return the answers to the given question, official answers first and then the oldest
+func ListAnswers(question *Post) ([]*Post, error) {
+	answers, err := query(func(p *Post) bool {
+		return p.Question == question.ID
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(answers, func(i, j int) bool {
+		return answers[i].Official && !answers[j].Official
+	})
+	return answers, nil
+}
+
+// update whether the question of the given answers is answered, excluding the answers with the ids given
+func updateAnswered(question *Post, answers []*Post, excluded ...string) {
+	question.Answered = false
+	for _, answer := range answers {
+		isExcluded := false
+		for _, id := range excluded {
+			isExcluded = isExcluded || answer.ID == id
+		}
+		if answer.Official && !isExcluded {
+			question.Answered = true
+		}
+	}
+}
+
+// mark the given answer as official or not, updating whether its question is answered
+func SetOfficial(answer *Post, official bool, asUser string) error {
+	if answer.IsQuestion() {
+		return &ErrInvalidPost{"only answers can be official"}
+	}
+	question, err := Get(answer.Question)
+	if err != nil {
+		return err
+	}
+	answers, err := ListAnswers(question)
+	if err != nil {
+		return err
+	}
+	answer.Official = official
+	for i := range answers {
+		if answers[i].ID == answer.ID {
+			answers[i] = answer
+		}
+	}
+	updateAnswered(question, answers)
+	return db.Update(asUser, answer, question)
+}
+
+// delete the given post. Deleting a question deletes its answers, while deleting an answer updates whether its
+// question is answered
+func Delete(post *Post, asUser string) error {
+	if post.IsQuestion() {
+		answers, err := ListAnswers(post)
+		if err != nil {
+			return err
+		}
+		toDel := []db.IBucketElement{post}
+		for _, answer := range answers {
+			toDel = append(toDel, answer)
+		}
+		return db.Delete(toDel...)
+	}
+	question, err := Get(post.Question)
+	if err != nil {
+		return err
+	}
+	answers, err := ListAnswers(question)
+	if err != nil {
+		return err
+	}
+	updateAnswered(question, answers, post.ID)
+	if err := db.Update(asUser, question); err != nil {
+		return err
+	}
+	return db.Delete(post)
+}
+
+// delete the forum of the given assignment definition
+func DeleteForum(assDef string) error {
+	var keysToDel [][]byte
+	if err := db.QueryBucket([]byte(db.ForumPosts), func(postKey, elemBytes []byte) error {
+		post := &Post{}
+		if err := json.Unmarshal(elemBytes, post); err != nil {
+			return err
+		}
+		if post.AssignmentDef == assDef {
+			keysToDel = append(keysToDel, postKey)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return db.DeleteKeysFromBucket([]byte(db.ForumPosts), keysToDel...)
+}
@@ -0,0 +1,67 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"time"
+)
+
+// a job the scheduler should run at a given time
+type Job struct {
+	db.ABucketElement
+	Type		string					`json:"type"`
+	Target		string					`json:"target"`
+	RunAt		time.Time				`json:"run_at"`
+	Labels		map[string]interface{}	`json:"labels"`
+	Attempts	int						`json:"attempts"`
+	LastError	string					`json:"last_error"`
+}
+
+// a job is identified by its type and target, so there is at most one job of each type for each target
+func (j *Job) Key() []byte {
+	return []byte(fmt.Sprintf("%s%s%s", j.Type, db.KeySeparator, j.Target))
+}
+
+func (j *Job) Bucket() []byte {
+	return []byte(db.Jobs)
+}
+
+// get job by id
+func Get(id string) (*Job, error) {
+	jobBytes, err := db.GetFromBucket([]byte(db.Jobs), []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(jobBytes, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// schedule a job of the given type for the given target to run at the given time. If such a job is already scheduled,
+// then it is rescheduled to the given time, keeping its labels
+func New(jobType, target string, runAt time.Time, asUser string, withDbUpdate bool) (*Job, error) {
+	if jobType == "" || target == "" {
+		return nil, fmt.Errorf("job type and target can't be empty")
+	}
+	job := &Job{Type: jobType, Target: target, Labels: make(map[string]interface{})}
+	existingJob, err := Get(string(job.Key()))
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); !ok {
+			return nil, err
+		}
+	} else {
+		job = existingJob
+	}
+	job.RunAt = runAt.UTC()
+	job.Attempts = 0
+	job.LastError = ""
+	if withDbUpdate {
+		if err := db.Update(asUser, job); err != nil {
+			return nil, err
+		}
+	}
+	return job, nil
+}
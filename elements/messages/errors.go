@@ -0,0 +1,19 @@
+package messages
+
+import "fmt"
+
+type ErrInvalidMessage struct {
+	Message	string
+}
+
+func (e *ErrInvalidMessage) Error() string {
+	return fmt.Sprintf("invalid message: %s", e.Message)
+}
+
+type ErrMessageNotModifiable struct {
+	Message	string
+}
+
+func (e *ErrMessageNotModifiable) Error() string {
+	return fmt.Sprintf("message can't be modified: %s", e.Message)
+}
@@ -1,16 +1,57 @@
 package messages
 
 import (
+	"encoding/json"
+	"fmt"
 	commons "github.com/DAv10195/submit_commons"
+	"github.com/DAv10195/submit_commons/containers"
 	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/fs"
+	"sort"
+	"strings"
+	"time"
 )
 
+// time after creation in which the sender of a message can edit or delete it
+const EditWindow = 15 * time.Minute
+
+// limits on the attachments of a single message
+const (
+	MaxAttachments			= 5
+	MaxAttachmentSize		= 5 * 1024 * 1024
+	// the max size of a message request: the attachments are base64 encoded, with room left for the text
+	MaxMessageRequestSize	= MaxAttachments * MaxAttachmentSize * 4 / 3 + 1024 * 1024
+)
+
+// a file attached to a message, stored in the file server
+type Attachment struct {
+	Name	string	`json:"name"`
+	Path	string	`json:"path"`
+	Size	int		`json:"size"`
+}
+
+// a file to attach to a new message
+type AttachmentUpload struct {
+	Name	string	`json:"name"`
+	Content	[]byte	`json:"content"`
+}
+
 // message
 type Message struct {
 	db.ABucketElement
-	ID		string	`json:"id"`
-	From	string	`json:"from"`
-	Text	string	`json:"text"`
+	ID			string					`json:"id"`
+	From		string					`json:"from"`
+	Text		string					`json:"text"`
+	Box			string					`json:"box"`
+	ParentID	string					`json:"parent_id"`
+	ThreadID	string					`json:"thread_id"`
+	ReadBy		*containers.StringSet	`json:"read_by"`
+	Attachments	[]*Attachment			`json:"attachments"`
+	EditedOn	time.Time				`json:"edited_on"`
+	Deleted		bool					`json:"deleted"`
+	// the users a targeted message is visible to (nil if it's visible to everyone with access to its box)
+	Recipients	*containers.StringSet	`json:"recipients"`
+	Audience	string					`json:"audience"`
 }
 
 func (m *Message) Key() []byte {
@@ -21,18 +62,194 @@ func (m *Message) Bucket() []byte {
 	return []byte(db.Messages)
 }
 
+// messages are found by their text and the names of their attachments. Deleted messages aren't found
+func (m *Message) SearchText() string {
+	if m.Deleted {
+		return ""
+	}
+	text := []string{m.Text}
+	for _, attachment := range m.Attachments {
+		text = append(text, attachment.Name)
+	}
+	return strings.Join(text, " ")
+}
+
+// get message by id
+func GetMessage(id string) (*Message, error) {
+	msgBytes, err := db.GetFromBucket([]byte(db.Messages), []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{}
+	if err := json.Unmarshal(msgBytes, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
 // create a new message in the box with the given id
 func NewMessage(from, text, boxId string, withDbUpdate bool) (*Message, *MessageBox, error) {
+	return NewReply(from, text, boxId, "", nil, withDbUpdate, false)
+}
+
+// create a new message in the box with the given id, replying to the message with the given parent id (a new thread is
+// started if it's empty) and attaching the given files
+func NewReply(from, text, boxId, parentId string, attachments []*AttachmentUpload, withDbUpdate, withFsUpdate bool) (*Message, *MessageBox, error) {
 	msgBox, err := Get(boxId)
 	if err != nil {
 		return nil, nil, err
 	}
-	msg := &Message{From: from, Text: text, ID: commons.GenerateUniqueId()}
+	msg := &Message{From: from, Text: text, ID: commons.GenerateUniqueId(), Box: boxId, ReadBy: containers.NewStringSet()}
+	msg.ThreadID = msg.ID
+	msg.ReadBy.Add(from)
+	if parentId != "" {
+		if !msgBox.Messages.Contains(parentId) {
+			return nil, nil, &ErrInvalidMessage{fmt.Sprintf("message '%s' isn't in message box '%s'", parentId, boxId)}
+		}
+		parent, err := GetMessage(parentId)
+		if err != nil {
+			return nil, nil, err
+		}
+		msg.ParentID, msg.ThreadID = parent.ID, parent.ThreadID
+		// messages created before threads were introduced start their own thread
+		if msg.ThreadID == "" {
+			msg.ThreadID = parent.ID
+		}
+	}
+	if len(attachments) > MaxAttachments {
+		return nil, nil, &ErrInvalidMessage{fmt.Sprintf("a message can have at most %d attachments", MaxAttachments)}
+	}
+	names := containers.NewStringSet()
+	for _, attachment := range attachments {
+		if attachment.Name == "" || strings.ContainsAny(attachment.Name, "/\\") || attachment.Name == "." || attachment.Name == ".." {
+			return nil, nil, &ErrInvalidMessage{fmt.Sprintf("invalid attachment name '%s'", attachment.Name)}
+		}
+		if names.Contains(attachment.Name) {
+			return nil, nil, &ErrInvalidMessage{fmt.Sprintf("attachment '%s' is given more than once", attachment.Name)}
+		}
+		if len(attachment.Content) > MaxAttachmentSize {
+			return nil, nil, &ErrInvalidMessage{fmt.Sprintf("attachment '%s' is larger than %d bytes", attachment.Name, MaxAttachmentSize)}
+		}
+		names.Add(attachment.Name)
+		msg.Attachments = append(msg.Attachments, &Attachment{Name: attachment.Name, Size: len(attachment.Content),
+			Path: strings.Join([]string{db.Messages, boxId, msg.ID, attachment.Name}, "/")})
+	}
+	if withFsUpdate {
+		for i, attachment := range attachments {
+			if err := fs.GetClient().UploadTextToFS(msg.Attachments[i].Path, attachment.Content); err != nil {
+				_ = msg.DeleteAttachmentFiles()
+				return nil, nil, err
+			}
+		}
+	}
 	if withDbUpdate {
 		msgBox.Messages.Add(msg.ID)
 		if err := db.Update(from, msg, msgBox); err != nil {
+			if withFsUpdate {
+				_ = msg.DeleteAttachmentFiles()
+			}
 			return nil, nil, err
 		}
 	}
 	return msg, msgBox, nil
 }
+
+// delete the files of the attachments of the message from the file server, e.g. when the message couldn't be written
+// to the DB after they were uploaded
+func (m *Message) DeleteAttachmentFiles() error {
+	if len(m.Attachments) == 0 {
+		return nil
+	}
+	return fs.GetClient().Delete(strings.Join([]string{db.Messages, m.Box, m.ID}, "/"))
+}
+
+// check if the given user can still edit or delete the message
+func (m *Message) checkModifiable(asUser string) error {
+	if m.Deleted {
+		return &ErrMessageNotModifiable{"message was deleted"}
+	}
+	if m.From != asUser {
+		return &ErrMessageNotModifiable{"only the sender of a message can modify it"}
+	}
+	if time.Now().UTC().Sub(m.CreatedOn) > EditWindow {
+		return &ErrMessageNotModifiable{fmt.Sprintf("messages can be modified only within %v of their creation", EditWindow)}
+	}
+	return nil
+}
+
+// replace the text of the message (no update in db)
+func (m *Message) Edit(text, asUser string) error {
+	if err := m.checkModifiable(asUser); err != nil {
+		return err
+	}
+	m.Text, m.EditedOn = text, time.Now().UTC()
+	return nil
+}
+
+// delete the message, keeping it as a placeholder so replies to it remain in their thread. Unless forced, only the
+// sender can delete the message and only within the edit window
+func DeleteMessage(msg *Message, asUser string, force, withFsUpdate bool) error {
+	if !force {
+		if err := msg.checkModifiable(asUser); err != nil {
+			return err
+		}
+	}
+	if withFsUpdate {
+		if err := msg.DeleteAttachmentFiles(); err != nil {
+			return err
+		}
+	}
+	msg.Text, msg.Attachments, msg.Deleted = "", nil, true
+	return db.Update(asUser, msg)
+}
+
+// check if the message is unread by the given user. Users never have their own messages unread
+func (m *Message) IsUnreadBy(user string) bool {
+	return !m.Deleted && m.From != user && (m.ReadBy == nil || !m.ReadBy.Contains(user))
+}
+
+// check if the message is visible to the given user
+func (m *Message) VisibleTo(user string) bool {
+	return m.Recipients == nil || m.From == user || m.Recipients.Contains(user)
+}
+
+// mark the message as read by the given user, returning true if it was unread by the user (no update in db)
+func (m *Message) MarkReadBy(user string) bool {
+	if !m.IsUnreadBy(user) {
+		return false
+	}
+	if m.ReadBy == nil {
+		m.ReadBy = containers.NewStringSet()
+	}
+	m.ReadBy.Add(user)
+	return true
+}
+
+// return the messages in the given box, ordered by creation time. If a thread id is given, only messages in that thread
+// are returned
+func List(box *MessageBox, threadId string) ([]*Message, error) {
+	var msgs []*Message
+	if err := db.QueryBucket([]byte(db.Messages), func(msgKey []byte, msgBytes []byte) error {
+		if !box.Messages.Contains(string(msgKey)) {
+			return nil
+		}
+		msg := &Message{}
+		if err := json.Unmarshal(msgBytes, msg); err != nil {
+			return err
+		}
+		if threadId != "" && msg.ThreadID != threadId && msg.ID != threadId {
+			return nil
+		}
+		msgs = append(msgs, msg)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].CreatedOn.Equal(msgs[j].CreatedOn) {
+			return msgs[i].ID < msgs[j].ID
+		}
+		return msgs[i].CreatedOn.Before(msgs[j].CreatedOn)
+	})
+	return msgs, nil
+}
@@ -5,6 +5,8 @@ import (
 	commons "github.com/DAv10195/submit_commons"
 	"github.com/DAv10195/submit_commons/containers"
 	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/fs"
+	"strings"
 )
 
 // message box
@@ -43,11 +45,24 @@ func Get(id string) (*MessageBox, error) {
 	return box, nil
 }
 
-// delete a message box and all of the messages associated with it
+// delete a message box and all of the messages associated with it, including their attachments
 func Delete(box *MessageBox) error {
 	var messagesToDel [][]byte
+	hasAttachments := false
 	for _, msgKey := range box.Messages.Slice() {
 		messagesToDel = append(messagesToDel, []byte(msgKey))
+		if fs.GetClient() != nil && !hasAttachments {
+			msg, err := GetMessage(msgKey)
+			if err != nil {
+				return err
+			}
+			hasAttachments = len(msg.Attachments) > 0
+		}
+	}
+	if hasAttachments {
+		if err := fs.GetClient().Delete(strings.Join([]string{db.Messages, box.ID}, "/")); err != nil {
+			return err
+		}
 	}
 	if err := db.DeleteKeysFromBucket([]byte(db.Messages), messagesToDel...); err != nil {
 		return err
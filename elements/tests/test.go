@@ -23,6 +23,7 @@ const (
 const (
 	OnSubmit 	= iota
 	OnDemand	= iota
+	OnDeadline	= iota
 )
 
 // test
@@ -81,7 +82,7 @@ func New(asUser, assDef, name, command, osType, architecture string, timeout, ru
 	if command == "" {
 		return nil, errors.New("empty command given for test")
 	}
-	if runsOn != OnDemand && runsOn != OnSubmit {
+	if runsOn != OnDemand && runsOn != OnSubmit && runsOn != OnDeadline {
 		return nil, fmt.Errorf("invalid runs on value given for test creation ('%d')", runsOn)
 	}
 	if timeout <= 0 {
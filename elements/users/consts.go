@@ -6,4 +6,14 @@ const (
 	StandardUser 	= "std_user"
 	Secretary		= "secretary"
 	Agent			= "agent"
+
+	// email notification preferences
+	EmailImmediate		= "immediate"
+	EmailDailyDigest	= "daily_digest"
+	EmailNone			= "none"
+
+	// password strength rules
+	MinPasswordLength	= 8
+
+	resetTokenLength	= 32
 )
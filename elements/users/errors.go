@@ -10,3 +10,19 @@ type ErrAuthenticationFailure struct {
 func (e *ErrAuthenticationFailure) Error() string {
 	return fmt.Sprintf("error authenticating user \"%s\": %s", e.User, e.Message)
 }
+
+type ErrWeakPassword struct {
+	Message	string
+}
+
+func (e *ErrWeakPassword) Error() string {
+	return fmt.Sprintf("password is too weak: %s", e.Message)
+}
+
+type ErrInvalidResetToken struct {
+	User	string
+}
+
+func (e *ErrInvalidResetToken) Error() string {
+	return fmt.Sprintf("invalid or expired password reset token for user \"%s\"", e.User)
+}
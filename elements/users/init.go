@@ -4,6 +4,9 @@ import "github.com/DAv10195/submit_commons/containers"
 
 var Roles = containers.NewStringSet()
 
+var EmailPreferences = containers.NewStringSet()
+
 func init() {
 	Roles.Add(Admin, Secretary, StandardUser, Agent)
+	EmailPreferences.Add(EmailImmediate, EmailDailyDigest, EmailNone)
 }
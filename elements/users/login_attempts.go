@@ -0,0 +1,100 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"time"
+)
+
+// possible login attempts subject kinds. Password reset requests are limited like failed login attempts, but are
+// counted separately so they don't lock users out
+const (
+	SubjectUser			= "user"
+	SubjectIp			= "ip"
+	SubjectResetUser	= "reset_user"
+	SubjectResetIp		= "reset_ip"
+)
+
+// failed login attempts of a user or made from an ip address
+type LoginAttempts struct {
+	db.ABucketElement
+	Subject			string		`json:"subject"`
+	Failures		int			`json:"failures"`
+	LastFailure		time.Time	`json:"last_failure"`
+	NextAttemptAt	time.Time	`json:"next_attempt_at"`
+	LockedUntil		time.Time	`json:"locked_until"`
+}
+
+func (a *LoginAttempts) Key() []byte {
+	return []byte(a.Subject)
+}
+
+func (a *LoginAttempts) Bucket() []byte {
+	return []byte(db.LoginAttempts)
+}
+
+// return the subject of the login attempts of the given kind and value (user name or ip address)
+func LoginAttemptsSubject(kind, value string) string {
+	return fmt.Sprintf("%s%s%s", kind, db.KeySeparator, value)
+}
+
+// get the failed login attempts of the given subject. No failed login attempts are returned if there are none
+func GetLoginAttempts(subject string) (*LoginAttempts, error) {
+	attemptsBytes, err := db.GetFromBucket([]byte(db.LoginAttempts), []byte(subject))
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			return &LoginAttempts{Subject: subject}, nil
+		}
+		return nil, err
+	}
+	attempts := &LoginAttempts{}
+	if err := json.Unmarshal(attemptsBytes, attempts); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// check if the subject is locked out at the given time
+func (a *LoginAttempts) IsLocked(now time.Time) bool {
+	return now.Before(a.LockedUntil)
+}
+
+// return how long the subject has to wait from the given time before attempting to log in again
+func (a *LoginAttempts) RetryAfter(now time.Time) time.Duration {
+	if a.IsLocked(now) {
+		return a.LockedUntil.Sub(now)
+	}
+	if now.Before(a.NextAttemptAt) {
+		return a.NextAttemptAt.Sub(now)
+	}
+	return 0
+}
+
+// record a failed login attempt at the given time. Failures older than the given window are forgotten. A single
+// failure (e.g. a typo) doesn't delay the next attempt, but each further failure doubles the delay before the next
+// attempt is allowed, starting with the given base delay. The subject is locked out for the given window once the
+// given number of failures is reached. Returns true if the subject was locked out by this failure
+func (a *LoginAttempts) RecordFailure(now time.Time, baseDelay, window time.Duration, maxFailures int) bool {
+	if now.Sub(a.LastFailure) > window {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailure = now
+	var delay time.Duration
+	if a.Failures > 1 {
+		delay = baseDelay
+		for i := 2; i < a.Failures && delay < window; i++ {
+			delay *= 2
+		}
+		if delay > window {
+			delay = window
+		}
+	}
+	a.NextAttemptAt = now.Add(delay)
+	if maxFailures > 0 && a.Failures >= maxFailures && !a.IsLocked(now) {
+		a.LockedUntil = now.Add(window)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptsRecordFailure(t *testing.T) {
+	now := time.Now().UTC()
+	attempts := &LoginAttempts{Subject: LoginAttemptsSubject(SubjectUser, Admin)}
+	expectedDelays := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second}
+	for i, expectedDelay := range expectedDelays {
+		if lockedOut := attempts.RecordFailure(now, time.Second, time.Minute, 5); lockedOut {
+			t.Fatalf("unexpected lockout after %d failures", i + 1)
+		}
+		if retryAfter := attempts.RetryAfter(now); retryAfter != expectedDelay {
+			t.Fatalf("expected a delay of %v after %d failures but got %v", expectedDelay, i + 1, retryAfter)
+		}
+	}
+	if lockedOut := attempts.RecordFailure(now, time.Second, time.Minute, 5); !lockedOut || !attempts.IsLocked(now) {
+		t.Fatal("expected a lockout after 5 failures")
+	}
+	if retryAfter := attempts.RetryAfter(now); retryAfter != time.Minute {
+		t.Fatalf("expected to retry after the lockout but got %v", retryAfter)
+	}
+	// failures older than the window are forgotten
+	later := now.Add(2 * time.Minute)
+	if lockedOut := attempts.RecordFailure(later, time.Second, time.Minute, 5); lockedOut || attempts.Failures != 1 || attempts.RetryAfter(later) != 0 {
+		t.Fatalf("expected old failures to be forgotten: %+v", attempts)
+	}
+}
@@ -0,0 +1,105 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// a token allowing to reset the password of a user. Only the hash of the token is kept, so the token itself is known
+// only to whoever it was delivered to
+type PasswordResetToken struct {
+	db.ABucketElement
+	UserName	string		`json:"user_name"`
+	TokenHash	string		`json:"token_hash"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+}
+
+// a user has at most one password reset token, so issuing a new token replaces the previous one
+func (t *PasswordResetToken) Key() []byte {
+	return []byte(t.UserName)
+}
+
+func (t *PasswordResetToken) Bucket() []byte {
+	return []byte(db.PasswordResetTokens)
+}
+
+func hashResetToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// check that the given password of the given user complies with the password strength rules
+func ValidatePasswordStrength(userName, password string) error {
+	if len(password) < MinPasswordLength {
+		return &ErrWeakPassword{fmt.Sprintf("password must be at least %d characters long", MinPasswordLength)}
+	}
+	var hasLetter, hasDigit bool
+	for _, c := range password {
+		hasLetter = hasLetter || unicode.IsLetter(c)
+		hasDigit = hasDigit || unicode.IsDigit(c)
+	}
+	if !hasLetter || !hasDigit {
+		return &ErrWeakPassword{"password must contain both letters and digits"}
+	}
+	if userName != "" && strings.Contains(strings.ToLower(password), strings.ToLower(userName)) {
+		return &ErrWeakPassword{"password can't contain the user name"}
+	}
+	return nil
+}
+
+// set the password of the user, marking the time it was changed
+func (u *User) SetPassword(password string) error {
+	encryptedPassword, err := db.Encrypt(password)
+	if err != nil {
+		return err
+	}
+	u.Password = encryptedPassword
+	u.PasswordChangedOn = time.Now().UTC()
+	return nil
+}
+
+// issue a password reset token for the given user, valid for the given duration. Returns the token element and the
+// token itself, which should be delivered to the user
+func NewPasswordResetToken(userName string, validFor time.Duration, asUser string, withDbUpdate bool) (*PasswordResetToken, string, error) {
+	tokenBytes := make([]byte, resetTokenLength)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	resetToken := &PasswordResetToken{UserName: userName, TokenHash: hashResetToken(token), ExpiresAt: time.Now().UTC().Add(validFor)}
+	if withDbUpdate {
+		if err := db.Update(asUser, resetToken); err != nil {
+			return nil, "", err
+		}
+	}
+	return resetToken, token, nil
+}
+
+// consume the given password reset token of the given user. The token can be consumed only once and only before it
+// expires. An expired token is deleted when an attempt to consume it is made. The token is checked and deleted in a
+// single transaction, so concurrent attempts can't consume it twice
+func ConsumePasswordResetToken(userName, token string) error {
+	resetToken := &PasswordResetToken{UserName: userName}
+	var expired, matches bool
+	if err := db.DeleteIf(resetToken, func() (bool, error) {
+		expired = time.Now().UTC().After(resetToken.ExpiresAt)
+		matches = subtle.ConstantTimeCompare([]byte(resetToken.TokenHash), []byte(hashResetToken(token))) == 1
+		return expired || matches, nil
+	}); err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			return &ErrInvalidResetToken{userName}
+		}
+		return err
+	}
+	if expired || !matches {
+		return &ErrInvalidResetToken{userName}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package users
+
+import (
+	"github.com/DAv10195/submit_server/db"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidatePasswordStrength(t *testing.T) {
+	testCases := []struct{
+		password	string
+		valid		bool
+	}{
+		{"short1", false},
+		{"onlyletters", false},
+		{"1234567890", false},
+		{"myuser123", false},
+		{"Passw0rd123", true},
+	}
+	for _, tc := range testCases {
+		if err := ValidatePasswordStrength("myUser", tc.password); (err == nil) != tc.valid {
+			t.Fatalf("expected validity of password '%s' to be %v but got error: %v", tc.password, tc.valid, err)
+		}
+	}
+}
+
+func TestPasswordResetToken(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	_, token, err := NewPasswordResetToken(Admin, time.Minute, db.System, true)
+	if err != nil {
+		t.Fatalf("error issuing password reset token: %v", err)
+	}
+	if err := ConsumePasswordResetToken(Admin, "wrong"); err == nil {
+		t.Fatal("expected consuming a wrong token to fail")
+	}
+	if err := ConsumePasswordResetToken(Admin, token); err != nil {
+		t.Fatalf("error consuming password reset token: %v", err)
+	}
+	if err := ConsumePasswordResetToken(Admin, token); err == nil {
+		t.Fatal("expected consuming a token twice to fail")
+	}
+	if _, token, err = NewPasswordResetToken(Admin, -time.Minute, db.System, true); err != nil {
+		t.Fatalf("error issuing password reset token: %v", err)
+	}
+	if err := ConsumePasswordResetToken(Admin, token); err == nil {
+		t.Fatal("expected consuming an expired token to fail")
+	}
+}
+
+func TestConcurrentPasswordResets(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	_, token, err := NewPasswordResetToken(Admin, time.Minute, db.System, true)
+	if err != nil {
+		t.Fatalf("error issuing password reset token: %v", err)
+	}
+	const resets = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, resets)
+	for i := 0; i < resets; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- ConsumePasswordResetToken(Admin, token)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	// the token is consumed by exactly one of the concurrent resets
+	consumed := 0
+	for err := range errs {
+		if err == nil {
+			consumed++
+		} else if _, ok := err.(*ErrInvalidResetToken); !ok {
+			t.Fatalf("error consuming password reset token: %v", err)
+		}
+	}
+	if consumed != 1 {
+		t.Fatalf("expected the token to be consumed once but it was consumed %d times", consumed)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/assignments"
 	"github.com/DAv10195/submit_server/elements/messages"
+	"strings"
+	"time"
 )
 
 // user
@@ -19,10 +21,15 @@ type User struct {
 	LastName				string					`json:"last_name"`
 	Password   				string                	`json:"password"`
 	Email      				string                	`json:"email"`
+	EmailPreference			string					`json:"email_preference"`
 	MessageBox 				string                	`json:"message_box"`
 	Roles      				*containers.StringSet 	`json:"roles"`
 	CoursesAsStaff			*containers.StringSet 	`json:"courses_as_staff"`
 	CoursesAsStudent		*containers.StringSet	`json:"courses_as_student"`
+	PasswordChangedOn		time.Time				`json:"password_changed_on"`
+	// the single sign-on identity the user is linked to: the issuer and subject of the id tokens of the user
+	SsoIssuer				string					`json:"sso_issuer"`
+	SsoSubject				string					`json:"sso_subject"`
 }
 
 func (u *User) Key() []byte {
@@ -33,6 +40,11 @@ func (u *User) Bucket() []byte {
 	return []byte(db.Users)
 }
 
+// users are found by their user name, name and email
+func (u *User) SearchText() string {
+	return strings.Join([]string{u.UserName, u.FirstName, u.LastName, u.Email}, " ")
+}
+
 // check if the default admin user is present in the DB and add it if not
 func InitDefaultAdmin() error {
 	exists, err := db.KeyExistsInBucket([]byte(db.Users), []byte(Admin))
@@ -61,6 +73,24 @@ func Get(userName string) (*User, error) {
 	return user, nil
 }
 
+// return the user linked to the single sign-on identity with the given issuer and subject, or nil if there is none
+func GetBySsoIdentity(issuer, subject string) (*User, error) {
+	var linkedUser *User
+	if err := db.QueryBucket([]byte(db.Users), func(_, userBytes []byte) error {
+		user := &User{}
+		if err := json.Unmarshal(userBytes, user); err != nil {
+			return err
+		}
+		if user.SsoSubject == subject && user.SsoIssuer == issuer {
+			linkedUser = user
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return linkedUser, nil
+}
+
 // authenticate the user with the given password. Returns the authenticated user when the returned error is nil
 func Authenticate(user, password string) (*User, error) {
 	userStruct, err := Get(user)
@@ -88,9 +118,12 @@ type UserBuilder struct {
 	lastName         string
 	password         string
 	email            string
+	emailPreference  string
 	roles            *containers.StringSet
 	coursesAsStaff   *containers.StringSet
 	coursesAsStudent *containers.StringSet
+	ssoIssuer		 string
+	ssoSubject		 string
 	asUser			 string
 	withDbUpdate	 bool
 }
@@ -100,6 +133,12 @@ func NewUserBuilder(asUser string, withDbUpdate bool) *UserBuilder{
 	return &UserBuilder{roles: containers.NewStringSet(), coursesAsStaff: containers.NewStringSet(), coursesAsStudent: containers.NewStringSet(), asUser: asUser, withDbUpdate: withDbUpdate}
 }
 
+// link the user to the single sign-on identity with the given issuer and subject
+func (b *UserBuilder) WithSsoIdentity(issuer, subject string) *UserBuilder {
+	b.ssoIssuer, b.ssoSubject = issuer, subject
+	return b
+}
+
 // set user name
 func (b *UserBuilder) WithUserName(userName string) *UserBuilder {
 	b.userName = userName
@@ -130,6 +169,12 @@ func (b *UserBuilder) WithEmail(email string) *UserBuilder {
 	return b
 }
 
+// set email notifications preference
+func (b *UserBuilder) WithEmailPreference(emailPreference string) *UserBuilder {
+	b.emailPreference = emailPreference
+	return b
+}
+
 // add a course in which the built user will be a staff member
 func (b *UserBuilder) WithCoursesAsStaff(CoursesAsStaff ...string) *UserBuilder {
 	b.coursesAsStaff.Add(CoursesAsStaff...)
@@ -171,6 +216,11 @@ func (b *UserBuilder) Build() (*User, error) {
 			return nil, fmt.Errorf("invalid role: %s", r)
 		}
 	}
+	if b.emailPreference == "" {
+		b.emailPreference = EmailImmediate
+	} else if !EmailPreferences.Contains(b.emailPreference) {
+		return nil, fmt.Errorf("invalid email preference: %s", b.emailPreference)
+	}
 	if containers.StringSetIntersection(b.coursesAsStudent, b.coursesAsStaff).NumberOfElements() > 0 {
 		return nil, errors.New("user can't be a staff member and a student in the same course")
 	}
@@ -194,9 +244,12 @@ func (b *UserBuilder) Build() (*User, error) {
 		LastName: b.lastName,
 		Password: encryptedPassword,
 		Email: b.email,
+		EmailPreference: b.emailPreference,
 		Roles: b.roles,
 		CoursesAsStaff: b.coursesAsStaff,
 		CoursesAsStudent: b.coursesAsStudent,
+		SsoIssuer: b.ssoIssuer,
+		SsoSubject: b.ssoSubject,
 	}
 	if b.withDbUpdate {
 		messageBox := messages.NewMessageBox()
@@ -235,5 +288,8 @@ func Delete(user *User, withFsUpdate bool) error {
 	if err := messages.Delete(box); err != nil {
 		return err
 	}
+	if err := db.DeleteKeysFromBucket([]byte(db.PasswordResetTokens), user.Key()); err != nil {
+		return err
+	}
 	return db.Delete(user)
 }
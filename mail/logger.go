@@ -0,0 +1,9 @@
+package mail
+
+import "github.com/sirupsen/logrus"
+
+var logger *logrus.Entry
+
+func init() {
+	logger = logrus.WithFields(logrus.Fields{"component":"mail"})
+}
@@ -0,0 +1,83 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// possible email kinds
+const (
+	AssignmentPublished	= "assignment_published"
+	DueDateReminder		= "due_date_reminder"
+	GradeReleased		= "grade_released"
+	AppealReply			= "appeal_reply"
+	CopyDetected		= "copy_detected"
+	PasswordReset		= "password_reset"
+	AppealResolved		= "appeal_resolved"
+	CourseAnnouncement	= "course_announcement"
+)
+
+// the data used for rendering email templates
+type TemplateData struct {
+	UserName	string
+	Assignment	string
+	DueBy		time.Time
+	Grade		int
+	Message		string
+	Token		string
+	ExpiresAt	time.Time
+	Outcome		string
+	Course		string
+}
+
+// the templates of an email kind
+type emailTemplate struct {
+	subject	*template.Template
+	body	*template.Template
+}
+
+var templates = make(map[string]*emailTemplate)
+
+func addTemplate(kind, subject, body string) {
+	templates[kind] = &emailTemplate{
+		template.Must(template.New(fmt.Sprintf("%s_subject", kind)).Parse(subject)),
+		template.Must(template.New(fmt.Sprintf("%s_body", kind)).Parse(body)),
+	}
+}
+
+// render the subject and the body of an email of the given kind using the given data
+func Render(kind string, data *TemplateData) (string, string, error) {
+	t := templates[kind]
+	if t == nil {
+		return "", "", fmt.Errorf("no email template for '%s'", kind)
+	}
+	var subject, body bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return "", "", err
+	}
+	if err := t.body.Execute(&body, data); err != nil {
+		return "", "", err
+	}
+	return subject.String(), body.String(), nil
+}
+
+func init() {
+	addTemplate(AssignmentPublished, "Submit: assignment '{{.Assignment}}' published",
+		"Hello {{.UserName}},\n\nassignment '{{.Assignment}}' was published and is due by {{.DueBy.Format \"2006-01-02 15:04 MST\"}}.\n")
+	addTemplate(DueDateReminder, "Submit: assignment '{{.Assignment}}' is due soon",
+		"Hello {{.UserName}},\n\nassignment '{{.Assignment}}' wasn't submitted yet and is due by {{.DueBy.Format \"2006-01-02 15:04 MST\"}}.\n")
+	addTemplate(GradeReleased, "Submit: assignment '{{.Assignment}}' graded",
+		"Hello {{.UserName}},\n\nassignment '{{.Assignment}}' was graded. Your grade is {{.Grade}}.\n")
+	addTemplate(AppealReply, "Submit: reply to your appeal on '{{.Assignment}}'",
+		"Hello {{.UserName}},\n\na reply was posted to your appeal on '{{.Assignment}}':\n\n{{.Message}}\n")
+	addTemplate(CopyDetected, "Submit: assignment '{{.Assignment}}' marked as copy",
+		"Hello {{.UserName}},\n\nassignment '{{.Assignment}}' was marked as copy by the copy detection.\n")
+	addTemplate(AppealResolved, "Submit: your appeal on '{{.Assignment}}' was resolved",
+		"Hello {{.UserName}},\n\nyour appeal on '{{.Assignment}}' was resolved as {{.Outcome}}. Your grade is {{.Grade}}.\n{{if .Message}}\n{{.Message}}\n{{end}}")
+	addTemplate(CourseAnnouncement, "Submit: announcement in course '{{.Course}}'",
+		"Hello {{.UserName}},\n\na new announcement was posted in course '{{.Course}}':\n\n{{.Message}}\n")
+	addTemplate(PasswordReset, "Submit: password reset",
+		"Hello {{.UserName}},\n\na password reset was requested for your user. Use the following token to reset your password until {{.ExpiresAt.Format \"2006-01-02 15:04 MST\"}}:\n\n{{.Token}}\n\nIf you didn't request a password reset, you can ignore this email.\n")
+}
@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+var transport Transport
+
+// a transport used for delivering emails
+type Transport interface {
+	// send an email with the given subject and body to the given address
+	Send(to, subject, body string) error
+}
+
+// a transport delivering emails via an SMTP server
+type smtpTransport struct {
+	addr	string
+	auth	smtp.Auth
+	from	string
+}
+
+// create a transport delivering emails via the SMTP server listening on the given host and port. Authentication is
+// performed only if a user is given
+func NewSmtpTransport(host string, port int, user, password, from string) Transport {
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	return &smtpTransport{net.JoinHostPort(host, strconv.Itoa(port)), auth, from}
+}
+
+func (t *smtpTransport) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid email address or subject")
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\n%s\r\n",
+		t.from, to, subject, strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(t.addr, t.auth, t.from, []string{to}, []byte(msg))
+}
+
+// initialize the mail transport using the SMTP server listening on the given host and port
+func Init(host string, port int, user, password, from string) {
+	logger.Infof("delivering emails via smtp server at %s:%d", host, port)
+	transport = NewSmtpTransport(host, port, user, password, from)
+}
+
+// set the transport used for delivering emails. Setting nil disables email delivery
+func SetTransport(t Transport) {
+	transport = t
+}
+
+// return the transport used for delivering emails (nil if email delivery is disabled)
+func GetTransport() Transport {
+	return transport
+}
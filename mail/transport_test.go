@@ -0,0 +1,82 @@
+package mail
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// a fake SMTP server accepting a single email and passing its data on the returned channel
+func startFakeSmtpServer(t *testing.T) (string, int, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error starting fake smtp server: %v", err)
+	}
+	data := make(chan string, 1)
+	go func() {
+		defer func() {
+			_ = listener.Close()
+		}()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		tp := textproto.NewConn(conn)
+		_ = tp.PrintfLine("220 fake smtp server")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+				case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+					_ = tp.PrintfLine("250 ok")
+				case "DATA":
+					_ = tp.PrintfLine("354 go ahead")
+					dataBytes, err := tp.ReadDotBytes()
+					if err != nil {
+						return
+					}
+					data <- string(dataBytes)
+					_ = tp.PrintfLine("250 ok")
+				case "QUIT":
+					_ = tp.PrintfLine("221 bye")
+					return
+				default:
+					_ = tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, data
+}
+
+func TestSmtpTransport(t *testing.T) {
+	host, port, data := startFakeSmtpServer(t)
+	subject, body, err := Render(GradeReleased, &TemplateData{UserName: "nikita", Assignment: "ass1", Grade: 100})
+	if err != nil {
+		t.Fatalf("error rendering email: %v", err)
+	}
+	if err := NewSmtpTransport(host, port, "", "", "submit@localhost").Send("nikita@localhost", subject, body); err != nil {
+		t.Fatalf("error sending email: %v", err)
+	}
+	email := <- data
+	scanner := bufio.NewScanner(strings.NewReader(email))
+	var foundSubject, foundGrade bool
+	for scanner.Scan() {
+		line := scanner.Text()
+		foundSubject = foundSubject || line == "Subject: Submit: assignment 'ass1' graded"
+		foundGrade = foundGrade || strings.Contains(line, "Your grade is 100.")
+	}
+	if !foundSubject || !foundGrade {
+		t.Fatalf("unexpected email received by smtp server: %s", email)
+	}
+	if err := NewSmtpTransport(host, port, "", "", "submit@localhost").Send("nikita@localhost\r\nBcc: x@y", subject, body); err == nil {
+		t.Fatal("expected sending an email to an invalid address to fail")
+	}
+}
@@ -0,0 +1,12 @@
+package oidc
+
+import "fmt"
+
+// a login which can't be completed due to invalid data given by the user or by the provider
+type ErrInvalidLogin struct {
+	Message	string
+}
+
+func (e *ErrInvalidLogin) Error() string {
+	return fmt.Sprintf("invalid single sign-on login: %s", e.Message)
+}
@@ -0,0 +1,168 @@
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mockKeyId			= "mock-key"
+	mockKeySize			= 2048
+	mockTokenTtl		= 5 * time.Minute
+	mockCodeLength		= 32
+	discoveryPath		= "/.well-known/openid-configuration"
+)
+
+// claims of an id token. The mock provider doesn't import the oidc package, so the tests of that package can use it
+type Claims = map[string]interface{}
+
+// an authorization code issued by the mock provider
+type mockAuthorization struct {
+	challenge	string
+	nonce		string
+	redirectUri	string
+	claims		Claims
+}
+
+// a local OpenID Connect provider for tests. Every authorization request is approved immediately, authenticating the
+// user whose claims were last set
+type MockProvider struct {
+	server		*httptest.Server
+	clientId	string
+	key			*rsa.PrivateKey
+	mutex		sync.Mutex
+	claims		Claims
+	codes		map[string]*mockAuthorization
+}
+
+// start a mock provider issuing id tokens to the client with the given id
+func NewMockProvider(clientId string) *MockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, mockKeySize)
+	if err != nil {
+		panic(err)
+	}
+	m := &MockProvider{clientId: clientId, key: key, claims: Claims{}, codes: make(map[string]*mockAuthorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, m.handleDiscovery)
+	mux.HandleFunc("/jwks", m.handleJwks)
+	mux.HandleFunc("/authorize", m.handleAuthorize)
+	mux.HandleFunc("/token", m.handleToken)
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+// the issuer url of the provider
+func (m *MockProvider) Issuer() string {
+	return m.server.URL
+}
+
+// set the claims of the user authenticated by the next authorization requests
+func (m *MockProvider) SetClaims(claims Claims) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.claims = claims
+}
+
+// stop the provider
+func (m *MockProvider) Close() {
+	m.server.Close()
+}
+
+func (m *MockProvider) handleDiscovery(w http.ResponseWriter, _ *http.Request) {
+	writeMockJson(w, http.StatusOK, map[string]string{"issuer": m.server.URL, "authorization_endpoint": m.server.URL + "/authorize",
+		"token_endpoint": m.server.URL + "/token", "jwks_uri": m.server.URL + "/jwks"})
+}
+
+func (m *MockProvider) handleJwks(w http.ResponseWriter, _ *http.Request) {
+	writeMockJson(w, http.StatusOK, map[string][]map[string]string{"keys": {{"kty": "RSA", "kid": mockKeyId, "use": "sig",
+		"n": base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()), "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes())}}})
+}
+
+func (m *MockProvider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if params.Get("client_id") != m.clientId || params.Get("response_type") != "code" || params.Get("code_challenge_method") != "S256" ||
+		params.Get("code_challenge") == "" || params.Get("redirect_uri") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	codeBytes := make([]byte, mockCodeLength)
+	if _, err := rand.Read(codeBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString(codeBytes)
+	m.mutex.Lock()
+	m.codes[code] = &mockAuthorization{challenge: params.Get("code_challenge"), nonce: params.Get("nonce"), redirectUri: params.Get("redirect_uri"), claims: m.claims}
+	m.mutex.Unlock()
+	redirect := url.Values{}
+	redirect.Set("code", code)
+	redirect.Set("state", params.Get("state"))
+	http.Redirect(w, r, params.Get("redirect_uri") + "?" + redirect.Encode(), http.StatusFound)
+}
+
+func (m *MockProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeMockJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	m.mutex.Lock()
+	auth := m.codes[r.PostForm.Get("code")]
+	// codes can be used only once
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mutex.Unlock()
+	if auth == nil || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("redirect_uri") != auth.redirectUri {
+		writeMockJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.challenge {
+		writeMockJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "code verifier doesn't match the code challenge"})
+		return
+	}
+	now := time.Now().UTC()
+	claims := Claims{"iss": m.server.URL, "aud": m.clientId, "iat": now.Unix(), "exp": now.Add(mockTokenTtl).Unix(), "nonce": auth.nonce}
+	for name, value := range auth.claims {
+		claims[name] = value
+	}
+	idToken, err := m.Sign(claims)
+	if err != nil {
+		writeMockJson(w, http.StatusInternalServerError, map[string]string{"error": "server_error", "error_description": err.Error()})
+		return
+	}
+	writeMockJson(w, http.StatusOK, map[string]string{"id_token": idToken})
+}
+
+// sign the given claims with the key of the provider, returning the signed JWT
+func (m *MockProvider) Sign(claims Claims) (string, error) {
+	var segments []string
+	for _, v := range []interface{}{map[string]string{"alg": "RS256", "kid": mockKeyId}, claims} {
+		segmentBytes, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		segments = append(segments, base64.RawURLEncoding.EncodeToString(segmentBytes))
+	}
+	digest := sha256.Sum256([]byte(strings.Join(segments, ".")))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(append(segments, base64.RawURLEncoding.EncodeToString(signature)), "."), nil
+}
+
+func writeMockJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
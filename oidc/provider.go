@@ -0,0 +1,202 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discoveryPath		= "/.well-known/openid-configuration"
+	randomValueLength	= 32
+	httpTimeout			= 10 * time.Second
+)
+
+// the configuration of the client of an OpenID Connect provider
+type Config struct {
+	Issuer			string
+	ClientId		string
+	ClientSecret	string
+	RedirectUrl		string
+	Scopes			[]string
+}
+
+// the endpoints of an OpenID Connect provider, as published in its discovery document
+type discoveryDocument struct {
+	Issuer					string	`json:"issuer"`
+	AuthorizationEndpoint	string	`json:"authorization_endpoint"`
+	TokenEndpoint			string	`json:"token_endpoint"`
+	JwksUri					string	`json:"jwks_uri"`
+}
+
+// the response of the token endpoint of an OpenID Connect provider
+type tokenResponse struct {
+	IdToken				string	`json:"id_token"`
+	Error				string	`json:"error"`
+	ErrorDescription	string	`json:"error_description"`
+}
+
+// an OpenID Connect provider users can be authenticated with using the authorization code flow with PKCE
+type Provider struct {
+	conf		*Config
+	discovery	*discoveryDocument
+	client		*http.Client
+	keys		*keySet
+}
+
+// create a provider with the given configuration, fetching its discovery document. The given http client is used for
+// accessing the provider (a default client is used if nil)
+func NewProvider(conf *Config, client *http.Client) (*Provider, error) {
+	if conf.Issuer == "" || conf.ClientId == "" || conf.RedirectUrl == "" {
+		return nil, errors.New("issuer, client id and redirect url must be given")
+	}
+	if client == nil {
+		client = &http.Client{Timeout: httpTimeout}
+	}
+	p := &Provider{conf: conf, client: client}
+	discovery := &discoveryDocument{}
+	if err := p.getJson(strings.TrimSuffix(conf.Issuer, "/") + discoveryPath, discovery); err != nil {
+		return nil, fmt.Errorf("error fetching the discovery document of '%s': %v", conf.Issuer, err)
+	}
+	if discovery.Issuer != conf.Issuer {
+		return nil, fmt.Errorf("issuer '%s' of the discovery document doesn't match the configured issuer '%s'", discovery.Issuer, conf.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksUri == "" {
+		return nil, fmt.Errorf("the discovery document of '%s' is missing required endpoints", conf.Issuer)
+	}
+	p.discovery = discovery
+	p.keys = &keySet{uri: discovery.JwksUri, provider: p}
+	return p, nil
+}
+
+func (p *Provider) getJson(uri string, v interface{}) error {
+	resp, err := p.client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// the values generated when starting a login with the provider which are needed for completing it
+type LoginState struct {
+	State		string	`json:"state"`
+	Nonce		string	`json:"nonce"`
+	Verifier	string	`json:"verifier"`
+}
+
+// start a login with the provider. Returns the url of the provider the user should be redirected to and the state which
+// has to be kept until the provider redirects the user back
+func (p *Provider) StartLogin() (string, *LoginState, error) {
+	ls := &LoginState{}
+	for _, value := range []*string{&ls.State, &ls.Nonce, &ls.Verifier} {
+		randomValue, err := newRandomValue()
+		if err != nil {
+			return "", nil, err
+		}
+		*value = randomValue
+	}
+	scopes := append([]string{"openid"}, p.conf.Scopes...)
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.conf.ClientId)
+	params.Set("redirect_uri", p.conf.RedirectUrl)
+	params.Set("scope", strings.Join(scopes, " "))
+	params.Set("state", ls.State)
+	params.Set("nonce", ls.Nonce)
+	params.Set("code_challenge", CodeChallenge(ls.Verifier))
+	params.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(p.discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.discovery.AuthorizationEndpoint + separator + params.Encode(), ls, nil
+}
+
+// complete a login started with the given state, exchanging the given authorization code for an id token. Returns the
+// claims of the verified id token
+func (p *Provider) CompleteLogin(ls *LoginState, state, code string) (Claims, error) {
+	if ls == nil || state == "" || state != ls.State {
+		return nil, &ErrInvalidLogin{"state doesn't match the started login"}
+	}
+	if code == "" {
+		return nil, &ErrInvalidLogin{"no authorization code given"}
+	}
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", code)
+	params.Set("redirect_uri", p.conf.RedirectUrl)
+	params.Set("client_id", p.conf.ClientId)
+	params.Set("code_verifier", ls.Verifier)
+	req, err := http.NewRequest(http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.conf.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.conf.ClientId), url.QueryEscape(p.conf.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	tr := &tokenResponse{}
+	if err := json.Unmarshal(respBytes, tr); err != nil {
+		return nil, fmt.Errorf("error parsing token response (status code %d): %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if tr.Error != "" {
+			return nil, &ErrInvalidLogin{fmt.Sprintf("authorization code rejected by the provider: %s %s", tr.Error, tr.ErrorDescription)}
+		}
+		return nil, fmt.Errorf("unexpected status code %d from the token endpoint", resp.StatusCode)
+	}
+	if tr.IdToken == "" {
+		return nil, &ErrInvalidLogin{"no id token in token response"}
+	}
+	return p.verifyIdToken(tr.IdToken, ls.Nonce, time.Now().UTC())
+}
+
+// return a random url safe value
+func newRandomValue() (string, error) {
+	b := make([]byte, randomValueLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// return the S256 PKCE code challenge of the given code verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// the signing keys of a provider, fetched when a key which isn't known yet is needed
+type keySet struct {
+	uri			string
+	provider	*Provider
+	mutex		sync.Mutex
+	keys		map[string]*rsa.PublicKey
+}
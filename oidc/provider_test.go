@@ -0,0 +1,127 @@
+package oidc
+
+import (
+	"github.com/DAv10195/submit_server/oidc/oidctest"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// start a login with the given provider and let the mock provider approve it, returning the state and the code the
+// user is redirected back with
+func authorize(t *testing.T, p *Provider) (*LoginState, string, string) {
+	loginUrl, ls, err := p.StartLogin()
+	if err != nil {
+		t.Fatalf("error starting login: %v", err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(loginUrl)
+	if err != nil {
+		t.Fatalf("error sending authorization request: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization request produced status code %d instead of %d", resp.StatusCode, http.StatusFound)
+	}
+	redirect, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("error parsing redirect: %v", err)
+	}
+	return ls, redirect.Query().Get("state"), redirect.Query().Get("code")
+}
+
+func TestProviderLogin(t *testing.T) {
+	mock := oidctest.NewMockProvider("submit")
+	defer mock.Close()
+	mock.SetClaims(Claims{"preferred_username": "student", "groups": []string{"students", "course1"}})
+	p, err := NewProvider(&Config{Issuer: mock.Issuer(), ClientId: "submit", RedirectUrl: "http://localhost/sso/oidc/callback"}, nil)
+	if err != nil {
+		t.Fatalf("error creating provider: %v", err)
+	}
+	ls, state, code := authorize(t, p)
+	claims, err := p.CompleteLogin(ls, state, code)
+	if err != nil {
+		t.Fatalf("error completing login: %v", err)
+	}
+	if claims.String("preferred_username") != "student" || len(claims.Strings("groups")) != 2 {
+		t.Fatalf("unexpected claims: %v", claims)
+	}
+	// codes can't be used twice
+	if _, err := p.CompleteLogin(ls, state, code); err == nil {
+		t.Fatal("expected reused code to be rejected")
+	}
+	testCases := []struct{
+		name	string
+		tamper	func(ls *LoginState, state, code string) (*LoginState, string, string)
+	}{
+		{"test state mismatch", func(ls *LoginState, _, code string) (*LoginState, string, string) {
+			return ls, "other", code
+		}},
+		{"test wrong code verifier", func(ls *LoginState, state, code string) (*LoginState, string, string) {
+			return &LoginState{State: ls.State, Nonce: ls.Nonce, Verifier: "other"}, state, code
+		}},
+		{"test nonce mismatch", func(ls *LoginState, state, code string) (*LoginState, string, string) {
+			return &LoginState{State: ls.State, Nonce: "other", Verifier: ls.Verifier}, state, code
+		}},
+		{"test no code", func(ls *LoginState, state, _ string) (*LoginState, string, string) {
+			return ls, state, ""
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ls, state, code := tc.tamper(authorize(t, p))
+			_, err := p.CompleteLogin(ls, state, code)
+			if _, ok := err.(*ErrInvalidLogin); !ok {
+				t.Fatalf("expected an invalid login error but got: %v", err)
+			}
+		})
+	}
+}
+
+func TestProviderRejectsForgedTokens(t *testing.T) {
+	mock := oidctest.NewMockProvider("submit")
+	defer mock.Close()
+	other := oidctest.NewMockProvider("submit")
+	defer other.Close()
+	p, err := NewProvider(&Config{Issuer: mock.Issuer(), ClientId: "submit", RedirectUrl: "http://localhost/sso/oidc/callback"}, nil)
+	if err != nil {
+		t.Fatalf("error creating provider: %v", err)
+	}
+	validToken, err := mock.Sign(Claims{"iss": mock.Issuer(), "aud": "submit", "exp": 4102444800, "nonce": "nonce"})
+	if err != nil {
+		t.Fatalf("error signing token: %v", err)
+	}
+	if _, err := p.verifyIdToken(validToken, "nonce", time.Now().UTC()); err != nil {
+		t.Fatalf("error verifying valid token: %v", err)
+	}
+	forge := func(signer *oidctest.MockProvider, claims Claims) string {
+		token, err := signer.Sign(claims)
+		if err != nil {
+			t.Fatalf("error signing token: %v", err)
+		}
+		return token
+	}
+	parts := strings.Split(validToken, ".")
+	testCases := []struct{
+		name	string
+		token	string
+	}{
+		{"test signed by another provider", forge(other, Claims{"iss": mock.Issuer(), "aud": "submit", "exp": 4102444800, "nonce": "nonce"})},
+		{"test tampered claims", strings.Join([]string{parts[0], strings.Split(forge(mock, Claims{"iss": mock.Issuer(), "aud": "submit", "exp": 4102444800, "nonce": "nonce", "groups": "admins"}), ".")[1], parts[2]}, ".")},
+		{"test wrong audience", forge(mock, Claims{"iss": mock.Issuer(), "aud": "other", "exp": 4102444800, "nonce": "nonce"})},
+		{"test wrong issuer", forge(mock, Claims{"iss": other.Issuer(), "aud": "submit", "exp": 4102444800, "nonce": "nonce"})},
+		{"test expired", forge(mock, Claims{"iss": mock.Issuer(), "aud": "submit", "exp": 946684800, "nonce": "nonce"})},
+		{"test malformed", "not.a.token"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := p.verifyIdToken(tc.token, "nonce", time.Now().UTC()); err == nil {
+				t.Fatal("expected the token to be rejected")
+			}
+		})
+	}
+}
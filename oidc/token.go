@@ -0,0 +1,160 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// allowed difference between the clocks of the server and of the provider when validating id tokens
+const clockSkew = time.Minute
+
+// the claims of an id token
+type Claims map[string]interface{}
+
+// return the string claim with the given name (empty if the claim doesn't exist or isn't a string)
+func (c Claims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// return the claim with the given name as a list of strings. A single string claim is returned as a list with one element
+func (c Claims) Strings(name string) []string {
+	switch value := c[name].(type) {
+		case string:
+			return []string{value}
+		case []interface{}:
+			var values []string
+			for _, elem := range value {
+				if str, ok := elem.(string); ok {
+					values = append(values, str)
+				}
+			}
+			return values
+		default:
+			return nil
+	}
+}
+
+// return the numeric claim with the given name as a time (zero if the claim doesn't exist or isn't a number)
+func (c Claims) time(name string) time.Time {
+	value, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(value), 0).UTC()
+}
+
+// the header of a JWT
+type jwtHeader struct {
+	Alg	string	`json:"alg"`
+	Kid	string	`json:"kid"`
+}
+
+// a json web key
+type jwk struct {
+	Kty	string	`json:"kty"`
+	Kid	string	`json:"kid"`
+	Use	string	`json:"use"`
+	N	string	`json:"n"`
+	E	string	`json:"e"`
+}
+
+// verify the signature and the claims of the given id token, returning its claims
+func (p *Provider) verifyIdToken(rawToken, nonce string, now time.Time) (Claims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, &ErrInvalidLogin{"malformed id token"}
+	}
+	header := &jwtHeader{}
+	if err := decodeSegment(parts[0], header); err != nil {
+		return nil, &ErrInvalidLogin{fmt.Sprintf("malformed id token header: %v", err)}
+	}
+	// only RS256 is supported, which every provider must support according to the OpenID Connect spec
+	if header.Alg != "RS256" {
+		return nil, &ErrInvalidLogin{fmt.Sprintf("unsupported id token signing algorithm '%s'", header.Alg)}
+	}
+	key, err := p.keys.get(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, &ErrInvalidLogin{"malformed id token signature"}
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, &ErrInvalidLogin{"invalid id token signature"}
+	}
+	claims := Claims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, &ErrInvalidLogin{fmt.Sprintf("malformed id token claims: %v", err)}
+	}
+	if claims.String("iss") != p.discovery.Issuer {
+		return nil, &ErrInvalidLogin{fmt.Sprintf("unexpected id token issuer '%s'", claims.String("iss"))}
+	}
+	audienceOk := false
+	for _, aud := range claims.Strings("aud") {
+		audienceOk = audienceOk || aud == p.conf.ClientId
+	}
+	if !audienceOk {
+		return nil, &ErrInvalidLogin{"id token wasn't issued for this client"}
+	}
+	if exp := claims.time("exp"); exp.IsZero() || now.After(exp.Add(clockSkew)) {
+		return nil, &ErrInvalidLogin{"id token expired"}
+	}
+	if claims.String("nonce") != nonce {
+		return nil, &ErrInvalidLogin{"id token nonce doesn't match the started login"}
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	segmentBytes, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(segmentBytes, v)
+}
+
+// return the key with the given id, fetching the keys of the provider again if the key isn't known. Providers rotate
+// their keys, so an unknown key id usually means a new key was published
+func (ks *keySet) get(kid string) (*rsa.PublicKey, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	if key, ok := ks.keys[kid]; ok {
+		return key, nil
+	}
+	set := &struct {
+		Keys	[]*jwk	`json:"keys"`
+	}{}
+	if err := ks.provider.getJson(ks.uri, set); err != nil {
+		return nil, fmt.Errorf("error fetching the keys of the provider: %v", err)
+	}
+	ks.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("malformed modulus of key '%s': %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("malformed exponent of key '%s': %v", k.Kid, err)
+		}
+		ks.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, &ErrInvalidLogin{fmt.Sprintf("id token signed with unknown key '%s'", kid)}
+	}
+	return key, nil
+}
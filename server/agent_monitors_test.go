@@ -22,6 +22,7 @@ func getDbForMonitorTest() (map[string]string, func()) {
 		OsType:          "windows",
 		Architecture:    "amd64",
 		Status:          agents.Up,
+		State:           agents.Approved,
 		NumRunningTasks: 0,
 		LastKeepalive:   time.Now().UTC(),
 	}
@@ -33,6 +34,7 @@ func getDbForMonitorTest() (map[string]string, func()) {
 		OsType:          "linux",
 		Architecture:    "amd64",
 		Status:          agents.Up,
+		State:           agents.Approved,
 		NumRunningTasks: 0,
 		LastKeepalive:   time.Now().UTC(),
 	}
@@ -44,6 +46,7 @@ func getDbForMonitorTest() (map[string]string, func()) {
 		OsType:          "windows",
 		Architecture:    "386",
 		Status:          agents.Up,
+		State:           agents.Approved,
 		NumRunningTasks: 0,
 		LastKeepalive:   time.Now().UTC(),
 	}
@@ -55,6 +58,7 @@ func getDbForMonitorTest() (map[string]string, func()) {
 		OsType:          "linux",
 		Architecture:    "386",
 		Status:          agents.Up,
+		State:           agents.Approved,
 		NumRunningTasks: 0,
 		LastKeepalive:   time.Now().UTC(),
 	}
@@ -217,3 +221,41 @@ func TestTasksMonitor(t *testing.T) {
 		t.Fatalf("error querying tasks bucket for test: %v", err)
 	}
 }
+
+func TestAgentDraining(t *testing.T) {
+	agentsMap, cleanup := getDbForMonitorTest()
+	defer cleanup()
+	agent, err := agents.Get(agentsMap["linux_amd64"])
+	if err != nil {
+		t.Fatalf("error getting agent for test: %v", err)
+	}
+	agent.State = agents.Draining
+	agent.NumRunningTasks = 2
+	if err := db.Update(db.System, agent); err != nil {
+		t.Fatalf("error updating agent for test: %v", err)
+	}
+	if _, err := agentEndpoints.selectAgentForTask(&agents.Task{OsType: "linux", Architecture: "amd64"}); err == nil {
+		t.Fatalf("draining agent with id == %s was selected for running a task", agent.ID)
+	}
+	testData := []struct{
+		numRunningTasks	int
+		status			int
+	}{
+		{1, agents.Up},
+		{0, agents.Down},
+	}
+	for _, data := range testData {
+		keepaliveBytes, err := json.Marshal(&submitws.Keepalive{OsType: "linux", Architecture: "amd64", NumRunningTasks: data.numRunningTasks})
+		if err != nil {
+			t.Fatalf("error formatting keepalive for test: %v", err)
+		}
+		handleKeepalive(agent.ID, keepaliveBytes)
+		agent, err = agents.Get(agent.ID)
+		if err != nil {
+			t.Fatalf("error getting agent for test: %v", err)
+		}
+		if agent.Status != data.status {
+			t.Fatalf("expected draining agent with %d running tasks to have status %d but he has status %d", data.numRunningTasks, data.status, agent.Status)
+		}
+	}
+}
@@ -9,40 +9,11 @@ import (
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/gorilla/mux"
 	"net/http"
+	"strings"
 )
 
 func handleGetAgents(w http.ResponseWriter, r *http.Request) {
-	params, err := submithttp.PagingParamsFromRequest(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
-		return
-	}
-	var elementsCount, elementsIndex int64
-	var elements []db.IBucketElement
-	if err := db.QueryBucket([]byte(db.Agents), func(_, elementBytes []byte) error {
-		elementsIndex++
-		if elementsIndex <= params.AfterId {
-			return nil
-		}
-		agent := &agents.Agent{}
-		if err := json.Unmarshal(elementBytes, agent); err != nil {
-			return err
-		}
-		elements = append(elements, agent)
-		elementsCount++
-		if elementsCount == params.Limit {
-			return &db.ErrStopQuery{}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.Agents, func() db.IBucketElement { return &agents.Agent{} }, nil)
 }
 
 func handleGetAgent(w http.ResponseWriter, r *http.Request) {
@@ -59,83 +30,117 @@ func handleGetAgent(w http.ResponseWriter, r *http.Request) {
 	writeElem(w, r, http.StatusOK, requestedAgent)
 }
 
-func handleGetTasksForAgent(forAgent string, w http.ResponseWriter, r *http.Request, params *submithttp.PagingParams) {
-	exists, err := db.KeyExistsInBucket([]byte(db.Agents), []byte(forAgent))
+type ResponseWithAgentCredential struct {
+	Message		string		`json:"message"`
+	Credential	string		`json:"credential"`
+}
+
+func (e *ResponseWithAgentCredential) String() string {
+	return _stringForResp(e)
+}
+
+// approve, drain, disable or revoke the requested agent according to the state given via the SubmitState header
+func handleUpdateAgentState(w http.ResponseWriter, r *http.Request) {
+	stateStr := strings.ToLower(r.Header.Get(submithttp.SubmitState))
+	requestedAgentId := mux.Vars(r)[agentId]
+	agent, err := agents.Get(requestedAgentId)
 	if err != nil {
-		writeErrResp(w, r, http.StatusInternalServerError, err)
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			writeErrResp(w, r, http.StatusNotFound, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
 		return
 	}
-	if !exists {
-		writeErrResp(w, r, http.StatusNotFound, &db.ErrKeyNotFoundInBucket{Key: forAgent, Bucket: db.Agents})
+	if agent.State == agents.Revoked {
+		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("agent with id == %s is revoked", agent.ID))
 		return
 	}
-	var elementsCount, elementsIndex int64
-	var elements []db.IBucketElement
-	if err := db.QueryBucket([]byte(db.Tasks), func(_, elementBytes []byte) error {
-		task := &agents.Task{}
-		if err := json.Unmarshal(elementBytes, task); err != nil {
-			return err
-		}
-		if task.Agent == forAgent {
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
+	var credential string
+	wasDraining := agent.State == agents.Draining
+	switch stateStr {
+		case agentStateApproved:
+			if agent.State == agents.Approved {
+				writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("agent with id == %s is already approved", agent.ID))
+				return
 			}
-			elements = append(elements, task)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
+			// a draining agent keeps his credential, otherwise (or if he has none, as legacy agents) a new one is issued
+			if !wasDraining || agent.Credential == "" {
+				credential, err = agent.NewCredential()
+				if err != nil {
+					writeErrResp(w, r, http.StatusInternalServerError, err)
+					return
+				}
 			}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
+			agent.State = agents.Approved
+		case agentStateDraining:
+			if !agent.IsApproved() {
+				writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("only approved agents can be drained and agent with id == %s is not approved", agent.ID))
+				return
+			}
+			agent.State = agents.Draining
+			// an idle agent is drained right away, otherwise the keepalive handler marks him as down once he's idle
+			if agent.NumRunningTasks == 0 {
+				agent.Status = agents.Down
+			}
+		case agentStateDisabled:
+			if agent.State == agents.Disabled {
+				writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("agent with id == %s is already disabled", agent.ID))
+				return
+			}
+			agent.State = agents.Disabled
+			agent.Status = agents.Down
+		case agentStateRevoked:
+			agent.State = agents.Revoked
+			agent.Status = agents.Down
+			agent.Credential = ""
+		default:
+			writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("missing, empty or invalid state '%s' header", submithttp.SubmitState))
 			return
-		}
 	}
-	writeElements(w, r, http.StatusOK, elements)
+	if err := db.Update(r.Context().Value(authenticatedUser).(*users.User).UserName, agent); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	switch agent.State {
+		case agents.Disabled, agents.Revoked:
+			agentEndpoints.removeEndpoint(agent.ID)
+		case agents.Draining:
+			sendDrainToAgent(agent.ID, true)
+		case agents.Approved:
+			if wasDraining {
+				sendDrainToAgent(agent.ID, false)
+			}
+	}
+	if credential != "" {
+		writeResponse(w, r, http.StatusOK, &ResponseWithAgentCredential{Message: fmt.Sprintf("agent with id == %s approved successfully", agent.ID), Credential: credential})
+		return
+	}
+	writeResponse(w, r, http.StatusOK, &Response{Message: fmt.Sprintf("agent with id == %s is now %s", agent.ID, stateStr)})
 }
 
-func handleGetTasks(w http.ResponseWriter, r *http.Request) {
-	params, err := submithttp.PagingParamsFromRequest(r)
+func handleGetTasksForAgent(forAgent string, w http.ResponseWriter, r *http.Request) {
+	exists, err := db.KeyExistsInBucket([]byte(db.Agents), []byte(forAgent))
 	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeErrResp(w, r, http.StatusNotFound, &db.ErrKeyNotFoundInBucket{Key: forAgent, Bucket: db.Agents})
 		return
 	}
+	writeQueriedElements(w, r, db.Tasks, func() db.IBucketElement { return &agents.Task{} }, func(elem db.IBucketElement) bool {
+		return elem.(*agents.Task).Agent == forAgent
+	})
+}
+
+func handleGetTasks(w http.ResponseWriter, r *http.Request) {
 	forAgent := r.Header.Get(submithttp.SubmitAgent)
 	if forAgent != "" {
-		handleGetTasksForAgent(forAgent, w, r, params)
+		handleGetTasksForAgent(forAgent, w, r)
 		return
 	}
-	var elementsCount, elementsIndex int64
-	var elements []db.IBucketElement
-	if err := db.QueryBucket([]byte(db.Tasks), func(_, elementBytes []byte) error {
-		elementsIndex++
-		if elementsIndex <= params.AfterId {
-			return nil
-		}
-		task := &agents.Task{}
-		if err := json.Unmarshal(elementBytes, task); err != nil {
-			return err
-		}
-		elements = append(elements, task)
-		elementsCount++
-		if elementsCount == params.Limit {
-			return &db.ErrStopQuery{}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.Tasks, func() db.IBucketElement { return &agents.Task{} }, nil)
 }
 
 func handleGetTask(w http.ResponseWriter, r *http.Request) {
@@ -40,27 +40,55 @@ func handleKeepalive(agentId string, payload []byte) {
 	}
 	var agent *agents.Agent
 	if agent, err = agents.Get(agentId); err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); !ok {
-			logger.WithError(err).Errorf("keepalive handler: error querying for agent with id == %s", agentId)
-			return
-		}
-		agent = &agents.Agent{
-			ID: agentId,
-		}
+		logger.WithError(err).Errorf("keepalive handler: error querying for agent with id == %s", agentId)
+		return
+	}
+	if !agent.IsApproved() && agent.State != agents.Draining {
+		logger.Warnf("keepalive handler: ignoring keepalive from agent with id == %s as it is not approved", agentId)
+		return
 	}
-	agent.User = endpoint.user
 	agent.Hostname = keepalive.Hostname
 	agent.IpAddress = keepalive.IpAddress
 	agent.OsType = keepalive.OsType
 	agent.Architecture = keepalive.Architecture
 	agent.NumRunningTasks = keepalive.NumRunningTasks
 	agent.Status = agents.Up
+	// a draining agent is marked as down once he finished running all of his tasks
+	if agent.State == agents.Draining && agent.NumRunningTasks == 0 {
+		logger.Infof("keepalive handler: agent with id == %s is drained", agentId)
+		agent.Status = agents.Down
+	}
 	agent.LastKeepalive = time.Now().UTC()
 	if err = db.Update(endpoint.user, agent); err != nil {
 		logger.WithError(err).Errorf("keepalive handler: error updating agent with id == %s in the db", agentId)
 	}
 }
 
+// a message informing an agent if he is draining (shouldn't expect new tasks) or not
+type agentDrain struct {
+	Draining	bool	`json:"draining"`
+}
+
+// inform the agent with the given id (if connected) if he is draining or not
+func sendDrainToAgent(agentId string, draining bool) {
+	endpoint := agentEndpoints.getEndpoint(agentId)
+	if endpoint == nil {
+		logger.Debugf("drain: no endpoint for agent with id == %s", agentId)
+		return
+	}
+	drainBytes, err := json.Marshal(&agentDrain{Draining: draining})
+	if err != nil {
+		logger.WithError(err).Errorf("drain: error formatting drain message for agent with id == %s", agentId)
+		return
+	}
+	msg, err := submitws.NewMessage(messageTypeDrain, drainBytes)
+	if err != nil {
+		logger.WithError(err).Errorf("drain: error creating drain message for agent with id == %s", agentId)
+		return
+	}
+	endpoint.write(msg)
+}
+
 // handle task responses from agents - update the task with the response and move it to done status so the
 // processing job will pick it up and process it
 func handleTaskResponses(agentId string, payload []byte) {
@@ -98,6 +126,7 @@ func handleTaskResponses(agentId string, payload []byte) {
 		if err := db.Update(endpoint.user, taskResponse, task); err != nil {
 			logger.WithError(err).Error("task responses handler: error updating task and response")
 		}
+		taskOutputStreams.finish(task.ID)
 	}
 }
 
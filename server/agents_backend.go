@@ -125,6 +125,17 @@ func (m *agentEndpointsManager) getEndpoint(agentId string) *agentEndpoint {
 	return m.endpoints[agentId]
 }
 
+// close the connection with the agent with the given id (if connected) and stop tracking his endpoint
+func (m *agentEndpointsManager) removeEndpoint(agentId string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if endpoint := m.endpoints[agentId]; endpoint != nil {
+		logger.Infof("closing agent (id == %s) endpoint", agentId)
+		endpoint.close()
+		delete(m.endpoints, agentId)
+	}
+}
+
 // accept incoming agent connections
 func (m *agentEndpointsManager) agentsEndpoint(w http.ResponseWriter, r *http.Request) {
 	agentId := r.Header.Get(submitws.AgentIdHeader)
@@ -132,8 +143,45 @@ func (m *agentEndpointsManager) agentsEndpoint(w http.ResponseWriter, r *http.Re
 		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("invalid agent ID sent to agent endpoint [ %s ]", agentId))
 		return
 	}
+	user := r.Context().Value(authenticatedUser).(*users.User)
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	agent, err := agents.Get(agentId)
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); !ok {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		// unknown agent, register it so an admin can approve it
+		if _, err := agents.Register(agentId, user.UserName, true); err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		logger.Infof("agent with id == %s registered by user %s and is pending approval", agentId, user.UserName)
+		writeStrErrResp(w, r, http.StatusForbidden, fmt.Sprintf("agent with id == %s registered and is pending approval", agentId))
+		return
+	}
+	if agent.User != user.UserName {
+		writeStrErrResp(w, r, http.StatusForbidden, fmt.Sprintf("agent with id == %s is bound to another user", agentId))
+		return
+	}
+	switch agent.State {
+		case agents.Approved, agents.Draining, agents.Legacy:
+		case agents.Pending:
+			writeStrErrResp(w, r, http.StatusForbidden, fmt.Sprintf("agent with id == %s is pending approval", agentId))
+			return
+		case agents.Disabled:
+			writeStrErrResp(w, r, http.StatusForbidden, fmt.Sprintf("agent with id == %s is disabled", agentId))
+			return
+		default:
+			writeStrErrResp(w, r, http.StatusForbidden, fmt.Sprintf("agent with id == %s is revoked", agentId))
+			return
+	}
+	// legacy agents connect without a credential until they're approved
+	if agent.State != agents.Legacy && !agent.VerifyCredential(r.Header.Get(agentCredentialHeader)) {
+		writeStrErrResp(w, r, http.StatusUnauthorized, fmt.Sprintf("invalid credential given for agent with id == %s", agentId))
+		return
+	}
 	endpoint := m.endpoints[agentId]
 	if endpoint != nil {
 		endpoint.mutex.RLock()
@@ -151,7 +199,7 @@ func (m *agentEndpointsManager) agentsEndpoint(w http.ResponseWriter, r *http.Re
 		return
 	}
 	logger.Debugf("successfully upgraded connection from [ %s ] to websocket", r.RemoteAddr)
-	endpoint = newAgentEndpoint(agentId, conn, r.Context().Value(authenticatedUser).(*users.User).UserName)
+	endpoint = newAgentEndpoint(agentId, conn, user.UserName)
 	m.endpoints[agentId] = endpoint
 	go endpoint.readLoop()
 }
@@ -228,7 +276,7 @@ func (m *agentEndpointsManager) selectAgentForTask(task *agents.Task) (string, e
 		if err := json.Unmarshal(agentBytes, agent); err != nil {
 			return err
 		}
-		if agent.Status != agents.Up {
+		if agent.Status != agents.Up || !agent.IsApproved() {
 			return nil
 		}
 		if task.Architecture != "" && task.Architecture != agent.Architecture {
@@ -262,6 +310,7 @@ func (m *agentEndpointsManager) updateTaskWithDescriptionToErr(task *agents.Task
 	if err := db.Update(db.System, task); err != nil {
 		logger.WithError(err).Errorf("agents tasks monitor: failed updating task with id == %s to error status", task.ID)
 	}
+	taskOutputStreams.finish(task.ID)
 }
 
 func (m *agentEndpointsManager) processTaskWithResponse(task *agents.Task) {
@@ -417,6 +466,9 @@ func (m *agentEndpointsManager) processTasks(wg *sync.WaitGroup) {
 			if err := db.Update(db.System, tasks...); err != nil {
 				logger.WithError(err).Error("failed updating timed out tasks")
 			}
+			for _, taskElem := range tasks {
+				taskOutputStreams.finish(taskElem.(*agents.Task).ID)
+			}
 		}(wg, taskElementsTimedOut)
 	}
 	// divide tasks between workers
@@ -467,38 +519,28 @@ func initAgentsBackend(r *mux.Router, manager *authManager, ctx context.Context,
 	agentsBasePath := fmt.Sprintf("/%s", submitws.Agents)
 	agentsRouter := r.PathPrefix(agentsBasePath).Subrouter()
 	agentsRouter.HandleFunc(fmt.Sprintf("/%s", endpoint), agentEndpoints.agentsEndpoint).Methods(http.MethodGet)
-	manager.addPathToMap(fmt.Sprintf("%s/%s", agentsBasePath, endpoint), func (user *users.User, _ *http.Request) bool {
-		return user.Roles.Contains(users.Agent) || user.Roles.Contains(users.Admin)
-	})
+	manager.addPathPolicy(fmt.Sprintf("%s/%s", agentsBasePath, endpoint), newPolicy("agent endpoint", nil, allow(relationAdmin), allow(relationAgent)))
 	agentsRouter.HandleFunc("/", handleGetAgents).Methods(http.MethodGet)
-	manager.addPathToMap(fmt.Sprintf("%s/", agentsBasePath), func (user *users.User, _ *http.Request) bool {
-		return user.Roles.Contains(users.Admin)
-	})
-	agentsRouter.HandleFunc(fmt.Sprintf("/{%s}", agentId), handleGetAgent).Methods(http.MethodGet)
-	manager.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", agentsBasePath)), func (user *users.User, _ *http.Request) bool {
-		return user.Roles.Contains(users.Admin)
-	})
+	manager.addPathPolicy(fmt.Sprintf("%s/", agentsBasePath), newPolicy(submitws.Agents, nil, allow(relationAdmin)))
+	specificAgentPath := fmt.Sprintf("/{%s}", agentId)
+	agentsRouter.HandleFunc(specificAgentPath, handleGetAgent).Methods(http.MethodGet)
+	agentsRouter.HandleFunc(specificAgentPath, handleUpdateAgentState).Methods(http.MethodPatch)
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", agentsBasePath)), newPolicy("agent", nil, allow(relationAdmin)))
 	tasksBasePath := fmt.Sprintf("/%s", db.Tasks)
 	tasksRouter := r.PathPrefix(tasksBasePath).Subrouter()
 	tasksRouter.HandleFunc("/", handleGetTasks).Methods(http.MethodGet)
 	tasksRouter.HandleFunc("/", handlePostOnDemandTask).Methods(http.MethodPost)
-	manager.addPathToMap(fmt.Sprintf("%s/", tasksBasePath), func (user *users.User, _ *http.Request) bool {
-		return user.Roles.Contains(users.Admin)
-	})
+	manager.addPathPolicy(fmt.Sprintf("%s/", tasksBasePath), newPolicy(db.Tasks, nil, allow(relationAdmin)))
 	tasksRouter.HandleFunc(fmt.Sprintf("/{%s}", taskId), handleGetTask).Methods(http.MethodGet)
-	manager.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", tasksBasePath)), func (user *users.User, _ *http.Request) bool {
-		return user.Roles.Contains(users.Admin)
-	})
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/[^/]+$", tasksBasePath)), newPolicy("task", nil, allow(relationAdmin)))
+	tasksRouter.HandleFunc(fmt.Sprintf("/{%s}/stream", taskId), handleStreamTaskOutput).Methods(http.MethodGet)
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/[^/]+/stream$", tasksBasePath)), newTestTaskPolicy())
 	taskResponsesBasePath := fmt.Sprintf("/%s", db.TaskResponses)
 	taskResponsesRouter := r.PathPrefix(taskResponsesBasePath).Subrouter()
 	taskResponsesRouter.HandleFunc("/", handleGetTaskResponses).Methods(http.MethodGet)
-	manager.addPathToMap(fmt.Sprintf("%s/", taskResponsesBasePath), func (user *users.User, _ *http.Request) bool {
-		return user.Roles.Contains(users.Admin)
-	})
+	manager.addPathPolicy(fmt.Sprintf("%s/", taskResponsesBasePath), newPolicy(db.TaskResponses, nil, allow(relationAdmin)))
 	taskResponsesRouter.HandleFunc(fmt.Sprintf("/{%s}", taskId), handleGetTaskResponse).Methods(http.MethodGet)
-	manager.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", taskResponsesBasePath)), func (user *users.User, _ *http.Request) bool {
-		return user.Roles.Contains(users.Admin)
-	})
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", taskResponsesBasePath)), newPolicy("task response", nil, allow(relationAdmin)))
 	wg.Add(2)
 	go agentEndpoints.agentStatusMonitor(ctx, wg)
 	go agentEndpoints.agentTasksMonitor(ctx, wg)
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/DAv10195/submit_commons"
 	"github.com/DAv10195/submit_commons/containers"
+	submithttp "github.com/DAv10195/submit_commons/http"
 	submitws "github.com/DAv10195/submit_commons/websocket"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/agents"
@@ -372,3 +373,104 @@ func TestTaskRespRestHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestAgentRegistration(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	cleanupSess := session.InitSessionForTest()
+	defer cleanupSess()
+	if err := users.InitDefaultAdmin(); err != nil {
+		t.Fatalf("error initialiting admin user for test: %v", err)
+	}
+	if _, err := users.NewUserBuilder(db.System, true).WithUserName(users.Agent).WithPassword(users.Agent).WithRoles(users.Agent).Build(); err != nil {
+		t.Fatalf("error creating agent user for agent registration test: %v", err)
+	}
+	router := newTestRouter(t)
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	initAgentsBackend(router.Router, router.am, ctx, wg)
+	agentId := submit_commons.GenerateUniqueId()
+	endpointPath, agentPath := fmt.Sprintf("/%s/%s", submitws.Agents, endpoint), fmt.Sprintf("/%s/%s", submitws.Agents, agentId)
+	connectAgent := func(id, credential string) int {
+		return router.sendWith(http.MethodGet, endpointPath, "", basicAuth(users.Agent, users.Agent), submitws.AgentIdHeader, id, agentCredentialHeader, credential).Code
+	}
+	connect := func(credential string) int {
+		return connectAgent(agentId, credential)
+	}
+	updateState := func(state string) *httptest.ResponseRecorder {
+		return router.send(http.MethodPatch, agentPath, "", users.Admin, submithttp.SubmitState, state)
+	}
+	// unknown agents are registered as pending and can't connect
+	if code := connect(""); code != http.StatusForbidden {
+		t.Fatalf("connecting unknown agent produced status code %d instead of the expected %d status code", code, http.StatusForbidden)
+	}
+	agent, err := agents.Get(agentId)
+	if err != nil {
+		t.Fatalf("error getting registered agent for test: %v", err)
+	}
+	if agent.State != agents.Pending || agent.User != users.Agent {
+		t.Fatalf("expected agent with id == %s to be pending and bound to %s but he's not", agentId, users.Agent)
+	}
+	if code := connect(""); code != http.StatusForbidden {
+		t.Fatalf("connecting pending agent produced status code %d instead of the expected %d status code", code, http.StatusForbidden)
+	}
+	// approve the agent and verify that a credential is issued for him
+	w := updateState(agentStateApproved)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approving agent produced status code %d instead of the expected %d status code", w.Code, http.StatusOK)
+	}
+	resp := &ResponseWithAgentCredential{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Fatalf("error parsing agent approval response: %v", err)
+	}
+	if resp.Credential == "" {
+		t.Fatal("no credential returned when approving agent")
+	}
+	if agent, err = agents.Get(agentId); err != nil || agent.Credential == resp.Credential || !agent.VerifyCredential(resp.Credential) {
+		t.Fatalf("expected only the hash of the credential of agent with id == %s to be stored", agentId)
+	}
+	if code := connect("bad"); code != http.StatusUnauthorized {
+		t.Fatalf("connecting agent with bad credential produced status code %d instead of the expected %d status code", code, http.StatusUnauthorized)
+	}
+	if w := updateState(agentStateDraining); w.Code != http.StatusOK {
+		t.Fatalf("draining agent produced status code %d instead of the expected %d status code", w.Code, http.StatusOK)
+	}
+	if w := updateState(agentStateDisabled); w.Code != http.StatusOK {
+		t.Fatalf("disabling agent produced status code %d instead of the expected %d status code", w.Code, http.StatusOK)
+	}
+	if code := connect(resp.Credential); code != http.StatusForbidden {
+		t.Fatalf("connecting disabled agent produced status code %d instead of the expected %d status code", code, http.StatusForbidden)
+	}
+	// revoked agents can't be approved again
+	if w := updateState(agentStateRevoked); w.Code != http.StatusOK {
+		t.Fatalf("revoking agent produced status code %d instead of the expected %d status code", w.Code, http.StatusOK)
+	}
+	if w := updateState(agentStateApproved); w.Code != http.StatusBadRequest {
+		t.Fatalf("approving revoked agent produced status code %d instead of the expected %d status code", w.Code, http.StatusBadRequest)
+	}
+	agent, err = agents.Get(agentId)
+	if err != nil {
+		t.Fatalf("error getting revoked agent for test: %v", err)
+	}
+	if agent.State != agents.Revoked || agent.Credential != "" {
+		t.Fatalf("expected agent with id == %s to be revoked without a credential but he's not", agentId)
+	}
+	// agents enrolled before agents had to be approved keep connecting without a credential until they're approved. A
+	// plain request passing the checks fails only the websocket upgrade
+	legacyAgent := &agents.Agent{ID: submit_commons.GenerateUniqueId(), User: users.Agent, Status: agents.Down}
+	if err := db.Update(db.System, legacyAgent); err != nil {
+		t.Fatalf("error creating legacy agent for test: %v", err)
+	}
+	if code := connectAgent(legacyAgent.ID, ""); code != http.StatusBadRequest {
+		t.Fatalf("connecting legacy agent produced status code %d instead of the expected %d status code", code, http.StatusBadRequest)
+	}
+	w = router.send(http.MethodPatch, fmt.Sprintf("/%s/%s", submitws.Agents, legacyAgent.ID), "", users.Admin, submithttp.SubmitState, agentStateApproved)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approving legacy agent produced status code %d instead of the expected %d status code", w.Code, http.StatusOK)
+	}
+	if code := connectAgent(legacyAgent.ID, ""); code != http.StatusUnauthorized {
+		t.Fatalf("connecting approved legacy agent without credential produced status code %d instead of the expected %d status code", code, http.StatusUnauthorized)
+	}
+}
@@ -125,8 +125,7 @@ func handleTestTask(payload []byte, labels map[string]interface{}) error {
 		return err
 	}
 	box.Messages.Add(msg.ID)
-	assInst.Grade = tr.Grade
-	assInst.State = assignments.Graded
+	assInst.SetGrade(tr.Grade)
 	return db.Update(db.System, assInst, msg, box)
 }
 
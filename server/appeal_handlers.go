@@ -2,19 +2,25 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/appeals"
 	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/messages"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/gorilla/mux"
+	"io"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
-func handleGetAppealsForCourse(forCourse string, w http.ResponseWriter, r *http.Request, params *submithttp.PagingParams) {
+func handleGetAppealsForCourse(forCourse string, w http.ResponseWriter, r *http.Request) {
 	exists, err := db.KeyExistsInBucket([]byte(db.Courses), []byte(forCourse))
 	if err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
@@ -24,37 +30,12 @@ func handleGetAppealsForCourse(forCourse string, w http.ResponseWriter, r *http.
 		writeErrResp(w, r, http.StatusNotFound, &db.ErrKeyNotFoundInBucket{Key: forCourse, Bucket: db.Courses})
 		return
 	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Appeals), func (appealKey []byte, appealBytes []byte) error {
-		appeal := &appeals.Appeal{}
-		if err := json.Unmarshal(appealBytes, appeal); err != nil {
-			return err
-		}
-		if strings.HasPrefix(string(appealKey), forCourse) {
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, appeal)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.Appeals, func() db.IBucketElement { return &appeals.Appeal{} }, func(elem db.IBucketElement) bool {
+		return strings.HasPrefix(string(elem.Key()), forCourse)
+	})
 }
 
-func handleGetAppealsForAss(forAss string, w http.ResponseWriter, r *http.Request, params *submithttp.PagingParams) {
+func handleGetAppealsForAss(forAss string, w http.ResponseWriter, r *http.Request) {
 	exists, err := db.KeyExistsInBucket([]byte(db.AssignmentDefinitions), []byte(forAss))
 	if err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
@@ -64,42 +45,12 @@ func handleGetAppealsForAss(forAss string, w http.ResponseWriter, r *http.Reques
 		writeErrResp(w, r, http.StatusNotFound, &db.ErrKeyNotFoundInBucket{Key: forAss, Bucket: db.AssignmentDefinitions})
 		return
 	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Appeals), func (appealKey []byte, appealBytes []byte) error {
-		appeal := &appeals.Appeal{}
-		if err := json.Unmarshal(appealBytes, appeal); err != nil {
-			return err
-		}
-		if strings.HasPrefix(string(appealKey), forAss) {
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, appeal)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.Appeals, func() db.IBucketElement { return &appeals.Appeal{} }, func(elem db.IBucketElement) bool {
+		return strings.HasPrefix(string(elem.Key()), forAss)
+	})
 }
 
 func handleGetAppeals(w http.ResponseWriter, r *http.Request) {
-	params, err := submithttp.PagingParamsFromRequest(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
-		return
-	}
 	forCourse := r.Header.Get(submithttp.ForSubmitCourse)
 	forAss := r.Header.Get(submithttp.ForSubmitAss)
 	if forCourse != "" && forAss != "" {
@@ -107,39 +58,14 @@ func handleGetAppeals(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if forCourse != "" {
-		handleGetAppealsForCourse(forCourse, w, r, params)
+		handleGetAppealsForCourse(forCourse, w, r)
 		return
 	}
 	if forAss != "" {
-		handleGetAppealsForAss(forAss, w, r, params)
+		handleGetAppealsForAss(forAss, w, r)
 		return
 	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Appeals), func (_ []byte, appealBytes []byte) error {
-		elementsIndex++
-		if elementsIndex <= params.AfterId {
-			return nil
-		}
-		appeal := &appeals.Appeal{}
-		if err := json.Unmarshal(appealBytes, appeal); err != nil {
-			return err
-		}
-		elements = append(elements, appeal)
-		elementsCount++
-		if elementsCount == params.Limit {
-			return &db.ErrStopQuery{}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.Appeals, func() db.IBucketElement { return &appeals.Appeal{} }, nil)
 }
 
 func handleGetAppeal(w http.ResponseWriter, r *http.Request) {
@@ -160,12 +86,24 @@ func handleGetAppeal(w http.ResponseWriter, r *http.Request) {
 	writeElem(w, r, http.StatusOK, appeal)
 }
 
+// the details of an appeal given when creating it
+type AppealRequest struct {
+	Category		string	`json:"category"`
+	RequestedChange	string	`json:"requested_change"`
+}
+
 func handleCreateAppeal(w http.ResponseWriter, r *http.Request) {
 	forAss := r.Header.Get(submithttp.ForSubmitAss)
 	if forAss == "" {
 		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("no assignment instance given via '%s' header", submithttp.ForSubmitAss))
 		return
 	}
+	// the details of the appeal are optional
+	ar := &AppealRequest{}
+	if err := json.NewDecoder(r.Body).Decode(ar); err != nil && err != io.EOF {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
 	ass, err := assignments.GetInstance(forAss)
 	if err != nil {
 		writeErrResp(w, r, http.StatusBadRequest, err)
@@ -175,30 +113,121 @@ func handleCreateAppeal(w http.ResponseWriter, r *http.Request) {
 		writeStrErrResp(w, r, http.StatusBadRequest, "creating appeal for an ungraded assignment is forbidden")
 		return
 	}
-	_, err = appeals.New(forAss, r.Context().Value(authenticatedUser).(*users.User).UserName, true)
+	assDef, err := assignments.GetDef(ass.AssignmentDef)
 	if err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	// instances graded before grading times were recorded have no appeal window
+	if assDef.AppealWindowDays > 0 && !ass.GradedOn.IsZero() {
+		if appealBy := ass.GradedOn.AddDate(0, 0, assDef.AppealWindowDays); time.Now().UTC().After(appealBy) {
+			writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("the appeal window of '%s' closed on %s", forAss, appealBy.Format(time.RFC3339)))
+			return
+		}
+	}
+	if ar.Category != "" && !appeals.Categories.Contains(ar.Category) {
+		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("invalid appeal category '%s'", ar.Category))
+		return
+	}
+	_, err = appeals.New(forAss, ar.Category, ar.RequestedChange, r.Context().Value(authenticatedUser).(*users.User).UserName, true)
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyExistsInBucket); ok {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
 	writeResponse(w, r, http.StatusAccepted, &Response{Message: "appeal created successfully"})
 }
 
+// return the kind of the given user as an actor on the given appeal
+func getAppealActor(user *users.User, appeal *appeals.Appeal) (*appeals.Actor, error) {
+	actor := &appeals.Actor{UserName: user.UserName}
+	if user.Roles.Contains(users.Admin) {
+		actor.Kind = appeals.ActorAdmin
+		return actor, nil
+	}
+	assInst, err := assignments.GetInstance(appeal.AssignmentInstance)
+	if err != nil {
+		return nil, err
+	}
+	assDef, err := assignments.GetDef(assInst.AssignmentDef)
+	if err != nil {
+		return nil, err
+	}
+	if user.CoursesAsStaff != nil && user.CoursesAsStaff.Contains(assDef.Course) {
+		course, err := courses.Get(assDef.Course)
+		if err != nil {
+			return nil, err
+		}
+		actor.Kind = appeals.ActorTeachingAssistant
+		if course.StaffRole(user.UserName) == courses.Lecturer {
+			actor.Kind = appeals.ActorLecturer
+		}
+		return actor, nil
+	}
+	actor.Kind = appeals.ActorStudent
+	return actor, nil
+}
+
+// write the response for an error returned by an appeal state transition
+func writeAppealTransitionErr(w http.ResponseWriter, r *http.Request, err error) {
+	switch err.(type) {
+		case *appeals.ErrTransitionForbidden:
+			writeErrResp(w, r, http.StatusForbidden, err)
+		case *appeals.ErrInvalidTransition, *appeals.ErrInvalidResolution:
+			writeErrResp(w, r, http.StatusBadRequest, err)
+		default:
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+	}
+}
+
 func handleUpdateAppealState(w http.ResponseWriter, r *http.Request) {
 	stateStr := strings.ToLower(r.Header.Get(submithttp.SubmitState))
 	var state int
+	var action string
 	switch stateStr {
 		case submithttp.AppealStateOpen:
-			state = appeals.Open
+			state, action = appeals.Open, appeals.ActionReopen
 		case submithttp.AppealStateClosed:
-			state = appeals.Closed
+			state, action = appeals.Closed, appeals.ActionClose
 		default:
 			writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("missing, empty or invalid state '%s' header", submithttp.SubmitState))
 			return
 	}
+	appeal := getAppealFromRequest(w, r)
+	if appeal == nil {
+		return
+	}
+	if appeal.State == state {
+		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("appeal is already in the given state ('%s')", stateStr))
+		return
+	}
+	user := r.Context().Value(authenticatedUser).(*users.User)
+	actor, err := getAppealActor(user, appeal)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := appeal.Transition(action, actor, ""); err != nil {
+		writeAppealTransitionErr(w, r, err)
+		return
+	}
+	if err := db.Update(user.UserName, appeal); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, &Response{Message: "appeal state updated successfully"})
+}
+
+// return the appeal of the course number and year, assignment def name and user name path params of the request. An
+// error response is written if the appeal can't be returned
+func getAppealFromRequest(w http.ResponseWriter, r *http.Request) *appeals.Appeal {
 	assKey, err := getAssInstKey(r)
 	if err != nil {
 		writeStrErrResp(w, r, http.StatusBadRequest, "invalid course number and/or year integer path params")
-		return
+		return nil
 	}
 	appeal, err := appeals.Get(assKey)
 	if err != nil {
@@ -207,18 +236,287 @@ func handleUpdateAppealState(w http.ResponseWriter, r *http.Request) {
 		} else {
 			writeErrResp(w, r, http.StatusInternalServerError, err)
 		}
+		return nil
+	}
+	return appeal
+}
+
+// the staff member assigned to handle an appeal
+type AppealAssignee struct {
+	AssignedTo	string	`json:"assigned_to"`
+}
+
+// assign a staff member of the course to handle the appeal. An empty assignee unassigns the appeal. Escalated appeals
+// can only be reassigned by admins, which escalates them to the new assignee
+func handleAssignAppeal(w http.ResponseWriter, r *http.Request) {
+	appeal := getAppealFromRequest(w, r)
+	if appeal == nil {
 		return
 	}
-	if appeal.State == state {
-		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("appeal is already in the given state ('%s')", stateStr))
+	assignee := &AppealAssignee{}
+	if err := json.NewDecoder(r.Body).Decode(assignee); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
 		return
 	}
-	appeal.State = state
-	if err := db.Update(r.Context().Value(authenticatedUser).(*users.User).UserName, appeal); err != nil {
+	user := r.Context().Value(authenticatedUser).(*users.User)
+	if appeal.EscalatedTo != "" {
+		if !user.Roles.Contains(users.Admin) {
+			writeStrErrResp(w, r, http.StatusForbidden, fmt.Sprintf("appeal was escalated to \"%s\"", appeal.EscalatedTo))
+			return
+		}
+		if assignee.AssignedTo == "" {
+			writeStrErrResp(w, r, http.StatusBadRequest, "an escalated appeal can't be unassigned")
+			return
+		}
+	}
+	if assignee.AssignedTo != "" {
+		number, year, err := getCourseNumberAndYearFromRequest(r)
+		if err != nil {
+			writeStrErrResp(w, r, http.StatusBadRequest, "invalid course number and/or year integer path params")
+			return
+		}
+		staffMember, err := users.Get(assignee.AssignedTo)
+		if err != nil {
+			if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+				writeErrResp(w, r, http.StatusBadRequest, err)
+			} else {
+				writeErrResp(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		if staffMember.CoursesAsStaff == nil || !staffMember.CoursesAsStaff.Contains(fmt.Sprintf("%d%s%d", number, db.KeySeparator, year)) {
+			writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("user \"%s\" isn't a staff member of the course", assignee.AssignedTo))
+			return
+		}
+	}
+	appeal.AssignedTo = assignee.AssignedTo
+	if appeal.EscalatedTo != "" {
+		appeal.EscalatedTo = assignee.AssignedTo
+	}
+	if err := db.Update(user.UserName, appeal); err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	writeResponse(w, r, http.StatusOK, &Response{Message: "appeal state updated successfully"})
+	writeResponse(w, r, http.StatusOK, &Response{Message: "appeal assigned successfully"})
+}
+
+// the resolution of an appeal given by a staff member. The grade can be omitted when the appeal is rejected
+type AppealResolutionRequest struct {
+	Outcome	string	`json:"outcome"`
+	Grade	*int	`json:"grade"`
+	Comment	string	`json:"comment"`
+}
+
+// resolve the appeal, closing it and updating the grade of the appealed assignment instance accordingly
+func handleResolveAppeal(w http.ResponseWriter, r *http.Request) {
+	appeal := getAppealFromRequest(w, r)
+	if appeal == nil {
+		return
+	}
+	rr := &AppealResolutionRequest{}
+	if err := json.NewDecoder(r.Body).Decode(rr); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	assInst, err := assignments.GetInstance(appeal.AssignmentInstance)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	grade := assInst.Grade
+	if rr.Grade != nil {
+		grade = *rr.Grade
+	}
+	user := r.Context().Value(authenticatedUser).(*users.User)
+	actor, err := getAppealActor(user, appeal)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := appeal.Resolve(rr.Outcome, assInst.Grade, grade, rr.Comment, actor); err != nil {
+		writeAppealTransitionErr(w, r, err)
+		return
+	}
+	assInst.Grade = grade
+	// the appeal and the grade are updated together, so a resolved appeal always matches the grade
+	if err := db.Update(user.UserName, appeal, assInst); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeElem(w, r, http.StatusOK, appeal)
+}
+
+// return the lecturer appeals of the course with the given key are escalated to. That's the designated lecturer of the
+// course if it has one, otherwise the first of its lecturers by name (empty if it has no lecturers)
+func getAppealsLecturer(courseKey string) (string, error) {
+	course, err := courses.Get(courseKey)
+	if err != nil {
+		return "", err
+	}
+	if course.AppealsLecturer != "" {
+		return course.AppealsLecturer, nil
+	}
+	var lecturers []string
+	if err := db.QueryBucket([]byte(db.Users), func(_, elemBytes []byte) error {
+		user := &users.User{}
+		if err := json.Unmarshal(elemBytes, user); err != nil {
+			return err
+		}
+		if user.CoursesAsStaff != nil && user.CoursesAsStaff.Contains(courseKey) && course.StaffRole(user.UserName) == courses.Lecturer {
+			lecturers = append(lecturers, user.UserName)
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	if len(lecturers) == 0 {
+		return "", nil
+	}
+	sort.Strings(lecturers)
+	return lecturers[0], nil
+}
+
+// the reason given by a student for escalating an appeal
+type AppealEscalationRequest struct {
+	Comment	string	`json:"comment"`
+}
+
+// escalate an appeal rejected by a teaching assistant to the lecturer handling escalated appeals of the course
+func handleEscalateAppeal(w http.ResponseWriter, r *http.Request) {
+	appeal := getAppealFromRequest(w, r)
+	if appeal == nil {
+		return
+	}
+	er := &AppealEscalationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(er); err != nil && err != io.EOF {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	courseKey, err := getCourseKeyFromRequest(r)
+	if err != nil {
+		writeStrErrResp(w, r, http.StatusBadRequest, "invalid course number and/or year integer path params")
+		return
+	}
+	lecturer, err := getAppealsLecturer(courseKey)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	user := r.Context().Value(authenticatedUser).(*users.User)
+	actor, err := getAppealActor(user, appeal)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := appeal.Escalate(lecturer, er.Comment, actor); err != nil {
+		writeAppealTransitionErr(w, r, err)
+		return
+	}
+	if err := db.Update(user.UserName, appeal); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeElem(w, r, http.StatusOK, appeal)
+}
+
+// an appeal waiting for a response of the staff
+type WaitingAppeal struct {
+	Appeal			string		`json:"appeal"`
+	State			int			`json:"state"`
+	AssignedTo		string		`json:"assigned_to"`
+	WaitingSince	time.Time	`json:"waiting_since"`
+	WaitingHours	float64		`json:"waiting_hours"`
+}
+
+// response times of the staff of a course to appeals
+type AppealsSla struct {
+	Course				string				`json:"course"`
+	Waiting				int					`json:"waiting"`
+	Escalated			int					`json:"escalated"`
+	AvgWaitingHours		float64				`json:"avg_waiting_hours"`
+	MaxWaitingHours		float64				`json:"max_waiting_hours"`
+	WaitingAppeals		[]*WaitingAppeal	`json:"waiting_appeals"`
+}
+
+func (s *AppealsSla) String() string {
+	return _stringForResp(s)
+}
+
+// report the appeals of a course waiting for a response of the staff, longest waiting first. An appeal waits since it
+// was last opened or escalated or since the last message of the staff in its message box, whichever is later
+func handleGetAppealsSla(w http.ResponseWriter, r *http.Request) {
+	forCourse := r.Header.Get(submithttp.ForSubmitCourse)
+	if forCourse == "" {
+		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("missing or empty '%s' header", submithttp.ForSubmitCourse))
+		return
+	}
+	exists, err := db.KeyExistsInBucket([]byte(db.Courses), []byte(forCourse))
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeErrResp(w, r, http.StatusNotFound, &db.ErrKeyNotFoundInBucket{Key: forCourse, Bucket: db.Courses})
+		return
+	}
+	var waiting []*appeals.Appeal
+	boxOwners := make(map[string]string)
+	if err := db.QueryBucketWithPrefix([]byte(db.Appeals), []byte(forCourse + db.KeySeparator), func (_, appealBytes []byte) error {
+		appeal := &appeals.Appeal{}
+		if err := json.Unmarshal(appealBytes, appeal); err != nil {
+			return err
+		}
+		if appeal.State != appeals.Closed {
+			waiting = append(waiting, appeal)
+			split := strings.Split(appeal.AssignmentInstance, db.KeySeparator)
+			boxOwners[appeal.MessageBox] = split[len(split) - 1]
+		}
+		return nil
+	}); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// messages in the box of an appeal which weren't sent by its owner are responses of the staff
+	lastStaffResponses := make(map[string]time.Time)
+	if len(waiting) > 0 {
+		if err := db.QueryBucket([]byte(db.Messages), func (_, msgBytes []byte) error {
+			msg := &messages.Message{}
+			if err := json.Unmarshal(msgBytes, msg); err != nil {
+				return err
+			}
+			if owner, ok := boxOwners[msg.Box]; ok && msg.From != owner && msg.CreatedOn.After(lastStaffResponses[msg.Box]) {
+				lastStaffResponses[msg.Box] = msg.CreatedOn
+			}
+			return nil
+		}); err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	now := time.Now().UTC()
+	sla := &AppealsSla{Course: forCourse, WaitingAppeals: []*WaitingAppeal{}}
+	var totalHours float64
+	for _, appeal := range waiting {
+		since := appeal.WaitingSince(lastStaffResponses[appeal.MessageBox])
+		hours := now.Sub(since).Hours()
+		sla.WaitingAppeals = append(sla.WaitingAppeals, &WaitingAppeal{Appeal: appeal.AssignmentInstance, State: appeal.State,
+			AssignedTo: appeal.AssignedTo, WaitingSince: since, WaitingHours: hours})
+		sla.Waiting++
+		if appeal.State == appeals.Escalated {
+			sla.Escalated++
+		}
+		totalHours += hours
+		if hours > sla.MaxWaitingHours {
+			sla.MaxWaitingHours = hours
+		}
+	}
+	if sla.Waiting > 0 {
+		sla.AvgWaitingHours = totalHours / float64(sla.Waiting)
+	}
+	sort.Slice(sla.WaitingAppeals, func(i, j int) bool {
+		return sla.WaitingAppeals[i].WaitingSince.Before(sla.WaitingAppeals[j].WaitingSince)
+	})
+	writeResponse(w, r, http.StatusOK, sla)
 }
 
 func initAppealsRouter(r *mux.Router, m *authManager) {
@@ -226,59 +524,51 @@ func initAppealsRouter(r *mux.Router, m *authManager) {
 	router := r.PathPrefix(basePath).Subrouter()
 	router.HandleFunc("/", handleGetAppeals).Methods(http.MethodGet)
 	router.HandleFunc("/", handleCreateAppeal).Methods(http.MethodPost)
-	m.addPathToMap(fmt.Sprintf("%s/", basePath), func(user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		forCourse := request.Header.Get(submithttp.ForSubmitCourse)
-		forAss := request.Header.Get(submithttp.ForSubmitAss)
-		if request.Method == http.MethodGet {
-			if forCourse != "" && forAss != "" {
-				return true // let the list handler fail this with bad request...
-			}
-			if forCourse != "" {
-				return user.CoursesAsStaff.Contains(forCourse)
-			}
-			if forAss != ""  {
-				ass, err := assignments.GetDef(forAss)
-				if err != nil {
-					return true // let the list handler fail this with bad request...
-				}
-				return user.CoursesAsStaff.Contains(ass.Course)
+	m.addPathPolicy(fmt.Sprintf("%s/", basePath), newPolicy(db.Appeals, func (ar *authRequest) (*authResource, error) {
+		forCourse := ar.request.Header.Get(submithttp.ForSubmitCourse)
+		forAss := ar.request.Header.Get(submithttp.ForSubmitAss)
+		if ar.request.Method == http.MethodPost {
+			ass, err := ar.assInst(forAss)
+			if err != nil {
+				return nil, err
 			}
-		} else if request.Method == http.MethodPost {
-			ass, err := assignments.GetInstance(forAss)
+			return &authResource{owner: ass.UserName}, nil
+		}
+		if forCourse != "" && forAss != "" {
+			return nil, errors.New("both course and assignment given") // let the list handler fail this with bad request...
+		}
+		if forAss != "" {
+			ass, err := ar.assDef(forAss)
 			if err != nil {
-				return true // next handler will handle
+				return nil, err
 			}
-			return ass.UserName == user.UserName
+			return &authResource{course: ass.Course}, nil
 		}
-		return false
-	})
+		return &authResource{course: forCourse}, nil
+	}, allow(relationAdmin), allow(relationCourseStaff, http.MethodGet), allow(relationOwner, http.MethodPost)))
+	router.HandleFunc("/sla", handleGetAppealsSla).Methods(http.MethodGet)
+	m.addPathPolicy(fmt.Sprintf("%s/sla", basePath), newPolicy("appeals sla", func (ar *authRequest) (*authResource, error) {
+		return &authResource{course: ar.request.Header.Get(submithttp.ForSubmitCourse)}, nil
+	}, allow(relationAdmin), allowWithPermission(courses.HandleAppeals, http.MethodGet)))
 	specificPath := fmt.Sprintf("/{%s}/{%s}/{%s}/{%s}", courseNumber, courseYear, assDefName, userName)
 	router.HandleFunc(specificPath, handleGetAppeal).Methods(http.MethodGet)
 	router.HandleFunc(specificPath, handleUpdateAppealState).Methods(http.MethodPatch)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), func(user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		cNumber, cYear, err := getCourseNumberAndYearFromRequest(request)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		courseKey := fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear)
-		exists, err := db.KeyExistsInBucket([]byte(db.Courses), []byte(courseKey))
-		if err != nil || !exists {
-			return true // let the next handler send an appropriate error message
-		}
-		if user.CoursesAsStaff.Contains(courseKey) {
-			return true
-		}
-		assKey, err := getAssInstKey(request)
-		ass, err := assignments.GetInstance(assKey)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		return user.UserName == ass.UserName
-	})
+	router.HandleFunc(fmt.Sprintf("%s/assignee", specificPath), handleAssignAppeal).Methods(http.MethodPut)
+	router.HandleFunc(fmt.Sprintf("%s/resolution", specificPath), handleResolveAppeal).Methods(http.MethodPost)
+	router.HandleFunc(fmt.Sprintf("%s/escalation", specificPath), handleEscalateAppeal).Methods(http.MethodPost)
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), newPolicy("appeal", resolveAssInstFromPath,
+		allow(relationAdmin),
+		allow(relationCourseStaff, http.MethodGet),
+		allowWithPermission(courses.HandleAppeals),
+		allow(relationOwner),
+	))
+	// only staff members handling appeals can assign and resolve them
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/[^/]+/[^/]+/[^/]+/[^/]+/(assignee|resolution)$", basePath)), newPolicy("appeal handling", resolveAssInstFromPath,
+		allow(relationAdmin),
+		allowWithPermission(courses.HandleAppeals),
+	))
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/[^/]+/[^/]+/[^/]+/[^/]+/escalation$", basePath)), newPolicy("appeal escalation", resolveAssInstFromPath,
+		allow(relationAdmin),
+		allow(relationOwner),
+	))
 }
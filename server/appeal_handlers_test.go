@@ -2,15 +2,21 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/appeals"
 	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/messages"
 	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/mail"
 	"github.com/DAv10195/submit_server/session"
 	"github.com/gorilla/mux"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -268,3 +274,250 @@ func TestAppealHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestAppealResolution(t *testing.T) {
+	testUsers, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	year := time.Now().UTC().Year()
+	courseKey, assDefKey := fmt.Sprintf("1:%d", year), fmt.Sprintf("1:%d:ass", year)
+	assDef, err := assignments.GetDef(assDefKey)
+	if err != nil {
+		t.Fatalf("error getting assignment def for test: %v", err)
+	}
+	assDef.AppealWindowDays = 3
+	if err := db.Update(db.System, assDef); err != nil {
+		t.Fatalf("error updating assignment def for test: %v", err)
+	}
+	for _, user := range []string{"user2", "user3"} {
+		assInst, err := assignments.NewInstance(courseKey, assDef.DueBy, assDef.Name, user, db.System, false, false)
+		if err != nil {
+			t.Fatalf("error creating assignment instance for test: %v", err)
+		}
+		assInst.SetGrade(80)
+		// the grade of user3 was released before the appeal window
+		if user == "user3" {
+			assInst.GradedOn = assInst.GradedOn.AddDate(0, 0, -4)
+		}
+		if err := db.Update(db.System, assInst); err != nil {
+			t.Fatalf("error creating assignment instance for test: %v", err)
+		}
+	}
+	initAssInstsRouter(router.Router, router.am)
+	initAppealsRouter(router.Router, router.am)
+	// a student can't reopen the appeal window by updating the release time of the grade
+	assUser3, err := assignments.GetInstance(assDefKey + ":user3")
+	if err != nil {
+		t.Fatalf("error getting assignment instance for test: %v", err)
+	}
+	assUser3.GradedOn = time.Now().UTC()
+	assUser3Bytes, err := json.Marshal(assUser3)
+	if err != nil {
+		t.Fatalf("error serializing assignment instance for test: %v", err)
+	}
+	if w := router.send(http.MethodPut, fmt.Sprintf("/%s/1/%d/ass/user3", db.AssignmentInstances, year), string(assUser3Bytes), "user3"); w.Code != http.StatusAccepted {
+		t.Fatalf("updating assignment instance produced status code %d instead of %d", w.Code, http.StatusAccepted)
+	}
+	appealPath := fmt.Sprintf("/%s/1/%d/ass/user2", db.Appeals, year)
+	testCases := []struct{
+		name	string
+		method	string
+		path	string
+		body	string
+		user	string
+		forAss	string
+		status	int
+	}{
+		{"test create appeal with invalid category", http.MethodPost, fmt.Sprintf("/%s/", db.Appeals), `{"category":"bribe"}`, "user2", assDefKey + ":user2", http.StatusBadRequest},
+		{"test create appeal after appeal window", http.MethodPost, fmt.Sprintf("/%s/", db.Appeals), `{"category":"grading_error"}`, "user3", assDefKey + ":user3", http.StatusBadRequest},
+		{"test create appeal", http.MethodPost, fmt.Sprintf("/%s/", db.Appeals), `{"category":"grading_error","requested_change":"test 3 should pass"}`, "user2", assDefKey + ":user2", http.StatusAccepted},
+		{"test assign appeal as student", http.MethodPut, appealPath + "/assignee", `{"assigned_to":"user1"}`, "user2", "", http.StatusForbidden},
+		{"test assign appeal to non staff member", http.MethodPut, appealPath + "/assignee", `{"assigned_to":"user3"}`, "user1", "", http.StatusBadRequest},
+		{"test assign appeal", http.MethodPut, appealPath + "/assignee", `{"assigned_to":"user1"}`, "user1", "", http.StatusOK},
+		{"test resolve appeal as student", http.MethodPost, appealPath + "/resolution", `{"outcome":"accepted","grade":100}`, "user2", "", http.StatusForbidden},
+		{"test accept appeal without changing grade", http.MethodPost, appealPath + "/resolution", `{"outcome":"accepted"}`, "user1", "", http.StatusBadRequest},
+		{"test reject appeal changing grade", http.MethodPost, appealPath + "/resolution", `{"outcome":"rejected","grade":90}`, "user1", "", http.StatusBadRequest},
+		{"test resolve appeal with invalid outcome", http.MethodPost, appealPath + "/resolution", `{"outcome":"maybe","grade":90}`, "user1", "", http.StatusBadRequest},
+		{"test partially accept appeal", http.MethodPost, appealPath + "/resolution", `{"outcome":"partially_accepted","grade":90,"comment":"test 3 passes"}`, "user1", "", http.StatusOK},
+		{"test resolve closed appeal", http.MethodPost, appealPath + "/resolution", `{"outcome":"rejected"}`, "user1", "", http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var headers []string
+			if tc.forAss != "" {
+				headers = append(headers, submithttp.ForSubmitAss, tc.forAss)
+			}
+			if w := router.send(tc.method, tc.path, tc.body, tc.user, headers...); w.Code != tc.status {
+				t.Fatalf("expected status code %d but got %d", tc.status, w.Code)
+			}
+		})
+	}
+	appeal, err := appeals.Get(assDefKey + ":user2")
+	if err != nil {
+		t.Fatalf("error getting appeal: %v", err)
+	}
+	if appeal.State != appeals.Closed || appeal.Category != appeals.CategoryGradingError || appeal.AssignedTo != "user1" || appeal.Resolution == nil ||
+		appeal.Resolution.Outcome != appeals.OutcomePartiallyAccepted || appeal.Resolution.PreviousGrade != 80 || appeal.Resolution.ResolvedBy != "user1" {
+		t.Fatalf("unexpected appeal after resolution: %+v", appeal)
+	}
+	assInst, err := assignments.GetInstance(assDefKey + ":user2")
+	if err != nil {
+		t.Fatalf("error getting assignment instance: %v", err)
+	}
+	if assInst.Grade != 90 {
+		t.Fatalf("expected the grade to be updated by the resolution but it's %d", assInst.Grade)
+	}
+	// the student is emailed about the resolution
+	mail.SetTransport(&fakeTransport{})
+	defer mail.SetTransport(nil)
+	user2 := testUsers["user2"]
+	user2.Email = "user2@localhost"
+	if err := db.Update(db.System, user2); err != nil {
+		t.Fatalf("error updating user for test: %v", err)
+	}
+	data, err := json.Marshal(appeal)
+	if err != nil {
+		t.Fatalf("error serializing appeal: %v", err)
+	}
+	openAppeal := *appeal
+	openAppeal.State, openAppeal.Resolution = appeals.Open, nil
+	previous, err := json.Marshal(&openAppeal)
+	if err != nil {
+		t.Fatalf("error serializing appeal: %v", err)
+	}
+	if err := processDbEventForEmails(&db.Event{Bucket: db.Appeals, Key: string(appeal.Key()), Action: db.Updated, Data: data, Previous: previous}); err != nil {
+		t.Fatalf("error processing appeal resolution event: %v", err)
+	}
+	queued := getQueuedEmails(t)
+	if len(queued) != 1 || !strings.Contains(queued[0].Body, "resolved as partially accepted. Your grade is 90.") || !strings.Contains(queued[0].Body, "test 3 passes") {
+		t.Fatalf("expected an appeal resolution email to be queued but got: %+v", queued)
+	}
+}
+
+func TestAppealTransitions(t *testing.T) {
+	testUsers, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	year := time.Now().UTC().Year()
+	courseKey, assDefKey := fmt.Sprintf("1:%d", year), fmt.Sprintf("1:%d:ass", year)
+	// user1 is a teaching assistant and user4 is the lecturer of the course
+	lecturer, err := users.NewUserBuilder(db.System, true).WithUserName("user4").WithPassword("user4").WithRoles(users.StandardUser).
+		WithCoursesAsStaff(courseKey).Build()
+	if err != nil {
+		t.Fatalf("error creating user for test: %v", err)
+	}
+	testUsers["user4"] = lecturer
+	course, err := courses.Get(courseKey)
+	if err != nil {
+		t.Fatalf("error getting course for test: %v", err)
+	}
+	course.StaffRoles = map[string]string{"user1": courses.TeachingAssistant}
+	if err := db.Update(db.System, course); err != nil {
+		t.Fatalf("error updating course for test: %v", err)
+	}
+	assInst, err := assignments.NewInstance(courseKey, time.Now().Add(time.Hour).UTC(), "ass", "user2", db.System, false, false)
+	if err != nil {
+		t.Fatalf("error creating assignment instance for test: %v", err)
+	}
+	assInst.SetGrade(70)
+	if err := db.Update(db.System, assInst); err != nil {
+		t.Fatalf("error creating assignment instance for test: %v", err)
+	}
+	initAppealsRouter(router.Router, router.am)
+	appealPath := fmt.Sprintf("/%s/1/%d/ass/user2", db.Appeals, year)
+	testCases := []struct{
+		name	string
+		method	string
+		path	string
+		body	string
+		user	string
+		headers	map[string]string
+		status	int
+	}{
+		{"test create appeal", http.MethodPost, fmt.Sprintf("/%s/", db.Appeals), "", "user2", map[string]string{submithttp.ForSubmitAss: assDefKey + ":user2"}, http.StatusAccepted},
+		{"test create duplicate appeal", http.MethodPost, fmt.Sprintf("/%s/", db.Appeals), "", "user2", map[string]string{submithttp.ForSubmitAss: assDefKey + ":user2"}, http.StatusBadRequest},
+		{"test escalate open appeal", http.MethodPost, appealPath + "/escalation", "", "user2", nil, http.StatusBadRequest},
+		{"test close appeal as student", http.MethodPatch, appealPath, "", "user2", map[string]string{submithttp.SubmitState: submithttp.AppealStateClosed}, http.StatusForbidden},
+		{"test close appeal as teaching assistant", http.MethodPatch, appealPath, "", "user1", map[string]string{submithttp.SubmitState: submithttp.AppealStateClosed}, http.StatusOK},
+		{"test reopen appeal as student", http.MethodPatch, appealPath, "", "user2", map[string]string{submithttp.SubmitState: submithttp.AppealStateOpen}, http.StatusOK},
+		{"test escalate appeal closed without rejection", http.MethodPost, appealPath + "/escalation", "", "user2", nil, http.StatusBadRequest},
+		{"test resolve appeal with invalid grade", http.MethodPost, appealPath + "/resolution", `{"outcome":"accepted","grade":101}`, "user1", nil, http.StatusBadRequest},
+		{"test resolve appeal with negative grade", http.MethodPost, appealPath + "/resolution", `{"outcome":"accepted","grade":-1}`, "user1", nil, http.StatusBadRequest},
+		{"test reject appeal as teaching assistant", http.MethodPost, appealPath + "/resolution", `{"outcome":"rejected"}`, "user1", nil, http.StatusOK},
+		{"test reopen appeal as student twice", http.MethodPatch, appealPath, "", "user2", map[string]string{submithttp.SubmitState: submithttp.AppealStateOpen}, http.StatusForbidden},
+		{"test reopen rejected appeal as teaching assistant", http.MethodPatch, appealPath, "", "user1", map[string]string{submithttp.SubmitState: submithttp.AppealStateOpen}, http.StatusOK},
+		{"test close reopened appeal", http.MethodPatch, appealPath, "", "user1", map[string]string{submithttp.SubmitState: submithttp.AppealStateClosed}, http.StatusOK},
+		{"test escalate appeal with discarded rejection", http.MethodPost, appealPath + "/escalation", "", "user2", nil, http.StatusBadRequest},
+		{"test reopen closed appeal as teaching assistant", http.MethodPatch, appealPath, "", "user1", map[string]string{submithttp.SubmitState: submithttp.AppealStateOpen}, http.StatusOK},
+		{"test reject reopened appeal", http.MethodPost, appealPath + "/resolution", `{"outcome":"rejected"}`, "user1", nil, http.StatusOK},
+		{"test escalate appeal as teaching assistant", http.MethodPost, appealPath + "/escalation", "", "user1", nil, http.StatusForbidden},
+		{"test escalate rejected appeal", http.MethodPost, appealPath + "/escalation", `{"comment":"test 3 is wrong"}`, "user2", nil, http.StatusOK},
+		{"test reassign escalated appeal as teaching assistant", http.MethodPut, appealPath + "/assignee", `{"assigned_to":"user1"}`, "user1", nil, http.StatusForbidden},
+		{"test unassign escalated appeal", http.MethodPut, appealPath + "/assignee", `{"assigned_to":""}`, users.Admin, nil, http.StatusBadRequest},
+		{"test sla as student", http.MethodGet, fmt.Sprintf("/%s/sla", db.Appeals), "", "user2", map[string]string{submithttp.ForSubmitCourse: courseKey}, http.StatusForbidden},
+		{"test sla", http.MethodGet, fmt.Sprintf("/%s/sla", db.Appeals), "", "user4", map[string]string{submithttp.ForSubmitCourse: courseKey}, http.StatusOK},
+		{"test resolve escalated appeal as teaching assistant", http.MethodPost, appealPath + "/resolution", `{"outcome":"accepted","grade":80}`, "user1", nil, http.StatusForbidden},
+		{"test resolve escalated appeal as lecturer", http.MethodPost, appealPath + "/resolution", `{"outcome":"accepted","grade":80}`, "user4", nil, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var headers []string
+			for header, value := range tc.headers {
+				headers = append(headers, header, value)
+			}
+			w := router.send(tc.method, tc.path, tc.body, tc.user, headers...)
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d but got %d", tc.status, w.Code)
+			}
+			if tc.name == "test sla" {
+				sla := &AppealsSla{}
+				if err := json.NewDecoder(w.Body).Decode(sla); err != nil {
+					t.Fatalf("error parsing sla: %v", err)
+				}
+				if sla.Waiting != 1 || sla.Escalated != 1 || len(sla.WaitingAppeals) != 1 || sla.WaitingAppeals[0].AssignedTo != "user4" {
+					t.Fatalf("unexpected sla: %+v", sla)
+				}
+			}
+		})
+	}
+	appeal, err := appeals.Get(assDefKey + ":user2")
+	if err != nil {
+		t.Fatalf("error getting appeal: %v", err)
+	}
+	var actions []string
+	for _, transition := range appeal.History {
+		actions = append(actions, transition.Action)
+	}
+	expected := []string{appeals.ActionCreate, appeals.ActionClose, appeals.ActionReopen, appeals.ActionResolve, appeals.ActionReopen,
+		appeals.ActionClose, appeals.ActionReopen, appeals.ActionResolve, appeals.ActionEscalate, appeals.ActionResolve}
+	if fmt.Sprint(actions) != fmt.Sprint(expected) {
+		t.Fatalf("expected appeal history %v but got %v", expected, actions)
+	}
+	if appeal.State != appeals.Closed || appeal.EscalatedTo != "user4" || appeal.Resolution.ResolvedBy != "user4" || appeal.Resolution.ResolvedByRole != appeals.ActorLecturer {
+		t.Fatalf("unexpected appeal after escalation: %+v", appeal)
+	}
+	// the appeal waits since the last response of the staff, which messages of its owner don't count as
+	if w := router.send(http.MethodPatch, appealPath, "", users.Admin, submithttp.SubmitState, submithttp.AppealStateOpen); w.Code != http.StatusOK {
+		t.Fatalf("reopening appeal as admin produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	response, _, err := messages.NewMessage("user4", "looking into it", appeal.MessageBox, true)
+	if err != nil {
+		t.Fatalf("error creating message for test: %v", err)
+	}
+	if _, _, err := messages.NewMessage("user2", "thanks", appeal.MessageBox, true); err != nil {
+		t.Fatalf("error creating message for test: %v", err)
+	}
+	sla := &AppealsSla{}
+	router.decode(router.send(http.MethodGet, fmt.Sprintf("/%s/sla", db.Appeals), "", "user4", submithttp.ForSubmitCourse, courseKey), http.StatusOK, sla)
+	if len(sla.WaitingAppeals) != 1 || !sla.WaitingAppeals[0].WaitingSince.Equal(response.CreatedOn) {
+		t.Fatalf("expected the appeal to wait since %v but got %+v", response.CreatedOn, sla.WaitingAppeals)
+	}
+	// reassigning an escalated appeal escalates it to the new assignee
+	if w := router.send(http.MethodPut, appealPath + "/assignee", `{"assigned_to":"user1"}`, users.Admin); w.Code != http.StatusOK {
+		t.Fatalf("reassigning escalated appeal as admin produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	if appeal, err = appeals.Get(assDefKey + ":user2"); err != nil {
+		t.Fatalf("error getting appeal: %v", err)
+	}
+	if appeal.AssignedTo != "user1" || appeal.EscalatedTo != "user1" {
+		t.Fatalf("unexpected appeal after reassignment: %+v", appeal)
+	}
+}
@@ -1,17 +1,16 @@
 package server
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/DAv10195/submit_server/fs"
 	"github.com/gorilla/mux"
-	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -26,74 +25,19 @@ func getAssDefKey(r *http.Request) (string, error) {
 	return strings.Join([]string{strconv.Itoa(number), strconv.Itoa(year), mux.Vars(r)[assDefName]}, db.KeySeparator), nil
 }
 
-func handleGetAssigmentDefsForCourse(forCourse string, w http.ResponseWriter, r *http.Request, params *submithttp.PagingParams) {
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.AssignmentDefinitions), func(_, elementBytes []byte) error {
-		ass := &assignments.AssignmentDef{}
-		if err := json.Unmarshal(elementBytes, ass); err != nil {
-			return err
-		}
-		if ass.Course == forCourse {
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, ass)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+func handleGetAssigmentDefsForCourse(forCourse string, w http.ResponseWriter, r *http.Request) {
+	writeQueriedElements(w, r, db.AssignmentDefinitions, func() db.IBucketElement { return &assignments.AssignmentDef{} }, func(elem db.IBucketElement) bool {
+		return elem.(*assignments.AssignmentDef).Course == forCourse
+	})
 }
 
 func handleGetAssignmentDefs(w http.ResponseWriter, r *http.Request) {
-	params, err := submithttp.PagingParamsFromRequest(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
-		return
-	}
 	forCourse := r.Header.Get(submithttp.ForSubmitCourse)
 	if forCourse != "" {
-		handleGetAssigmentDefsForCourse(forCourse, w, r, params)
+		handleGetAssigmentDefsForCourse(forCourse, w, r)
 		return
 	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.AssignmentDefinitions), func(_, elementBytes []byte) error {
-		elementsIndex++
-		if elementsIndex <= params.AfterId {
-			return nil
-		}
-		ass := &assignments.AssignmentDef{}
-		if err := json.Unmarshal(elementBytes, ass); err != nil {
-			return err
-		}
-		elements = append(elements, ass)
-		elementsCount++
-		if elementsCount == params.Limit {
-			return &db.ErrStopQuery{}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.AssignmentDefinitions, func() db.IBucketElement { return &assignments.AssignmentDef{} }, nil)
 }
 
 func handleGetAssignmentDef(w http.ResponseWriter, r *http.Request) {
@@ -120,7 +64,38 @@ func handleCreateAssignmentDef(w http.ResponseWriter, r *http.Request) {
 		writeErrResp(w, r, http.StatusBadRequest, err)
 		return
 	}
-	if _, err := assignments.NewDef(ass.Course, ass.DueBy, ass.Name, r.Context().Value(authenticatedUser).(*users.User).UserName, true, fs.GetClient() != nil); err != nil {
+	asUser := r.Context().Value(authenticatedUser).(*users.User).UserName
+	// the folder of the ass def is created on the file server only once the whole request is valid
+	assDef, err := assignments.NewDef(ass.Course, ass.DueBy, ass.Name, asUser, false, false)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := assDef.SetSchedule(ass.PublishAt, ass.AutoGradeAt); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if ass.AppealWindowDays < 0 {
+		writeStrErrResp(w, r, http.StatusBadRequest, "appeal window can't be negative")
+		return
+	}
+	assDef.AppealWindowDays = ass.AppealWindowDays
+	assDef.ZeroGradeMissing = ass.ZeroGradeMissing
+	if fs.GetClient() != nil {
+		if err := assDef.CreateFsFolder(); err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := db.Update(asUser, assDef); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := scheduleAssignmentPublication(assDef, asUser); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := scheduleAssignmentAutoGrade(assDef, asUser); err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
@@ -152,6 +127,29 @@ func handleUpdateAssignmentDef(w http.ResponseWriter, r *http.Request) {
 	updatedAss.Name = preUpdateAss.Name
 	updatedAss.CreatedOn = preUpdateAss.CreatedOn
 	updatedAss.CreatedBy = preUpdateAss.CreatedBy
+	publishAt, autoGradeAt := updatedAss.PublishAt, updatedAss.AutoGradeAt
+	// times which aren't given keep their current value unless they're explicitly cleared
+	clearedTimes := make(map[string]bool)
+	for _, field := range strings.Split(r.Header.Get(clearScheduleHeader), ",") {
+		clearedTimes[strings.TrimSpace(field)] = true
+	}
+	if publishAt.IsZero() && !clearedTimes[publishAtField] {
+		publishAt = preUpdateAss.PublishAt
+	}
+	if autoGradeAt.IsZero() && !clearedTimes[autoGradeAtField] {
+		autoGradeAt = preUpdateAss.AutoGradeAt
+	}
+	updatedAss.PublishAt = preUpdateAss.PublishAt
+	updatedAss.AutoGradeAt = preUpdateAss.AutoGradeAt
+	updatedAss.Status = preUpdateAss.Status
+	if err := updatedAss.SetSchedule(publishAt, autoGradeAt); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if updatedAss.AppealWindowDays < 0 {
+		writeStrErrResp(w, r, http.StatusBadRequest, "appeal window can't be negative")
+		return
+	}
 	var elementsToUpdate []db.IBucketElement
 	if updatedAss.DueBy != preUpdateAss.DueBy {
 		if err := db.QueryBucket([]byte(db.AssignmentInstances), func(_ []byte, assInstBytes []byte) error {
@@ -176,6 +174,25 @@ func handleUpdateAssignmentDef(w http.ResponseWriter, r *http.Request) {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	asUser := r.Context().Value(authenticatedUser).(*users.User).UserName
+	if updatedAss.State == assignments.Published && updatedAss.DueBy != preUpdateAss.DueBy {
+		if err := scheduleAssignmentDueDateJobs(updatedAss, asUser); err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if updatedAss.PublishAt != preUpdateAss.PublishAt {
+		if err := scheduleAssignmentPublication(updatedAss, asUser); err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if updatedAss.AutoGradeAt != preUpdateAss.AutoGradeAt {
+		if err := scheduleAssignmentAutoGrade(updatedAss, asUser); err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
 	writeResponse(w, r, http.StatusAccepted, &Response{Message: fmt.Sprintf("assignment def '%s' updated successfully", updatedAss.Name)})
 }
 
@@ -198,28 +215,16 @@ func handleDeleteAssignmentDef(w http.ResponseWriter, r *http.Request) {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	if err := deleteAssignmentJobs(assKey); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
 	writeResponse(w, r, http.StatusOK, &Response{Message: fmt.Sprintf("assignment def '%s' deleted successfully", ass.Name)})
 }
 
-func handlePublishAssignmentDef(w http.ResponseWriter, r *http.Request) {
-	assKey, err := getAssDefKey(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, errors.New("invalid course number and/or year integer path params"))
-		return
-	}
-	assDef, err := assignments.GetDef(assKey)
-	if err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
-			writeErrResp(w, r, http.StatusNotFound, err)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-		}
-		return
-	}
-	if assDef.State == assignments.Published {
-		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("assignment def '%s' already published", assDef.Name))
-		return
-	}
+// create instances of the given assignment def for all students of its course, mark it as published and schedule the
+// jobs acting on its due date
+func publishAssignmentDef(assDef *assignments.AssignmentDef, asUser string) error {
 	var courseUserNames []string
 	if err := db.QueryBucket([]byte(db.Users), func(_ []byte, userBytes []byte) error {
 		user := &users.User{}
@@ -231,22 +236,45 @@ func handlePublishAssignmentDef(w http.ResponseWriter, r *http.Request) {
 		}
 		return nil
 	}); err != nil {
-		writeErrResp(w, r, http.StatusInternalServerError, err)
-		return
+		return err
 	}
 	var elements []db.IBucketElement
-	asUser := r.Context().Value(authenticatedUser).(*users.User).UserName
 	for _, userName := range courseUserNames {
 		ass, err := assignments.NewInstance(assDef.Course, assDef.DueBy, assDef.Name, userName, asUser, false, fs.GetClient() != nil)
 		if err != nil {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
+			return err
 		}
 		elements = append(elements, ass)
 	}
 	assDef.State = assignments.Published
 	elements = append(elements, assDef)
 	if err := db.Update(asUser, elements...); err != nil {
+		return err
+	}
+	return scheduleAssignmentDueDateJobs(assDef, asUser)
+}
+
+func handlePublishAssignmentDef(w http.ResponseWriter, r *http.Request) {
+	assKey, err := getAssDefKey(r)
+	if err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, errors.New("invalid course number and/or year integer path params"))
+		return
+	}
+	assDef, err := assignments.GetDef(assKey)
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			writeErrResp(w, r, http.StatusNotFound, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if assDef.State == assignments.Published {
+		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("assignment def '%s' already published", assDef.Name))
+		return
+	}
+	asUser := r.Context().Value(authenticatedUser).(*users.User).UserName
+	if err := publishAssignmentDef(assDef, asUser); err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
@@ -258,48 +286,28 @@ func initAssDefsRouter(r *mux.Router, manager *authManager) {
 	router := r.PathPrefix(basePath).Subrouter()
 	router.HandleFunc("/", handleGetAssignmentDefs).Methods(http.MethodGet)
 	router.HandleFunc("/", handleCreateAssignmentDef).Methods(http.MethodPost)
-	manager.addPathToMap(fmt.Sprintf("%s/", basePath), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		if request.Method == http.MethodGet {
-			forCourse := request.Header.Get(submithttp.ForSubmitCourse)
-			if forCourse != "" {
-				return user.CoursesAsStaff.Contains(forCourse)
-			}
-		} else if request.Method == http.MethodPost {
-			buf, err := ioutil.ReadAll(request.Body)
-			if err != nil {
-				return true // let the creation handler fail this with bad request...
-			}
-			bodyCopy1, bodyCopy2 := ioutil.NopCloser(bytes.NewBuffer(buf)), ioutil.NopCloser(bytes.NewBuffer(buf))
-			request.Body = bodyCopy1
+	manager.addPathPolicy(fmt.Sprintf("%s/", basePath), newPolicy(db.AssignmentDefinitions, func (ar *authRequest) (*authResource, error) {
+		if ar.request.Method == http.MethodPost {
 			ass := &assignments.AssignmentDef{}
-			if err := json.NewDecoder(bodyCopy2).Decode(ass); err != nil {
-				return true // let the creation handler fail this with bad request...
+			if err := ar.decodeBody(ass); err != nil {
+				return nil, err
 			}
-			return user.CoursesAsStaff.Contains(ass.Course)
+			return &authResource{course: ass.Course}, nil
 		}
-		return false
-	})
+		return &authResource{course: ar.request.Header.Get(submithttp.ForSubmitCourse)}, nil
+	},
+		allow(relationAdmin),
+		allow(relationCourseStaff, http.MethodGet),
+		allowWithPermission(courses.PublishAssignment, http.MethodPost),
+	))
 	specificPath := fmt.Sprintf("/{%s}/{%s}/{%s}", courseNumber, courseYear, assDefName)
 	router.HandleFunc(specificPath, handleGetAssignmentDef).Methods(http.MethodGet)
 	router.HandleFunc(specificPath, handleDeleteAssignmentDef).Methods(http.MethodDelete)
 	router.HandleFunc(specificPath, handleUpdateAssignmentDef).Methods(http.MethodPut)
 	router.HandleFunc(specificPath, handlePublishAssignmentDef).Methods(http.MethodPatch)
-	manager.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		cNumber, cYear, err := getCourseNumberAndYearFromRequest(request)
-		if err != nil {
-			return true // let handlers manage the error
-		}
-		courseKey := fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear)
-		exists, err := db.KeyExistsInBucket([]byte(db.Courses), []byte(courseKey))
-		if err != nil || !exists {
-			return true // let the next handler send an appropriate error message
-		}
-		return user.CoursesAsStaff.Contains(courseKey)
-	})
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), newPolicy("assignment def", resolveExistingCourseFromPath,
+		allow(relationAdmin),
+		allow(relationCourseStaff, http.MethodGet),
+		allowWithPermission(courses.PublishAssignment, http.MethodPut, http.MethodPatch, http.MethodDelete),
+	))
 }
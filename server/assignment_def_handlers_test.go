@@ -264,3 +264,41 @@ func TestAssDefsHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdateAssignmentDefSchedule(t *testing.T) {
+	_, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	initAssDefsRouter(router.Router, router.am)
+	year := time.Now().UTC().Year()
+	assDefKey := fmt.Sprintf("1%s%d%sass", db.KeySeparator, year, db.KeySeparator)
+	path := fmt.Sprintf("/%s/1/%d/ass", db.AssignmentDefinitions, year)
+	assDef, err := assignments.GetDef(assDefKey)
+	if err != nil {
+		t.Fatalf("error getting assignment def for test: %v", err)
+	}
+	publishAt, autoGradeAt := assDef.DueBy.Add(-time.Minute / 2), assDef.DueBy.Add(time.Hour)
+	put := func(body string, headers ...string) *assignments.AssignmentDef {
+		if w := router.send(http.MethodPut, path, body, "user1", headers...); w.Code != http.StatusAccepted {
+			t.Fatalf("updating assignment def produced status code %d instead of %d", w.Code, http.StatusAccepted)
+		}
+		assDef, err := assignments.GetDef(assDefKey)
+		if err != nil {
+			t.Fatalf("error getting assignment def for test: %v", err)
+		}
+		return assDef
+	}
+	dueBy := assDef.DueBy.Format(time.RFC3339Nano)
+	assDef = put(fmt.Sprintf("{\"due_by\":\"%s\",\"publish_at\":\"%s\",\"auto_grade_at\":\"%s\"}", dueBy, publishAt.Format(time.RFC3339Nano), autoGradeAt.Format(time.RFC3339Nano)))
+	if !assDef.PublishAt.Equal(publishAt) || assDef.Status.State != assignments.AutoGradeScheduled {
+		t.Fatal("expected assignment def to be scheduled")
+	}
+	// an update which doesn't mention the schedule keeps it
+	if assDef = put(fmt.Sprintf("{\"due_by\":\"%s\",\"appeal_window_days\":3}", dueBy)); !assDef.PublishAt.Equal(publishAt) || !assDef.AutoGradeAt.Equal(autoGradeAt) ||
+		assDef.Status.State != assignments.AutoGradeScheduled {
+		t.Fatal("expected update without schedule times to keep the schedule")
+	}
+	if assDef = put(fmt.Sprintf("{\"due_by\":\"%s\"}", dueBy), clearScheduleHeader, autoGradeAtField); !assDef.PublishAt.Equal(publishAt) ||
+		!assDef.AutoGradeAt.IsZero() || assDef.Status.State != assignments.AutoGradeNone {
+		t.Fatal("expected only the automatic grading to be cleared")
+	}
+}
@@ -2,10 +2,12 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
 	"github.com/DAv10195/submit_server/elements/tests"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/gorilla/mux"
@@ -22,74 +24,19 @@ func getAssInstKey(r *http.Request) (string, error) {
 	return fmt.Sprintf("%s%s%s", assDefKey, db.KeySeparator, mux.Vars(r)[userName]), nil
 }
 
-func handleGetAssignmentInstsForUser(forUser string, w http.ResponseWriter, r *http.Request, params *submithttp.PagingParams) {
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.AssignmentInstances), func(_ []byte, assInstBytes []byte) error {
-		ass := &assignments.AssignmentInstance{}
-		if err := json.Unmarshal(assInstBytes, ass); err != nil {
-			return err
-		}
-		if ass.UserName == forUser {
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, ass)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+func handleGetAssignmentInstsForUser(forUser string, w http.ResponseWriter, r *http.Request) {
+	writeQueriedElements(w, r, db.AssignmentInstances, func() db.IBucketElement { return &assignments.AssignmentInstance{} }, func(elem db.IBucketElement) bool {
+		return elem.(*assignments.AssignmentInstance).UserName == forUser
+	})
 }
 
-func handleGetAssignmentInstsForAss(forAss string, w http.ResponseWriter, r *http.Request, params *submithttp.PagingParams) {
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.AssignmentInstances), func(_ []byte, assInstBytes []byte) error {
-		ass := &assignments.AssignmentInstance{}
-		if err := json.Unmarshal(assInstBytes, ass); err != nil {
-			return err
-		}
-		if ass.AssignmentDef == forAss {
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, ass)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+func handleGetAssignmentInstsForAss(forAss string, w http.ResponseWriter, r *http.Request) {
+	writeQueriedElements(w, r, db.AssignmentInstances, func() db.IBucketElement { return &assignments.AssignmentInstance{} }, func(elem db.IBucketElement) bool {
+		return elem.(*assignments.AssignmentInstance).AssignmentDef == forAss
+	})
 }
 
 func handleGetAssignmentInsts(w http.ResponseWriter, r *http.Request) {
-	params, err := submithttp.PagingParamsFromRequest(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
-		return
-	}
 	forUser := r.Header.Get(submithttp.ForSubmitUser)
 	forAss := r.Header.Get(submithttp.ForSubmitAss)
 	if forUser != "" && forAss != "" {
@@ -97,39 +44,14 @@ func handleGetAssignmentInsts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if forUser != "" {
-		handleGetAssignmentInstsForUser(forUser, w, r, params)
+		handleGetAssignmentInstsForUser(forUser, w, r)
 		return
 	}
 	if forAss != "" {
-		handleGetAssignmentInstsForAss(forAss, w, r, params)
+		handleGetAssignmentInstsForAss(forAss, w, r)
 		return
 	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.AssignmentInstances), func (_ []byte, assInstBytes []byte) error {
-		elementsIndex++
-		if elementsIndex <= params.AfterId {
-			return nil
-		}
-		ass := &assignments.AssignmentInstance{}
-		if err := json.Unmarshal(assInstBytes, ass); err != nil {
-			return err
-		}
-		elements = append(elements, ass)
-		elementsCount++
-		if elementsCount == params.Limit {
-			return &db.ErrStopQuery{}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.AssignmentInstances, func() db.IBucketElement { return &assignments.AssignmentInstance{} }, nil)
 }
 
 func handleGetAssignmentInst(w http.ResponseWriter, r *http.Request) {
@@ -165,6 +87,10 @@ func handleUpdateAssignmentInst(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if preUpdateAss.Archived {
+		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("assignment instance '%s' is archived", string(preUpdateAss.Key())))
+		return
+	}
 	updatedAss := &assignments.AssignmentInstance{}
 	if err := json.NewDecoder(r.Body).Decode(updatedAss); err != nil {
 		writeErrResp(w, r, http.StatusBadRequest, err)
@@ -173,6 +99,9 @@ func handleUpdateAssignmentInst(w http.ResponseWriter, r *http.Request) {
 	updatedAss.UserName = preUpdateAss.UserName
 	updatedAss.AssignmentDef = preUpdateAss.AssignmentDef
 	updatedAss.State = preUpdateAss.State
+	updatedAss.ReminderSent = preUpdateAss.ReminderSent
+	updatedAss.Archived = preUpdateAss.Archived
+	updatedAss.GradedOn = preUpdateAss.GradedOn
 	updatedAss.CreatedOn = preUpdateAss.CreatedOn
 	updatedAss.CreatedBy = preUpdateAss.CreatedBy
 	cNumber, cYear, err := getCourseNumberAndYearFromRequest(r)
@@ -182,11 +111,11 @@ func handleUpdateAssignmentInst(w http.ResponseWriter, r *http.Request) {
 	}
 	courseKey := fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear)
 	requestUser := r.Context().Value(authenticatedUser).(*users.User)
-	if !requestUser.CoursesAsStaff.Contains(courseKey) && !requestUser.Roles.Contains(users.Admin) {
-		if updatedAss.MarkedAsCopy != preUpdateAss.MarkedAsCopy {
-			writeStrErrResp(w, r, http.StatusBadRequest, "updating assignment instance copy flag is forbidden")
-			return
-		}
+	if updatedAss.MarkedAsCopy != preUpdateAss.MarkedAsCopy && !hasCoursePermission(requestUser, courseKey, courses.ViewCopies) {
+		writeStrErrResp(w, r, http.StatusBadRequest, "updating assignment instance copy flag is forbidden")
+		return
+	}
+	if !hasCoursePermission(requestUser, courseKey, courses.Grade) {
 		if updatedAss.Grade != preUpdateAss.Grade {
 			writeStrErrResp(w, r, http.StatusBadRequest, "updating assignment instance grade is forbidden")
 			return
@@ -218,6 +147,10 @@ func handleSubmitAssignmentInst(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if assInst.Archived {
+		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("assignment instance '%s' is archived", string(assInst.Key())))
+		return
+	}
 	if assInst.State == assignments.Submitted {
 		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("assignment instance '%s' already submitted", string(assInst.Key())))
 		return
@@ -281,55 +214,40 @@ func handleSubmitAssignmentInst(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, r, http.StatusOK, &Response{Message: fmt.Sprintf("assignment instance '%s' submitted successfully", string(assInst.Key()))})
 }
 
+// archived instances, of students who dropped the course, can't be changed anymore
+var isNotArchived = &condition{"the assignment instance isn't archived", func(_ *authRequest, res *authResource) bool {
+	return !res.elem.(*assignments.AssignmentInstance).Archived
+}}
+
 func initAssInstsRouter(r *mux.Router, manager *authManager) {
 	basePath := fmt.Sprintf("/%s", db.AssignmentInstances)
 	router := r.PathPrefix(basePath).Subrouter()
 	router.HandleFunc("/", handleGetAssignmentInsts).Methods(http.MethodGet)
-	manager.addPathToMap(fmt.Sprintf("%s/", basePath), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		forUser := request.Header.Get(submithttp.ForSubmitUser)
-		forAss := request.Header.Get(submithttp.ForSubmitAss)
+	manager.addPathPolicy(fmt.Sprintf("%s/", basePath), newPolicy(db.AssignmentInstances, func (ar *authRequest) (*authResource, error) {
+		forUser := ar.request.Header.Get(submithttp.ForSubmitUser)
+		forAss := ar.request.Header.Get(submithttp.ForSubmitAss)
 		if forUser != "" && forAss != "" {
-			return true // let the list handler fail this with bad request...
-		}
-		if forUser != "" {
-			return forUser == user.UserName
+			return nil, errors.New("both user and assignment given") // let the list handler fail this with bad request...
 		}
 		if forAss != "" {
-			ass, err := assignments.GetDef(forAss)
+			ass, err := ar.assDef(forAss)
 			if err != nil {
-				return true // let the list handler fail this with bad request...
+				return nil, err
 			}
-			return user.CoursesAsStaff.Contains(ass.Course)
+			return &authResource{course: ass.Course}, nil
 		}
-		return false
-	})
+		return &authResource{owner: forUser}, nil
+	}, allow(relationAdmin), allow(relationOwner), allow(relationCourseStaff)))
 	specificPath := fmt.Sprintf("/{%s}/{%s}/{%s}/{%s}", courseNumber, courseYear, assDefName, userName)
 	router.HandleFunc(specificPath, handleGetAssignmentInst).Methods(http.MethodGet)
 	router.HandleFunc(specificPath, handleUpdateAssignmentInst).Methods(http.MethodPut)
 	router.HandleFunc(specificPath, handleSubmitAssignmentInst).Methods(http.MethodPatch)
-	manager.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		cNumber, cYear, err := getCourseNumberAndYearFromRequest(request)
-		if err != nil {
-			return true // let handlers manage the error
-		}
-		courseKey := fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear)
-		if user.CoursesAsStaff.Contains(courseKey) {
-			return request.Method == http.MethodGet || request.Method == http.MethodPut
-		}
-		assKey, err := getAssInstKey(request)
-		if err != nil {
-			return true // next handler will handle
-		}
-		ass, err := assignments.GetInstance(assKey)
-		if err != nil {
-			return true // next handler will handle
-		}
-		return ass.UserName == user.UserName
-	})
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), newPolicy("assignment instance", resolveAssInstFromPath,
+		allow(relationAdmin),
+		allow(relationCourseStaff, http.MethodGet),
+		allowWithPermission(courses.Grade, http.MethodPut),
+		allowWithPermission(courses.ViewCopies, http.MethodPut),
+		allow(relationOwner, http.MethodGet),
+		allow(relationOwner).when(isNotArchived),
+	))
 }
@@ -267,3 +267,47 @@ func TestAssInstHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestArchivedAssInstWrites(t *testing.T) {
+	_, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	initAssInstsRouter(router.Router, router.am)
+	initFilesRouter(router.Router, router.am)
+	year := time.Now().UTC().Year()
+	assInst, err := assignments.NewInstance(fmt.Sprintf("1%s%d", db.KeySeparator, year), time.Now().UTC().Add(time.Hour), "ass", "user2", db.System, false, false)
+	if err != nil {
+		t.Fatalf("error creating assignment instance for test: %v", err)
+	}
+	assInst.Archived = true
+	if err := db.Update(db.System, assInst); err != nil {
+		t.Fatalf("error archiving assignment instance for test: %v", err)
+	}
+	assInstPath := fmt.Sprintf("/%s/1/%d/ass/user2", db.AssignmentInstances, year)
+	filesPath := fmt.Sprintf("/files%s", assInstPath)
+	testCases := []struct{
+		name	string
+		method	string
+		path	string
+		user	string
+		status	int
+	}{
+		{"owner gets archived instance", http.MethodGet, assInstPath, "user2", http.StatusOK},
+		{"owner submits archived instance", http.MethodPatch, assInstPath, "user2", http.StatusForbidden},
+		{"owner updates archived instance", http.MethodPut, assInstPath, "user2", http.StatusForbidden},
+		{"owner uploads file to archived instance", http.MethodPost, filesPath, "user2", http.StatusForbidden},
+		{"owner deletes file of archived instance", http.MethodDelete, filesPath, "user2", http.StatusForbidden},
+		{"admin submits archived instance", http.MethodPatch, assInstPath, users.Admin, http.StatusBadRequest},
+		{"admin updates archived instance", http.MethodPut, assInstPath, users.Admin, http.StatusBadRequest},
+		{"staff grades archived instance", http.MethodPut, assInstPath, "user1", http.StatusBadRequest},
+		{"admin uploads file to archived instance", http.MethodPost, filesPath, users.Admin, http.StatusBadRequest},
+		{"admin deletes file of archived instance", http.MethodDelete, filesPath, users.Admin, http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		if w := router.send(testCase.method, testCase.path, "{\"grade\":100}", testCase.user); w.Code != testCase.status {
+			t.Fatalf("%s produced status code %d instead of %d", testCase.name, w.Code, testCase.status)
+		}
+	}
+	if assInst, err = assignments.GetInstance(string(assInst.Key())); err != nil || assInst.State != assignments.Assigned || assInst.Grade != 0 {
+		t.Fatal("expected archived assignment instance to be left unchanged")
+	}
+}
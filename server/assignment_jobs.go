@@ -0,0 +1,371 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/agents"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/jobs"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/tests"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/mail"
+	"time"
+)
+
+// schedule a reminder before the due date of the given assignment def and closing it at the due date
+func scheduleAssignmentDueDateJobs(assDef *assignments.AssignmentDef, asUser string) error {
+	assDefKey := string(assDef.Key())
+	if _, err := jobs.New(jobTypeDueDateReminder, assDefKey, assDef.DueBy.Add(-dueDateReminderPeriod), asUser, true); err != nil {
+		return err
+	}
+	_, err := jobs.New(jobTypeAssignmentDeadline, assDefKey, assDef.DueBy, asUser, true)
+	return err
+}
+
+// schedule the publication of the given assignment def at its publish at time, or cancel it if there is none
+func scheduleAssignmentPublication(assDef *assignments.AssignmentDef, asUser string) error {
+	if assDef.State != assignments.Draft {
+		return nil
+	}
+	if assDef.PublishAt.IsZero() {
+		return db.DeleteKeysFromBucket([]byte(db.Jobs), (&jobs.Job{Type: jobTypePublishAssignment, Target: string(assDef.Key())}).Key())
+	}
+	_, err := jobs.New(jobTypePublishAssignment, string(assDef.Key()), assDef.PublishAt, asUser, true)
+	return err
+}
+
+// schedule the automatic grading of the given assignment def at its auto grade at time, or cancel it if there is none
+func scheduleAssignmentAutoGrade(assDef *assignments.AssignmentDef, asUser string) error {
+	switch assDef.Status.State {
+		case assignments.AutoGradeNone:
+			return db.DeleteKeysFromBucket([]byte(db.Jobs), (&jobs.Job{Type: jobTypeAutoGrade, Target: string(assDef.Key())}).Key())
+		case assignments.AutoGradeScheduled:
+			_, err := jobs.New(jobTypeAutoGrade, string(assDef.Key()), assDef.AutoGradeAt, asUser, true)
+			return err
+	}
+	return nil
+}
+
+// delete all jobs scheduled for the assignment def with the given key
+func deleteAssignmentJobs(assDefKey string) error {
+	var jobKeys [][]byte
+	for _, jobType := range []string{jobTypePublishAssignment, jobTypeDueDateReminder, jobTypeAssignmentDeadline, jobTypeAutoGrade} {
+		jobKeys = append(jobKeys, (&jobs.Job{Type: jobType, Target: assDefKey}).Key())
+	}
+	return db.DeleteKeysFromBucket([]byte(db.Jobs), jobKeys...)
+}
+
+// get the values of the given list label of the given job
+func jobLabelSet(job *jobs.Job, label string) *containers.StringSet {
+	set := containers.NewStringSet()
+	values, _ := job.Labels[label].([]interface{})
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			set.Add(str)
+		}
+	}
+	return set
+}
+
+// add the given values to the given list labels of the given job and save the job together with the given elements
+func updateWithJobLabels(job *jobs.Job, labelValues map[string][]string, elements ...db.IBucketElement) error {
+	prevLabels := make(map[string]interface{})
+	for label, values := range labelValues {
+		prevLabels[label] = job.Labels[label]
+		list, _ := job.Labels[label].([]interface{})
+		for _, value := range values {
+			list = append(list, value)
+		}
+		job.Labels[label] = list
+	}
+	if err := db.Update(db.System, append(elements, job)...); err != nil {
+		for label, prev := range prevLabels {
+			job.Labels[label] = prev
+		}
+		return err
+	}
+	return nil
+}
+
+// get the assignment def the given job is scheduled for. Returns nil if the def doesn't exist anymore
+func getAssignmentDefOfJob(job *jobs.Job) (*assignments.AssignmentDef, error) {
+	assDef, err := assignments.GetDef(job.Target)
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			logger.Warnf("scheduler: assignment def '%s' of job '%s' doesn't exist anymore", job.Target, string(job.Key()))
+			return nil, nil
+		}
+		return nil, err
+	}
+	return assDef, nil
+}
+
+// get the instances of the assignment def with the given key
+func getInstancesOfAssignmentDef(assDefKey string) ([]*assignments.AssignmentInstance, error) {
+	var assInsts []*assignments.AssignmentInstance
+	if err := db.QueryBucket([]byte(db.AssignmentInstances), func(_, elemBytes []byte) error {
+		assInst := &assignments.AssignmentInstance{}
+		if err := json.Unmarshal(elemBytes, assInst); err != nil {
+			return err
+		}
+		if assInst.AssignmentDef == assDefKey {
+			assInsts = append(assInsts, assInst)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return assInsts, nil
+}
+
+// publish an assignment def which was scheduled for publication
+func handlePublishAssignmentJob(job *jobs.Job) (*time.Time, error) {
+	assDef, err := getAssignmentDefOfJob(job)
+	if err != nil || assDef == nil || assDef.State == assignments.Published {
+		return nil, err
+	}
+	return nil, publishAssignmentDef(assDef, job.CreatedBy)
+}
+
+// remind students about assignments they didn't submit yet. Students whose due date was extended are reminded later
+func handleDueDateReminderJob(job *jobs.Job) (*time.Time, error) {
+	assDef, err := getAssignmentDefOfJob(job)
+	if err != nil || assDef == nil {
+		return nil, err
+	}
+	assInsts, err := getInstancesOfAssignmentDef(job.Target)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	var nextRunAt *time.Time
+	for _, assInst := range assInsts {
+		if assInst.State != assignments.Assigned || assInst.ReminderSent || assInst.Archived || !assInst.DueBy.After(now) {
+			continue
+		}
+		if remindAt := assInst.DueBy.Add(-dueDateReminderPeriod); remindAt.After(now) {
+			if nextRunAt == nil || remindAt.Before(*nextRunAt) {
+				nextRunAt = &remindAt
+			}
+			continue
+		}
+		user, err := users.Get(assInst.UserName)
+		if err != nil {
+			return nil, err
+		}
+		msg, box, err := messages.NewMessage(db.System, fmt.Sprintf("assignment '%s' wasn't submitted yet and is due by %s", assDef.Name, assInst.DueBy.Format(time.RFC3339)), user.MessageBox, false)
+		if err != nil {
+			return nil, err
+		}
+		box.Messages.Add(msg.ID)
+		assInst.ReminderSent = true
+		if err := db.Update(db.System, assInst, msg, box); err != nil {
+			return nil, err
+		}
+		if err := queueEmail(assInst.UserName, mail.DueDateReminder, &mail.TemplateData{Assignment: assDef.Name, DueBy: assInst.DueBy}); err != nil {
+			return nil, err
+		}
+	}
+	return nextRunAt, nil
+}
+
+// close the instances of an assignment def at their due date. Tests which run on deadline are executed for submitted
+// instances and instances which weren't submitted are graded with 0 if the def asks for it. Instances whose due date
+// was extended are closed later
+func handleAssignmentDeadlineJob(job *jobs.Job) (*time.Time, error) {
+	assDef, err := getAssignmentDefOfJob(job)
+	if err != nil || assDef == nil {
+		return nil, err
+	}
+	assInsts, err := getInstancesOfAssignmentDef(job.Target)
+	if err != nil {
+		return nil, err
+	}
+	var deadlineTests []string
+	if err := db.QueryBucket([]byte(db.Tests), func(_, elemBytes []byte) error {
+		test := &tests.Test{}
+		if err := json.Unmarshal(elemBytes, test); err != nil {
+			return err
+		}
+		if test.AssignmentDef == job.Target && test.RunsOn == tests.OnDeadline && test.State == tests.Published {
+			deadlineTests = append(deadlineTests, string(test.Key()))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	closed := jobLabelSet(job, closedInstances)
+	now := time.Now().UTC()
+	var nextRunAt *time.Time
+	for _, assInst := range assInsts {
+		if assInst.Archived || closed.Contains(string(assInst.Key())) {
+			continue
+		}
+		if assInst.DueBy.After(now) {
+			if assInst.State != assignments.Graded && (nextRunAt == nil || assInst.DueBy.Before(*nextRunAt)) {
+				dueBy := assInst.DueBy
+				nextRunAt = &dueBy
+			}
+			continue
+		}
+		var elementsToUpdate []db.IBucketElement
+		switch assInst.State {
+			case assignments.Assigned:
+				if assDef.ZeroGradeMissing {
+					assInst.SetGrade(0)
+					elementsToUpdate = append(elementsToUpdate, assInst)
+				}
+			case assignments.Submitted:
+				for _, deadlineTest := range deadlineTests {
+					tr, err := NewTestRequest(deadlineTest, string(assInst.Key()), false)
+					if err != nil {
+						return nil, err
+					}
+					task, err := tr.ToTask(db.System, false)
+					if err != nil {
+						return nil, err
+					}
+					elementsToUpdate = append(elementsToUpdate, task)
+				}
+		}
+		// the instance is marked as closed in the same transaction, so a failed or interrupted run never closes it twice
+		if err := updateWithJobLabels(job, map[string][]string{closedInstances: {string(assInst.Key())}}, elementsToUpdate...); err != nil {
+			return nil, err
+		}
+	}
+	return nextRunAt, nil
+}
+
+// automatically grade an assignment def: all published tests of the def are executed for the submitted instances, like
+// a multi test request of the staff, whenever the tests usually run. Instances which weren't submitted are left to the
+// deadline job. The job then keeps running periodically and reports the progress of
+// the created tasks in the status of the def until all of them are finished
+func handleAutoGradeJob(job *jobs.Job) (*time.Time, error) {
+	assDef, err := getAssignmentDefOfJob(job)
+	if err != nil || assDef == nil {
+		return nil, err
+	}
+	switch assDef.Status.State {
+		case assignments.AutoGradeNone, assignments.AutoGradeDone:
+			return nil, nil
+		case assignments.AutoGradeScheduled:
+			if assDef.State != assignments.Published {
+				return nil, fmt.Errorf("assignment def '%s' isn't published yet", assDef.Name)
+			}
+			return startAutoGrade(job, assDef)
+	}
+	return updateAutoGradeProgress(job, assDef)
+}
+
+func startAutoGrade(job *jobs.Job, assDef *assignments.AssignmentDef) (*time.Time, error) {
+	assInsts, err := getInstancesOfAssignmentDef(job.Target)
+	if err != nil {
+		return nil, err
+	}
+	var gradingTests []string
+	if err := db.QueryBucket([]byte(db.Tests), func(_, elemBytes []byte) error {
+		test := &tests.Test{}
+		if err := json.Unmarshal(elemBytes, test); err != nil {
+			return err
+		}
+		if test.AssignmentDef == job.Target && test.State == tests.Published {
+			gradingTests = append(gradingTests, string(test.Key()))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	// instances whose tasks were created by an interrupted run keep them
+	started := jobLabelSet(job, autoGradedInstances)
+	status := assignments.AutoGradeStatus{State: assignments.AutoGradeInProgress}
+	for _, assInst := range assInsts {
+		if assInst.Archived {
+			continue
+		}
+		status.Instances++
+		// instances which weren't submitted have no files, whether they're still assigned or were graded at the deadline
+		if assInst.State == assignments.Assigned || assInst.Files == nil || assInst.Files.NumberOfElements() == 0 {
+			status.NotSubmitted++
+			continue
+		}
+		if started.Contains(string(assInst.Key())) {
+			continue
+		}
+		var tasks []db.IBucketElement
+		var taskIds []string
+		for _, test := range gradingTests {
+			tr, err := NewTestRequest(test, string(assInst.Key()), false)
+			if err != nil {
+				return nil, err
+			}
+			task, err := tr.ToTask(db.System, false)
+			if err != nil {
+				return nil, err
+			}
+			tasks = append(tasks, task)
+			taskIds = append(taskIds, task.ID)
+		}
+		if err := updateWithJobLabels(job, map[string][]string{autoGradedInstances: {string(assInst.Key())}, autoGradeTasks: taskIds}, tasks...); err != nil {
+			return nil, err
+		}
+	}
+	status.TasksCreated = jobLabelSet(job, autoGradeTasks).NumberOfElements()
+	if status.TasksCreated == 0 {
+		status.State = assignments.AutoGradeDone
+	}
+	assDef.Status = status
+	if err := db.Update(db.System, assDef); err != nil {
+		return nil, err
+	}
+	if status.State == assignments.AutoGradeDone {
+		return nil, nil
+	}
+	nextRunAt := time.Now().UTC().Add(autoGradeProgressInterval)
+	return &nextRunAt, nil
+}
+
+func updateAutoGradeProgress(job *jobs.Job, assDef *assignments.AssignmentDef) (*time.Time, error) {
+	taskIds, _ := job.Labels[autoGradeTasks].([]interface{})
+	assDef.Status.TasksDone, assDef.Status.TasksFailed = 0, 0
+	for _, taskIdElem := range taskIds {
+		taskId, ok := taskIdElem.(string)
+		if !ok {
+			continue
+		}
+		task, err := agents.GetTask(taskId)
+		if err != nil {
+			if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+				assDef.Status.TasksFailed++
+				continue
+			}
+			return nil, err
+		}
+		switch task.Status {
+			case agents.TaskStatusOk:
+				assDef.Status.TasksDone++
+			case agents.TaskStatusError, agents.TaskStatusTimeout:
+				assDef.Status.TasksFailed++
+		}
+	}
+	var nextRunAt *time.Time
+	if assDef.Status.TasksDone + assDef.Status.TasksFailed >= assDef.Status.TasksCreated {
+		assDef.Status.State = assignments.AutoGradeDone
+	} else {
+		next := time.Now().UTC().Add(autoGradeProgressInterval)
+		nextRunAt = &next
+	}
+	if err := db.Update(db.System, assDef); err != nil {
+		return nil, err
+	}
+	return nextRunAt, nil
+}
+
+func init() {
+	jobHandlers[jobTypePublishAssignment] = handlePublishAssignmentJob
+	jobHandlers[jobTypeDueDateReminder] = handleDueDateReminderJob
+	jobHandlers[jobTypeAssignmentDeadline] = handleAssignmentDeadlineJob
+	jobHandlers[jobTypeAutoGrade] = handleAutoGradeJob
+}
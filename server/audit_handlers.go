@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	submithttp "github.com/DAv10195/submit_commons/http"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/audit"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// return the events recorded in the audit trail
+func handleGetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	params, err := submithttp.PagingParamsFromRequest(r)
+	if err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
+		return
+	}
+	var elements []db.IBucketElement
+	var elementsCount, elementsIndex int64
+	if err := db.QueryBucket([]byte(db.AuditEvents), func(_, elementBytes []byte) error {
+		elementsIndex++
+		if elementsIndex <= params.AfterId {
+			return nil
+		}
+		event := &audit.Event{}
+		if err := json.Unmarshal(elementBytes, event); err != nil {
+			return err
+		}
+		elements = append(elements, event)
+		elementsCount++
+		if elementsCount == params.Limit {
+			return &db.ErrStopQuery{}
+		}
+		return nil
+	}); err != nil {
+		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
+			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeElements(w, r, http.StatusOK, elements)
+}
+
+func initAuditRouter(r *mux.Router, manager *authManager) {
+	basePath := "/audit"
+	router := r.PathPrefix(basePath).Subrouter()
+	router.HandleFunc("/", handleGetAuditEvents).Methods(http.MethodGet)
+	manager.addPathPolicy(fmt.Sprintf("%s/", basePath), newPolicy(db.AuditEvents, nil, allow(relationAdmin)))
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// a request to explain the authorization of a request of some user
+type AuthExplainRequest struct {
+	User		string				`json:"user"`
+	Method		string				`json:"method"`
+	Path		string				`json:"path"`
+	Headers		map[string]string	`json:"headers"`
+	Body		json.RawMessage		`json:"body"`
+}
+
+// return a handler explaining which policies allow or deny a request of some user to the routes of the given router
+func handleAuthExplain(router *mux.Router, manager *authManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		er := &AuthExplainRequest{}
+		if err := json.NewDecoder(r.Body).Decode(er); err != nil {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if er.User == "" || er.Method == "" || er.Path == "" {
+			writeErrResp(w, r, http.StatusBadRequest, errors.New("user, method and path must be given"))
+			return
+		}
+		user, err := users.Get(er.User)
+		if err != nil {
+			if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+				writeErrResp(w, r, http.StatusNotFound, err)
+			} else {
+				writeErrResp(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		explainedReq, err := http.NewRequest(er.Method, er.Path, bytes.NewBuffer(er.Body))
+		if err != nil {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+			return
+		}
+		for header, value := range er.Headers {
+			explainedReq.Header.Set(header, value)
+		}
+		match := &mux.RouteMatch{}
+		if !router.Match(explainedReq, match) {
+			writeErrResp(w, r, http.StatusNotFound, fmt.Errorf("no route matches %s %s", er.Method, er.Path))
+			return
+		}
+		explainedReq = mux.SetURLVars(explainedReq, match.Vars)
+		writeResponse(w, r, http.StatusOK, manager.authorize(newAuthRequest(user, explainedReq)))
+	}
+}
+
+func initAuthRouter(r *mux.Router, manager *authManager) {
+	basePath := "/auth"
+	router := r.PathPrefix(basePath).Subrouter()
+	router.HandleFunc("/explain", handleAuthExplain(r, manager)).Methods(http.MethodPost)
+	manager.addPathPolicy(fmt.Sprintf("%s/explain", basePath), newPolicy("authorization explanation", nil, allow(relationAdmin)))
+}
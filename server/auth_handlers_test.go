@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/session"
+	"net/http"
+	"testing"
+)
+
+func TestAuthExplain(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	cleanupSess := session.InitSessionForTest()
+	defer cleanupSess()
+	if err := users.InitDefaultAdmin(); err != nil {
+		t.Fatalf("error initialiting admin user for test: %v", err)
+	}
+	course, err := courses.NewCourse(1, "course", db.System, false, false)
+	if err != nil {
+		t.Fatalf("error creating course for test: %v", err)
+	}
+	courseKey := string(course.Key())
+	course.StaffRoles["observer"] = courses.Observer
+	if err := db.Update(db.System, course); err != nil {
+		t.Fatalf("error creating course for test: %v", err)
+	}
+	if _, err := users.NewUserBuilder(db.System, true).WithUserName("observer").WithPassword("observer").WithRoles(users.StandardUser).
+		WithCoursesAsStaff(courseKey).Build(); err != nil {
+		t.Fatalf("error creating user for test: %v", err)
+	}
+	router := newTestRouter(t)
+	initCoursesRouter(router.Router, router.am)
+	initAuthRouter(router.Router, router.am)
+	coursePath := fmt.Sprintf("/%s/%d/%d", db.Courses, course.Number, course.Year)
+	testCases := []struct{
+		name		string
+		user		string
+		request		*AuthExplainRequest
+		status		int
+		allowed		bool
+	}{
+		{"test observer get course", users.Admin, &AuthExplainRequest{User: "observer", Method: http.MethodGet, Path: coursePath}, http.StatusOK, true},
+		{"test observer update course", users.Admin, &AuthExplainRequest{User: "observer", Method: http.MethodPut, Path: coursePath}, http.StatusOK, false},
+		{"test admin update course", users.Admin, &AuthExplainRequest{User: users.Admin, Method: http.MethodPut, Path: coursePath}, http.StatusOK, true},
+		{"test unknown user", users.Admin, &AuthExplainRequest{User: "unknown", Method: http.MethodGet, Path: coursePath}, http.StatusNotFound, false},
+		{"test unmatched path", users.Admin, &AuthExplainRequest{User: "observer", Method: http.MethodGet, Path: "/unknown"}, http.StatusNotFound, false},
+		{"test explain by non admin", "observer", &AuthExplainRequest{User: "observer", Method: http.MethodGet, Path: coursePath}, http.StatusForbidden, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(tc.request)
+			if err != nil {
+				t.Fatalf("error serializing explain request: %v", err)
+			}
+			w := router.send(http.MethodPost, "/auth/explain", string(body), tc.user)
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d but got %d", tc.status, w.Code)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			explanation := &AuthExplanation{}
+			if err := json.NewDecoder(w.Body).Decode(explanation); err != nil {
+				t.Fatalf("error parsing explain response: %v", err)
+			}
+			if explanation.Allowed != tc.allowed || len(explanation.Decisions) == 0 {
+				t.Fatalf("unexpected explanation: %+v", explanation)
+			}
+			for _, decision := range explanation.Decisions {
+				if decision.Reason == "" {
+					t.Fatalf("expected a reason for the decision of policy '%s'", decision.Pattern)
+				}
+			}
+		})
+	}
+}
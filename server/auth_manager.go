@@ -1,68 +1,138 @@
 package server
 
 import (
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/courses"
 	"github.com/DAv10195/submit_server/elements/users"
 	"net/http"
 	"regexp"
 )
 
-type authorizationFunc func(*users.User, *http.Request) bool
-
-// an authorization handler using a regex
-type regexpHandler struct {
+// an authorization policy applied to paths matching a regex
+type regexpPolicy struct {
 	regexp	*regexp.Regexp
-	invoke 	authorizationFunc
+	policy	*policy
 }
 
 // authorization manager
 type authManager struct {
-	authMap 		map[string]authorizationFunc
-	regExpHandlers	[]*regexpHandler
+	pathPolicies	map[string]*policy
+	regexpPolicies	[]*regexpPolicy
+}
+
+// the decision of a single policy about a request
+type PolicyDecision struct {
+	Pattern		string	`json:"pattern"`
+	Resource	string	`json:"resource"`
+	Allowed		bool	`json:"allowed"`
+	Reason		string	`json:"reason"`
+}
+
+// explanation of the authorization of a request
+type AuthExplanation struct {
+	User		string				`json:"user"`
+	Method		string				`json:"method"`
+	Path		string				`json:"path"`
+	Allowed		bool				`json:"allowed"`
+	Decisions	[]*PolicyDecision	`json:"decisions"`
+}
+
+func (e *AuthExplanation) String() string {
+	return _stringForResp(e)
 }
 
 // return a new auth manager
 func NewAuthManager() *authManager{
 	am := &authManager{}
-	am.authMap = make(map[string]authorizationFunc)
+	am.pathPolicies = make(map[string]*policy)
 	return am
 }
 
-// middleware for invoking authorization handlers
+// authorize the given request. A policy of the exact path of the request takes precedence. Otherwise, all the policies
+// with a regex matching the path of the request have to allow it
+func (a *authManager) authorize(ar *authRequest) *AuthExplanation {
+	path := ar.request.URL.Path
+	explanation := &AuthExplanation{User: ar.user.UserName, Method: ar.request.Method, Path: path, Allowed: true, Decisions: []*PolicyDecision{}}
+	evaluate := func(pattern string, p *policy) {
+		allowed, reason := p.evaluate(ar)
+		explanation.Decisions = append(explanation.Decisions, &PolicyDecision{Pattern: pattern, Resource: p.resource, Allowed: allowed, Reason: reason})
+		explanation.Allowed = explanation.Allowed && allowed
+	}
+	if p := a.pathPolicies[path]; p != nil {
+		evaluate(path, p)
+		return explanation
+	}
+	for _, rp := range a.regexpPolicies {
+		if rp.regexp.MatchString(path) {
+			evaluate(rp.regexp.String(), rp.policy)
+		}
+	}
+	return explanation
+}
+
+// middleware for enforcing authorization policies
 func (a *authManager) authorizationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
-		user := r.Context().Value(authenticatedUser).(*users.User)
-		// try to get the handler with the path
-		handler := a.authMap[path]
-		// if path is in the map invoke the handler.
-		if handler != nil {
-			if handler(user, r) {
-				next.ServeHTTP(w, r)
-			} else {
-				writeStrErrResp(w, r, http.StatusForbidden, accessDenied)
-			}
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
 			return
 		}
-		// well, no direct handler, lets try matching regular expressions to find a handler
-		for _, regExpHandler := range a.regExpHandlers {
-			if regExpHandler.regexp.MatchString(path) && !regExpHandler.invoke(user, r) {
-				writeStrErrResp(w, r, http.StatusForbidden, accessDenied)
-				return
-			}
+		ar := newAuthRequest(r.Context().Value(authenticatedUser).(*users.User), r)
+		if !a.authorize(ar).Allowed {
+			writeStrErrResp(w, r, http.StatusForbidden, accessDenied)
+			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-// add a concrete path auth handler
-func (a *authManager) addPathToMap(path string, authFunc authorizationFunc){
-	a.authMap[path] = authFunc
+// add a policy for a concrete path
+func (a *authManager) addPathPolicy(path string, p *policy) {
+	a.pathPolicies[path] = p
 }
 
-// add a regex auth handler
-func (a *authManager) addRegex(regex *regexp.Regexp, authFunc authorizationFunc) {
-	a.regExpHandlers = append(a.regExpHandlers, &regexpHandler{
+// add a policy for the paths matching the given regex
+func (a *authManager) addRegexPolicy(regex *regexp.Regexp, p *policy) {
+	a.regexpPolicies = append(a.regexpPolicies, &regexpPolicy{
 		regex,
-		authFunc,
+		p,
 	})
 }
+
+// check if the given user has the given permission in the given course. Admins have all permissions and course staff
+// members have the permissions of their role in the course
+func hasPermissionInCourse(user *users.User, course *courses.Course, permission string) bool {
+	if user.Roles.Contains(users.Admin) {
+		return true
+	}
+	if !user.CoursesAsStaff.Contains(string(course.Key())) {
+		return false
+	}
+	return course.HasPermission(user.UserName, permission)
+}
+
+// check if the given user has the given permission in the course with the given key
+func hasCoursePermission(user *users.User, courseKey string, permission string) bool {
+	if user.Roles.Contains(users.Admin) {
+		return true
+	}
+	if !user.CoursesAsStaff.Contains(courseKey) {
+		return false
+	}
+	course, err := courses.Get(courseKey)
+	if err != nil {
+		logger.WithError(err).Errorf("error getting course '%s' for checking permissions", courseKey)
+		return false
+	}
+	return hasPermissionInCourse(user, course, permission)
+}
+
+// get the course key from the course number and year path params of the given request
+func getCourseKeyFromRequest(r *http.Request) (string, error) {
+	number, year, err := getCourseNumberAndYearFromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d%s%d", number, db.KeySeparator, year), nil
+}
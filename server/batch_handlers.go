@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+// max number of requests in a single batch
+const maxBatchRequests = 50
+
+// a read request executed as part of a batch
+type BatchRequestItem struct {
+	Path	string				`json:"path"`
+	Headers	map[string]string	`json:"headers"`
+}
+
+type BatchRequest struct {
+	Requests	[]*BatchRequestItem	`json:"requests"`
+}
+
+// the response to a single request of a batch. Bodies which aren't json are given as strings
+type BatchResponseItem struct {
+	Path	string				`json:"path"`
+	Status	int					`json:"status"`
+	Headers	map[string]string	`json:"headers"`
+	Body	json.RawMessage		`json:"body"`
+}
+
+type BatchResponse struct {
+	Responses	[]*BatchResponseItem	`json:"responses"`
+}
+
+func (b *BatchResponse) String() string {
+	return _stringForResp(b)
+}
+
+// collects the response of a request executed as part of a batch
+type batchResponseWriter struct {
+	header	http.Header
+	status	int
+	body	bytes.Buffer
+}
+
+func (b *batchResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *batchResponseWriter) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+func (b *batchResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// execute the given read request on behalf of the user of the given batch request. The request is authorized by the
+// given auth manager as if it was sent on its own, but isn't authenticated again
+func executeBatchItem(router *mux.Router, am *authManager, batch *http.Request, item *BatchRequestItem) *BatchResponseItem {
+	resp := &BatchResponseItem{Path: item.Path, Headers: make(map[string]string)}
+	itemErr := func(status int, message string) *BatchResponseItem {
+		resp.Status, resp.Body = status, json.RawMessage((&Response{Message: message}).String())
+		return resp
+	}
+	if !strings.HasPrefix(item.Path, "/") {
+		return itemErr(http.StatusBadRequest, fmt.Sprintf("invalid path '%s'", item.Path))
+	}
+	r, err := http.NewRequestWithContext(batch.Context(), http.MethodGet, item.Path, nil)
+	if err != nil {
+		return itemErr(http.StatusBadRequest, err.Error())
+	}
+	if r.URL.Path == batch.URL.Path {
+		return itemErr(http.StatusBadRequest, "batches can't be nested")
+	}
+	for header, value := range item.Headers {
+		r.Header.Set(header, value)
+	}
+	r.RemoteAddr = batch.RemoteAddr
+	match := &mux.RouteMatch{}
+	if !router.Match(r, match) {
+		if match.MatchErr == mux.ErrMethodMismatch {
+			return itemErr(http.StatusMethodNotAllowed, "only read requests can be batched")
+		}
+		return itemErr(http.StatusNotFound, fmt.Sprintf("path '%s' not found", r.URL.Path))
+	}
+	w := &batchResponseWriter{header: make(http.Header)}
+	// the handler of the matched route is wrapped by the authentication middleware, so the unwrapped one is used
+	am.authorizationMiddleware(match.Route.GetHandler()).ServeHTTP(w, mux.SetURLVars(r, match.Vars))
+	resp.Status = w.status
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	for header := range w.header {
+		resp.Headers[header] = w.header.Get(header)
+	}
+	body := w.body.Bytes()
+	if len(body) == 0 {
+		body = []byte("null")
+	} else if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+	resp.Body = body
+	return resp
+}
+
+// execute multiple read requests in a single call, returning the status, headers and body of each of them
+func handleBatch(router *mux.Router, am *authManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batch := &BatchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(batch); err != nil {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if len(batch.Requests) == 0 || len(batch.Requests) > maxBatchRequests {
+			writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("a batch must contain between 1 and %d requests", maxBatchRequests))
+			return
+		}
+		resp := &BatchResponse{}
+		for _, item := range batch.Requests {
+			resp.Responses = append(resp.Responses, executeBatchItem(router, am, r, item))
+		}
+		writeResponse(w, r, http.StatusOK, resp)
+	}
+}
+
+func initBatchRouter(r *mux.Router, manager *authManager) {
+	basePath := "/batch"
+	r.HandleFunc(basePath, handleBatch(r, manager)).Methods(http.MethodPost)
+	// each of the batched requests is authorized on its own
+	manager.addPathPolicy(basePath, newPolicy("batch", nil, allow(relationAnyone)))
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	submithttp "github.com/DAv10195/submit_commons/http"
+	"github.com/DAv10195/submit_server/elements/users"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProjectionsAndBatch(t *testing.T) {
+	_, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	initUsersRouter(router.Router, router.am)
+	initCoursesRouter(router.Router, router.am)
+	initBatchRouter(router.Router, router.am)
+	user := make(map[string]interface{})
+	router.decode(router.send(http.MethodGet, "/users/user2", "", "user2"), http.StatusOK, &user)
+	if user["user_name"] != "user2" || user["password"] != nil {
+		t.Fatalf("user response is missing its name or contains its password: %v", user)
+	}
+	user = make(map[string]interface{})
+	router.decode(router.send(http.MethodGet, "/users/user2?fields=user_name,password", "", "user2"), http.StatusOK, &user)
+	if len(user) != 1 || user["user_name"] != "user2" {
+		t.Fatalf("projected user response contains %v instead of only the user name", user)
+	}
+	var listed struct {
+		Elements	[]map[string]interface{}	`json:"elements"`
+	}
+	router.decode(router.send(http.MethodGet, "/users/?fields=user_name,email", "", users.Admin), http.StatusOK, &listed)
+	if len(listed.Elements) != 4 {
+		t.Fatalf("listed %d users instead of 4", len(listed.Elements))
+	}
+	for _, u := range listed.Elements {
+		if _, ok := u["user_name"]; !ok || len(u) != 2 {
+			t.Fatalf("projected user contains %v instead of its name and email", u)
+		}
+	}
+	courseKey := fmt.Sprintf("1:%d", time.Now().UTC().Year())
+	batch := &BatchRequest{Requests: []*BatchRequestItem{
+		{Path: "/users/user2?fields=user_name,password"},
+		{Path: "/users/user3"},
+		{Path: "/courses/?fields=name", Headers: map[string]string{submithttp.ForSubmitUser: "user2"}},
+		{Path: "/missing"},
+		{Path: "/batch"},
+		{Path: "relative"},
+	}}
+	batchBytes, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("error encoding batch for test: %v", err)
+	}
+	resp := &BatchResponse{}
+	router.decode(router.send(http.MethodPost, "/batch", string(batchBytes), "user2"), http.StatusOK, resp)
+	if len(resp.Responses) != len(batch.Requests) {
+		t.Fatalf("batch returned %d responses instead of %d", len(resp.Responses), len(batch.Requests))
+	}
+	expectedStatuses := []int{http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusNotFound, http.StatusBadRequest, http.StatusBadRequest}
+	for i, item := range resp.Responses {
+		if item.Status != expectedStatuses[i] || item.Path != batch.Requests[i].Path {
+			t.Fatalf("batched request to '%s' produced status code %d instead of %d", item.Path, item.Status, expectedStatuses[i])
+		}
+	}
+	if body := string(resp.Responses[0].Body); body != `{"user_name":"user2"}` {
+		t.Fatalf("batched projected user response is %s", body)
+	}
+	if body := string(resp.Responses[2].Body); !strings.Contains(body, `"name":"course"`) || strings.Contains(body, courseKey) {
+		t.Fatalf("batched projected courses response is %s", body)
+	}
+	if resp.Responses[2].Headers[totalCountHeader] != "1" {
+		t.Fatalf("batched courses response doesn't have its headers: %v", resp.Responses[2].Headers)
+	}
+	if w := router.send(http.MethodPost, "/batch", `{"requests": []}`, "user2"); w.Code != http.StatusBadRequest {
+		t.Fatalf("empty batch produced status code %d instead of %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -11,10 +11,29 @@ const (
 	accessDenied			= "access denied"
 
 	authenticatedUser		= "authenticated_user"
+	currentSession			= "current_session"
+	sessionHandle			= "sessionHandle"
+	lockoutSubject			= "subject"
+	retryAfterHeader		= "Retry-After"
+
+	// defaults of the login protection and single sign-on configuration, also used as the defaults of the matching flags
+	DefMaxUserLoginFailures		= 5
+	DefMaxIpLoginFailures		= 50
+	DefLoginFailureBaseDelay	= time.Second
+	DefLoginLockoutDuration		= 15 * time.Minute
+	DefSsoUserNameClaim			= "preferred_username"
 
 	agentId					= "agentId"
 	hello					= "Hello"
 	endpoint				= "endpoint"
+	agentCredentialHeader	= "Submit-Agent-Credential"
+	messageTypeDrain		= "drain"
+	messageTypeTaskOutput	= "task_output"
+
+	agentStateApproved		= "approved"
+	agentStateDraining		= "draining"
+	agentStateDisabled		= "disabled"
+	agentStateRevoked		= "revoked"
 
 	serverTimeout			= 15 * time.Second
 
@@ -22,8 +41,52 @@ const (
 	taskProcessingTimeout	= 120
 	taskId					= "taskId"
 
+	maxTaskOutputBufferSize		= 1024 * 1024
+	taskOutputWatcherBufferSize	= 100
+
+	notificationsWatcherBufferSize	= 100
+	notificationTypeMessage			= "message"
+	notificationTypeAppeal			= "appeal"
+	notificationTypeAssignment		= "assignment"
+	notificationTypeTest			= "test"
+	notificationTypeAnnouncement	= "announcement"
+
+	dueDateReminderPeriod		= 24 * time.Hour
+	emailDigestPeriod			= 24 * time.Hour
+	emailRetryDelay				= time.Minute
+	maxEmailDeliveryAttempts	= 10
+
+	jobRetryDelay					= time.Minute
+	maxJobAttempts					= 10
+	jobTypeDueDateReminder			= "due_date_reminder"
+	jobTypeAssignmentDeadline		= "assignment_deadline"
+	jobTypePublishAssignment		= "publish_assignment"
+	jobTypeAutoGrade				= "auto_grade"
+	jobTypeSessionCleanup			= "session_cleanup"
+	jobTypeLoginAttemptsCleanup		= "login_attempts_cleanup"
+	cleanupJobsInterval				= time.Hour
+	autoGradeProgressInterval		= time.Minute
+	autoGradeTasks					= "tasks"
+	closedInstances					= "closed_instances"
+	autoGradedInstances				= "instances"
+	clearScheduleHeader				= "Submit-Clear-Schedule"
+	publishAtField					= "publish_at"
+	autoGradeAtField				= "auto_grade_at"
+
+	passwordResetTokenTtl	= 30 * time.Minute
+
+	ssoPasswordLength		= 32
+
 	trueStr					= "true"
 
+	limitParam				= "limit"
+	afterIdParam			= "after_id"
+	cursorParam				= "cursor"
+	sortParam				= "sort"
+	fieldsParam				= "fields"
+	nextCursorHeader		= "Submit-Next-Cursor"
+	totalCountHeader		= "Submit-Total-Count"
+
 	courseNumber			= "courseNumber"
 	courseYear				= "courseYear"
 
@@ -31,6 +94,17 @@ const (
 
 	testName				= "testName"
 
+	messageId				= "messageId"
+	attachmentName			= "attachmentName"
+	messageThreadParam		= "thread"
+
+	forumPostId				= "postId"
+	forumSearchParam		= "q"
+	forumAnsweredParam		= "answered"
+
+	searchQueryParam		= "q"
+	searchTypeParam			= "type"
+
 	onDemandTask			= "on_demand_task"
 	testTask				= "test_task"
 	assInstUsrName			= "ass_inst_user_name"
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
@@ -290,3 +291,71 @@ func TestCoursesHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestCourseStaffRoles(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	cleanupSess := session.InitSessionForTest()
+	defer cleanupSess()
+	course, err := courses.NewCourse(1, "course", db.System, false, false)
+	if err != nil {
+		t.Fatalf("error creating course for test: %v", err)
+	}
+	courseKey := string(course.Key())
+	course.StaffRoles["grader"], course.StaffRoles["observer"] = courses.Grader, courses.Observer
+	if err := db.Update(db.System, course); err != nil {
+		t.Fatalf("error creating course for test: %v", err)
+	}
+	staff := make(map[string]*users.User)
+	for _, userName := range []string{"lecturer", "grader", "observer"} {
+		user, err := users.NewUserBuilder(db.System, true).WithUserName(userName).WithPassword(userName).WithRoles(users.StandardUser).
+			WithCoursesAsStaff(courseKey).Build()
+		if err != nil {
+			t.Fatalf("error creating user for test: %v", err)
+		}
+		staff[userName] = user
+	}
+	expectedPermissions := map[string]map[string]bool{
+		"lecturer":	{courses.PublishAssignment: true, courses.Grade: true, courses.ManageRoster: true},
+		"grader":	{courses.PublishAssignment: false, courses.Grade: true, courses.ManageRoster: false},
+		"observer":	{courses.PublishAssignment: false, courses.Grade: false, courses.ManageRoster: false},
+	}
+	for userName, permissions := range expectedPermissions {
+		for permission, expected := range permissions {
+			if hasCoursePermission(staff[userName], courseKey, permission) != expected {
+				t.Fatalf("expected permission '%s' of %s to be %v", permission, userName, expected)
+			}
+		}
+	}
+	router := newTestRouter(t)
+	initCoursesRouter(router.Router, router.am)
+	coursePath := fmt.Sprintf("/%s/%d/%d", db.Courses, course.Number, course.Year)
+	testCases := []struct{
+		name	string
+		method	string
+		user	string
+		data	[]byte
+		status	int
+	}{
+		{"test observer get course", http.MethodGet, "observer", nil, http.StatusOK},
+		{"test observer update course forbidden", http.MethodPut, "observer", []byte(`{"name": "updated"}`), http.StatusForbidden},
+		{"test lecturer update course invalid role", http.MethodPut, "lecturer", []byte(`{"name": "updated", "staff_roles": {"observer": "bad"}}`), http.StatusBadRequest},
+		{"test lecturer update course roles", http.MethodPut, "lecturer", []byte(`{"name": "updated", "staff_roles": {"observer": "ta"}}`), http.StatusAccepted},
+	}
+	for _, testCase := range testCases {
+		if w := router.send(testCase.method, coursePath, string(testCase.data), testCase.user); w.Code != testCase.status {
+			t.Fatalf("test case [ %s ] produced status code %d instead of the expected %d status code", testCase.name, w.Code, testCase.status)
+		}
+	}
+	w := router.send(http.MethodGet, "/", "", "observer")
+	if w.Code != http.StatusOK {
+		t.Fatalf("error calling login handler. Expected 200 status code but got %d", w.Code)
+	}
+	ld := &session.LoginData{}
+	if err := json.NewDecoder(w.Body).Decode(ld); err != nil {
+		t.Fatal("error parsing login data from response")
+	}
+	if ld.CourseRoles[courseKey] != courses.TeachingAssistant || len(ld.Permissions[courseKey]) != len(courses.RolePermissions[courses.TeachingAssistant]) {
+		t.Fatalf("expected login data to contain the updated course role but got %v with permissions %v", ld.CourseRoles, ld.Permissions)
+	}
+}
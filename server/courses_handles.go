@@ -45,7 +45,7 @@ func handleGetCourse(w http.ResponseWriter, r *http.Request) {
 	writeElem(w, r, http.StatusOK, course)
 }
 
-func handleGetCoursesForUser(forUser string, w http.ResponseWriter, r *http.Request, params *submithttp.PagingParams) {
+func handleGetCoursesForUser(forUser string, w http.ResponseWriter, r *http.Request) {
 	var user *users.User
 	requestUser := r.Context().Value(authenticatedUser).(*users.User)
 	if requestUser.UserName == forUser {
@@ -62,73 +62,19 @@ func handleGetCoursesForUser(forUser string, w http.ResponseWriter, r *http.Requ
 			return
 		}
 	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Courses), func(_, elementBytes []byte) error {
-		course := &courses.Course{}
-		if err := json.Unmarshal(elementBytes, course); err != nil {
-			return err
-		}
-		if user.CoursesAsStudent.Contains(string(course.Key())) || user.CoursesAsStaff.Contains(string(course.Key())) {
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, course)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.Courses, func() db.IBucketElement { return &courses.Course{} }, func(elem db.IBucketElement) bool {
+		courseKey := string(elem.Key())
+		return user.CoursesAsStudent.Contains(courseKey) || user.CoursesAsStaff.Contains(courseKey)
+	})
 }
 
 func handleGetCourses(w http.ResponseWriter, r *http.Request) {
-	params, err := submithttp.PagingParamsFromRequest(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
-		return
-	}
 	forUser := r.Header.Get(submithttp.ForSubmitUser)
 	if forUser != "" {
-		handleGetCoursesForUser(forUser, w, r, params)
+		handleGetCoursesForUser(forUser, w, r)
 		return
 	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Courses), func(_, elementBytes []byte) error {
-		elementsIndex++
-		if elementsIndex <= params.AfterId {
-			return nil
-		}
-		course := &courses.Course{}
-		if err := json.Unmarshal(elementBytes, course); err != nil {
-			return err
-		}
-		elements = append(elements, course)
-		elementsCount++
-		if elementsCount == params.Limit {
-			return &db.ErrStopQuery{}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.Courses, func() db.IBucketElement { return &courses.Course{} }, nil)
 }
 
 func handleCreateCourse(w http.ResponseWriter, r *http.Request) {
@@ -174,6 +120,29 @@ func handleUpdateCourse(w http.ResponseWriter, r *http.Request) {
 	updatedCourse.Year = preUpdateCourse.Year
 	updatedCourse.CreatedOn = preUpdateCourse.CreatedOn
 	updatedCourse.CreatedBy = preUpdateCourse.CreatedBy
+	// the announcements box can't be replaced
+	updatedCourse.MessageBox = preUpdateCourse.MessageBox
+	if updatedCourse.StaffRoles == nil {
+		updatedCourse.StaffRoles = preUpdateCourse.StaffRoles
+	} else if err := updatedCourse.ValidateStaffRoles(); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if updatedCourse.AppealsLecturer != "" {
+		lecturer, err := users.Get(updatedCourse.AppealsLecturer)
+		if err != nil {
+			if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+				writeErrResp(w, r, http.StatusBadRequest, err)
+			} else {
+				writeErrResp(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		if lecturer.CoursesAsStaff == nil || !lecturer.CoursesAsStaff.Contains(courseKey) || updatedCourse.StaffRole(lecturer.UserName) != courses.Lecturer {
+			writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("user \"%s\" isn't a lecturer of the course", lecturer.UserName))
+			return
+		}
+	}
 	if err := db.Update(r.Context().Value(authenticatedUser).(*users.User).UserName, updatedCourse); err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
@@ -204,42 +173,34 @@ func handleDeleteCourse(w http.ResponseWriter, r *http.Request) {
 }
 
 // configure the courses router
+// courses can be accessed by users other than admins and secretaries only if they are standard users
+var isStandardUser = &condition{"the user is a standard user", func(ar *authRequest, _ *authResource) bool {
+	return ar.user.Roles.Contains(users.StandardUser)
+}}
+
 func initCoursesRouter(r *mux.Router, manager *authManager) {
 	coursesBasePath := fmt.Sprintf("/%s", db.Courses)
 	coursesRouter := r.PathPrefix(coursesBasePath).Subrouter()
 	coursesRouter.HandleFunc("/", handleGetCourses).Methods(http.MethodGet)
 	coursesRouter.HandleFunc("/", handleCreateCourse).Methods(http.MethodPost)
-	manager.addPathToMap(fmt.Sprintf("%s/", coursesBasePath), func (user *users.User, r *http.Request) bool {
-		if user.Roles.Contains(users.Secretary) || user.Roles.Contains(users.Admin) {
-			return true
-		}
-		return r.Method == http.MethodGet && user.Roles.Contains(users.StandardUser) && user.UserName == r.Header.Get(submithttp.ForSubmitUser)
-	})
+	manager.addPathPolicy(fmt.Sprintf("%s/", coursesBasePath), newPolicy(db.Courses, func (ar *authRequest) (*authResource, error) {
+		return &authResource{owner: ar.request.Header.Get(submithttp.ForSubmitUser)}, nil
+	}, allow(relationAdmin), allow(relationSecretary), allow(relationOwner, http.MethodGet).when(isStandardUser)))
 	specificCoursePath := fmt.Sprintf("/{%s}/{%s}", courseNumber, courseYear)
 	coursesRouter.HandleFunc(specificCoursePath, handleGetCourse).Methods(http.MethodGet)
 	coursesRouter.HandleFunc(specificCoursePath, handleDeleteCourse).Methods(http.MethodDelete)
 	coursesRouter.HandleFunc(specificCoursePath, handleUpdateCourse).Methods(http.MethodPut)
-	manager.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", coursesBasePath)), func (user *users.User, r *http.Request) bool {
-		if user.Roles.Contains(users.Admin) || user.Roles.Contains(users.Secretary) {
-			return true
-		}
-		if user.Roles.Contains(users.StandardUser) {
-			number, year, err := getCourseNumberAndYearFromRequest(r)
-			if err != nil {
-				return true // let the next handler send an appropriate error message
-			}
-			courseKey := fmt.Sprintf("%d%s%d", number, db.KeySeparator, year)
-			exists, err := db.KeyExistsInBucket([]byte(db.Courses), []byte(courseKey))
-			if err != nil || !exists {
-				return true // let the next handler send an appropriate error message
-			}
-			if user.CoursesAsStaff.Contains(courseKey) && (r.Method == http.MethodGet || r.Method == http.MethodPut) {
-				return true
-			}
-			if user.CoursesAsStudent.Contains(courseKey) && r.Method == http.MethodGet {
-				return true
-			}
-		}
-		return false
-	})
+	reconcilePath := fmt.Sprintf("%s/reconcile", specificCoursePath)
+	coursesRouter.HandleFunc(reconcilePath, handleReconcileCourse).Methods(http.MethodGet, http.MethodPost)
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/[^/]+/[^/]+/reconcile$", coursesBasePath)), newPolicy("course reconciliation", nil, allow(relationAdmin), allow(relationSecretary)))
+	rosterPath := fmt.Sprintf("%s/roster", specificCoursePath)
+	coursesRouter.HandleFunc(rosterPath, handleImportRoster).Methods(http.MethodPost)
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/[^/]+/[^/]+/roster$", coursesBasePath)), newPolicy("course roster", nil, allow(relationAdmin), allow(relationSecretary)))
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", coursesBasePath)), newPolicy("course", resolveExistingCourseFromPath,
+		allow(relationAdmin),
+		allow(relationSecretary),
+		allow(relationCourseStaff, http.MethodGet).when(isStandardUser),
+		allowWithPermission(courses.ManageRoster, http.MethodPut).when(isStandardUser),
+		allow(relationCourseStudent, http.MethodGet).when(isStandardUser),
+	))
 }
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/emails"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// render an email of the given kind and queue it for delivery to the given user according to his preferences
+func queueEmail(userName, kind string, data *mail.TemplateData) error {
+	if mail.GetTransport() == nil {
+		return nil
+	}
+	user, err := users.Get(userName)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" || user.EmailPreference == users.EmailNone {
+		return nil
+	}
+	data.UserName = user.UserName
+	subject, body, err := mail.Render(kind, data)
+	if err != nil {
+		return err
+	}
+	_, err = emails.New(user.UserName, user.Email, subject, body, user.EmailPreference == users.EmailDailyDigest, db.System, true)
+	return err
+}
+
+// handle events published by the DB, queueing emails for the relevant ones in a separate goroutine
+func handleDbEventForEmails(event *db.Event) {
+	if event.Action == db.Deleted || mail.GetTransport() == nil {
+		return
+	}
+	switch event.Bucket {
+		case db.AssignmentInstances, db.MessageBoxes, db.Appeals:
+			go func() {
+				if err := processDbEventForEmails(event); err != nil {
+					logger.WithError(err).Errorf("email notifications: error processing event for key == %s in %s bucket", event.Key, event.Bucket)
+				}
+			}()
+	}
+}
+
+// queue emails about the given new announcements in the given course to their recipients
+func queueAnnouncementEmails(course *courses.Course, newMessages []string) error {
+	for _, msgId := range newMessages {
+		msg, err := messages.GetMessage(msgId)
+		if err != nil {
+			return err
+		}
+		recipients, err := getAnnouncementRecipients(course, msg)
+		if err != nil {
+			return err
+		}
+		for _, recipient := range recipients.Slice() {
+			if recipient == msg.From {
+				continue
+			}
+			if err := queueEmail(recipient, mail.CourseAnnouncement, &mail.TemplateData{Course: string(course.Key()), Message: msg.Text}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// queue emails about published, graded and copied assignments, course announcements, replies to appeals and their
+// resolutions
+func processDbEventForEmails(event *db.Event) error {
+	if event.Bucket == db.Appeals {
+		appeal, err := resolvedAppeal(event)
+		if err != nil || appeal == nil {
+			return err
+		}
+		assInst, err := assignments.GetInstance(appeal.AssignmentInstance)
+		if err != nil {
+			return err
+		}
+		return queueEmail(assInst.UserName, mail.AppealResolved, &mail.TemplateData{Assignment: assInst.AssignmentDef, Grade: appeal.Resolution.Grade,
+			Outcome: strings.ReplaceAll(appeal.Resolution.Outcome, "_", " "), Message: appeal.Resolution.Comment})
+	}
+	if event.Bucket == db.MessageBoxes {
+		box, newMessages, err := newMessagesInBox(event)
+		if err != nil || len(newMessages) == 0 {
+			return err
+		}
+		course, err := getCourseByMessageBox(box.ID)
+		if err != nil {
+			return err
+		}
+		if course != nil {
+			return queueAnnouncementEmails(course, newMessages)
+		}
+		appeal, err := getAppealByMessageBox(box.ID)
+		if err != nil || appeal == nil {
+			return err
+		}
+		assInst, err := assignments.GetInstance(appeal.AssignmentInstance)
+		if err != nil {
+			return err
+		}
+		if event.AsUser == assInst.UserName { // the owner of the assignment wrote this, so it isn't a reply
+			return nil
+		}
+		for _, msgId := range newMessages {
+			msgBytes, err := db.GetFromBucket([]byte(db.Messages), []byte(msgId))
+			if err != nil {
+				return err
+			}
+			msg := &messages.Message{}
+			if err := json.Unmarshal(msgBytes, msg); err != nil {
+				return err
+			}
+			if err := queueEmail(assInst.UserName, mail.AppealReply, &mail.TemplateData{Assignment: assInst.AssignmentDef, Message: msg.Text}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	assInst, previousAssInst := &assignments.AssignmentInstance{}, &assignments.AssignmentInstance{}
+	if err := json.Unmarshal(event.Data, assInst); err != nil {
+		return err
+	}
+	data := &mail.TemplateData{Assignment: assInst.AssignmentDef, DueBy: assInst.DueBy, Grade: assInst.Grade}
+	if event.Action == db.Inserted {
+		return queueEmail(assInst.UserName, mail.AssignmentPublished, data)
+	}
+	if err := json.Unmarshal(event.Previous, previousAssInst); err != nil {
+		return err
+	}
+	if assInst.State == assignments.Graded && previousAssInst.State != assignments.Graded {
+		if err := queueEmail(assInst.UserName, mail.GradeReleased, data); err != nil {
+			return err
+		}
+	}
+	if assInst.MarkedAsCopy && !previousAssInst.MarkedAsCopy {
+		return queueEmail(assInst.UserName, mail.CopyDetected, data)
+	}
+	return nil
+}
+
+// deliver the given emails (all to the same address) as a single email. On failure, the delivery is retried later
+// with an increasing delay until it's given up on
+func deliverEmails(now time.Time, subject, body string, toDeliver []*emails.Email) {
+	to := toDeliver[0].To
+	var elements []db.IBucketElement
+	for _, email := range toDeliver {
+		elements = append(elements, email)
+	}
+	err := mail.GetTransport().Send(to, subject, body)
+	if err == nil {
+		if err := db.Delete(elements...); err != nil {
+			logger.WithError(err).Error("emails monitor: error deleting delivered emails")
+		}
+		return
+	}
+	logger.WithError(err).Warnf("emails monitor: error delivering email to %s", to)
+	for _, email := range toDeliver {
+		email.Attempts++
+		email.LastError = err.Error()
+		email.NextAttempt = now.Add(time.Duration(email.Attempts * email.Attempts) * emailRetryDelay)
+	}
+	if toDeliver[0].Attempts >= maxEmailDeliveryAttempts {
+		logger.Errorf("emails monitor: giving up on delivering email to %s after %d attempts", to, toDeliver[0].Attempts)
+		if err := db.Delete(elements...); err != nil {
+			logger.WithError(err).Error("emails monitor: error deleting undeliverable emails")
+		}
+		return
+	}
+	if err := db.Update(db.System, elements...); err != nil {
+		logger.WithError(err).Error("emails monitor: error updating emails after failed delivery")
+	}
+}
+
+// deliver queued emails. Digest emails of a user are delivered together once the oldest of them is a day old
+func processEmails() {
+	if mail.GetTransport() == nil {
+		return
+	}
+	now := time.Now().UTC()
+	var immediate []*emails.Email
+	digests := make(map[string][]*emails.Email)
+	if err := db.QueryBucket([]byte(db.Emails), func(_, elemBytes []byte) error {
+		email := &emails.Email{}
+		if err := json.Unmarshal(elemBytes, email); err != nil {
+			return err
+		}
+		if email.Digest {
+			digests[email.UserName] = append(digests[email.UserName], email)
+		} else if !email.NextAttempt.After(now) {
+			immediate = append(immediate, email)
+		}
+		return nil
+	}); err != nil {
+		logger.WithError(err).Error("emails monitor: error querying for emails to deliver")
+		return
+	}
+	for _, email := range immediate {
+		deliverEmails(now, email.Subject, email.Body, []*emails.Email{email})
+	}
+	for userName, digest := range digests {
+		sort.Slice(digest, func(i, j int) bool {
+			return digest[i].CreatedOn.Before(digest[j].CreatedOn)
+		})
+		if now.Sub(digest[0].CreatedOn) < emailDigestPeriod || digest[0].NextAttempt.After(now) {
+			continue
+		}
+		var body strings.Builder
+		body.WriteString(fmt.Sprintf("Hello %s,\n\nhere is your daily Submit digest:\n", userName))
+		for _, email := range digest {
+			body.WriteString(fmt.Sprintf("\n* %s\n\n%s", email.Subject, email.Body))
+		}
+		deliverEmails(now, fmt.Sprintf("Submit: daily digest (%d notifications)", len(digest)), body.String(), digest)
+	}
+}
+
+// deliver queued emails each minute
+func emailsMonitor(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	processEmails()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+			case <- ticker.C:
+				processEmails()
+			case <- ctx.Done():
+				logger.Info("stopping emails monitor")
+				return
+		}
+	}
+}
+
+func initEmailNotifications(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go emailsMonitor(ctx, wg)
+}
+
+func init() {
+	db.Subscribe(handleDbEventForEmails)
+}
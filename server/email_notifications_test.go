@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/emails"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a transport recording the emails it was asked to send
+type fakeTransport struct {
+	sent	[]string
+	fail	bool
+	mutex	sync.Mutex
+}
+
+func (t *fakeTransport) Send(to, subject, body string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.fail {
+		return errors.New("delivery failure")
+	}
+	t.sent = append(t.sent, strings.Join([]string{to, subject, body}, "\n"))
+	return nil
+}
+
+func getQueuedEmails(t *testing.T) []*emails.Email {
+	var queued []*emails.Email
+	if err := db.QueryBucket([]byte(db.Emails), func(_, elemBytes []byte) error {
+		email := &emails.Email{}
+		if err := json.Unmarshal(elemBytes, email); err != nil {
+			return err
+		}
+		queued = append(queued, email)
+		return nil
+	}); err != nil {
+		t.Fatalf("error querying emails bucket: %v", err)
+	}
+	return queued
+}
+
+func TestEmailNotifications(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	transport := &fakeTransport{}
+	mail.SetTransport(transport)
+	defer mail.SetTransport(nil)
+	for _, pref := range []string{users.EmailImmediate, users.EmailDailyDigest, users.EmailNone} {
+		if _, err := users.NewUserBuilder(db.System, true).WithUserName(pref).WithPassword(pref).WithEmail(pref + "@localhost").
+			WithEmailPreference(pref).WithRoles(users.StandardUser).Build(); err != nil {
+			t.Fatalf("error creating user for email notifications test: %v", err)
+		}
+	}
+	data := &mail.TemplateData{Assignment: "ass", Grade: 90}
+	// emails to users who don't want them aren't queued
+	if err := queueEmail(users.EmailNone, mail.GradeReleased, data); err != nil {
+		t.Fatalf("error queueing email: %v", err)
+	}
+	if queued := getQueuedEmails(t); len(queued) != 0 {
+		t.Fatalf("expected no emails to be queued but %d were", len(queued))
+	}
+	// failed deliveries are retried later
+	transport.fail = true
+	if err := queueEmail(users.EmailImmediate, mail.GradeReleased, data); err != nil {
+		t.Fatalf("error queueing email: %v", err)
+	}
+	processEmails()
+	queued := getQueuedEmails(t)
+	if len(queued) != 1 || queued[0].Attempts != 1 || !queued[0].NextAttempt.After(time.Now().UTC()) {
+		t.Fatal("expected failed email delivery to be scheduled for a retry")
+	}
+	transport.fail = false
+	queued[0].NextAttempt = time.Now().UTC()
+	if err := db.Update(db.System, queued[0]); err != nil {
+		t.Fatalf("error updating email for test: %v", err)
+	}
+	processEmails()
+	if len(transport.sent) != 1 || !strings.Contains(transport.sent[0], "Your grade is 90.") {
+		t.Fatalf("expected grade released email to be delivered but got: %v", transport.sent)
+	}
+	if queued := getQueuedEmails(t); len(queued) != 0 {
+		t.Fatal("expected delivered email to be removed from the queue")
+	}
+	// digests are delivered once a day as a single email
+	for i := 0; i < 2; i++ {
+		if err := queueEmail(users.EmailDailyDigest, mail.GradeReleased, data); err != nil {
+			t.Fatalf("error queueing email: %v", err)
+		}
+	}
+	processEmails()
+	if len(transport.sent) != 1 {
+		t.Fatal("expected digest not to be delivered before it's a day old")
+	}
+	queued = getQueuedEmails(t)
+	queued[0].CreatedOn = time.Now().UTC().Add(-2 * emailDigestPeriod)
+	if err := db.Update(db.System, queued[0]); err != nil {
+		t.Fatalf("error updating email for test: %v", err)
+	}
+	processEmails()
+	if len(transport.sent) != 2 || strings.Count(transport.sent[1], "Your grade is 90.") != 2 {
+		t.Fatalf("expected a single digest with both notifications to be delivered but got: %v", transport.sent)
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/fs"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// mismatches between the students of a course and the instances of its published assignment defs
+type CourseReconciliation struct {
+	Course		string		`json:"course"`
+	Missing		[]string	`json:"missing"`
+	Dropped		[]string	`json:"dropped"`
+	Restored	[]string	`json:"restored"`
+	Fixed		bool		`json:"fixed"`
+}
+
+func (c *CourseReconciliation) String() string {
+	return _stringForResp(c)
+}
+
+// a roster of students and staff members of a course to import. Users which don't exist yet are created as standard
+// users
+type Roster struct {
+	Students	[]*users.User	`json:"students"`
+	Staff		[]*users.User	`json:"staff"`
+}
+
+// result of importing a roster
+type RosterImport struct {
+	Course		string		`json:"course"`
+	Created		[]string	`json:"created"`
+	Enrolled	[]string	`json:"enrolled"`
+	Unchanged	[]string	`json:"unchanged"`
+}
+
+func (ri *RosterImport) String() string {
+	return _stringForResp(ri)
+}
+
+// error indicating a roster which can't be imported
+type ErrInvalidRoster struct {
+	Message	string
+}
+
+func (e *ErrInvalidRoster) Error() string {
+	return fmt.Sprintf("invalid roster: %s", e.Message)
+}
+
+// find the mismatches between the students of the given course and the instances of its published assignment defs and
+// fix them if requested: instances are created for students who don't have one yet, instances of users who aren't
+// students of the course anymore are archived and archived instances of users who are students again are restored.
+// Instances aren't created for assignment defs which are already past their due date
+func reconcileCourse(courseKey string, asUser string, fix bool) (*CourseReconciliation, error) {
+	var assDefs []*assignments.AssignmentDef
+	if err := db.QueryBucket([]byte(db.AssignmentDefinitions), func(_, elemBytes []byte) error {
+		assDef := &assignments.AssignmentDef{}
+		if err := json.Unmarshal(elemBytes, assDef); err != nil {
+			return err
+		}
+		if assDef.Course == courseKey && assDef.State == assignments.Published {
+			assDefs = append(assDefs, assDef)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	students := containers.NewStringSet()
+	if err := db.QueryBucket([]byte(db.Users), func(_, elemBytes []byte) error {
+		user := &users.User{}
+		if err := json.Unmarshal(elemBytes, user); err != nil {
+			return err
+		}
+		if user.CoursesAsStudent.Contains(courseKey) {
+			students.Add(user.UserName)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	rec := &CourseReconciliation{Course: courseKey, Missing: []string{}, Dropped: []string{}, Restored: []string{}, Fixed: fix}
+	now := time.Now().UTC()
+	var elementsToUpdate []db.IBucketElement
+	for _, assDef := range assDefs {
+		assInsts, err := getInstancesOfAssignmentDef(string(assDef.Key()))
+		if err != nil {
+			return nil, err
+		}
+		usersWithInst := containers.NewStringSet()
+		for _, assInst := range assInsts {
+			usersWithInst.Add(assInst.UserName)
+			if students.Contains(assInst.UserName) == assInst.Archived {
+				if assInst.Archived {
+					rec.Restored = append(rec.Restored, string(assInst.Key()))
+				} else {
+					rec.Dropped = append(rec.Dropped, string(assInst.Key()))
+				}
+				assInst.Archived = !assInst.Archived
+				elementsToUpdate = append(elementsToUpdate, assInst)
+			}
+		}
+		if !assDef.DueBy.After(now) {
+			continue
+		}
+		for _, student := range students.Slice() {
+			if usersWithInst.Contains(student) {
+				continue
+			}
+			assInst, err := assignments.NewInstance(assDef.Course, assDef.DueBy, assDef.Name, student, asUser, false, fix && fs.GetClient() != nil)
+			if err != nil {
+				return nil, err
+			}
+			rec.Missing = append(rec.Missing, string(assInst.Key()))
+			elementsToUpdate = append(elementsToUpdate, assInst)
+		}
+	}
+	sort.Strings(rec.Missing)
+	sort.Strings(rec.Dropped)
+	sort.Strings(rec.Restored)
+	if fix && len(elementsToUpdate) > 0 {
+		if err := db.Update(asUser, elementsToUpdate...); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// reconcile the instances of the courses the given user was enrolled to or dropped from
+func reconcileEnrollmentChanges(preUpdateCourses, postUpdateCourses *containers.StringSet, asUser string) error {
+	changedCourses := containers.NewStringSet()
+	for _, course := range preUpdateCourses.Slice() {
+		if !postUpdateCourses.Contains(course) {
+			changedCourses.Add(course)
+		}
+	}
+	for _, course := range postUpdateCourses.Slice() {
+		if !preUpdateCourses.Contains(course) {
+			changedCourses.Add(course)
+		}
+	}
+	for _, course := range changedCourses.Slice() {
+		if _, err := reconcileCourse(course, asUser, true); err != nil {
+			return fmt.Errorf("error reconciling assignment instances of course '%s': %v", course, err)
+		}
+	}
+	return nil
+}
+
+// report the mismatches between the students of a course and the instances of its assignments. The mismatches are also
+// fixed when requested with POST
+func handleReconcileCourse(w http.ResponseWriter, r *http.Request) {
+	number, year, err := getCourseNumberAndYearFromRequest(r)
+	if err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, errors.New("invalid course number and/or year integer path params"))
+		return
+	}
+	course, err := courses.Get(fmt.Sprintf("%d%s%d", number, db.KeySeparator, year))
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			writeErrResp(w, r, http.StatusNotFound, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	rec, err := reconcileCourse(string(course.Key()), r.Context().Value(authenticatedUser).(*users.User).UserName, r.Method == http.MethodPost)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, rec)
+}
+
+// import the given roster to the course with the given key. Existing users are enrolled to the course and users who
+// don't exist yet are created and enrolled to the course. Only users the given user can manage can be enrolled
+func importRoster(courseKey string, roster *Roster, asUser *users.User) (*RosterImport, error) {
+	ri := &RosterImport{Course: courseKey, Created: []string{}, Enrolled: []string{}, Unchanged: []string{}}
+	var elementsToUpdate []db.IBucketElement
+	seen := containers.NewStringSet()
+	studentsEnrolled := false
+	for _, asStaff := range []bool{false, true} {
+		entries := roster.Students
+		if asStaff {
+			entries = roster.Staff
+		}
+		for _, entry := range entries {
+			if seen.Contains(entry.UserName) {
+				return nil, &ErrInvalidRoster{Message: fmt.Sprintf("user \"%s\" appears more than once in the roster", entry.UserName)}
+			}
+			seen.Add(entry.UserName)
+			user, err := users.Get(entry.UserName)
+			if err != nil {
+				if _, ok := err.(*db.ErrKeyNotFoundInBucket); !ok {
+					return nil, err
+				}
+				builder := users.NewUserBuilder(asUser.UserName, false).WithUserName(entry.UserName).WithFirstName(entry.FirstName).
+					WithLastName(entry.LastName).WithPassword(entry.Password).WithEmail(entry.Email).WithRoles(users.StandardUser)
+				if asStaff {
+					builder.WithCoursesAsStaff(courseKey)
+				} else {
+					builder.WithCoursesAsStudent(courseKey)
+				}
+				if user, err = builder.Build(); err != nil {
+					return nil, &ErrInvalidRoster{Message: err.Error()}
+				}
+				messageBox := messages.NewMessageBox()
+				user.MessageBox = messageBox.ID
+				elementsToUpdate = append(elementsToUpdate, messageBox, user)
+				ri.Created = append(ri.Created, user.UserName)
+				studentsEnrolled = studentsEnrolled || !asStaff
+				continue
+			}
+			if !canManageUsersWithRoles(asUser, user.Roles) {
+				return nil, &ErrInvalidRoster{Message: fmt.Sprintf("enrollment of user \"%s\" is forbidden", user.UserName)}
+			}
+			if user.CoursesAsStudent == nil {
+				user.CoursesAsStudent = containers.NewStringSet()
+			}
+			if user.CoursesAsStaff == nil {
+				user.CoursesAsStaff = containers.NewStringSet()
+			}
+			enrolledAs, otherwise := user.CoursesAsStudent, user.CoursesAsStaff
+			if asStaff {
+				enrolledAs, otherwise = otherwise, enrolledAs
+			}
+			if enrolledAs.Contains(courseKey) {
+				ri.Unchanged = append(ri.Unchanged, user.UserName)
+				continue
+			}
+			if otherwise.Contains(courseKey) {
+				return nil, &ErrInvalidRoster{Message: fmt.Sprintf("user \"%s\" can't be a staff member and a student in the same course", user.UserName)}
+			}
+			enrolledAs.Add(courseKey)
+			elementsToUpdate = append(elementsToUpdate, user)
+			ri.Enrolled = append(ri.Enrolled, user.UserName)
+			studentsEnrolled = studentsEnrolled || !asStaff
+		}
+	}
+	sort.Strings(ri.Created)
+	sort.Strings(ri.Enrolled)
+	sort.Strings(ri.Unchanged)
+	if len(elementsToUpdate) == 0 {
+		return ri, nil
+	}
+	if err := db.Update(asUser.UserName, elementsToUpdate...); err != nil {
+		return nil, err
+	}
+	if studentsEnrolled {
+		if _, err := reconcileCourse(courseKey, asUser.UserName, true); err != nil {
+			return nil, fmt.Errorf("error reconciling assignment instances of course '%s': %v", courseKey, err)
+		}
+	}
+	return ri, nil
+}
+
+// import a roster of students and staff members to a course
+func handleImportRoster(w http.ResponseWriter, r *http.Request) {
+	number, year, err := getCourseNumberAndYearFromRequest(r)
+	if err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, errors.New("invalid course number and/or year integer path params"))
+		return
+	}
+	course, err := courses.Get(fmt.Sprintf("%d%s%d", number, db.KeySeparator, year))
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			writeErrResp(w, r, http.StatusNotFound, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	roster := &Roster{}
+	if err := json.NewDecoder(r.Body).Decode(roster); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ri, err := importRoster(string(course.Key()), roster, r.Context().Value(authenticatedUser).(*users.User))
+	if err != nil {
+		if _, ok := err.(*ErrInvalidRoster); ok {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	writeResponse(w, r, http.StatusAccepted, ri)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/session"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEnrollmentReconciliation(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	cleanupSess := session.InitSessionForTest()
+	defer cleanupSess()
+	if err := users.InitDefaultAdmin(); err != nil {
+		t.Fatalf("error initialiting admin user for test: %v", err)
+	}
+	if _, err := users.NewUserBuilder(db.System, true).WithUserName(users.Secretary).WithPassword(users.Secretary).WithRoles(users.Secretary).Build(); err != nil {
+		t.Fatalf("error creating secretary user for test: %v", err)
+	}
+	course := &courses.Course{Number: 1, Year: 2020, Name: "course", Files: containers.NewStringSet()}
+	if err := db.Update(db.System, course); err != nil {
+		t.Fatalf("error creating course for test: %v", err)
+	}
+	courseKey := string(course.Key())
+	for _, student := range []string{"s1", "s2"} {
+		if _, err := users.NewUserBuilder(db.System, true).WithUserName(student).WithPassword(student).WithRoles(users.StandardUser).
+			WithCoursesAsStudent(courseKey).Build(); err != nil {
+			t.Fatalf("error creating user for test: %v", err)
+		}
+	}
+	if _, err := users.NewUserBuilder(db.System, true).WithUserName("s3").WithPassword("s3").WithRoles(users.StandardUser).Build(); err != nil {
+		t.Fatalf("error creating user for test: %v", err)
+	}
+	assDef, err := assignments.NewDef(courseKey, time.Now().UTC().Add(time.Hour), "ass", db.System, true, false)
+	if err != nil {
+		t.Fatalf("error creating assignment def for test: %v", err)
+	}
+	if err := publishAssignmentDef(assDef, db.System); err != nil {
+		t.Fatalf("error publishing assignment def for test: %v", err)
+	}
+	assDefKey := string(assDef.Key())
+	router := newTestRouter(t)
+	initUsersRouter(router.Router, router.am)
+	initCoursesRouter(router.Router, router.am)
+	// s3 enrolls and s1 drops the course after the assignment was published
+	updates := map[string]*containers.StringSet{"s1": containers.NewStringSet(), "s3": containers.NewStringSet()}
+	updates["s3"].Add(courseKey)
+	for userName, coursesAsStudent := range updates {
+		body, err := json.Marshal(&users.User{CoursesAsStudent: coursesAsStudent})
+		if err != nil {
+			t.Fatalf("error serializing user for test: %v", err)
+		}
+		if w := router.send(http.MethodPut, fmt.Sprintf("/%s/%s", db.Users, userName), string(body), users.Admin); w.Code != http.StatusAccepted {
+			t.Fatalf("updating user %s produced status code %d instead of %d", userName, w.Code, http.StatusAccepted)
+		}
+	}
+	expectedArchived := map[string]bool{"s1": true, "s2": false, "s3": false}
+	for student, archived := range expectedArchived {
+		assInst, err := assignments.GetInstance(assDefKey + db.KeySeparator + student)
+		if err != nil {
+			t.Fatalf("expected an assignment instance for %s: %v", student, err)
+		}
+		if assInst.Archived != archived {
+			t.Fatalf("expected archived of the assignment instance of %s to be %v", student, archived)
+		}
+	}
+	// mismatches are reported by GET and fixed by POST, by admins and secretaries only
+	if err := db.DeleteKeysFromBucket([]byte(db.AssignmentInstances), []byte(assDefKey + db.KeySeparator + "s2")); err != nil {
+		t.Fatalf("error deleting assignment instance for test: %v", err)
+	}
+	reconcilePath := fmt.Sprintf("/%s/%d/%d/reconcile", db.Courses, course.Number, course.Year)
+	if w := router.send(http.MethodGet, reconcilePath, "", "s2"); w.Code != http.StatusForbidden {
+		t.Fatalf("reconciliation by student produced status code %d instead of %d", w.Code, http.StatusForbidden)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w := router.send(method, reconcilePath, "", users.Admin)
+		if w.Code != http.StatusOK {
+			t.Fatalf("reconciliation with %s produced status code %d instead of %d", method, w.Code, http.StatusOK)
+		}
+		rec := &CourseReconciliation{}
+		if err := json.NewDecoder(w.Body).Decode(rec); err != nil {
+			t.Fatalf("error parsing reconciliation response: %v", err)
+		}
+		if len(rec.Missing) != 1 || rec.Missing[0] != assDefKey + db.KeySeparator + "s2" || len(rec.Dropped) != 0 || len(rec.Restored) != 0 {
+			t.Fatalf("unexpected reconciliation response: %+v", rec)
+		}
+	}
+	if _, err := assignments.GetInstance(assDefKey + db.KeySeparator + "s2"); err != nil {
+		t.Fatalf("expected missing assignment instance to be created: %v", err)
+	}
+}
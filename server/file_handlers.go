@@ -393,6 +393,10 @@ func handlePostFileForAssignmentInst(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if ass.Archived {
+		writeStrErrResp(w, r, http.StatusBadRequest, "can't upload file for an archived assignment instance")
+		return
+	}
 	if ass.State == assignments.Submitted {
 		writeStrErrResp(w, r, http.StatusBadRequest, "can't upload file for a submitted assignment instance")
 		return
@@ -477,6 +481,10 @@ func handleDeleteFileForAssignmentInst(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if ass.Archived {
+		writeStrErrResp(w, r, http.StatusBadRequest, "can't delete file for an archived assignment instance")
+		return
+	}
 	if ass.State == assignments.Submitted {
 		writeStrErrResp(w, r, http.StatusBadRequest, "can't delete file for a submitted assignment instance")
 		return
@@ -506,91 +514,51 @@ func handleDeleteFileForAssignmentInst(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, r, http.StatusAccepted, &Response{Message: "file deleted successfully"})
 }
 
+// files of assignment instances can be changed only until their due date and as long as they aren't archived
+var isBeforeDueDate = &condition{"the due date of the assignment instance didn't pass and it isn't archived", func(_ *authRequest, res *authResource) bool {
+	ass := res.elem.(*assignments.AssignmentInstance)
+	return !time.Now().UTC().After(ass.DueBy) && !ass.Archived
+}}
+
 func initFilesRouter(r *mux.Router, m *authManager) {
 	router := r.PathPrefix("/files").Subrouter()
 	specificCoursePath := fmt.Sprintf("/%s/{%s}/{%s}", db.Courses, courseNumber, courseYear)
 	router.HandleFunc(specificCoursePath, handleGetFileForCourse).Methods(http.MethodGet)
 	router.HandleFunc(specificCoursePath, handlePostFileForCourse).Methods(http.MethodPost)
 	router.HandleFunc(specificCoursePath, handleDeleteFileForCourse).Methods(http.MethodDelete)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^/files/%s/.", db.Courses)), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) || user.Roles.Contains(users.Secretary) {
-			return true
-		}
-		cNumber, cYear, err := getCourseNumberAndYearFromRequest(request)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		courseKey := fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear)
-		if request.Method == http.MethodGet {
-			return user.CoursesAsStaff.Contains(courseKey) || user.CoursesAsStudent.Contains(courseKey)
-		} else if request.Method == http.MethodPost || request.Method == http.MethodDelete {
-			return user.CoursesAsStaff.Contains(courseKey)
-		}
-		return false
-	})
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^/files/%s/.", db.Courses)), newPolicy("course files", resolveCourseFromPath,
+		allow(relationAdmin),
+		allow(relationSecretary),
+		allow(relationCourseStaff, http.MethodGet),
+		allow(relationCourseStudent, http.MethodGet),
+		allowWithPermission(courses.PublishAssignment, http.MethodPost, http.MethodDelete),
+	))
 	specificAssDefPath := fmt.Sprintf("/%s/{%s}/{%s}/{%s}", db.AssignmentDefinitions, courseNumber, courseYear, assDefName)
 	router.HandleFunc(specificAssDefPath, handleGetFileForAssignmentDef).Methods(http.MethodGet)
 	router.HandleFunc(specificAssDefPath, handlePostFileForAssignmentDef).Methods(http.MethodPost)
 	router.HandleFunc(specificAssDefPath, handleDeleteFileForAssignmentDef).Methods(http.MethodDelete)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^/files/%s/.", db.AssignmentDefinitions)), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		cNumber, cYear, err := getCourseNumberAndYearFromRequest(request)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		return user.CoursesAsStaff.Contains(fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear))
-	})
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^/files/%s/.", db.AssignmentDefinitions)), newPolicy("assignment def files", resolveCourseFromPath,
+		allow(relationAdmin),
+		allow(relationCourseStaff, http.MethodGet),
+		allowWithPermission(courses.PublishAssignment),
+	))
 	specificAssInstPath := fmt.Sprintf("/%s/{%s}/{%s}/{%s}/{%s}", db.AssignmentInstances, courseNumber, courseYear, assDefName, userName)
 	router.HandleFunc(specificAssInstPath, handleGetFileForAssignmentInst).Methods(http.MethodGet)
 	router.HandleFunc(specificAssInstPath, handlePostFileForAssignmentInst).Methods(http.MethodPost)
 	router.HandleFunc(specificAssInstPath, handleDeleteFileForAssignmentInst).Methods(http.MethodDelete)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^/files/%s/.", db.AssignmentInstances)), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		if request.Method == http.MethodPost || request.Method == http.MethodDelete {
-			assInstKey, err := getAssInstKey(request)
-			if err != nil {
-				return true // let the next handler send an appropriate error message
-			}
-			ass, err := assignments.GetInstance(assInstKey)
-			if err != nil {
-				return true // let the next handler send an appropriate error message
-			}
-			return mux.Vars(request)[userName] == user.UserName && !time.Now().UTC().After(ass.DueBy)
-		}
-		cNumber, cYear, err := getCourseNumberAndYearFromRequest(request)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		return request.Method == http.MethodGet && user.CoursesAsStaff.Contains(fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear))
-	})
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^/files/%s/.", db.AssignmentInstances)), newPolicy("assignment instance files", resolveAssInstFromPath,
+		allow(relationAdmin),
+		allow(relationCourseStaff, http.MethodGet),
+		allow(relationOwner, http.MethodPost, http.MethodDelete).when(isBeforeDueDate),
+	))
 	specificTestPath := fmt.Sprintf("/%s/{%s}/{%s}/{%s}/{%s}", db.Tests, courseNumber, courseYear, assDefName, testName)
 	router.HandleFunc(specificTestPath, handleGetFileForTest).Methods(http.MethodGet)
 	router.HandleFunc(specificTestPath, handlePostFileForTest).Methods(http.MethodPost)
 	router.HandleFunc(specificTestPath, handleDeleteFileForTest).Methods(http.MethodDelete)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^/files/%s/.", db.Tests)), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		cNumber, cYear, err := getCourseNumberAndYearFromRequest(request)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		courseKey := fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear)
-		if user.CoursesAsStaff.Contains(courseKey) {
-			return true
-		}
-		testKey, err := getTestKey(request)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		test, err := tests.Get(testKey)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		return test.CreatedBy == user.UserName
-	})
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^/files/%s/.", db.Tests)), newPolicy("test files", resolveTestFromPath,
+		allow(relationAdmin),
+		allow(relationCourseStaff, http.MethodGet),
+		allowWithPermission(courses.EditTests),
+		allow(relationOwner),
+	))
 }
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	submithttp "github.com/DAv10195/submit_commons/http"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/forum"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// return the assignment definition whose forum is in the path of the request. Students can't access the forums of
+// assignments which weren't published yet. If it can't be accessed, an error response is written and nil is returned
+func getForumAssDef(w http.ResponseWriter, r *http.Request) *assignments.AssignmentDef {
+	assKey, err := getAssDefKey(r)
+	if err != nil {
+		writeStrErrResp(w, r, http.StatusBadRequest, "invalid course number and/or year integer path params")
+		return nil
+	}
+	assDef, err := assignments.GetDef(assKey)
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			writeErrResp(w, r, http.StatusNotFound, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return nil
+	}
+	if assDef.State == assignments.Draft && !isForumStaff(r.Context().Value(authenticatedUser).(*users.User), assDef) {
+		writeErrResp(w, r, http.StatusNotFound, &db.ErrKeyNotFoundInBucket{Key: assKey, Bucket: db.AssignmentDefinitions})
+		return nil
+	}
+	return assDef
+}
+
+// return the post with the id in the path of the request from the forum of the given assignment definition. If it
+// can't be found, an error response is written and nil is returned
+func getForumPost(w http.ResponseWriter, r *http.Request, assDef *assignments.AssignmentDef) *forum.Post {
+	postId := mux.Vars(r)[forumPostId]
+	post, err := forum.Get(postId)
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			writeErrResp(w, r, http.StatusNotFound, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return nil
+	}
+	if post.AssignmentDef != string(assDef.Key()) {
+		writeErrResp(w, r, http.StatusNotFound, &db.ErrKeyNotFoundInBucket{Key: postId, Bucket: db.ForumPosts})
+		return nil
+	}
+	return post
+}
+
+// check if the given user is an admin or a staff member of the course of the given assignment definition
+func isForumStaff(user *users.User, assDef *assignments.AssignmentDef) bool {
+	return user.Roles.Contains(users.Admin) || (user.CoursesAsStaff != nil && user.CoursesAsStaff.Contains(assDef.Course))
+}
+
+// a question in the forum and its answers
+type ForumThread struct {
+	Question	*PublicPost		`json:"question"`
+	Answers		[]*PublicPost	`json:"answers"`
+}
+
+func (t *ForumThread) String() string {
+	return _stringForResp(t)
+}
+
+// list the questions in the forum of an assignment, pinned questions first. Questions can be searched by a query
+// matching the question or one of its answers and filtered by whether they're answered
+func handleGetForumQuestions(w http.ResponseWriter, r *http.Request) {
+	params, err := submithttp.PagingParamsFromRequest(r)
+	if err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
+		return
+	}
+	assDef := getForumAssDef(w, r)
+	if assDef == nil {
+		return
+	}
+	query := r.URL.Query()
+	searchQuery := query.Get(forumSearchParam)
+	var answered *bool
+	if answeredStr := query.Get(forumAnsweredParam); answeredStr != "" {
+		answeredVal, err := strconv.ParseBool(answeredStr)
+		if err != nil {
+			writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("invalid '%s' query param", forumAnsweredParam))
+			return
+		}
+		answered = &answeredVal
+	}
+	questions, err := forum.ListQuestions(string(assDef.Key()))
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var elements []db.IBucketElement
+	var elementsIndex int64
+	for _, question := range questions {
+		if answered != nil && question.Answered != *answered {
+			continue
+		}
+		if searchQuery != "" && !question.Matches(searchQuery) {
+			answers, err := forum.ListAnswers(question)
+			if err != nil {
+				writeErrResp(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			matches := false
+			for _, answer := range answers {
+				matches = matches || answer.Matches(searchQuery)
+			}
+			if !matches {
+				continue
+			}
+		}
+		elementsIndex++
+		if elementsIndex <= params.AfterId {
+			continue
+		}
+		if int64(len(elements)) == params.Limit {
+			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
+			break
+		}
+		elements = append(elements, question)
+	}
+	writeElements(w, r, http.StatusOK, elements)
+}
+
+// a new question or answer in the forum of an assignment
+type ForumPostRequest struct {
+	Title		string	`json:"title"`
+	Text		string	`json:"text"`
+	Anonymous	bool	`json:"anonymous"`
+}
+
+func handleCreateForumQuestion(w http.ResponseWriter, r *http.Request) {
+	assDef := getForumAssDef(w, r)
+	if assDef == nil {
+		return
+	}
+	pr := &ForumPostRequest{}
+	if err := json.NewDecoder(r.Body).Decode(pr); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	question, err := forum.NewQuestion(string(assDef.Key()), r.Context().Value(authenticatedUser).(*users.User).UserName, pr.Title, pr.Text,
+		pr.Anonymous, true)
+	if err != nil {
+		if _, ok := err.(*forum.ErrInvalidPost); ok {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	writeElem(w, r, http.StatusAccepted, question)
+}
+
+func handleGetForumQuestion(w http.ResponseWriter, r *http.Request) {
+	assDef := getForumAssDef(w, r)
+	if assDef == nil {
+		return
+	}
+	question := getForumPost(w, r, assDef)
+	if question == nil {
+		return
+	}
+	if !question.IsQuestion() {
+		writeStrErrResp(w, r, http.StatusNotFound, "post isn't a question")
+		return
+	}
+	answers, err := forum.ListAnswers(question)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	user := r.Context().Value(authenticatedUser).(*users.User)
+	thread := &ForumThread{Question: publicElem(question, user).(*PublicPost), Answers: []*PublicPost{}}
+	for _, answer := range answers {
+		thread.Answers = append(thread.Answers, publicElem(answer, user).(*PublicPost))
+	}
+	writeResponse(w, r, http.StatusOK, thread)
+}
+
+func handleAnswerForumQuestion(w http.ResponseWriter, r *http.Request) {
+	assDef := getForumAssDef(w, r)
+	if assDef == nil {
+		return
+	}
+	question := getForumPost(w, r, assDef)
+	if question == nil {
+		return
+	}
+	pr := &ForumPostRequest{}
+	if err := json.NewDecoder(r.Body).Decode(pr); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	answer, err := forum.NewAnswer(question, r.Context().Value(authenticatedUser).(*users.User).UserName, pr.Text, pr.Anonymous, true)
+	if err != nil {
+		if _, ok := err.(*forum.ErrInvalidPost); ok {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	writeElem(w, r, http.StatusAccepted, answer)
+}
+
+// delete a post. Posts can be deleted by their authors and by staff members moderating the forum
+func handleDeleteForumPost(w http.ResponseWriter, r *http.Request) {
+	assDef := getForumAssDef(w, r)
+	if assDef == nil {
+		return
+	}
+	post := getForumPost(w, r, assDef)
+	if post == nil {
+		return
+	}
+	user := r.Context().Value(authenticatedUser).(*users.User)
+	if post.Author != user.UserName && !hasCoursePermission(user, assDef.Course, courses.ModerateForum) {
+		writeStrErrResp(w, r, http.StatusForbidden, accessDenied)
+		return
+	}
+	if err := forum.Delete(post, user.UserName); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, &Response{Message: "post deleted successfully"})
+}
+
+// whether a question is pinned
+type ForumPin struct {
+	Pinned	bool	`json:"pinned"`
+}
+
+func handlePinForumQuestion(w http.ResponseWriter, r *http.Request) {
+	assDef := getForumAssDef(w, r)
+	if assDef == nil {
+		return
+	}
+	question := getForumPost(w, r, assDef)
+	if question == nil {
+		return
+	}
+	if !question.IsQuestion() {
+		writeStrErrResp(w, r, http.StatusBadRequest, "only questions can be pinned")
+		return
+	}
+	pin := &ForumPin{}
+	if err := json.NewDecoder(r.Body).Decode(pin); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	question.Pinned = pin.Pinned
+	if err := db.Update(r.Context().Value(authenticatedUser).(*users.User).UserName, question); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeElem(w, r, http.StatusOK, question)
+}
+
+// whether an answer is official
+type ForumOfficialAnswer struct {
+	Official	bool	`json:"official"`
+}
+
+func handleMarkForumAnswerOfficial(w http.ResponseWriter, r *http.Request) {
+	assDef := getForumAssDef(w, r)
+	if assDef == nil {
+		return
+	}
+	answer := getForumPost(w, r, assDef)
+	if answer == nil {
+		return
+	}
+	oa := &ForumOfficialAnswer{}
+	if err := json.NewDecoder(r.Body).Decode(oa); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := forum.SetOfficial(answer, oa.Official, r.Context().Value(authenticatedUser).(*users.User).UserName); err != nil {
+		if _, ok := err.(*forum.ErrInvalidPost); ok {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	writeElem(w, r, http.StatusOK, answer)
+}
+
+func initForumRouter(r *mux.Router, m *authManager) {
+	basePath := "/forum"
+	router := r.PathPrefix(basePath).Subrouter()
+	forumPath := fmt.Sprintf("/{%s}/{%s}/{%s}", courseNumber, courseYear, assDefName)
+	router.HandleFunc(forumPath, handleGetForumQuestions).Methods(http.MethodGet)
+	router.HandleFunc(forumPath, handleCreateForumQuestion).Methods(http.MethodPost)
+	postPath := fmt.Sprintf("%s/{%s}", forumPath, forumPostId)
+	router.HandleFunc(postPath, handleGetForumQuestion).Methods(http.MethodGet)
+	router.HandleFunc(postPath, handleDeleteForumPost).Methods(http.MethodDelete)
+	router.HandleFunc(fmt.Sprintf("%s/answers", postPath), handleAnswerForumQuestion).Methods(http.MethodPost)
+	router.HandleFunc(fmt.Sprintf("%s/pinned", postPath), handlePinForumQuestion).Methods(http.MethodPut)
+	router.HandleFunc(fmt.Sprintf("%s/official", postPath), handleMarkForumAnswerOfficial).Methods(http.MethodPut)
+	// the forum of an assignment is open to the users enrolled in its course
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), newPolicy("forum", resolveExistingCourseFromPath,
+		allow(relationAdmin),
+		allow(relationCourseStaff),
+		allow(relationCourseStudent, http.MethodGet, http.MethodPost, http.MethodDelete),
+	))
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/[^/]+/[^/]+/[^/]+/[^/]+/(pinned|official)$", basePath)), newPolicy("forum moderation", resolveExistingCourseFromPath,
+		allow(relationAdmin),
+		allowWithPermission(courses.ModerateForum),
+	))
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/forum"
+	"github.com/DAv10195/submit_server/elements/users"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForumHandlers(t *testing.T) {
+	_, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	newTestUser(t, "user4", users.StandardUser)
+	year := time.Now().UTC().Year()
+	forumPath := fmt.Sprintf("/forum/1/%d/ass", year)
+	initForumRouter(router.Router, router.am)
+	post := func(path, body, user string) *forum.Post {
+		p := &forum.Post{}
+		router.decode(router.send(http.MethodPost, path, body, user), http.StatusAccepted, p)
+		return p
+	}
+	list := func(query, user string) []*forum.Post {
+		var listed struct {
+			Elements	[]*forum.Post	`json:"elements"`
+		}
+		router.decode(router.send(http.MethodGet, forumPath + query, "", user), http.StatusOK, &listed)
+		return listed.Elements
+	}
+	if w := router.send(http.MethodGet, forumPath, "", "user2"); w.Code != http.StatusNotFound {
+		t.Fatalf("accessing forum of draft assignment produced status code %d instead of %d", w.Code, http.StatusNotFound)
+	}
+	assDef, err := assignments.GetDef(fmt.Sprintf("1:%d:ass", year))
+	if err != nil {
+		t.Fatalf("error getting assignment def for test: %v", err)
+	}
+	assDef.State = assignments.Published
+	if err := db.Update(db.System, assDef); err != nil {
+		t.Fatalf("error publishing assignment def for test: %v", err)
+	}
+	if w := router.send(http.MethodGet, forumPath, "", "user4"); w.Code != http.StatusForbidden {
+		t.Fatalf("accessing forum of another course produced status code %d instead of %d", w.Code, http.StatusForbidden)
+	}
+	if w := router.send(http.MethodPost, forumPath, `{"text":"no title"}`, "user2"); w.Code != http.StatusBadRequest {
+		t.Fatalf("posting question without title produced status code %d instead of %d", w.Code, http.StatusBadRequest)
+	}
+	question := post(forumPath, `{"title":"How to run the tests?","text":"they fail locally","anonymous":true}`, "user2")
+	other := post(forumPath, `{"title":"Is there an extension?"}`, "user3")
+	questionPath := fmt.Sprintf("%s/%s", forumPath, question.ID)
+	// anonymous posts hide their author from other students only
+	for user, author := range map[string]string{"user1": "user2", "user2": "user2", "user3": ""} {
+		thread := &ForumThread{}
+		router.decode(router.send(http.MethodGet, questionPath, "", user), http.StatusOK, thread)
+		if thread.Question.Author != author {
+			t.Fatalf("expected %s to see author '%s' but got '%s'", user, author, thread.Question.Author)
+		}
+	}
+	// no field of the anonymous question names its author, whether it's listed or returned with its answers
+	for _, path := range []string{questionPath, forumPath} {
+		if w := router.send(http.MethodGet, path, "", "user3"); w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"user2"`) {
+			t.Fatalf("anonymous question returned by %s with status code %d names its author: %s", path, w.Code, w.Body.String())
+		}
+	}
+	peerAnswer := post(questionPath + "/answers", `{"text":"try again"}`, "user3")
+	staffAnswer := post(questionPath + "/answers", `{"text":"run them with pytest -v"}`, "user1")
+	testCases := []struct{
+		name	string
+		method	string
+		path	string
+		body	string
+		user	string
+		status	int
+	}{
+		{"test pin question as student", http.MethodPut, fmt.Sprintf("%s/%s/pinned", forumPath, other.ID), `{"pinned":true}`, "user2", http.StatusForbidden},
+		{"test pin question", http.MethodPut, fmt.Sprintf("%s/%s/pinned", forumPath, other.ID), `{"pinned":true}`, "user1", http.StatusOK},
+		{"test mark answer official as student", http.MethodPut, fmt.Sprintf("%s/%s/official", forumPath, staffAnswer.ID), `{"official":true}`, "user2", http.StatusForbidden},
+		{"test mark question official", http.MethodPut, questionPath + "/official", `{"official":true}`, "user1", http.StatusBadRequest},
+		{"test mark answer official", http.MethodPut, fmt.Sprintf("%s/%s/official", forumPath, staffAnswer.ID), `{"official":true}`, "user1", http.StatusOK},
+		{"test delete question of another student", http.MethodDelete, questionPath, "", "user3", http.StatusForbidden},
+		{"test delete answer of another student", http.MethodDelete, fmt.Sprintf("%s/%s", forumPath, peerAnswer.ID), "", "user2", http.StatusForbidden},
+		{"test delete own answer", http.MethodDelete, fmt.Sprintf("%s/%s", forumPath, peerAnswer.ID), "", "user3", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := router.send(tc.method, tc.path, tc.body, tc.user); w.Code != tc.status {
+				t.Fatalf("expected status code %d but got %d", tc.status, w.Code)
+			}
+		})
+	}
+	if questions := list("", "user3"); len(questions) != 2 || questions[0].ID != other.ID || questions[1].Author != "" {
+		t.Fatalf("expected the pinned question first and the anonymous author hidden but got: %+v", questions)
+	}
+	if questions := list("?answered=true", "user3"); len(questions) != 1 || questions[0].ID != question.ID {
+		t.Fatalf("expected only the answered question but got: %+v", questions)
+	}
+	if questions := list("?q=PYTEST", "user3"); len(questions) != 1 || questions[0].ID != question.ID {
+		t.Fatalf("expected the question with a matching answer but got: %+v", questions)
+	}
+	// deleting the official answer leaves the question unanswered
+	if w := router.send(http.MethodDelete, fmt.Sprintf("%s/%s", forumPath, staffAnswer.ID), "", "user1"); w.Code != http.StatusOK {
+		t.Fatalf("deleting answer produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	if questions := list("?answered=true", "user3"); len(questions) != 0 {
+		t.Fatalf("expected no answered questions but got: %+v", questions)
+	}
+	// the forum is deleted with its assignment
+	if err := assignments.DeleteDef(assDef, false); err != nil {
+		t.Fatalf("error deleting assignment def: %v", err)
+	}
+	if exists, err := db.KeyExistsInBucket([]byte(db.ForumPosts), []byte(other.ID)); err != nil || exists {
+		t.Fatalf("expected forum posts to be deleted with the assignment (err: %v)", err)
+	}
+}
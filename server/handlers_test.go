@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/session"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// router with the middleware of the server and the login handler, for testing handlers
+type testRouter struct {
+	*mux.Router
+	am	*authManager
+	t	*testing.T
+}
+
+func newTestRouter(t *testing.T) *testRouter {
+	router := mux.NewRouter()
+	am := NewAuthManager()
+	router.Use(contentTypeMiddleware, authenticationMiddleware, am.authorizationMiddleware)
+	router.HandleFunc("/", session.LoginHandler(nil)).Methods(http.MethodGet)
+	return &testRouter{Router: router, am: am, t: t}
+}
+
+// initialize the DB of getDbForAssInstHandlersTest and the sessions, returning the test users, a router and a cleanup function
+func initHandlersTest(t *testing.T) (map[string]*users.User, *testRouter, func()) {
+	testUsers, cleanupDb := getDbForAssInstHandlersTest()
+	cleanupSess := session.InitSessionForTest()
+	return testUsers, newTestRouter(t), func() {
+		cleanupSess()
+		cleanupDb()
+	}
+}
+
+// create a user whose password is his name
+func newTestUser(t *testing.T, userName, role string) *users.User {
+	user, err := users.NewUserBuilder(db.System, true).WithUserName(userName).WithPassword(userName).WithRoles(role).Build()
+	if err != nil {
+		t.Fatalf("error creating user for test: %v", err)
+	}
+	return user
+}
+
+// authenticate requests with the given user name and password
+func basicAuth(userName, password string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.SetBasicAuth(userName, password)
+	}
+}
+
+// authenticate requests with the given cookies
+func withCookies(cookies []*http.Cookie) func(r *http.Request) {
+	return func(r *http.Request) {
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// send a request authenticated by the given function, if any
+func (tr *testRouter) sendWith(method, path, body string, auth func(r *http.Request), headers ...string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+	if err != nil {
+		tr.t.Fatalf("error creating http request for test: %v", err)
+	}
+	if auth != nil {
+		auth(r)
+	}
+	for i := 0; i + 1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i + 1])
+	}
+	w := httptest.NewRecorder()
+	tr.ServeHTTP(w, r)
+	return w
+}
+
+// send a request authenticated as the given user, whose password is taken from the DB. Headers are given as name and value pairs
+func (tr *testRouter) send(method, path, body, userName string, headers ...string) *httptest.ResponseRecorder {
+	user, err := users.Get(userName)
+	if err != nil {
+		tr.t.Fatalf("error getting user for test: %v", err)
+	}
+	password, err := db.Decrypt(user.Password)
+	if err != nil {
+		tr.t.Fatalf("error decrypting password for test: %v", err)
+	}
+	return tr.sendWith(method, path, body, basicAuth(userName, password), headers...)
+}
+
+// decode the body of the given response, failing the test if its status code isn't the expected one
+func (tr *testRouter) decode(w *httptest.ResponseRecorder, status int, v interface{}) {
+	if w.Code != status {
+		tr.t.Fatalf("request produced status code %d instead of %d: %s", w.Code, status, w.Body.String())
+	}
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		tr.t.Fatalf("error parsing response: %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/session"
 	"github.com/gorilla/mux"
 	"net/http"
@@ -26,8 +27,27 @@ func InitServer(port int, tlsConf *tls.Config, wg *sync.WaitGroup, ctx context.C
 	initTestRequestsRouter(baseRouter, am)
 	initMossRequestRouter(baseRouter, am)
 	initMessagesRouter(baseRouter, am)
+	initForumRouter(baseRouter, am)
+	initSearchRouter(baseRouter, am)
+	initNotificationsRouter(baseRouter, am)
 	initFilesRouter(baseRouter, am)
 	initAgentsBackend(baseRouter, am, ctx, wg)
+	initAuthRouter(baseRouter, am)
+	initPasswordResetRouter(baseRouter)
+	initSsoRouter(baseRouter)
+	initSessionsRouter(baseRouter, am)
+	initLockoutsRouter(baseRouter, am)
+	initAuditRouter(baseRouter, am)
+	initBatchRouter(baseRouter, am)
+	initOpenApiRouter(baseRouter)
+	initEmailNotifications(ctx, wg)
+	if err := schedulePeriodicJob(jobTypeSessionCleanup, db.Sessions); err != nil {
+		logger.WithError(err).Error("error scheduling the cleanup of expired sessions")
+	}
+	if err := schedulePeriodicJob(jobTypeLoginAttemptsCleanup, db.LoginAttempts); err != nil {
+		logger.WithError(err).Error("error scheduling the cleanup of failed login attempts")
+	}
+	initScheduler(ctx, wg)
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
 		Handler:      baseRouter,
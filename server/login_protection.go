@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/audit"
+	"github.com/DAv10195/submit_server/elements/jobs"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/gorilla/mux"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// configuration of the protection against brute forcing the passwords of users
+type LoginProtectionConfig struct {
+	MaxUserFailures		int
+	MaxIpFailures		int
+	BaseDelay			time.Duration
+	LockoutDuration		time.Duration
+}
+
+var loginProtection = &LoginProtectionConfig{
+	MaxUserFailures:	DefMaxUserLoginFailures,
+	MaxIpFailures:		DefMaxIpLoginFailures,
+	BaseDelay:			DefLoginFailureBaseDelay,
+	LockoutDuration:	DefLoginLockoutDuration,
+}
+
+// set the configuration of the protection against brute forcing the passwords of users
+func SetLoginProtection(conf *LoginProtectionConfig) {
+	loginProtection = conf
+}
+
+// return how long an attempt of the given subjects has to wait, due to their previous failed attempts
+func subjectsRetryAfter(now time.Time, subjects ...string) (time.Duration, error) {
+	var retryAfter time.Duration
+	for _, subject := range subjects {
+		attempts, err := users.GetLoginAttempts(subject)
+		if err != nil {
+			return 0, err
+		}
+		if subjectRetryAfter := attempts.RetryAfter(now); subjectRetryAfter > retryAfter {
+			retryAfter = subjectRetryAfter
+		}
+	}
+	return retryAfter, nil
+}
+
+// return how long a login attempt of the given user from the given ip address has to wait, due to previous failed
+// attempts of the user or from the ip address
+func loginRetryAfter(userName, ip string, now time.Time) (time.Duration, error) {
+	return subjectsRetryAfter(now, users.LoginAttemptsSubject(users.SubjectUser, userName), users.LoginAttemptsSubject(users.SubjectIp, ip))
+}
+
+// write a too many requests response telling the client how long to wait before attempting again
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set(retryAfterHeader, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeStrErrResp(w, r, http.StatusTooManyRequests, "too many attempts, try again later")
+}
+
+// record a failed attempt of the subject of the given kind and value, locking it out once it reaches the given number
+// of failures. Returns true if the subject was locked out by this failure
+func recordSubjectFailure(kind, value string, maxFailures int, now time.Time) (bool, *users.LoginAttempts, error) {
+	// the failures are counted in a single transaction, so concurrent attempts can't pass the limit
+	attempts := &users.LoginAttempts{Subject: users.LoginAttemptsSubject(kind, value)}
+	lockedOut := false
+	if err := db.Modify(db.System, attempts, func() error {
+		lockedOut = attempts.RecordFailure(now, loginProtection.BaseDelay, loginProtection.LockoutDuration, maxFailures)
+		return nil
+	}); err != nil {
+		return false, nil, err
+	}
+	return lockedOut, attempts, nil
+}
+
+// record a failed login attempt of the given user from the given ip address, locking out the user or the ip address
+// once they reach the configured number of failures. Failures of users who don't exist are counted only for the ip
+// address, so attempts with random user names can't fill the DB
+func recordLoginFailure(userName, ip string, now time.Time) error {
+	userExists, err := db.KeyExistsInBucket([]byte(db.Users), []byte(userName))
+	if err != nil {
+		return err
+	}
+	type subject struct {
+		kind, value, eventType	string
+		maxFailures				int
+	}
+	subjects := []*subject{{users.SubjectIp, ip, audit.IpLockedOut, loginProtection.MaxIpFailures}}
+	if userExists {
+		subjects = append(subjects, &subject{users.SubjectUser, userName, audit.UserLockedOut, loginProtection.MaxUserFailures})
+	}
+	for _, s := range subjects {
+		lockedOut, attempts, err := recordSubjectFailure(s.kind, s.value, s.maxFailures, now)
+		if err != nil {
+			return err
+		}
+		if lockedOut {
+			details := fmt.Sprintf("%s '%s' locked out until %s after %d failed login attempts", s.kind, s.value, attempts.LockedUntil.Format(time.RFC3339), attempts.Failures)
+			logger.Warn(details)
+			if _, err := audit.Log(s.eventType, userName, ip, details, db.System); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forget the failed login attempts of the given user after he logged in successfully
+func recordLoginSuccess(userName string) error {
+	return db.DeleteKeysFromBucket([]byte(db.LoginAttempts), []byte(users.LoginAttemptsSubject(users.SubjectUser, userName)))
+}
+
+// return the users and ip addresses which are currently locked out or delayed
+func handleGetLockouts(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	var elements []db.IBucketElement
+	if err := db.QueryBucket([]byte(db.LoginAttempts), func(_, elemBytes []byte) error {
+		attempts := &users.LoginAttempts{}
+		if err := json.Unmarshal(elemBytes, attempts); err != nil {
+			return err
+		}
+		if attempts.RetryAfter(now) > 0 {
+			elements = append(elements, attempts)
+		}
+		return nil
+	}); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeElements(w, r, http.StatusOK, elements)
+}
+
+// clear the lockout of the given user or ip address
+func handleClearLockout(w http.ResponseWriter, r *http.Request) {
+	subject := mux.Vars(r)[lockoutSubject]
+	exists, err := db.KeyExistsInBucket([]byte(db.LoginAttempts), []byte(subject))
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeStrErrResp(w, r, http.StatusNotFound, fmt.Sprintf("no failed login attempts of '%s'", subject))
+		return
+	}
+	if err := db.DeleteKeysFromBucket([]byte(db.LoginAttempts), []byte(subject)); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	asUser := r.Context().Value(authenticatedUser).(*users.User).UserName
+	if _, err := audit.Log(audit.LockoutCleared, "", "", fmt.Sprintf("lockout of '%s' cleared", subject), asUser); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, &Response{Message: fmt.Sprintf("lockout of '%s' cleared successfully", subject)})
+}
+
+// delete failed login attempts which are too old to count, periodically
+func handleLoginAttemptsCleanupJob(_ *jobs.Job) (*time.Time, error) {
+	now := time.Now().UTC()
+	var subjects [][]byte
+	if err := db.QueryBucket([]byte(db.LoginAttempts), func(_, elemBytes []byte) error {
+		attempts := &users.LoginAttempts{}
+		if err := json.Unmarshal(elemBytes, attempts); err != nil {
+			return err
+		}
+		if now.Sub(attempts.LastFailure) > loginProtection.LockoutDuration && attempts.RetryAfter(now) == 0 {
+			subjects = append(subjects, attempts.Key())
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(subjects) > 0 {
+		if err := db.DeleteKeysFromBucket([]byte(db.LoginAttempts), subjects...); err != nil {
+			return nil, err
+		}
+	}
+	nextRunAt := now.Add(cleanupJobsInterval)
+	return &nextRunAt, nil
+}
+
+func initLockoutsRouter(r *mux.Router, manager *authManager) {
+	basePath := "/lockouts"
+	router := r.PathPrefix(basePath).Subrouter()
+	router.HandleFunc("/", handleGetLockouts).Methods(http.MethodGet)
+	manager.addPathPolicy(fmt.Sprintf("%s/", basePath), newPolicy(db.LoginAttempts, nil, allow(relationAdmin)))
+	router.HandleFunc(fmt.Sprintf("/{%s}", lockoutSubject), handleClearLockout).Methods(http.MethodDelete)
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), newPolicy("lockout", nil, allow(relationAdmin)))
+}
+
+func init() {
+	jobHandlers[jobTypeLoginAttemptsCleanup] = handleLoginAttemptsCleanupJob
+}
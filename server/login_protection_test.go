@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/audit"
+	"github.com/DAv10195/submit_server/elements/users"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginProtection(t *testing.T) {
+	cleanup := getDbForSessionTest()
+	defer cleanup()
+	if _, err := users.NewUserBuilder(db.System, true).WithUserName("student").WithPassword("student").WithRoles(users.StandardUser).Build(); err != nil {
+		t.Fatalf("error creating user for test: %v", err)
+	}
+	prevConf := loginProtection
+	defer SetLoginProtection(prevConf)
+	SetLoginProtection(&LoginProtectionConfig{MaxUserFailures: 3, MaxIpFailures: 100, LockoutDuration: time.Hour})
+	router := newTestRouter(t)
+	initLockoutsRouter(router.Router, router.am)
+	initAuditRouter(router.Router, router.am)
+	for i := 0; i < 3; i++ {
+		if w := router.sendWith(http.MethodGet, "/", "", basicAuth("student", "wrong")); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login attempt produced status code %d instead of %d", w.Code, http.StatusUnauthorized)
+		}
+	}
+	w := router.sendWith(http.MethodGet, "/", "", basicAuth("student", "student"))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get(retryAfterHeader) == "" {
+		t.Fatalf("login of locked out user produced status code %d instead of %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w := router.sendWith(http.MethodGet, "/lockouts/", "", basicAuth("student", "student")); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("listing lockouts with locked out user produced status code %d", w.Code)
+	}
+	w = router.send(http.MethodGet, "/lockouts/", "", users.Admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing lockouts produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	var lockouts struct {
+		Elements	[]*users.LoginAttempts	`json:"elements"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&lockouts); err != nil {
+		t.Fatalf("error parsing lockouts: %v", err)
+	}
+	userSubject := users.LoginAttemptsSubject(users.SubjectUser, "student")
+	if len(lockouts.Elements) != 1 || lockouts.Elements[0].Subject != userSubject {
+		t.Fatalf("expected only the user to be locked out but got %+v", lockouts.Elements)
+	}
+	if w := router.send(http.MethodDelete, fmt.Sprintf("/lockouts/%s", userSubject), "", users.Admin); w.Code != http.StatusOK {
+		t.Fatalf("clearing lockout produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	if w := router.sendWith(http.MethodGet, "/", "", basicAuth("student", "student")); w.Code != http.StatusOK {
+		t.Fatalf("login after clearing lockout produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	w = router.send(http.MethodGet, "/audit/", "", users.Admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing audit events produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	var events struct {
+		Elements	[]*audit.Event	`json:"elements"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatalf("error parsing audit events: %v", err)
+	}
+	eventTypes := make(map[string]bool)
+	for _, event := range events.Elements {
+		eventTypes[event.Type] = true
+	}
+	if len(events.Elements) != 2 || !eventTypes[audit.UserLockedOut] || !eventTypes[audit.LockoutCleared] {
+		t.Fatalf("unexpected audit events: %+v", events.Elements)
+	}
+}
+
+func TestConcurrentLoginFailures(t *testing.T) {
+	cleanup := getDbForSessionTest()
+	defer cleanup()
+	newTestUser(t, "student", users.StandardUser)
+	const failures = 20
+	now := time.Now().UTC()
+	var wg sync.WaitGroup
+	errs := make(chan error, failures)
+	for i := 0; i < failures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- recordLoginFailure("student", "10.0.0.1", now)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("error recording login failure: %v", err)
+		}
+	}
+	// no failure is lost when they're recorded concurrently
+	for _, subject := range []string{users.LoginAttemptsSubject(users.SubjectUser, "student"), users.LoginAttemptsSubject(users.SubjectIp, "10.0.0.1")} {
+		attempts, err := users.GetLoginAttempts(subject)
+		if err != nil {
+			t.Fatalf("error getting login attempts for test: %v", err)
+		}
+		if attempts.Failures != failures {
+			t.Fatalf("expected %d failures of '%s' but got %d", failures, subject, attempts.Failures)
+		}
+	}
+}
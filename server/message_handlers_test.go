@@ -2,15 +2,20 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/messages"
 	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/mail"
 	"github.com/DAv10195/submit_server/session"
 	"github.com/gorilla/mux"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -285,3 +290,209 @@ func TestMessageHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestMessageThreads(t *testing.T) {
+	_, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	initMessagesRouter(router.Router, router.am)
+	boxPath := fmt.Sprintf("/%s/%s/user1", db.Messages, db.Users)
+	post := func(body, user string) *messages.Message {
+		msg := &messages.Message{}
+		router.decode(router.send(http.MethodPost, boxPath, body, user), http.StatusAccepted, msg)
+		return msg
+	}
+	unread := func(path, user string) int {
+		u := &UnreadMessages{}
+		router.decode(router.send(http.MethodGet, path, "", user), http.StatusOK, u)
+		return u.Unread
+	}
+	first := post(`{"text":"question","attachments":[{"name":"output.txt","content":"aGVsbG8="}]}`, "user2")
+	if len(first.Attachments) != 1 || first.Attachments[0].Size != 5 || first.ThreadID != first.ID {
+		t.Fatalf("unexpected first message: %+v", first)
+	}
+	reply := post(fmt.Sprintf(`{"text":"answer","parent_id":"%s"}`, first.ID), "user1")
+	other := post(`{"text":"other question"}`, "user3")
+	if reply.ThreadID != first.ID || reply.ParentID != first.ID {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+	for _, body := range []string{`{}`, `{"text":"x","parent_id":"missing"}`, `{"text":"x","attachments":[{"name":"../x","content":""}]}`} {
+		if w := router.send(http.MethodPost, boxPath, body, "user2"); w.Code != http.StatusBadRequest {
+			t.Fatalf("posting invalid message %s produced status code %d instead of %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	// listing is ordered by creation time and continues from the cursor
+	w := router.send(http.MethodGet, boxPath + "?limit=2", "", "user1")
+	if w.Code != http.StatusOK || w.Header().Get(nextCursorHeader) != reply.ID {
+		t.Fatalf("listing messages produced status code %d and cursor '%s'", w.Code, w.Header().Get(nextCursorHeader))
+	}
+	var listed struct {
+		Elements	[]*messages.Message	`json:"elements"`
+	}
+	w = router.send(http.MethodGet, fmt.Sprintf("%s?limit=2&cursor=%s", boxPath, reply.ID), "", "user1")
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatalf("error parsing messages: %v", err)
+	}
+	if len(listed.Elements) != 1 || listed.Elements[0].ID != other.ID || w.Header().Get(nextCursorHeader) != "" {
+		t.Fatalf("unexpected messages after cursor: %+v", listed.Elements)
+	}
+	// clients paging by the number of messages to skip keep working
+	w = router.send(http.MethodGet, boxPath + "?limit=1&after_id=1", "", "user1")
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatalf("error parsing messages: %v", err)
+	}
+	if len(listed.Elements) != 1 || listed.Elements[0].ID != reply.ID || w.Header().Get(nextCursorHeader) != reply.ID {
+		t.Fatalf("unexpected messages after the first one: %+v", listed.Elements)
+	}
+	tooLarge := fmt.Sprintf(`{"text":"%s"}`, strings.Repeat("x", messages.MaxMessageRequestSize))
+	if w := router.send(http.MethodPost, boxPath, tooLarge, "user2"); w.Code != http.StatusBadRequest {
+		t.Fatalf("posting a too large message produced status code %d instead of %d", w.Code, http.StatusBadRequest)
+	}
+	w = router.send(http.MethodGet, fmt.Sprintf("%s?thread=%s", boxPath, first.ID), "", "user1")
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatalf("error parsing messages: %v", err)
+	}
+	if len(listed.Elements) != 2 {
+		t.Fatalf("expected 2 messages in thread but got %d", len(listed.Elements))
+	}
+	// read receipts
+	if n := unread(fmt.Sprintf("/%s/unread", db.Messages), "user1"); n != 2 {
+		t.Fatalf("expected 2 unread messages but got %d", n)
+	}
+	if w := router.send(http.MethodPost, boxPath + "/read", fmt.Sprintf(`{"messages":["%s"]}`, first.ID), "user2"); w.Code != http.StatusForbidden {
+		t.Fatalf("marking messages of another user as read produced status code %d instead of %d", w.Code, http.StatusForbidden)
+	}
+	if w := router.send(http.MethodPost, boxPath + "/read", fmt.Sprintf(`{"messages":["%s"]}`, first.ID), "user1"); w.Code != http.StatusOK {
+		t.Fatalf("marking message as read produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	if n := unread(boxPath + "/unread", "user1"); n != 1 {
+		t.Fatalf("expected 1 unread message but got %d", n)
+	}
+	// edits and deletions
+	if w := router.send(http.MethodPut, fmt.Sprintf("%s/%s", boxPath, first.ID), `{"text":"edited"}`, "user3"); w.Code != http.StatusForbidden {
+		t.Fatalf("editing message of another user produced status code %d instead of %d", w.Code, http.StatusForbidden)
+	}
+	if w := router.send(http.MethodPut, fmt.Sprintf("%s/%s", boxPath, first.ID), `{"text":"edited"}`, "user2"); w.Code != http.StatusOK {
+		t.Fatalf("editing message produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	old, err := messages.GetMessage(other.ID)
+	if err != nil {
+		t.Fatalf("error getting message: %v", err)
+	}
+	old.CreatedOn = old.CreatedOn.Add(-2 * messages.EditWindow)
+	if err := db.Update(db.System, old); err != nil {
+		t.Fatalf("error updating message for test: %v", err)
+	}
+	if w := router.send(http.MethodDelete, fmt.Sprintf("%s/%s", boxPath, other.ID), "", "user3"); w.Code != http.StatusForbidden {
+		t.Fatalf("deleting message after edit window produced status code %d instead of %d", w.Code, http.StatusForbidden)
+	}
+	if w := router.send(http.MethodDelete, fmt.Sprintf("%s/%s", boxPath, other.ID), "", users.Admin); w.Code != http.StatusOK {
+		t.Fatalf("deleting message as admin produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	if n := unread(boxPath + "/unread", "user1"); n != 0 {
+		t.Fatalf("expected no unread messages after deletion but got %d", n)
+	}
+	edited, err := messages.GetMessage(first.ID)
+	if err != nil {
+		t.Fatalf("error getting message: %v", err)
+	}
+	if edited.Text != "edited" || edited.EditedOn.IsZero() {
+		t.Fatalf("unexpected edited message: %+v", edited)
+	}
+}
+
+func TestCourseAnnouncements(t *testing.T) {
+	testUsers, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	year := time.Now().UTC().Year()
+	courseKey := fmt.Sprintf("1:%d", year)
+	// user2 submitted the assignment while user3 didn't
+	for _, user := range []string{"user2", "user3"} {
+		assInst, err := assignments.NewInstance(courseKey, time.Now().Add(time.Hour).UTC(), "ass", user, db.System, false, false)
+		if err != nil {
+			t.Fatalf("error creating assignment instance for test: %v", err)
+		}
+		if user == "user2" {
+			assInst.State = assignments.Submitted
+		}
+		if err := db.Update(db.System, assInst); err != nil {
+			t.Fatalf("error creating assignment instance for test: %v", err)
+		}
+	}
+	initMessagesRouter(router.Router, router.am)
+	announcementsPath := fmt.Sprintf("/%s/%s/1/%d", db.Messages, db.Courses, year)
+	testCases := []struct{
+		name	string
+		body	string
+		user	string
+		status	int
+	}{
+		{"test post announcement as student", `{"text":"hello"}`, "user2", http.StatusForbidden},
+		{"test post announcement with invalid audience", `{"text":"hello","audience":"parents"}`, "user1", http.StatusBadRequest},
+		{"test post announcement for missing assignment", `{"text":"hello","not_submitted":"missing"}`, "user1", http.StatusNotFound},
+		{"test post announcement to staff for unsubmitted assignment", `{"text":"hello","audience":"staff","not_submitted":"ass"}`, "user1", http.StatusBadRequest},
+		{"test post announcement", `{"text":"welcome"}`, "user1", http.StatusAccepted},
+		{"test post announcement to students who didn't submit", `{"text":"submit soon","not_submitted":"ass"}`, "user1", http.StatusAccepted},
+		{"test post announcement to staff", `{"text":"grading meeting","audience":"staff"}`, "user1", http.StatusAccepted},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := router.send(http.MethodPost, announcementsPath, tc.body, tc.user); w.Code != tc.status {
+				t.Fatalf("expected status code %d but got %d", tc.status, w.Code)
+			}
+		})
+	}
+	if w := router.send(http.MethodPost, fmt.Sprintf("/%s/%s/user1", db.Messages, db.Users), `{"text":"hello","audience":"students"}`, "user2"); w.Code != http.StatusBadRequest {
+		t.Fatalf("targeting a user message produced status code %d instead of %d", w.Code, http.StatusBadRequest)
+	}
+	// every user sees the announcements targeted at it
+	for user, expected := range map[string]int{"user1": 3, "user2": 1, "user3": 2} {
+		var listed struct {
+			Elements	[]*messages.Message	`json:"elements"`
+		}
+		router.decode(router.send(http.MethodGet, announcementsPath, "", user), http.StatusOK, &listed)
+		if len(listed.Elements) != expected {
+			t.Fatalf("expected %s to see %d announcements but got %d", user, expected, len(listed.Elements))
+		}
+	}
+	if w := router.send(http.MethodPost, announcementsPath + "/read", "", "user3"); w.Code != http.StatusOK {
+		t.Fatalf("marking announcements as read produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	// only staff members can edit announcements, which are emailed to their recipients
+	course, err := courses.Get(courseKey)
+	if err != nil {
+		t.Fatalf("error getting course: %v", err)
+	}
+	box, err := messages.Get(course.MessageBox)
+	if err != nil {
+		t.Fatalf("error getting announcements box: %v", err)
+	}
+	msgs, err := messages.List(box, "")
+	if err != nil {
+		t.Fatalf("error listing announcements: %v", err)
+	}
+	// announcements which aren't targeted at a user can't be reached by it at all
+	if w := router.send(http.MethodGet, fmt.Sprintf("%s/%s/attachments/notes.txt", announcementsPath, msgs[2].ID), "", "user2"); w.Code != http.StatusNotFound {
+		t.Fatalf("getting an attachment of an announcement to staff as student produced status code %d instead of %d", w.Code, http.StatusNotFound)
+	}
+	if w := router.send(http.MethodPost, announcementsPath + "/read", fmt.Sprintf(`{"messages":["%s"]}`, msgs[2].ID), "user2"); w.Code != http.StatusNotFound {
+		t.Fatalf("marking an announcement to staff as read as student produced status code %d instead of %d", w.Code, http.StatusNotFound)
+	}
+	if w := router.send(http.MethodPut, fmt.Sprintf("%s/%s", announcementsPath, msgs[0].ID), `{"text":"edited"}`, "user3"); w.Code != http.StatusForbidden {
+		t.Fatalf("editing an announcement as student produced status code %d instead of %d", w.Code, http.StatusForbidden)
+	}
+	mail.SetTransport(&fakeTransport{})
+	defer mail.SetTransport(nil)
+	for _, user := range []string{"user2", "user3"} {
+		testUsers[user].Email = user + "@localhost"
+		if err := db.Update(db.System, testUsers[user]); err != nil {
+			t.Fatalf("error updating user for test: %v", err)
+		}
+	}
+	if err := queueAnnouncementEmails(course, []string{msgs[1].ID}); err != nil {
+		t.Fatalf("error queueing announcement emails: %v", err)
+	}
+	queued := getQueuedEmails(t)
+	if len(queued) != 1 || queued[0].To != "user3@localhost" || !strings.Contains(queued[0].Body, "submit soon") {
+		t.Fatalf("expected an announcement email to be queued for user3 but got: %+v", queued)
+	}
+}
@@ -1,17 +1,23 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
 	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/appeals"
+	"github.com/DAv10195/submit_server/elements/courses"
 	"github.com/DAv10195/submit_server/elements/messages"
 	"github.com/DAv10195/submit_server/elements/tests"
 	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/fs"
 	"github.com/gorilla/mux"
+	"io"
 	"net/http"
 	"regexp"
+	"strings"
 )
 
 func handleGetMessageBoxes(w http.ResponseWriter, r *http.Request) {
@@ -48,256 +54,422 @@ func handleGetMessageBoxes(w http.ResponseWriter, r *http.Request) {
 	writeElements(w, r, http.StatusOK, elements)
 }
 
-func handleGetMessageBoxForUser(w http.ResponseWriter, r *http.Request) {
-	params, err := submithttp.PagingParamsFromRequest(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
-		return
+// return the message box of the user, appeal, test or course in the path of the request. If it can't be found, an error
+// response is written and nil is returned
+func getMessageBoxFromRequest(w http.ResponseWriter, r *http.Request) *messages.MessageBox {
+	vars := mux.Vars(r)
+	var boxId string
+	var err error
+	switch {
+		case vars[testName] != "":
+			testKey, keyErr := getTestKey(r)
+			if keyErr != nil {
+				writeErrResp(w, r, http.StatusBadRequest, keyErr)
+				return nil
+			}
+			var test *tests.Test
+			if test, err = tests.Get(testKey); err == nil {
+				boxId = test.MessageBox
+			}
+		case vars[assDefName] != "":
+			assKey, keyErr := getAssInstKey(r)
+			if keyErr != nil {
+				writeStrErrResp(w, r, http.StatusBadRequest, "invalid course number and/or year integer path params")
+				return nil
+			}
+			var appeal *appeals.Appeal
+			if appeal, err = appeals.Get(assKey); err == nil {
+				boxId = appeal.MessageBox
+			}
+		case vars[courseNumber] != "":
+			courseKey, keyErr := getCourseKeyFromRequest(r)
+			if keyErr != nil {
+				writeStrErrResp(w, r, http.StatusBadRequest, "invalid course number and/or year integer path params")
+				return nil
+			}
+			var course *courses.Course
+			if course, err = courses.Get(courseKey); err == nil {
+				boxId = course.MessageBox
+			}
+		default:
+			var user *users.User
+			if user, err = users.Get(vars[userName]); err == nil {
+				boxId = user.MessageBox
+			}
 	}
-	user, err := users.Get(mux.Vars(r)[userName])
-	if err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
-			writeErrResp(w, r, http.StatusNotFound, err)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-		}
-		return
+	var msgBox *messages.MessageBox
+	if err == nil {
+		msgBox, err = messages.Get(boxId)
 	}
-	msgBox, err := messages.Get(user.MessageBox)
 	if err != nil {
 		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
 			writeErrResp(w, r, http.StatusNotFound, err)
 		} else {
 			writeErrResp(w, r, http.StatusInternalServerError, err)
 		}
-		return
-	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Messages), func (msgKey []byte, msgBytes []byte) error {
-		if msgBox.Messages.Contains(string(msgKey)) {
-			msg := &messages.Message{}
-			if err := json.Unmarshal(msgBytes, msg); err != nil {
-				return err
-			}
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, msg)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
-		}
 		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
 	}
-	writeElements(w, r, http.StatusOK, elements)
+	return msgBox
 }
 
-func handlePostMessageToUser(w http.ResponseWriter, r *http.Request) {
-	user, err := users.Get(mux.Vars(r)[userName])
+// return the messages in the given box which are visible to the authenticated user, ordered by creation time. If a
+// thread id is given, only messages in that thread are returned
+func listVisibleMessages(r *http.Request, msgBox *messages.MessageBox, threadId string) ([]*messages.Message, error) {
+	msgs, err := messages.List(msgBox, threadId)
 	if err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
-			writeErrResp(w, r, http.StatusNotFound, err)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
+		return nil, err
+	}
+	user := r.Context().Value(authenticatedUser).(*users.User)
+	if user.Roles.Contains(users.Admin) {
+		return msgs, nil
+	}
+	var visible []*messages.Message
+	for _, msg := range msgs {
+		if msg.VisibleTo(user.UserName) {
+			visible = append(visible, msg)
 		}
-		return
 	}
-	msg := &messages.Message{}
-	if err := json.NewDecoder(r.Body).Decode(msg); err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, err)
-		return
+	return visible, nil
+}
+
+// return the message with the id in the path of the request from the given box. If it can't be found, an error
+// response is written and nil is returned
+func getMessageFromRequest(w http.ResponseWriter, r *http.Request, msgBox *messages.MessageBox) *messages.Message {
+	msgId := mux.Vars(r)[messageId]
+	if !msgBox.Messages.Contains(msgId) {
+		writeErrResp(w, r, http.StatusNotFound, &db.ErrKeyNotFoundInBucket{Key: msgId, Bucket: db.Messages})
+		return nil
 	}
-	if _, _, err := messages.NewMessage(r.Context().Value(authenticatedUser).(*users.User).UserName, msg.Text, user.MessageBox, true); err != nil {
+	msg, err := messages.GetMessage(msgId)
+	if err != nil {
 		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
 			writeErrResp(w, r, http.StatusNotFound, err)
 		} else {
 			writeErrResp(w, r, http.StatusInternalServerError, err)
 		}
-		return
+		return nil
 	}
-	writeResponse(w, r, http.StatusAccepted, &Response{Message: "message created successfully"})
+	// messages which aren't visible to the user are treated as if they don't exist
+	if user := r.Context().Value(authenticatedUser).(*users.User); !user.Roles.Contains(users.Admin) && !msg.VisibleTo(user.UserName) {
+		writeErrResp(w, r, http.StatusNotFound, &db.ErrKeyNotFoundInBucket{Key: msgId, Bucket: db.Messages})
+		return nil
+	}
+	return msg
 }
 
-func handleGetMessageBoxForAppeal(w http.ResponseWriter, r *http.Request) {
+// list the messages of a box ordered by creation time, optionally only those of a single thread. The id of the last
+// message returned serves as the cursor for getting the messages after it, while the after id param still skips a
+// number of messages for clients paging the way they did before cursors
+func handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	params, err := submithttp.PagingParamsFromRequest(r)
 	if err != nil {
 		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
 		return
 	}
-	assKey, err := getAssInstKey(r)
-	if err != nil {
-		writeStrErrResp(w, r, http.StatusBadRequest, "invalid course number and/or year integer path params")
+	msgBox := getMessageBoxFromRequest(w, r)
+	if msgBox == nil {
 		return
 	}
-	appeal, err := appeals.Get(assKey)
+	query := r.URL.Query()
+	msgs, err := listVisibleMessages(r, msgBox, query.Get(messageThreadParam))
 	if err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
-			writeErrResp(w, r, http.StatusNotFound, err)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-		}
+		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	msgBox, err := messages.Get(appeal.MessageBox)
-	if err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
-			writeErrResp(w, r, http.StatusNotFound, err)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
+	start := 0
+	if cursor := query.Get(cursorParam); cursor != "" {
+		start = -1
+		for i, msg := range msgs {
+			if msg.ID == cursor {
+				start = i + 1
+				break
+			}
+		}
+		if start == -1 {
+			writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("invalid cursor '%s'", cursor))
+			return
+		}
+	} else if params.AfterId > 0 {
+		start = int(params.AfterId)
+		if start > len(msgs) {
+			start = len(msgs)
 		}
-		return
 	}
 	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Messages), func (msgKey []byte, msgBytes []byte) error {
-		if msgBox.Messages.Contains(string(msgKey)) {
-			msg := &messages.Message{}
-			if err := json.Unmarshal(msgBytes, msg); err != nil {
-				return err
-			}
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, msg)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
+	for _, msg := range msgs[start:] {
+		if int64(len(elements)) == params.Limit {
 			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
+			w.Header().Set(nextCursorHeader, elements[len(elements) - 1].(*messages.Message).ID)
+			break
 		}
+		elements = append(elements, msg)
 	}
 	writeElements(w, r, http.StatusOK, elements)
 }
 
-func handlePostMessageToAppeal(w http.ResponseWriter, r *http.Request) {
-	assKey, err := getAssInstKey(r)
-	if err != nil {
-		writeStrErrResp(w, r, http.StatusBadRequest, "invalid course number and/or year integer path params")
+// a new message, optionally replying to another message in the same box. Course announcements can be targeted at an
+// audience or at the students who haven't submitted an assignment yet
+type MessageRequest struct {
+	Text			string							`json:"text"`
+	ParentID		string							`json:"parent_id"`
+	Attachments		[]*messages.AttachmentUpload	`json:"attachments"`
+	Audience		string							`json:"audience"`
+	NotSubmitted	string							`json:"not_submitted"`
+}
+
+func handlePostMessage(w http.ResponseWriter, r *http.Request) {
+	msgBox := getMessageBoxFromRequest(w, r)
+	if msgBox == nil {
+		return
+	}
+	mr := &MessageRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, messages.MaxMessageRequestSize)).Decode(mr); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if mr.Text == "" && len(mr.Attachments) == 0 {
+		writeStrErrResp(w, r, http.StatusBadRequest, "a message must have a text or attachments")
+		return
+	}
+	var recipients *containers.StringSet
+	vars := mux.Vars(r)
+	if vars[courseNumber] != "" && vars[assDefName] == "" {
+		course, err := courses.Get(fmt.Sprintf("%s%s%s", vars[courseNumber], db.KeySeparator, vars[courseYear]))
+		if err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if recipients, err = course.AnnouncementRecipients(mr.Audience, mr.NotSubmitted); err != nil {
+			if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+				writeErrResp(w, r, http.StatusNotFound, err)
+			} else {
+				writeErrResp(w, r, http.StatusBadRequest, err)
+			}
+			return
+		}
+		if mr.Audience == "" {
+			mr.Audience = courses.AudienceAll
+		}
+	} else if mr.Audience != "" || mr.NotSubmitted != "" {
+		writeStrErrResp(w, r, http.StatusBadRequest, "only course announcements can be targeted")
 		return
 	}
-	appeal, err := appeals.Get(assKey)
+	asUser := r.Context().Value(authenticatedUser).(*users.User).UserName
+	msg, msgBox, err := messages.NewReply(asUser, mr.Text, msgBox.ID, mr.ParentID, mr.Attachments, false, fs.GetClient() != nil)
+	if err == nil {
+		msg.Recipients, msg.Audience = recipients, mr.Audience
+		msgBox.Messages.Add(msg.ID)
+		if err = db.Update(asUser, msg, msgBox); err != nil && fs.GetClient() != nil {
+			// the attachments of a message which wasn't written are never downloaded, so they're deleted right away
+			if delErr := msg.DeleteAttachmentFiles(); delErr != nil {
+				logger.WithError(delErr).Errorf("error deleting attachments of message with id == %s", msg.ID)
+			}
+		}
+	}
 	if err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+		if _, ok := err.(*messages.ErrInvalidMessage); ok {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+		} else if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
 			writeErrResp(w, r, http.StatusNotFound, err)
 		} else {
 			writeErrResp(w, r, http.StatusInternalServerError, err)
 		}
 		return
 	}
-	msg := &messages.Message{}
-	if err := json.NewDecoder(r.Body).Decode(msg); err != nil {
+	writeElem(w, r, http.StatusAccepted, msg)
+}
+
+// the new text of an edited message
+type MessageEdit struct {
+	Text	string	`json:"text"`
+}
+
+func handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	msgBox := getMessageBoxFromRequest(w, r)
+	if msgBox == nil {
+		return
+	}
+	msg := getMessageFromRequest(w, r, msgBox)
+	if msg == nil {
+		return
+	}
+	me := &MessageEdit{}
+	if err := json.NewDecoder(r.Body).Decode(me); err != nil {
 		writeErrResp(w, r, http.StatusBadRequest, err)
 		return
 	}
-	if _, _, err := messages.NewMessage(r.Context().Value(authenticatedUser).(*users.User).UserName, msg.Text, appeal.MessageBox, true); err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
-			writeErrResp(w, r, http.StatusNotFound, err)
+	asUser := r.Context().Value(authenticatedUser).(*users.User).UserName
+	if err := msg.Edit(me.Text, asUser); err != nil {
+		writeErrResp(w, r, http.StatusForbidden, err)
+		return
+	}
+	if err := db.Update(asUser, msg); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeElem(w, r, http.StatusOK, msg)
+}
+
+// delete a message. Admins can delete any message at any time
+func handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	msgBox := getMessageBoxFromRequest(w, r)
+	if msgBox == nil {
+		return
+	}
+	msg := getMessageFromRequest(w, r, msgBox)
+	if msg == nil {
+		return
+	}
+	user := r.Context().Value(authenticatedUser).(*users.User)
+	if err := messages.DeleteMessage(msg, user.UserName, user.Roles.Contains(users.Admin), fs.GetClient() != nil); err != nil {
+		if _, ok := err.(*messages.ErrMessageNotModifiable); ok {
+			writeErrResp(w, r, http.StatusForbidden, err)
 		} else {
 			writeErrResp(w, r, http.StatusInternalServerError, err)
 		}
 		return
 	}
-	writeResponse(w, r, http.StatusAccepted, &Response{Message: "message created successfully"})
+	writeResponse(w, r, http.StatusOK, &Response{Message: "message deleted successfully"})
 }
 
-func handleGetMessageBoxForTest(w http.ResponseWriter, r *http.Request) {
-	params, err := submithttp.PagingParamsFromRequest(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
+func handleDownloadMessageAttachment(w http.ResponseWriter, r *http.Request) {
+	msgBox := getMessageBoxFromRequest(w, r)
+	if msgBox == nil {
 		return
 	}
-	testKey, err := getTestKey(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, err)
+	msg := getMessageFromRequest(w, r, msgBox)
+	if msg == nil {
 		return
 	}
-	test, err := tests.Get(testKey)
-	if err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
-			writeErrResp(w, r, http.StatusNotFound, err)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
+	var attachment *messages.Attachment
+	for _, a := range msg.Attachments {
+		if a.Name == mux.Vars(r)[attachmentName] {
+			attachment = a
 		}
+	}
+	if attachment == nil {
+		writeStrErrResp(w, r, http.StatusNotFound, "attachment not found")
 		return
 	}
-	msgBox, err := messages.Get(test.MessageBox)
+	if fs.GetClient() == nil {
+		writeStrErrResp(w, r, http.StatusServiceUnavailable, "file server is not configured")
+		return
+	}
+	writer := &bytes.Buffer{}
+	respHeaders, err := fs.GetClient().DownloadFile(fmt.Sprintf("/%s", attachment.Path), writer)
 	if err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
-			writeErrResp(w, r, http.StatusNotFound, err)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for k, v := range respHeaders {
+		w.Header().Del(k)
+		for _, hv := range v {
+			w.Header().Add(k, hv)
 		}
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, writer); err != nil {
+		logger.WithError(err).Error("error copying data from file server to client")
 		return
 	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Messages), func (msgKey []byte, msgBytes []byte) error {
-		if msgBox.Messages.Contains(string(msgKey)) {
-			msg := &messages.Message{}
-			if err := json.Unmarshal(msgBytes, msg); err != nil {
-				return err
-			}
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, msg)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
+}
+
+// the messages to mark as read. If none are given, all messages in the box are marked as read
+type MessagesRead struct {
+	Messages	[]string	`json:"messages"`
+}
+
+// the number of messages in a box which are unread by the authenticated user
+type UnreadMessages struct {
+	Box		string	`json:"box"`
+	Unread	int		`json:"unread"`
+}
+
+func (u *UnreadMessages) String() string {
+	return _stringForResp(u)
+}
+
+func handleMarkMessagesRead(w http.ResponseWriter, r *http.Request) {
+	msgBox := getMessageBoxFromRequest(w, r)
+	if msgBox == nil {
+		return
+	}
+	mr := &MessagesRead{}
+	if err := json.NewDecoder(r.Body).Decode(mr); err != nil && err != io.EOF {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	toMark := containers.NewStringSet()
+	toMark.Add(mr.Messages...)
+	for _, msgId := range toMark.Slice() {
+		if !msgBox.Messages.Contains(msgId) {
+			writeErrResp(w, r, http.StatusBadRequest, &db.ErrKeyNotFoundInBucket{Key: msgId, Bucket: db.Messages})
+			return
 		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
+	}
+	msgs, err := listVisibleMessages(r, msgBox, "")
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	visible := containers.NewStringSet()
+	for _, msg := range msgs {
+		visible.Add(msg.ID)
+	}
+	for _, msgId := range toMark.Slice() {
+		if !visible.Contains(msgId) {
+			writeErrResp(w, r, http.StatusNotFound, &db.ErrKeyNotFoundInBucket{Key: msgId, Bucket: db.Messages})
+			return
+		}
+	}
+	asUser := r.Context().Value(authenticatedUser).(*users.User).UserName
+	var marked []db.IBucketElement
+	unread := &UnreadMessages{Box: msgBox.ID}
+	for _, msg := range msgs {
+		if (toMark.NumberOfElements() == 0 || toMark.Contains(msg.ID)) && msg.MarkReadBy(asUser) {
+			marked = append(marked, msg)
+		} else if msg.IsUnreadBy(asUser) {
+			unread.Unread++
+		}
+	}
+	if len(marked) > 0 {
+		if err := db.Update(asUser, marked...); err != nil {
 			writeErrResp(w, r, http.StatusInternalServerError, err)
 			return
 		}
 	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeResponse(w, r, http.StatusOK, unread)
 }
 
-func handlePostMessageToTest(w http.ResponseWriter, r *http.Request) {
-	testKey, err := getTestKey(r)
+// write the number of messages in the given box which are unread by the authenticated user
+func writeUnreadMessages(w http.ResponseWriter, r *http.Request, msgBox *messages.MessageBox) {
+	msgs, err := listVisibleMessages(r, msgBox, "")
 	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, err)
+		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	test, err := tests.Get(testKey)
-	if err != nil {
-		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
-			writeErrResp(w, r, http.StatusNotFound, err)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
+	asUser := r.Context().Value(authenticatedUser).(*users.User).UserName
+	unread := &UnreadMessages{Box: msgBox.ID}
+	for _, msg := range msgs {
+		if msg.IsUnreadBy(asUser) {
+			unread.Unread++
 		}
-		return
 	}
-	msg := &messages.Message{}
-	if err := json.NewDecoder(r.Body).Decode(msg); err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, err)
+	writeResponse(w, r, http.StatusOK, unread)
+}
+
+func handleGetUnreadMessages(w http.ResponseWriter, r *http.Request) {
+	msgBox := getMessageBoxFromRequest(w, r)
+	if msgBox == nil {
 		return
 	}
-	if _, _, err := messages.NewMessage(r.Context().Value(authenticatedUser).(*users.User).UserName, msg.Text, test.MessageBox, true); err != nil {
+	writeUnreadMessages(w, r, msgBox)
+}
+
+// return the number of unread messages in the message box of the authenticated user
+func handleGetOwnUnreadMessages(w http.ResponseWriter, r *http.Request) {
+	msgBox, err := messages.Get(r.Context().Value(authenticatedUser).(*users.User).MessageBox)
+	if err != nil {
 		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
 			writeErrResp(w, r, http.StatusNotFound, err)
 		} else {
@@ -305,66 +477,74 @@ func handlePostMessageToTest(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	writeResponse(w, r, http.StatusAccepted, &Response{Message: "message created successfully"})
+	writeUnreadMessages(w, r, msgBox)
+}
+
+// users who can read the messages in a box can mark them as read
+var isMarkingMessagesRead = &condition{"the messages are marked as read", func(ar *authRequest, _ *authResource) bool {
+	return strings.HasSuffix(ar.request.URL.Path, "/read")
+}}
+
+// register the handlers of the message box in the given path of the given router
+func initMessageBoxRoutes(router *mux.Router, boxPath string) {
+	router.HandleFunc(boxPath, handleGetMessages).Methods(http.MethodGet)
+	router.HandleFunc(boxPath, handlePostMessage).Methods(http.MethodPost)
+	router.HandleFunc(fmt.Sprintf("%s/unread", boxPath), handleGetUnreadMessages).Methods(http.MethodGet)
+	router.HandleFunc(fmt.Sprintf("%s/read", boxPath), handleMarkMessagesRead).Methods(http.MethodPost)
+	specificMsgPath := fmt.Sprintf("%s/{%s}", boxPath, messageId)
+	router.HandleFunc(specificMsgPath, handleEditMessage).Methods(http.MethodPut)
+	router.HandleFunc(specificMsgPath, handleDeleteMessage).Methods(http.MethodDelete)
+	router.HandleFunc(fmt.Sprintf("%s/attachments/{%s}", specificMsgPath, attachmentName), handleDownloadMessageAttachment).Methods(http.MethodGet)
 }
 
 func initMessagesRouter(r *mux.Router, m *authManager) {
 	basePath := fmt.Sprintf("/%s", db.Messages)
 	router := r.PathPrefix(basePath).Subrouter()
 	router.HandleFunc("/", handleGetMessageBoxes).Methods(http.MethodGet)
-	m.addPathToMap(fmt.Sprintf("%s/", basePath), func(user *users.User, request *http.Request) bool {
-		return user.Roles.Contains(users.Admin)
-	})
-	specificUserPath := fmt.Sprintf("/%s/{%s}", db.Users, userName)
-	router.HandleFunc(specificUserPath, handleGetMessageBoxForUser).Methods(http.MethodGet)
-	router.HandleFunc(specificUserPath, handlePostMessageToUser).Methods(http.MethodPost)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/%s/.", basePath, db.Users)), func (user *users.User, r *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		if r.Method == http.MethodGet {
-			return mux.Vars(r)[userName] == user.UserName
-		}
-		return r.Method == http.MethodPost
-	})
+	m.addPathPolicy(fmt.Sprintf("%s/", basePath), newPolicy(db.Messages, nil, allow(relationAdmin)))
+	router.HandleFunc("/unread", handleGetOwnUnreadMessages).Methods(http.MethodGet)
+	m.addPathPolicy(fmt.Sprintf("%s/unread", basePath), newPolicy("unread messages", nil, allow(relationAnyone)))
+	initMessageBoxRoutes(router, fmt.Sprintf("/%s/{%s}", db.Users, userName))
+	resolveUserBox := func (ar *authRequest) (*authResource, error) {
+		return &authResource{owner: mux.Vars(ar.request)[userName]}, nil
+	}
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/%s/[^/]+$", basePath, db.Users)), newPolicy("user message box", resolveUserBox,
+		allow(relationAdmin), allow(relationOwner, http.MethodGet), allow(relationAnyone, http.MethodPost)))
+	// anyone can send messages to a user, so only the sender of a message can modify it (enforced by the handlers)
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/%s/[^/]+/.", basePath, db.Users)), newPolicy("user message box messages", resolveUserBox,
+		allow(relationAdmin), allow(relationOwner), allow(relationAnyone, http.MethodPut, http.MethodDelete)))
 	specificAppealPath := fmt.Sprintf("/%s/{%s}/{%s}/{%s}/{%s}", db.Appeals, courseNumber, courseYear, assDefName, userName)
-	router.HandleFunc(specificAppealPath, handleGetMessageBoxForAppeal).Methods(http.MethodGet)
-	router.HandleFunc(specificAppealPath, handlePostMessageToAppeal).Methods(http.MethodPost)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/%s/.", basePath, db.Appeals)), func (user *users.User, r *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		if mux.Vars(r)[userName] == user.UserName {
-			return true
-		}
-		cNumber, cYear, err := getCourseNumberAndYearFromRequest(r)
+	initMessageBoxRoutes(router, specificAppealPath)
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/%s/.", basePath, db.Appeals)), newPolicy("appeal message box", func (ar *authRequest) (*authResource, error) {
+		res, err := resolveCourseFromPath(ar)
 		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		return user.CoursesAsStaff.Contains(fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear))
-	})
+			return nil, err
+		}
+		res.owner = mux.Vars(ar.request)[userName]
+		return res, nil
+	},
+		allow(relationAdmin),
+		allow(relationOwner),
+		allow(relationCourseStaff, http.MethodGet),
+		allowWithPermission(courses.HandleAppeals),
+	))
+	specificCoursePath := fmt.Sprintf("/%s/{%s}/{%s}", db.Courses, courseNumber, courseYear)
+	initMessageBoxRoutes(router, specificCoursePath)
+	// every user enrolled in a course can read its announcements, while only staff members with the permission to post
+	// announcements can post, edit and delete them
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/%s/.", basePath, db.Courses)), newPolicy("course announcements", resolveCourseFromPath,
+		allow(relationAdmin),
+		allowWithPermission(courses.PostAnnouncements),
+		allow(relationCourseStaff, http.MethodGet),
+		allow(relationCourseStudent, http.MethodGet),
+		allow(relationCourseStaff, http.MethodPost).when(isMarkingMessagesRead),
+		allow(relationCourseStudent, http.MethodPost).when(isMarkingMessagesRead),
+	))
 	specificTestPath := fmt.Sprintf(fmt.Sprintf("/%s/{%s}/{%s}/{%s}/{%s}", db.Tests, courseNumber, courseYear, assDefName, testName))
-	router.HandleFunc(specificTestPath, handleGetMessageBoxForTest).Methods(http.MethodGet)
-	router.HandleFunc(specificTestPath, handlePostMessageToTest).Methods(http.MethodPost)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/%s/.", basePath, db.Tests)), func (user *users.User, r *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		cNumber, cYear, err := getCourseNumberAndYearFromRequest(r)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		if user.CoursesAsStaff.Contains(fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear)) {
-			return true
-		}
-		testKey, err := getTestKey(r)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		test, err := tests.Get(testKey)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		return test.CreatedBy == user.UserName
-	})
+	initMessageBoxRoutes(router, specificTestPath)
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/%s/.", basePath, db.Tests)), newPolicy("test message box", resolveTestFromPath,
+		allow(relationAdmin),
+		allow(relationCourseStaff),
+		allow(relationOwner),
+	))
 }
@@ -2,9 +2,11 @@ package server
 
 import (
 	"context"
+	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/DAv10195/submit_server/session"
 	"net/http"
+	"time"
 )
 
 // set content type of responses to application/json
@@ -15,22 +17,39 @@ func contentTypeMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// paths which can be accessed without authentication
+var publicPaths = make(map[string]bool)
+
 // authenticate incoming requests
 func authenticationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
 		// check if a session exists
 		sess, err := session.Get(r)
 		if err == nil {
-			sess.Options.MaxAge = session.SubmitMaxCookieAge
-			if err := sess.Save(r, w); err != nil {
-				writeErrResp(w, r, http.StatusInternalServerError, err)
+			user, err := users.Get(sess.UserName)
+			if err != nil {
+				if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+					// the user of the session was deleted
+					if err := session.Revoke(sess.ID); err != nil {
+						writeErrResp(w, r, http.StatusInternalServerError, err)
+						return
+					}
+					writeStrErrResp(w, r, http.StatusUnauthorized, "session expired")
+				} else {
+					writeErrResp(w, r, http.StatusInternalServerError, err)
+				}
 				return
 			}
-			user, err := users.Get(sess.Values[session.SubmitSessionUser].(string))
-			if err != nil {
+			if err := sess.Refresh(w, r); err != nil {
 				writeErrResp(w, r, http.StatusInternalServerError, err)
+				return
 			}
-			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authenticatedUser, user)))
+			ctx := context.WithValue(context.WithValue(r.Context(), authenticatedUser, user), currentSession, sess)
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		} else if err != session.ErrNotFound {
 			writeErrResp(w, r, http.StatusInternalServerError, err)
@@ -42,25 +61,40 @@ func authenticationMiddleware(next http.Handler) http.Handler {
 			writeStrErrResp(w, r, http.StatusUnauthorized, "no username/password given")
 			return
 		}
+		// users and ip addresses with recent failed login attempts have to wait before attempting again
+		now, ip := time.Now().UTC(), session.RemoteIp(r)
+		retryAfter, err := loginRetryAfter(user, ip, now)
+		if err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if retryAfter > 0 {
+			writeTooManyAttempts(w, r, retryAfter)
+			return
+		}
 		// authenticate the user associated with this request
 		userStruct, err = users.Authenticate(user, password)
 		if err != nil {
 			if _, ok := err.(*users.ErrAuthenticationFailure); ok {
+				if err := recordLoginFailure(user, ip, now); err != nil {
+					logger.WithError(err).Errorf("error recording failed login attempt of user \"%s\"", user)
+				}
 				writeErrResp(w, r, http.StatusUnauthorized, err)
 			} else {
 				writeErrResp(w, r, http.StatusInternalServerError, err)
 			}
 			return
 		}
-		sess, err = session.New(r, user)
-		if err != nil {
+		if err := recordLoginSuccess(user); err != nil {
 			writeErrResp(w, r, http.StatusInternalServerError, err)
 			return
 		}
-		if err := sess.Save(r, w); err != nil {
+		sess, err = session.New(w, r, user)
+		if err != nil {
 			writeErrResp(w, r, http.StatusInternalServerError, err)
 			return
 		}
-		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authenticatedUser, userStruct)))
+		ctx := context.WithValue(context.WithValue(r.Context(), authenticatedUser, userStruct), currentSession, sess)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
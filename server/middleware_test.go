@@ -171,20 +171,7 @@ func TestAuthorizationMiddleware(t *testing.T){
 }
 
 func initTestAuthManager(authManager *authManager){
-	authManager.addPathToMap("/", func(user *users.User, _ *http.Request) bool{
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		return false
-	})
-	regex := regexp.MustCompile("^/regex/.")
-	authManager.addRegex(regex, func(user *users.User, _ *http.Request) bool{
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		return false
-	})
-	authManager.addRegex(regexp.MustCompile("^/get/."), func(user *users.User, r *http.Request) bool {
-		return user.Roles.Contains(users.Admin) && r.Method == http.MethodGet
-	})
+	authManager.addPathPolicy("/", newPolicy("root", nil, allow(relationAdmin)))
+	authManager.addRegexPolicy(regexp.MustCompile("^/regex/."), newPolicy("regex", nil, allow(relationAdmin)))
+	authManager.addRegexPolicy(regexp.MustCompile("^/get/."), newPolicy("get", nil, allow(relationAdmin, http.MethodGet)))
 }
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,9 +9,9 @@ import (
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/agents"
 	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/gorilla/mux"
-	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strings"
@@ -117,47 +116,23 @@ func initMossRequestRouter(r *mux.Router, m *authManager) {
 	basePath := "/moss_requests"
 	router := r.PathPrefix(basePath).Subrouter()
 	router.HandleFunc("/", handlePostMossRequest).Methods(http.MethodPost)
-	m.addPathToMap(fmt.Sprintf("%s/", basePath), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		buf, err := ioutil.ReadAll(request.Body)
-		if err != nil {
-			return true // let the next handler fail this with bad request...
-		}
-		bodyCopy1, bodyCopy2 := ioutil.NopCloser(bytes.NewBuffer(buf)), ioutil.NopCloser(bytes.NewBuffer(buf))
-		request.Body = bodyCopy1
+	m.addPathPolicy(fmt.Sprintf("%s/", basePath), newPolicy("moss request", func (ar *authRequest) (*authResource, error) {
 		mr := &MossRequest{}
-		if err := json.NewDecoder(bodyCopy2).Decode(mr); err != nil {
-			return true // let the next handler fail this with bad request...
-		}
-		split := strings.Split(mr.AssignmentDef, db.KeySeparator)
-		if len(split) != 3 {
-			return true // let the next handler fail this with bad request...
+		if err := ar.decodeBody(mr); err != nil {
+			return nil, err
 		}
-		return user.CoursesAsStaff.Contains(fmt.Sprintf("%s:%s", split[0], split[1]))
-	})
+		return resolveCourseOfAssDefKey(mr.AssignmentDef)
+	}, allow(relationAdmin), allowWithPermission(courses.ViewCopies)))
 	router.HandleFunc(fmt.Sprintf("/{%s}", taskId), handleGetMossResponse).Methods(http.MethodGet)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		task, err := agents.GetTask(mux.Vars(request)[taskId])
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), newPolicy("moss task", func (ar *authRequest) (*authResource, error) {
+		task, err := ar.task(mux.Vars(ar.request)[taskId])
 		if err != nil {
-			return true // let the next handler fail this request...
-		}
-		adn, ok := task.Labels[assDefName]
-		if !ok {
-			return true // let the next handler fail this request...
+			return nil, err
 		}
-		assDef, ok := adn.(string)
+		assDef, ok := task.Labels[assDefName].(string)
 		if !ok {
-			return true // let the next handler fail this request...
-		}
-		split := strings.Split(assDef, db.KeySeparator)
-		if len(split) != 3 {
-			return true // let the next handler fail this with bad request...
+			return nil, errors.New("task has no assignment def label")
 		}
-		return user.CoursesAsStaff.Contains(fmt.Sprintf("%s:%s", split[0], split[1]))
-	})
+		return resolveCourseOfAssDefKey(assDef)
+	}, allow(relationAdmin), allowWithPermission(courses.ViewCopies)))
 }
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/agents"
+	"github.com/DAv10195/submit_server/elements/appeals"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var notifications *notificationsHub
+
+// a notification pushed to a user
+type Notification struct {
+	Type		string		`json:"type"`
+	Key			string		`json:"key"`
+	Message		string		`json:"message"`
+}
+
+// notifications hub, holding the channels of the connected users
+type notificationsHub struct {
+	watchers	map[string]map[chan *Notification]bool
+	mutex		*sync.RWMutex
+}
+
+// create a notifications hub
+func newNotificationsHub() *notificationsHub {
+	return &notificationsHub{make(map[string]map[chan *Notification]bool), &sync.RWMutex{}}
+}
+
+// start watching notifications sent to the given user
+func (h *notificationsHub) watch(user string) chan *Notification {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	watcher := make(chan *Notification, notificationsWatcherBufferSize)
+	if h.watchers[user] == nil {
+		h.watchers[user] = make(map[chan *Notification]bool)
+	}
+	h.watchers[user][watcher] = true
+	return watcher
+}
+
+// stop watching notifications sent to the given user
+func (h *notificationsHub) unwatch(user string, watcher chan *Notification) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if userWatchers := h.watchers[user]; userWatchers != nil {
+		delete(userWatchers, watcher)
+		if len(userWatchers) == 0 {
+			delete(h.watchers, user)
+		}
+	}
+}
+
+// determine if any user is watching notifications
+func (h *notificationsHub) isWatched() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.watchers) > 0
+}
+
+// send the given notification to the given user. Watchers which can't keep up are disconnected
+func (h *notificationsHub) notify(user string, notification *Notification) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for watcher := range h.watchers[user] {
+		select {
+			case watcher <- notification:
+			default:
+				close(watcher)
+				delete(h.watchers[user], watcher)
+		}
+	}
+}
+
+// handle events published by the DB. Events are processed in a separate goroutine so DB writes aren't delayed and
+// only if someone is watching notifications
+func (h *notificationsHub) handleDbEvent(event *db.Event) {
+	if event.Action == db.Deleted || !h.isWatched() {
+		return
+	}
+	switch event.Bucket {
+		case db.MessageBoxes, db.Appeals, db.AssignmentInstances, db.Tasks:
+			go h.processDbEvent(event)
+	}
+}
+
+// translate the given DB event to notifications for the relevant users
+func (h *notificationsHub) processDbEvent(event *db.Event) {
+	var err error
+	switch event.Bucket {
+		case db.MessageBoxes:
+			err = h.processMessageBoxEvent(event)
+		case db.Appeals:
+			err = h.processAppealEvent(event)
+		case db.AssignmentInstances:
+			err = h.processAssignmentInstanceEvent(event)
+		case db.Tasks:
+			err = h.processTaskEvent(event)
+	}
+	if err != nil {
+		logger.WithError(err).Errorf("notifications: error processing event for key == %s in %s bucket", event.Key, event.Bucket)
+	}
+}
+
+// return the message box written by the given DB event and the ids of the messages added to it by the write
+func newMessagesInBox(event *db.Event) (*messages.MessageBox, []string, error) {
+	box, previousBox := &messages.MessageBox{}, &messages.MessageBox{Messages: containers.NewStringSet()}
+	if err := json.Unmarshal(event.Data, box); err != nil {
+		return nil, nil, err
+	}
+	if event.Previous != nil {
+		if err := json.Unmarshal(event.Previous, previousBox); err != nil {
+			return nil, nil, err
+		}
+	}
+	var newMessages []string
+	for _, msg := range box.Messages.Slice() {
+		if !previousBox.Messages.Contains(msg) {
+			newMessages = append(newMessages, msg)
+		}
+	}
+	return box, newMessages, nil
+}
+
+// return the course the message box with the given id belongs to (nil if it doesn't belong to a course)
+func getCourseByMessageBox(boxId string) (*courses.Course, error) {
+	var courseOfBox *courses.Course
+	if err := db.QueryBucket([]byte(db.Courses), func(_, elemBytes []byte) error {
+		course := &courses.Course{}
+		if err := json.Unmarshal(elemBytes, course); err != nil {
+			return err
+		}
+		if course.MessageBox == boxId {
+			courseOfBox = course
+			return &db.ErrStopQuery{}
+		}
+		return nil
+	}); err != nil {
+		if _, ok := err.(*db.ErrElementsLeftToProcess); !ok {
+			return nil, err
+		}
+	}
+	return courseOfBox, nil
+}
+
+// return the users the given announcement in the given course is visible to
+func getAnnouncementRecipients(course *courses.Course, msg *messages.Message) (*containers.StringSet, error) {
+	if msg.Recipients != nil {
+		return msg.Recipients, nil
+	}
+	courseKey := string(course.Key())
+	recipients := containers.NewStringSet()
+	if err := db.QueryBucket([]byte(db.Users), func(_, elemBytes []byte) error {
+		user := &users.User{}
+		if err := json.Unmarshal(elemBytes, user); err != nil {
+			return err
+		}
+		if (user.CoursesAsStaff != nil && user.CoursesAsStaff.Contains(courseKey)) || (user.CoursesAsStudent != nil && user.CoursesAsStudent.Contains(courseKey)) {
+			recipients.Add(user.UserName)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return recipients, nil
+}
+
+// return the appeal the message box with the given id belongs to (nil if it doesn't belong to an appeal)
+func getAppealByMessageBox(boxId string) (*appeals.Appeal, error) {
+	var appealOfBox *appeals.Appeal
+	if err := db.QueryBucket([]byte(db.Appeals), func(_, elemBytes []byte) error {
+		appeal := &appeals.Appeal{}
+		if err := json.Unmarshal(elemBytes, appeal); err != nil {
+			return err
+		}
+		if appeal.MessageBox == boxId {
+			appealOfBox = appeal
+			return &db.ErrStopQuery{}
+		}
+		return nil
+	}); err != nil {
+		if _, ok := err.(*db.ErrElementsLeftToProcess); !ok {
+			return nil, err
+		}
+	}
+	return appealOfBox, nil
+}
+
+// notify the owners of a message box about new messages in it
+func (h *notificationsHub) processMessageBoxEvent(event *db.Event) error {
+	box, newMessages, err := newMessagesInBox(event)
+	if err != nil {
+		return err
+	}
+	if len(newMessages) == 0 {
+		return nil
+	}
+	// the box either belongs to a user, to a course, in which case the recipients of the announcement are notified, or to
+	// an appeal, in which case the owner of the appealed assignment is notified
+	recipients := containers.NewStringSet()
+	if err := db.QueryBucket([]byte(db.Users), func(_, elemBytes []byte) error {
+		user := &users.User{}
+		if err := json.Unmarshal(elemBytes, user); err != nil {
+			return err
+		}
+		if user.MessageBox == box.ID {
+			recipients.Add(user.UserName)
+			return &db.ErrStopQuery{}
+		}
+		return nil
+	}); err != nil {
+		if _, ok := err.(*db.ErrElementsLeftToProcess); !ok {
+			return err
+		}
+	}
+	if recipients.NumberOfElements() == 0 {
+		course, err := getCourseByMessageBox(box.ID)
+		if err != nil {
+			return err
+		}
+		if course != nil {
+			for _, msgId := range newMessages {
+				msg, err := messages.GetMessage(msgId)
+				if err != nil {
+					return err
+				}
+				announcementRecipients, err := getAnnouncementRecipients(course, msg)
+				if err != nil {
+					return err
+				}
+				for _, recipient := range announcementRecipients.Slice() {
+					if recipient != msg.From {
+						h.notify(recipient, &Notification{Type: notificationTypeAnnouncement, Key: msgId, Message: fmt.Sprintf("new announcement in course %s", course.Key())})
+					}
+				}
+			}
+			return nil
+		}
+		appeal, err := getAppealByMessageBox(box.ID)
+		if err != nil {
+			return err
+		}
+		if appeal != nil {
+			assInst, err := assignments.GetInstance(appeal.AssignmentInstance)
+			if err != nil {
+				return err
+			}
+			recipients.Add(assInst.UserName)
+		}
+	}
+	for _, recipient := range recipients.Slice() {
+		if recipient == event.AsUser { // no need to notify the user about messages he wrote
+			continue
+		}
+		for _, msg := range newMessages {
+			h.notify(recipient, &Notification{Type: notificationTypeMessage, Key: msg, Message: fmt.Sprintf("new message in message box with id == %s", box.ID)})
+		}
+	}
+	return nil
+}
+
+// return the appeal written by the given DB event if the write resolved it (nil otherwise)
+func resolvedAppeal(event *db.Event) (*appeals.Appeal, error) {
+	appeal, previousAppeal := &appeals.Appeal{}, &appeals.Appeal{}
+	if err := json.Unmarshal(event.Data, appeal); err != nil {
+		return nil, err
+	}
+	if appeal.Resolution == nil {
+		return nil, nil
+	}
+	if event.Previous != nil {
+		if err := json.Unmarshal(event.Previous, previousAppeal); err != nil {
+			return nil, err
+		}
+		if previousAppeal.Resolution != nil && previousAppeal.Resolution.ResolvedOn.Equal(appeal.Resolution.ResolvedOn) {
+			return nil, nil
+		}
+	}
+	return appeal, nil
+}
+
+// notify the owner of the appealed assignment that the appeal state changed, and the lecturer an appeal is escalated to
+func (h *notificationsHub) processAppealEvent(event *db.Event) error {
+	appeal, previousAppeal := &appeals.Appeal{}, &appeals.Appeal{}
+	if err := json.Unmarshal(event.Data, appeal); err != nil {
+		return err
+	}
+	if event.Previous != nil {
+		if err := json.Unmarshal(event.Previous, previousAppeal); err != nil {
+			return err
+		}
+		if previousAppeal.State == appeal.State {
+			return nil
+		}
+	}
+	assInst, err := assignments.GetInstance(appeal.AssignmentInstance)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolvedAppeal(event)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("appeal on '%s' is open", appeal.AssignmentInstance)
+	if appeal.State == appeals.Escalated {
+		message = fmt.Sprintf("appeal on '%s' was escalated to %s", appeal.AssignmentInstance, appeal.EscalatedTo)
+		h.notify(appeal.EscalatedTo, &Notification{Type: notificationTypeAppeal, Key: appeal.AssignmentInstance, Message: message})
+	} else if resolved != nil {
+		message = fmt.Sprintf("appeal on '%s' was resolved as %s", appeal.AssignmentInstance, resolved.Resolution.Outcome)
+	} else if appeal.State == appeals.Closed {
+		message = fmt.Sprintf("appeal on '%s' is closed", appeal.AssignmentInstance)
+	}
+	h.notify(assInst.UserName, &Notification{Type: notificationTypeAppeal, Key: appeal.AssignmentInstance, Message: message})
+	return nil
+}
+
+// notify a user when an assignment is published to him or graded
+func (h *notificationsHub) processAssignmentInstanceEvent(event *db.Event) error {
+	assInst, previousAssInst := &assignments.AssignmentInstance{}, &assignments.AssignmentInstance{}
+	if err := json.Unmarshal(event.Data, assInst); err != nil {
+		return err
+	}
+	if event.Action == db.Inserted {
+		h.notify(assInst.UserName, &Notification{Type: notificationTypeAssignment, Key: event.Key, Message: fmt.Sprintf("assignment '%s' published", assInst.AssignmentDef)})
+		return nil
+	}
+	if err := json.Unmarshal(event.Previous, previousAssInst); err != nil {
+		return err
+	}
+	if assInst.State == assignments.Graded && previousAssInst.State != assignments.Graded {
+		h.notify(assInst.UserName, &Notification{Type: notificationTypeAssignment, Key: event.Key, Message: fmt.Sprintf("assignment '%s' graded", assInst.AssignmentDef)})
+	}
+	return nil
+}
+
+// notify the user who triggered a test execution that it finished
+func (h *notificationsHub) processTaskEvent(event *db.Event) error {
+	task, previousTask := &agents.Task{}, &agents.Task{}
+	if err := json.Unmarshal(event.Data, task); err != nil {
+		return err
+	}
+	if task.ResponseHandler != testTask || event.Previous == nil {
+		return nil
+	}
+	if err := json.Unmarshal(event.Previous, previousTask); err != nil {
+		return err
+	}
+	if previousTask.Status == task.Status {
+		return nil
+	}
+	switch task.Status {
+		case agents.TaskStatusOk, agents.TaskStatusError, agents.TaskStatusTimeout:
+			h.notify(task.CreatedBy, &Notification{Type: notificationTypeTest, Key: task.ID, Message: fmt.Sprintf("test execution task with id == %s finished", task.ID)})
+	}
+	return nil
+}
+
+// push notifications to the authenticated user over a websocket
+func handleNotifications(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(authenticatedUser).(*users.User)
+	wsUpgrade := websocket.Upgrader{}
+	conn, err := wsUpgrade.Upgrade(w, r, nil)
+	if err != nil {
+		logger.WithError(err).Errorf("error upgrading connection from [ %s ] to websocket", r.RemoteAddr)
+		return
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logger.WithError(err).Errorf("error closing notifications connection of user %s", user.UserName)
+		}
+	}()
+	watcher := notifications.watch(user.UserName)
+	defer notifications.unwatch(user.UserName, watcher)
+	// read (and discard) incoming messages so a client closing the connection is noticed
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+			case notification, ok := <- watcher:
+				if !ok {
+					return
+				}
+				notificationBytes, err := json.Marshal(notification)
+				if err != nil {
+					logger.WithError(err).Errorf("error formatting notification for user %s", user.UserName)
+					continue
+				}
+				if err := conn.SetWriteDeadline(time.Now().Add(serverTimeout)); err != nil {
+					return
+				}
+				if err := conn.WriteMessage(websocket.TextMessage, notificationBytes); err != nil {
+					logger.WithError(err).Debugf("error sending notification to user %s", user.UserName)
+					return
+				}
+			case <- clientGone:
+				return
+		}
+	}
+}
+
+func initNotificationsRouter(r *mux.Router, manager *authManager) {
+	basePath := "/notifications"
+	router := r.PathPrefix(basePath).Subrouter()
+	router.HandleFunc("/", handleNotifications).Methods(http.MethodGet)
+	manager.addPathPolicy(fmt.Sprintf("%s/", basePath), newPolicy("notifications", nil, allow(relationAnyone)))
+}
+
+func init() {
+	notifications = newNotificationsHub()
+	db.Subscribe(notifications.handleDbEvent)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/session"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifications(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	cleanupSess := session.InitSessionForTest()
+	defer cleanupSess()
+	if err := users.InitDefaultAdmin(); err != nil {
+		t.Fatalf("error initialiting admin user for test: %v", err)
+	}
+	user, err := users.NewUserBuilder(db.System, true).WithUserName("nikita").WithPassword("nikita").WithRoles(users.StandardUser).Build()
+	if err != nil {
+		t.Fatalf("error creating user for notifications test: %v", err)
+	}
+	router := newTestRouter(t)
+	initNotificationsRouter(router.Router, router.am)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	header := http.Header{}
+	(&http.Request{Header: header}).SetBasicAuth(user.UserName, user.UserName)
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws%s/notifications/", strings.TrimPrefix(server.URL, "http")), header)
+	if err != nil {
+		t.Fatalf("error connecting to notifications endpoint: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	// wait for the handler to start watching before triggering notifications
+	for i := 0; i < 100 && !notifications.isWatched(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, _, err := messages.NewMessage(user.UserName, "written by the user himself", user.MessageBox, true); err != nil {
+		t.Fatalf("error creating message for notifications test: %v", err)
+	}
+	msg, _, err := messages.NewMessage(users.Admin, "hello", user.MessageBox, true)
+	if err != nil {
+		t.Fatalf("error creating message for notifications test: %v", err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	notification := &Notification{}
+	if err := conn.ReadJSON(notification); err != nil {
+		t.Fatalf("error reading notification: %v", err)
+	}
+	if notification.Type != notificationTypeMessage || notification.Key != msg.ID {
+		t.Fatalf("expected a notification about message with id == %s but got: %+v", msg.ID, notification)
+	}
+}
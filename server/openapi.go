@@ -0,0 +1,745 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	submithttp "github.com/DAv10195/submit_commons/http"
+	submitws "github.com/DAv10195/submit_commons/websocket"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/agents"
+	"github.com/DAv10195/submit_server/elements/appeals"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/audit"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/forum"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/tests"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/session"
+	"github.com/gorilla/mux"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	openApiVersion	= "3.0.3"
+	apiVersion		= "1.0.0"
+	openApiPath		= "/openapi.json"
+	schemasRefBase	= "#/components/schemas/"
+	basicAuthScheme	= "basic_auth"
+	cookieScheme	= "session_cookie"
+)
+
+// the subset of the OpenAPI 3 document structure describing the api of the server
+
+type OpenApiDoc struct {
+	OpenApi		string								`json:"openapi"`
+	Info		*OpenApiInfo						`json:"info"`
+	Paths		map[string]map[string]*OpenApiOperation	`json:"paths"`
+	Components	*OpenApiComponents					`json:"components"`
+	Security	[]map[string][]string				`json:"security"`
+}
+
+func (d *OpenApiDoc) String() string {
+	return _stringForResp(d)
+}
+
+type OpenApiInfo struct {
+	Title		string	`json:"title"`
+	Description	string	`json:"description"`
+	Version		string	`json:"version"`
+}
+
+type OpenApiOperation struct {
+	Summary		string						`json:"summary"`
+	Tags		[]string					`json:"tags"`
+	Parameters	[]*OpenApiParameter			`json:"parameters,omitempty"`
+	RequestBody	*OpenApiRequestBody			`json:"requestBody,omitempty"`
+	Responses	map[string]*OpenApiResponse	`json:"responses"`
+	// an empty list for operations which don't require authentication
+	Security	*[]map[string][]string		`json:"security,omitempty"`
+}
+
+type OpenApiParameter struct {
+	Name		string			`json:"name"`
+	In			string			`json:"in"`
+	Description	string			`json:"description"`
+	Required	bool			`json:"required"`
+	Style		string			`json:"style,omitempty"`
+	Explode		bool			`json:"explode,omitempty"`
+	Schema		*OpenApiSchema	`json:"schema"`
+}
+
+type OpenApiRequestBody struct {
+	Description	string							`json:"description,omitempty"`
+	Required	bool							`json:"required"`
+	Content		map[string]*OpenApiMediaType	`json:"content"`
+}
+
+type OpenApiMediaType struct {
+	Schema	*OpenApiSchema	`json:"schema"`
+}
+
+type OpenApiResponse struct {
+	Description	string							`json:"description"`
+	Headers		map[string]*OpenApiHeader		`json:"headers,omitempty"`
+	Content		map[string]*OpenApiMediaType	`json:"content,omitempty"`
+}
+
+type OpenApiHeader struct {
+	Description	string			`json:"description"`
+	Schema		*OpenApiSchema	`json:"schema"`
+}
+
+type OpenApiSchema struct {
+	Ref						string						`json:"$ref,omitempty"`
+	Type					string						`json:"type,omitempty"`
+	Format					string						`json:"format,omitempty"`
+	Description				string						`json:"description,omitempty"`
+	Enum					[]string					`json:"enum,omitempty"`
+	Items					*OpenApiSchema				`json:"items,omitempty"`
+	Properties				map[string]*OpenApiSchema	`json:"properties,omitempty"`
+	AdditionalProperties	*OpenApiSchema				`json:"additionalProperties,omitempty"`
+	OneOf					[]*OpenApiSchema			`json:"oneOf,omitempty"`
+}
+
+type OpenApiComponents struct {
+	Schemas			map[string]*OpenApiSchema			`json:"schemas"`
+	SecuritySchemes	map[string]*OpenApiSecurityScheme	`json:"securitySchemes"`
+}
+
+type OpenApiSecurityScheme struct {
+	Type		string	`json:"type"`
+	Scheme		string	`json:"scheme,omitempty"`
+	In			string	`json:"in,omitempty"`
+	Name		string	`json:"name,omitempty"`
+	Description	string	`json:"description"`
+}
+
+// generator of the schemas of go types. Named struct types are registered as components and referenced
+type openApiSchemas struct {
+	components	map[string]*OpenApiSchema
+	names		map[reflect.Type]string
+}
+
+func newOpenApiSchemas() *openApiSchemas {
+	return &openApiSchemas{components: make(map[string]*OpenApiSchema), names: make(map[reflect.Type]string)}
+}
+
+// return the schema of the json encoding of values of the given type
+func (s *openApiSchemas) of(t reflect.Type) *OpenApiSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+		case reflect.TypeOf(time.Time{}):
+			return &OpenApiSchema{Type: "string", Format: "date-time"}
+		case reflect.TypeOf(json.RawMessage{}):
+			return &OpenApiSchema{}
+	}
+	switch t.Kind() {
+		case reflect.Bool:
+			return &OpenApiSchema{Type: "boolean"}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+			return &OpenApiSchema{Type: "integer"}
+		case reflect.Int64, reflect.Uint64:
+			return &OpenApiSchema{Type: "integer", Format: "int64"}
+		case reflect.Float32, reflect.Float64:
+			return &OpenApiSchema{Type: "number"}
+		case reflect.String:
+			return &OpenApiSchema{Type: "string"}
+		case reflect.Slice, reflect.Array:
+			if t.Elem().Kind() == reflect.Uint8 {
+				return &OpenApiSchema{Type: "string", Format: "byte"}
+			}
+			return &OpenApiSchema{Type: "array", Items: s.of(t.Elem())}
+		case reflect.Map:
+			return &OpenApiSchema{Type: "object", AdditionalProperties: s.of(t.Elem())}
+		case reflect.Struct:
+			return s.ref(t)
+	}
+	// interfaces can hold any value
+	return &OpenApiSchema{}
+}
+
+// return a reference to the component of the given struct type, registering it if needed. Anonymous structs are inlined
+func (s *openApiSchemas) ref(t reflect.Type) *OpenApiSchema {
+	if t.Name() == "" {
+		return s.object(t)
+	}
+	name, ok := s.names[t]
+	if !ok {
+		name = t.Name()
+		if _, taken := s.components[name]; taken {
+			pkg := path.Base(t.PkgPath())
+			name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+		}
+		s.names[t] = name
+		// registered before the properties are generated, so recursive types end up referencing themselves
+		schema := &OpenApiSchema{}
+		s.components[name] = schema
+		*schema = *s.object(t)
+	}
+	return &OpenApiSchema{Ref: schemasRefBase + name}
+}
+
+// return the schema of the given struct type. Like in its json encoding, fields of embedded structs are promoted
+// unless shadowed by a field of the same name
+func (s *openApiSchemas) object(t reflect.Type) *OpenApiSchema {
+	schema := &OpenApiSchema{Type: "object", Properties: make(map[string]*OpenApiSchema)}
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			embeddedType := field.Type
+			for embeddedType.Kind() == reflect.Ptr {
+				embeddedType = embeddedType.Elem()
+			}
+			if embeddedType.Kind() == reflect.Struct {
+				embedded = append(embedded, embeddedType)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = s.of(field.Type)
+	}
+	for _, embeddedType := range embedded {
+		for name, prop := range s.object(embeddedType).Properties {
+			if _, shadowed := schema.Properties[name]; !shadowed {
+				schema.Properties[name] = prop
+			}
+		}
+	}
+	return schema
+}
+
+// return the schema of the given element as written in responses, which is its public view without secret fields
+func (s *openApiSchemas) element(e db.IBucketElement) *OpenApiSchema {
+	ref := s.of(reflect.TypeOf(publicElem(e, nil)))
+	for field := range secretFields {
+		delete(s.components[strings.TrimPrefix(ref.Ref, schemasRefBase)].Properties, field)
+	}
+	return ref
+}
+
+// the body of a request or a response of an operation
+type apiContent struct {
+	description	string
+	contentType	string
+	schema		func(s *openApiSchemas) *OpenApiSchema
+	headers		[]string
+}
+
+// the parts of an operation of the api which can't be derived from its route
+type apiOperation struct {
+	summary		string
+	params		[]*OpenApiParameter
+	request		*apiContent
+	responses	map[int]*apiContent
+	// errors other than those every operation may fail with
+	errors		[]int
+}
+
+// the content of json values of the type of the given value
+func jsonContent(description string, v interface{}) *apiContent {
+	return &apiContent{description: description, contentType: ApplicationJson, schema: func(s *openApiSchemas) *OpenApiSchema {
+		return s.of(reflect.TypeOf(v))
+	}}
+}
+
+// the content of one of the json values of the types of the given values
+func oneOfContent(description string, values ...interface{}) *apiContent {
+	return &apiContent{description: description, contentType: ApplicationJson, schema: func(s *openApiSchemas) *OpenApiSchema {
+		schema := &OpenApiSchema{}
+		for _, v := range values {
+			schema.OneOf = append(schema.OneOf, s.of(reflect.TypeOf(v)))
+		}
+		return schema
+	}}
+}
+
+// the content of files of any type
+func fileContent(description, contentType string) *apiContent {
+	return &apiContent{description: description, contentType: contentType, schema: func(_ *openApiSchemas) *OpenApiSchema {
+		if contentType == "multipart/form-data" {
+			return &OpenApiSchema{Type: "object", AdditionalProperties: &OpenApiSchema{Type: "string", Format: "binary"}}
+		}
+		return &OpenApiSchema{Type: "string", Format: "binary"}
+	}}
+}
+
+// a successful response holding a message
+func message(status int, description string) map[int]*apiContent {
+	return map[int]*apiContent{status: jsonContent(description, &Response{})}
+}
+
+// a successful response holding the given value
+func object(status int, description string, v interface{}) map[int]*apiContent {
+	return map[int]*apiContent{status: jsonContent(description, v)}
+}
+
+// a successful response holding the public view of an element of the type of the given element
+func elem(status int, description string, e db.IBucketElement) map[int]*apiContent {
+	return map[int]*apiContent{status: {description: description, contentType: ApplicationJson, schema: func(s *openApiSchemas) *OpenApiSchema {
+		return s.element(e)
+	}}}
+}
+
+// a successful response holding the public views of elements of the type of the given element with the given headers
+func elems(description string, e db.IBucketElement, headers ...string) map[int]*apiContent {
+	return map[int]*apiContent{http.StatusOK: {description: description, contentType: ApplicationJson, headers: headers, schema: func(s *openApiSchemas) *OpenApiSchema {
+		return &OpenApiSchema{Type: "object", Properties: map[string]*OpenApiSchema{"elements": {Type: "array", Items: s.element(e)}}}
+	}}}
+}
+
+// a successful response holding elements listed by a list query
+func listed(description string, e db.IBucketElement) map[int]*apiContent {
+	return elems(description, e, totalCountHeader, submithttp.ElementsLeftToProcess, nextCursorHeader)
+}
+
+// a successful response holding elements listed by paging params
+func paged(description string, e db.IBucketElement) map[int]*apiContent {
+	return elems(description, e, submithttp.ElementsLeftToProcess)
+}
+
+// a connection upgraded to a websocket over which json messages of the type of the given value are sent
+func websocketMessages(description string, v interface{}) map[int]*apiContent {
+	return map[int]*apiContent{http.StatusSwitchingProtocols: jsonContent(fmt.Sprintf("the connection is upgraded to a websocket over which %s are sent as text messages", description), v)}
+}
+
+func queryParam(name, description string, schema *OpenApiSchema) *OpenApiParameter {
+	return &OpenApiParameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+func headerParam(name, description string, required bool) *OpenApiParameter {
+	return &OpenApiParameter{Name: name, In: "header", Description: description, Required: required, Schema: &OpenApiSchema{Type: "string"}}
+}
+
+func stringEnum(values ...string) *OpenApiSchema {
+	return &OpenApiSchema{Type: "string", Enum: values}
+}
+
+var (
+	limitQueryParam		= queryParam(limitParam, "max number of elements to return", &OpenApiSchema{Type: "integer", Format: "int64"})
+	afterIdQueryParam	= queryParam(afterIdParam, "number of elements to skip", &OpenApiSchema{Type: "integer", Format: "int64"})
+	fieldsQueryParam	= queryParam(fieldsParam, "comma separated fields to return of each element. Secret fields are never returned", &OpenApiSchema{Type: "string"})
+	// params of requests listing elements via a list query
+	listQueryParams		= []*OpenApiParameter{
+		limitQueryParam,
+		queryParam(cursorParam, fmt.Sprintf("the '%s' header of the previous page", nextCursorHeader), &OpenApiSchema{Type: "string"}),
+		afterIdQueryParam,
+		queryParam(sortParam, "field to sort by, prefixed by '-' for descending order", &OpenApiSchema{Type: "string"}),
+		fieldsQueryParam,
+		{Name: "filters", In: "query", Style: "form", Explode: true, Schema: &OpenApiSchema{Type: "object", AdditionalProperties: &OpenApiSchema{Type: "string"}},
+			Description: "filters of fields given as field=value, field!=value, field<value, field<=value, field>value or field>=value. " +
+				"Numeric states and statuses can be given by name and collections are filtered by whether they contain the value"},
+	}
+	// params of requests listing elements via paging params
+	pagingQueryParams	= []*OpenApiParameter{limitQueryParam, afterIdQueryParam, fieldsQueryParam}
+	fieldsQueryParams	= []*OpenApiParameter{fieldsQueryParam}
+	forUserHeaderParam	= headerParam(submithttp.ForSubmitUser, "name of the user to return the elements of", false)
+	forCourseHeaderParam	= headerParam(submithttp.ForSubmitCourse, "key of the course to return the elements of", false)
+	forAssHeaderParam	= headerParam(submithttp.ForSubmitAss, "key of the assignment to return the elements of", false)
+	fileHeaderParam		= headerParam(submithttp.SubmitFile, "name of the file", true)
+)
+
+// descriptions of the headers of responses
+var apiResponseHeaders = map[string]string{
+	totalCountHeader:					"total number of elements matching the query",
+	submithttp.ElementsLeftToProcess:	fmt.Sprintf("'%s' if there are more elements to return", trueStr),
+	nextCursorHeader:					fmt.Sprintf("value of the '%s' query param returning the next page", cursorParam),
+	retryAfterHeader:					"seconds to wait before attempting again",
+}
+
+// descriptions of the path params of routes
+var apiPathParams = map[string]*OpenApiParameter{
+	userName:		{Description: "name of the user", Schema: &OpenApiSchema{Type: "string"}},
+	courseNumber:	{Description: "number of the course", Schema: &OpenApiSchema{Type: "integer"}},
+	courseYear:		{Description: "year of the course", Schema: &OpenApiSchema{Type: "integer"}},
+	assDefName:		{Description: "name of the assignment", Schema: &OpenApiSchema{Type: "string"}},
+	testName:		{Description: "name of the test", Schema: &OpenApiSchema{Type: "string"}},
+	agentId:		{Description: "id of the agent", Schema: &OpenApiSchema{Type: "string"}},
+	taskId:			{Description: "id of the task", Schema: &OpenApiSchema{Type: "string"}},
+	messageId:		{Description: "id of the message", Schema: &OpenApiSchema{Type: "string"}},
+	attachmentName:	{Description: "name of the attachment", Schema: &OpenApiSchema{Type: "string"}},
+	forumPostId:	{Description: "id of the forum post", Schema: &OpenApiSchema{Type: "string"}},
+	sessionHandle:	{Description: "handle of the session", Schema: &OpenApiSchema{Type: "string"}},
+	lockoutSubject:	{Description: "name of the user or ip address which is locked out", Schema: &OpenApiSchema{Type: "string"}},
+}
+
+// the operations of the api by method and path template. Each route of the router must have an operation
+var apiOperations = map[string]*apiOperation{
+	"GET /": {summary: "log in, creating a session", responses: object(http.StatusOK, "the login data of the user", &session.LoginData{})},
+	"GET " + openApiPath: {summary: "return this document", responses: map[int]*apiContent{http.StatusOK: {description: "the OpenAPI document of the api", contentType: ApplicationJson,
+		schema: func(_ *openApiSchemas) *OpenApiSchema {
+			return &OpenApiSchema{Type: "object"}
+		}}}},
+	// users
+	"GET /users/": {summary: "list users", params: listQueryParams, responses: listed("the users", &users.User{}), errors: []int{http.StatusBadRequest}},
+	"POST /users/": {summary: "register users", request: jsonContent("the users to register", &struct {
+		Users	[]*users.User	`json:"users"`
+	}{}), responses: message(http.StatusAccepted, "the users were registered"), errors: []int{http.StatusBadRequest}},
+	"GET /users/{userName}": {summary: "return a user", params: fieldsQueryParams, responses: elem(http.StatusOK, "the user", &users.User{}), errors: []int{http.StatusNotFound}},
+	"DELETE /users/{userName}": {summary: "delete a user", responses: message(http.StatusOK, "the user was deleted"), errors: []int{http.StatusNotFound}},
+	"PUT /users/{userName}": {summary: "update a user", request: jsonContent("the updated user", &users.User{}), responses: message(http.StatusAccepted, "the user was updated"),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PUT /users/{userName}/password": {summary: "change the password of the authenticated user", request: jsonContent("the current and the new password", &struct {
+		OldPassword	string	`json:"old_password"`
+		NewPassword	string	`json:"new_password"`
+	}{}), responses: message(http.StatusAccepted, "the password was changed"), errors: []int{http.StatusBadRequest}},
+	"POST /users/{userName}/password_reset": {summary: "reset the password of a user", request: jsonContent("the new password", &struct {
+		Password	string	`json:"password"`
+	}{}), responses: message(http.StatusAccepted, "the password was reset"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /users/{userName}/sessions": {summary: "list the sessions of a user", params: fieldsQueryParams, responses: elems("the sessions", &session.Session{})},
+	"DELETE /users/{userName}/sessions": {summary: "revoke the sessions of a user", responses: message(http.StatusOK, "the sessions were revoked")},
+	// courses
+	"GET /courses/": {summary: "list courses", params: append([]*OpenApiParameter{forUserHeaderParam}, listQueryParams...), responses: listed("the courses", &courses.Course{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /courses/": {summary: "create a course", request: jsonContent("the course", &courses.Course{}), responses: message(http.StatusAccepted, "the course was created"),
+		errors: []int{http.StatusBadRequest}},
+	"GET /courses/{courseNumber}/{courseYear}": {summary: "return a course", params: fieldsQueryParams, responses: elem(http.StatusOK, "the course", &courses.Course{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /courses/{courseNumber}/{courseYear}": {summary: "delete a course", responses: message(http.StatusOK, "the course was deleted"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PUT /courses/{courseNumber}/{courseYear}": {summary: "update a course", request: jsonContent("the updated course", &courses.Course{}),
+		responses: message(http.StatusAccepted, "the course was updated"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /courses/{courseNumber}/{courseYear}/reconcile": {summary: "find mismatches between the students of a course and the instances of its assignments",
+		responses: object(http.StatusOK, "the mismatches", &CourseReconciliation{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /courses/{courseNumber}/{courseYear}/reconcile": {summary: "fix mismatches between the students of a course and the instances of its assignments",
+		responses: object(http.StatusOK, "the fixed mismatches", &CourseReconciliation{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /courses/{courseNumber}/{courseYear}/roster": {summary: "import a roster of students and staff members to a course", request: jsonContent("the roster", &Roster{}),
+		responses: object(http.StatusAccepted, "the result of the import", &RosterImport{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	// assignments
+	"GET /assignment_definitions/": {summary: "list assignments", params: append([]*OpenApiParameter{forCourseHeaderParam}, listQueryParams...),
+		responses: listed("the assignments", &assignments.AssignmentDef{}), errors: []int{http.StatusBadRequest}},
+	"POST /assignment_definitions/": {summary: "create an assignment", request: jsonContent("the assignment", &assignments.AssignmentDef{}),
+		responses: message(http.StatusAccepted, "the assignment was created"), errors: []int{http.StatusBadRequest}},
+	"GET /assignment_definitions/{courseNumber}/{courseYear}/{assDefName}": {summary: "return an assignment", params: fieldsQueryParams,
+		responses: elem(http.StatusOK, "the assignment", &assignments.AssignmentDef{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /assignment_definitions/{courseNumber}/{courseYear}/{assDefName}": {summary: "delete an assignment", responses: message(http.StatusOK, "the assignment was deleted"),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PUT /assignment_definitions/{courseNumber}/{courseYear}/{assDefName}": {summary: "update an assignment",
+		params: []*OpenApiParameter{headerParam(clearScheduleHeader, fmt.Sprintf("comma separated times to clear, '%s' and/or '%s'. Times which aren't given keep their current value otherwise", publishAtField, autoGradeAtField), false)},
+		request: jsonContent("the updated assignment", &assignments.AssignmentDef{}),
+		responses: message(http.StatusAccepted, "the assignment was updated"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PATCH /assignment_definitions/{courseNumber}/{courseYear}/{assDefName}": {summary: "publish an assignment right away, assigning it to the students of its course",
+		responses: message(http.StatusOK, "the assignment was published"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /assignment_instances/": {summary: "list assignment instances", params: append([]*OpenApiParameter{forUserHeaderParam, forAssHeaderParam}, listQueryParams...),
+		responses: listed("the assignment instances", &assignments.AssignmentInstance{}), errors: []int{http.StatusBadRequest}},
+	"GET /assignment_instances/{courseNumber}/{courseYear}/{assDefName}/{userName}": {summary: "return an assignment instance", params: fieldsQueryParams,
+		responses: elem(http.StatusOK, "the assignment instance", &assignments.AssignmentInstance{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PUT /assignment_instances/{courseNumber}/{courseYear}/{assDefName}/{userName}": {summary: "update an assignment instance",
+		request: jsonContent("the updated assignment instance", &assignments.AssignmentInstance{}), responses: message(http.StatusAccepted, "the assignment instance was updated"),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PATCH /assignment_instances/{courseNumber}/{courseYear}/{assDefName}/{userName}": {summary: "submit an assignment instance, running its tests which run on submission",
+		responses: message(http.StatusOK, "the assignment instance was submitted"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	// appeals
+	"GET /appeals/": {summary: "list appeals", params: append([]*OpenApiParameter{forCourseHeaderParam, headerParam(submithttp.ForSubmitAss, "key of the assignment instance to return the appeals of", false)}, listQueryParams...),
+		responses: listed("the appeals", &appeals.Appeal{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /appeals/": {summary: "appeal the grade of an assignment instance", params: []*OpenApiParameter{headerParam(submithttp.ForSubmitAss, "key of the appealed assignment instance", true)},
+		request: jsonContent("the optional details of the appeal", &AppealRequest{}), responses: message(http.StatusAccepted, "the appeal was created"), errors: []int{http.StatusBadRequest}},
+	"GET /appeals/sla": {summary: "report the appeals of a course waiting for a response of the staff",
+		params: []*OpenApiParameter{headerParam(submithttp.ForSubmitCourse, "key of the course", true)}, responses: object(http.StatusOK, "the report", &AppealsSla{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /appeals/{courseNumber}/{courseYear}/{assDefName}/{userName}": {summary: "return an appeal", params: fieldsQueryParams, responses: elem(http.StatusOK, "the appeal", &appeals.Appeal{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PATCH /appeals/{courseNumber}/{courseYear}/{assDefName}/{userName}": {summary: "close or reopen an appeal",
+		params: []*OpenApiParameter{{Name: submithttp.SubmitState, In: "header", Description: "the new state of the appeal", Required: true, Schema: stringEnum(submithttp.AppealStateOpen, submithttp.AppealStateClosed)}},
+		responses: message(http.StatusOK, "the state of the appeal was updated"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PUT /appeals/{courseNumber}/{courseYear}/{assDefName}/{userName}/assignee": {summary: "assign a staff member to handle an appeal",
+		request: jsonContent("the assigned staff member, empty for unassigning the appeal", &AppealAssignee{}), responses: message(http.StatusOK, "the appeal was assigned"),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /appeals/{courseNumber}/{courseYear}/{assDefName}/{userName}/resolution": {summary: "resolve an appeal, updating the grade of the assignment instance",
+		request: jsonContent("the resolution", &AppealResolutionRequest{}), responses: elem(http.StatusOK, "the resolved appeal", &appeals.Appeal{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /appeals/{courseNumber}/{courseYear}/{assDefName}/{userName}/escalation": {summary: "escalate a rejected appeal to the lecturer of the course",
+		request: jsonContent("the optional reason for escalating the appeal", &AppealEscalationRequest{}), responses: elem(http.StatusOK, "the escalated appeal", &appeals.Appeal{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	// tests
+	"GET /tests/": {summary: "list tests", params: append([]*OpenApiParameter{forAssHeaderParam, headerParam(submithttp.ForSubmitUser, fmt.Sprintf("name of the user to return the tests of, given with the '%s' header", submithttp.ForSubmitAss), false)}, listQueryParams...),
+		responses: listed("the tests", &tests.Test{}), errors: []int{http.StatusBadRequest}},
+	"POST /tests/": {summary: "create a test", request: jsonContent("the test", &tests.Test{}), responses: message(http.StatusAccepted, "the test was created"), errors: []int{http.StatusBadRequest}},
+	"GET /tests/{courseNumber}/{courseYear}/{assDefName}/{testName}": {summary: "return a test", params: fieldsQueryParams, responses: elem(http.StatusOK, "the test", &tests.Test{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /tests/{courseNumber}/{courseYear}/{assDefName}/{testName}": {summary: "delete a test", responses: message(http.StatusOK, "the test was deleted"),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PUT /tests/{courseNumber}/{courseYear}/{assDefName}/{testName}": {summary: "update a test", request: jsonContent("the updated test", &tests.Test{}),
+		responses: message(http.StatusAccepted, "the test was updated"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PATCH /tests/{courseNumber}/{courseYear}/{assDefName}/{testName}": {summary: "advance a test from draft to review and from review to published",
+		responses: message(http.StatusOK, "the state of the test was updated"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /test_requests/single": {summary: "run a test on an assignment instance", request: jsonContent("the test and the assignment instance", &TestRequest{}),
+		responses: object(http.StatusAccepted, "the task running the test was created", &ResponseWithTaskId{}), errors: []int{http.StatusBadRequest}},
+	"POST /test_requests/multi": {summary: "run a test on multiple assignment instances, all instances of its assignment if none are given",
+		request: jsonContent("the test and the assignment instances", &MultiTestRequest{}), responses: message(http.StatusAccepted, "the tasks running the test were created"),
+		errors: []int{http.StatusBadRequest}},
+	"GET /test_requests/{taskId}": {summary: "return the result of a test", params: fieldsQueryParams,
+		responses: map[int]*apiContent{http.StatusOK: elem(http.StatusOK, "the result of the test", &agents.TaskResponse{})[http.StatusOK], http.StatusAccepted: jsonContent("the test is still running", &Response{})},
+		errors: []int{http.StatusNotFound, http.StatusRequestTimeout}},
+	"POST /moss_requests/": {summary: "run copy detection on the instances of an assignment", request: jsonContent("the copy detection request", &MossRequest{}),
+		responses: object(http.StatusAccepted, "the task running the copy detection was created", &ResponseWithTaskId{})},
+	"GET /moss_requests/{taskId}": {summary: "return the result of copy detection", params: fieldsQueryParams,
+		responses: map[int]*apiContent{http.StatusOK: elem(http.StatusOK, "the result of the copy detection", &agents.TaskResponse{})[http.StatusOK], http.StatusAccepted: jsonContent("the copy detection is still running", &Response{})},
+		errors: []int{http.StatusNotFound, http.StatusRequestTimeout}},
+	// messages
+	"GET /messages/": {summary: "list message boxes", params: pagingQueryParams, responses: paged("the message boxes", &messages.MessageBox{}), errors: []int{http.StatusBadRequest}},
+	"GET /messages/unread": {summary: "return the number of unread messages of the authenticated user", responses: object(http.StatusOK, "the number of unread messages", &UnreadMessages{}),
+		errors: []int{http.StatusNotFound}},
+	// forum
+	"GET /forum/{courseNumber}/{courseYear}/{assDefName}": {summary: "list the questions in the forum of an assignment, pinned questions first",
+		params: append([]*OpenApiParameter{
+			queryParam(forumSearchParam, "text to search in the questions and their answers", &OpenApiSchema{Type: "string"}),
+			queryParam(forumAnsweredParam, "whether to return only answered or only unanswered questions", &OpenApiSchema{Type: "boolean"}),
+		}, pagingQueryParams...), responses: paged("the questions", &forum.Post{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /forum/{courseNumber}/{courseYear}/{assDefName}": {summary: "ask a question in the forum of an assignment", request: jsonContent("the question", &ForumPostRequest{}),
+		responses: elem(http.StatusAccepted, "the question", &forum.Post{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /forum/{courseNumber}/{courseYear}/{assDefName}/{postId}": {summary: "return a question and its answers", responses: object(http.StatusOK, "the question and its answers", &ForumThread{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /forum/{courseNumber}/{courseYear}/{assDefName}/{postId}": {summary: "delete a question or an answer", responses: message(http.StatusOK, "the post was deleted"),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /forum/{courseNumber}/{courseYear}/{assDefName}/{postId}/answers": {summary: "answer a question", request: jsonContent("the answer", &ForumPostRequest{}),
+		responses: elem(http.StatusAccepted, "the answer", &forum.Post{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PUT /forum/{courseNumber}/{courseYear}/{assDefName}/{postId}/pinned": {summary: "pin or unpin a question", request: jsonContent("whether the question is pinned", &ForumPin{}),
+		responses: elem(http.StatusOK, "the question", &forum.Post{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"PUT /forum/{courseNumber}/{courseYear}/{assDefName}/{postId}/official": {summary: "mark an answer as official or not",
+		request: jsonContent("whether the answer is official", &ForumOfficialAnswer{}), responses: elem(http.StatusOK, "the answer", &forum.Post{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	// search and batches
+	"GET /search": {summary: "search users, courses, assignments, forum posts and messages readable by the authenticated user", params: []*OpenApiParameter{
+		{Name: searchQueryParam, In: "query", Description: "the words to search, all of which must be matched by a prefix of a word of each hit", Required: true, Schema: &OpenApiSchema{Type: "string"}},
+		queryParam(searchTypeParam, "comma separated types of elements to search", &OpenApiSchema{Type: "string"}),
+		limitQueryParam,
+		afterIdQueryParam,
+	}, responses: map[int]*apiContent{http.StatusOK: {description: "the hits", contentType: ApplicationJson, headers: []string{submithttp.ElementsLeftToProcess}, schema: func(s *openApiSchemas) *OpenApiSchema {
+		return s.of(reflect.TypeOf(&SearchResults{}))
+	}}}, errors: []int{http.StatusBadRequest}},
+	"POST /batch": {summary: "execute multiple read requests, each authorized on its own", request: jsonContent("the requests", &BatchRequest{}),
+		responses: object(http.StatusOK, "the responses of the requests, in the order of the requests", &BatchResponse{}), errors: []int{http.StatusBadRequest}},
+	// notifications
+	"GET /notifications/": {summary: "receive the notifications of the authenticated user", responses: websocketMessages("notifications", &Notification{})},
+	// files
+	"GET /files/courses/{courseNumber}/{courseYear}": {summary: "download a file of a course", params: []*OpenApiParameter{fileHeaderParam},
+		responses: map[int]*apiContent{http.StatusOK: fileContent("the file", "application/octet-stream")}, errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /files/courses/{courseNumber}/{courseYear}": {summary: "upload files of a course", request: fileContent("the files", "multipart/form-data"),
+		responses: message(http.StatusAccepted, "the files were uploaded"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /files/courses/{courseNumber}/{courseYear}": {summary: "delete a file of a course", params: []*OpenApiParameter{fileHeaderParam},
+		responses: message(http.StatusAccepted, "the file was deleted"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /files/assignment_definitions/{courseNumber}/{courseYear}/{assDefName}": {summary: "download a file of an assignment", params: []*OpenApiParameter{fileHeaderParam},
+		responses: map[int]*apiContent{http.StatusOK: fileContent("the file", "application/octet-stream")}, errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /files/assignment_definitions/{courseNumber}/{courseYear}/{assDefName}": {summary: "upload files of an assignment", request: fileContent("the files", "multipart/form-data"),
+		responses: message(http.StatusAccepted, "the files were uploaded"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /files/assignment_definitions/{courseNumber}/{courseYear}/{assDefName}": {summary: "delete a file of an assignment", params: []*OpenApiParameter{fileHeaderParam},
+		responses: message(http.StatusAccepted, "the file was deleted"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /files/assignment_instances/{courseNumber}/{courseYear}/{assDefName}/{userName}": {summary: "download a file of an assignment instance", params: []*OpenApiParameter{fileHeaderParam},
+		responses: map[int]*apiContent{http.StatusOK: fileContent("the file", "application/octet-stream")}, errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /files/assignment_instances/{courseNumber}/{courseYear}/{assDefName}/{userName}": {summary: "upload files of an assignment instance", request: fileContent("the files", "multipart/form-data"),
+		responses: message(http.StatusAccepted, "the files were uploaded"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /files/assignment_instances/{courseNumber}/{courseYear}/{assDefName}/{userName}": {summary: "delete a file of an assignment instance", params: []*OpenApiParameter{fileHeaderParam},
+		responses: message(http.StatusAccepted, "the file was deleted"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /files/tests/{courseNumber}/{courseYear}/{assDefName}/{testName}": {summary: "download a file of a test", params: []*OpenApiParameter{fileHeaderParam},
+		responses: map[int]*apiContent{http.StatusOK: fileContent("the file", "application/octet-stream")}, errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /files/tests/{courseNumber}/{courseYear}/{assDefName}/{testName}": {summary: "upload files of a test", request: fileContent("the files", "multipart/form-data"),
+		responses: message(http.StatusAccepted, "the files were uploaded"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /files/tests/{courseNumber}/{courseYear}/{assDefName}/{testName}": {summary: "delete a file of a test", params: []*OpenApiParameter{fileHeaderParam},
+		responses: message(http.StatusAccepted, "the file was deleted"), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	// agents and tasks
+	"GET /agents/endpoint": {summary: "connect an agent to the server", params: []*OpenApiParameter{
+		headerParam(submitws.AgentIdHeader, "id of the agent. Unknown agents are registered and wait for the approval of an admin", true),
+		headerParam(agentCredentialHeader, "the credential issued to the agent when it was approved", true),
+	}, responses: websocketMessages("keepalives, tasks and task responses", &Response{}), errors: []int{http.StatusBadRequest}},
+	"GET /agents/": {summary: "list agents", params: listQueryParams, responses: listed("the agents", &agents.Agent{}), errors: []int{http.StatusBadRequest}},
+	"GET /agents/{agentId}": {summary: "return an agent", params: fieldsQueryParams, responses: elem(http.StatusOK, "the agent", &agents.Agent{}), errors: []int{http.StatusNotFound}},
+	"PATCH /agents/{agentId}": {summary: "approve, drain, disable or revoke an agent", params: []*OpenApiParameter{{Name: submithttp.SubmitState, In: "header", Description: "the new state of the agent",
+		Required: true, Schema: stringEnum(agentStateApproved, agentStateDraining, agentStateDisabled, agentStateRevoked)}},
+		responses: map[int]*apiContent{http.StatusOK: oneOfContent("the state of the agent was updated. A credential is returned when a new one is issued to the agent", &Response{}, &ResponseWithAgentCredential{})},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /tasks/": {summary: "list tasks", params: append([]*OpenApiParameter{headerParam(submithttp.SubmitAgent, "id of the agent to return the tasks of", false)}, listQueryParams...),
+		responses: listed("the tasks", &agents.Task{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /tasks/": {summary: "create a task", request: jsonContent("the task", &agents.Task{}), responses: object(http.StatusAccepted, "the task was created", &ResponseWithTaskId{}),
+		errors: []int{http.StatusBadRequest}},
+	"GET /tasks/{taskId}": {summary: "return a task", params: fieldsQueryParams, responses: elem(http.StatusOK, "the task", &agents.Task{}), errors: []int{http.StatusNotFound}},
+	"GET /tasks/{taskId}/stream": {summary: "stream the output of a running task", responses: websocketMessages("chunks of the output of the task", &TaskOutputChunk{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /task_responses/": {summary: "list task responses", params: pagingQueryParams, responses: paged("the task responses", &agents.TaskResponse{}), errors: []int{http.StatusBadRequest}},
+	"GET /task_responses/{taskId}": {summary: "return the response of a task", params: fieldsQueryParams,
+		responses: map[int]*apiContent{http.StatusOK: elem(http.StatusOK, "the response of the task", &agents.TaskResponse{})[http.StatusOK], http.StatusAccepted: jsonContent("the task is still running", &Response{})},
+		errors: []int{http.StatusNotFound, http.StatusRequestTimeout}},
+	// authentication and authorization
+	"POST /auth/explain": {summary: "explain which policies allow or deny a request of a user", request: jsonContent("the request", &AuthExplainRequest{}),
+		responses: object(http.StatusOK, "the decisions of the policies", &AuthExplanation{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"POST /password_reset/request": {summary: "deliver a password reset token to a user", request: jsonContent("the user", &struct {
+		UserName	string	`json:"user_name"`
+	}{}), responses: message(http.StatusAccepted, "the token was delivered if the user exists"), errors: []int{http.StatusBadRequest, http.StatusTooManyRequests}},
+	"POST /password_reset/confirm": {summary: "reset the password of a user using a password reset token", request: jsonContent("the token and the new password", &struct {
+		UserName	string	`json:"user_name"`
+		Token		string	`json:"token"`
+		Password	string	`json:"password"`
+	}{}), responses: message(http.StatusAccepted, "the password was reset"), errors: []int{http.StatusBadRequest}},
+	"GET /sso/oidc/login": {summary: "start a single sign-on login", responses: map[int]*apiContent{http.StatusFound: {description: "redirection to the identity provider"}},
+		errors: []int{http.StatusNotFound}},
+	"GET /sso/oidc/callback": {summary: "complete a single sign-on login, creating a session", params: []*OpenApiParameter{
+		queryParam("code", "the authorization code given by the identity provider", &OpenApiSchema{Type: "string"}),
+		queryParam("state", "the state of the login", &OpenApiSchema{Type: "string"}),
+		queryParam("error", "the error given by the identity provider", &OpenApiSchema{Type: "string"}),
+		queryParam("error_description", "the description of the error given by the identity provider", &OpenApiSchema{Type: "string"}),
+	}, responses: object(http.StatusOK, "the login data of the user", &session.LoginData{}), errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound}},
+	"GET /sessions/": {summary: "list the sessions of the authenticated user", params: fieldsQueryParams, responses: elems("the sessions", &session.Session{})},
+	"DELETE /sessions/{sessionHandle}": {summary: "revoke a session of the authenticated user", responses: message(http.StatusOK, "the session was revoked"), errors: []int{http.StatusNotFound}},
+	"GET /lockouts/": {summary: "list users and ip addresses locked out after failed login attempts", params: fieldsQueryParams, responses: elems("the lockouts", &users.LoginAttempts{})},
+	"DELETE /lockouts/{subject}": {summary: "clear the lockout of a user or ip address", responses: message(http.StatusOK, "the lockout was cleared"), errors: []int{http.StatusNotFound}},
+	"GET /audit/": {summary: "list the events recorded in the audit trail", params: pagingQueryParams, responses: paged("the events", &audit.Event{}), errors: []int{http.StatusBadRequest}},
+}
+
+// add the operations of the message box in the given path, whose owner is given by the given description
+func addMessageBoxOperations(boxPath, owner string) {
+	msgPath := fmt.Sprintf("%s/{%s}", boxPath, messageId)
+	apiOperations["GET " + boxPath] = &apiOperation{summary: fmt.Sprintf("list the messages visible to the authenticated user in the message box of %s", owner),
+		params: []*OpenApiParameter{
+			limitQueryParam,
+			queryParam(cursorParam, fmt.Sprintf("the '%s' header of the previous page", nextCursorHeader), &OpenApiSchema{Type: "string"}),
+			afterIdQueryParam,
+			queryParam(messageThreadParam, "id of a message to return only it and its replies", &OpenApiSchema{Type: "string"}),
+			fieldsQueryParam,
+		}, responses: elems("the messages", &messages.Message{}, submithttp.ElementsLeftToProcess, nextCursorHeader), errors: []int{http.StatusBadRequest, http.StatusNotFound}}
+	apiOperations["POST " + boxPath] = &apiOperation{summary: fmt.Sprintf("send a message to the message box of %s", owner), request: jsonContent("the message", &MessageRequest{}),
+		responses: elem(http.StatusAccepted, "the message", &messages.Message{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}}
+	apiOperations["GET " + boxPath + "/unread"] = &apiOperation{summary: fmt.Sprintf("return the number of messages in the message box of %s unread by the authenticated user", owner),
+		responses: object(http.StatusOK, "the number of unread messages", &UnreadMessages{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}}
+	apiOperations["POST " + boxPath + "/read"] = &apiOperation{summary: fmt.Sprintf("mark messages in the message box of %s as read by the authenticated user", owner),
+		request: jsonContent("the messages to mark as read, all messages if none are given", &MessagesRead{}), responses: object(http.StatusOK, "the number of unread messages", &UnreadMessages{}),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}}
+	apiOperations["PUT " + msgPath] = &apiOperation{summary: "edit a message sent by the authenticated user", request: jsonContent("the new text of the message", &MessageEdit{}),
+		responses: elem(http.StatusOK, "the edited message", &messages.Message{}), errors: []int{http.StatusBadRequest, http.StatusNotFound}}
+	apiOperations["DELETE " + msgPath] = &apiOperation{summary: "delete a message sent by the authenticated user", responses: message(http.StatusOK, "the message was deleted"),
+		errors: []int{http.StatusBadRequest, http.StatusNotFound}}
+	apiOperations[fmt.Sprintf("GET %s/attachments/{%s}", msgPath, attachmentName)] = &apiOperation{summary: "download an attachment of a message",
+		responses: map[int]*apiContent{http.StatusOK: fileContent("the attachment", "application/octet-stream")},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusServiceUnavailable}}
+}
+
+var pathParamsRegexp = regexp.MustCompile(`{([^}]+)}`)
+
+// return the OpenAPI document of the operations of the routes of the given router
+func newOpenApiDoc(router *mux.Router) (*OpenApiDoc, error) {
+	schemas := newOpenApiSchemas()
+	doc := &OpenApiDoc{
+		OpenApi:	openApiVersion,
+		Info:		&OpenApiInfo{Title: "submit_server", Version: apiVersion, Description: "the api of the submit server. Errors are returned as json objects holding a message"},
+		Paths:		make(map[string]map[string]*OpenApiOperation),
+		Components:	&OpenApiComponents{Schemas: schemas.components, SecuritySchemes: map[string]*OpenApiSecurityScheme{
+			basicAuthScheme:	{Type: "http", Scheme: "basic", Description: "user name and password, creating a session"},
+			cookieScheme:		{Type: "apiKey", In: "cookie", Name: session.SubmitCookie, Description: "the cookie of a session created by a previous request"},
+		}},
+		Security:	[]map[string][]string{{basicAuthScheme: {}}, {cookieScheme: {}}},
+	}
+	content := func(c *apiContent) map[string]*OpenApiMediaType {
+		if c.schema == nil {
+			return nil
+		}
+		return map[string]*OpenApiMediaType{c.contentType: {Schema: c.schema(schemas)}}
+	}
+	errResp := func(status int) *OpenApiResponse {
+		resp := &OpenApiResponse{Description: http.StatusText(status), Content: content(jsonContent("", &Response{}))}
+		if status == http.StatusTooManyRequests {
+			resp.Headers = map[string]*OpenApiHeader{retryAfterHeader: {Description: apiResponseHeaders[retryAfterHeader], Schema: &OpenApiSchema{Type: "integer"}}}
+		}
+		return resp
+	}
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// subrouters have no methods of their own
+			return nil
+		}
+		for _, method := range methods {
+			op, ok := apiOperations[fmt.Sprintf("%s %s", method, template)]
+			if !ok {
+				return fmt.Errorf("no operation describes %s %s", method, template)
+			}
+			public := publicPaths[template]
+			docOp := &OpenApiOperation{Summary: op.summary, Tags: []string{strings.Split(strings.TrimPrefix(template, "/"), "/")[0]}, Responses: make(map[string]*OpenApiResponse)}
+			for _, match := range pathParamsRegexp.FindAllStringSubmatch(template, -1) {
+				param, ok := apiPathParams[match[1]]
+				if !ok {
+					return fmt.Errorf("no description of the '%s' path param of %s", match[1], template)
+				}
+				docOp.Parameters = append(docOp.Parameters, &OpenApiParameter{Name: match[1], In: "path", Description: param.Description, Required: true, Schema: param.Schema})
+			}
+			docOp.Parameters = append(docOp.Parameters, op.params...)
+			if op.request != nil {
+				docOp.RequestBody = &OpenApiRequestBody{Description: op.request.description, Required: true, Content: content(op.request)}
+			}
+			for status, resp := range op.responses {
+				docResp := &OpenApiResponse{Description: resp.description, Content: content(resp)}
+				for _, header := range resp.headers {
+					if docResp.Headers == nil {
+						docResp.Headers = make(map[string]*OpenApiHeader)
+					}
+					docResp.Headers[header] = &OpenApiHeader{Description: apiResponseHeaders[header], Schema: &OpenApiSchema{Type: "string"}}
+				}
+				docOp.Responses[strconv.Itoa(status)] = docResp
+			}
+			for _, status := range op.errors {
+				docOp.Responses[strconv.Itoa(status)] = errResp(status)
+			}
+			if public {
+				docOp.Security = &[]map[string][]string{}
+			} else {
+				// every authenticated operation may fail authentication or authorization
+				docOp.Responses[strconv.Itoa(http.StatusUnauthorized)] = errResp(http.StatusUnauthorized)
+				docOp.Responses[strconv.Itoa(http.StatusForbidden)] = errResp(http.StatusForbidden)
+				docOp.Responses[strconv.Itoa(http.StatusTooManyRequests)] = errResp(http.StatusTooManyRequests)
+			}
+			docOp.Responses[strconv.Itoa(http.StatusInternalServerError)] = errResp(http.StatusInternalServerError)
+			if doc.Paths[template] == nil {
+				doc.Paths[template] = make(map[string]*OpenApiOperation)
+			}
+			doc.Paths[template][strings.ToLower(method)] = docOp
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// return a handler serving the OpenAPI document of the routes of the given router
+func handleOpenApiDoc(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, err := newOpenApiDoc(router)
+		if err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		writeResponse(w, r, http.StatusOK, doc)
+	}
+}
+
+func initOpenApiRouter(r *mux.Router) {
+	r.HandleFunc(openApiPath, handleOpenApiDoc(r)).Methods(http.MethodGet)
+	publicPaths[openApiPath] = true
+}
+
+func init() {
+	addMessageBoxOperations(fmt.Sprintf("/%s/%s/{%s}", db.Messages, db.Users, userName), "a user")
+	addMessageBoxOperations(fmt.Sprintf("/%s/%s/{%s}/{%s}/{%s}/{%s}", db.Messages, db.Appeals, courseNumber, courseYear, assDefName, userName), "an appeal")
+	addMessageBoxOperations(fmt.Sprintf("/%s/%s/{%s}/{%s}", db.Messages, db.Courses, courseNumber, courseYear), "a course, holding its announcements")
+	addMessageBoxOperations(fmt.Sprintf("/%s/%s/{%s}/{%s}/{%s}/{%s}", db.Messages, db.Tests, courseNumber, courseYear, assDefName, testName), "a test")
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/session"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOpenApiDoc(t *testing.T) {
+	_, cleanup := getDbForAssInstHandlersTest()
+	defer cleanup()
+	cleanupSess := session.InitSessionForTest()
+	defer cleanupSess()
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router := InitServer(0, nil, wg, ctx).Handler.(*mux.Router)
+	// every route must be described by an operation and every operation must describe a route
+	described := make(map[string]bool)
+	if err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			op := fmt.Sprintf("%s %s", method, template)
+			if _, ok := apiOperations[op]; !ok {
+				t.Errorf("route %s lacks an operation in the OpenAPI document", op)
+			}
+			described[op] = true
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("error walking router: %v", err)
+	}
+	for op := range apiOperations {
+		if !described[op] {
+			t.Errorf("operation %s in the OpenAPI document describes no route", op)
+		}
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+	// the document is served without authentication
+	r, err := http.NewRequest(http.MethodGet, openApiPath, nil)
+	if err != nil {
+		t.Fatalf("error creating http request for test: %v", err)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("request to %s produced status code %d instead of %d: %s", openApiPath, w.Code, http.StatusOK, w.Body.String())
+	}
+	doc := &OpenApiDoc{}
+	if err := json.Unmarshal(w.Body.Bytes(), doc); err != nil {
+		t.Fatalf("error parsing OpenAPI document: %v", err)
+	}
+	for op := range apiOperations {
+		parts := strings.SplitN(op, " ", 2)
+		docOp := doc.Paths[parts[1]][strings.ToLower(parts[0])]
+		if docOp == nil {
+			t.Fatalf("OpenAPI document lacks operation %s", op)
+		}
+		if _, ok := docOp.Responses["500"]; !ok {
+			t.Fatalf("OpenAPI document lacks the internal error response of %s", op)
+		}
+		if publicPaths[parts[1]] != (docOp.Security != nil) {
+			t.Fatalf("security of %s in OpenAPI document doesn't match its authentication", op)
+		}
+		// authenticated operations are limited by the login protection, public ones only if they declare it
+		limited := !publicPaths[parts[1]]
+		for _, status := range apiOperations[op].errors {
+			limited = limited || status == http.StatusTooManyRequests
+		}
+		if _, ok := docOp.Responses["429"]; ok != limited {
+			t.Fatalf("too many requests response of %s in OpenAPI document doesn't match its authentication", op)
+		}
+	}
+	// all referenced schemas are defined and no secret field is described
+	body := w.Body.String()
+	for _, ref := range strings.Split(body, `"$ref":"`+schemasRefBase)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+		if doc.Components.Schemas[name] == nil {
+			t.Fatalf("OpenAPI document references undefined schema %s", name)
+		}
+	}
+	for name, schema := range doc.Components.Schemas {
+		if strings.HasPrefix(name, "Public") {
+			for field := range secretFields {
+				if _, ok := schema.Properties[field]; ok {
+					t.Fatalf("schema %s in OpenAPI document describes secret field %s", name, field)
+				}
+			}
+		}
+	}
+	if doc.Components.Schemas["PublicUser"] == nil || doc.Components.Schemas["PublicUser"].Properties["user_name"] == nil {
+		t.Fatalf("OpenAPI document lacks the schema of users: %v", doc.Components.Schemas["PublicUser"])
+	}
+}
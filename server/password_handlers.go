@@ -0,0 +1,237 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/mail"
+	"github.com/DAv10195/submit_server/session"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// possible password reset notifier kinds
+const (
+	PasswordResetNotifierEmail	= "email"
+	PasswordResetNotifierLog	= "log"
+)
+
+// delivers password reset tokens to users
+type passwordResetNotifier interface {
+	notify(user *users.User, token string, expiresAt time.Time) error
+}
+
+// delivers password reset tokens by email
+type emailPasswordResetNotifier struct {}
+
+func (n *emailPasswordResetNotifier) notify(user *users.User, token string, expiresAt time.Time) error {
+	transport := mail.GetTransport()
+	if transport == nil {
+		return errors.New("email delivery is disabled")
+	}
+	if user.Email == "" {
+		return fmt.Errorf("user \"%s\" has no email address", user.UserName)
+	}
+	subject, body, err := mail.Render(mail.PasswordReset, &mail.TemplateData{UserName: user.UserName, Token: token, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+	return transport.Send(user.Email, subject, body)
+}
+
+// prints password reset tokens to the log. Meant for development environments with no mail server
+type logPasswordResetNotifier struct {}
+
+func (n *logPasswordResetNotifier) notify(user *users.User, token string, expiresAt time.Time) error {
+	logger.Warnf("password reset token for user \"%s\" (valid until %s): %s", user.UserName, expiresAt.Format(time.RFC3339), token)
+	return nil
+}
+
+var resetNotifier passwordResetNotifier = &emailPasswordResetNotifier{}
+
+// set the kind of the notifier delivering password reset tokens to users
+func SetPasswordResetNotifier(kind string) error {
+	switch kind {
+		case PasswordResetNotifierEmail:
+			resetNotifier = &emailPasswordResetNotifier{}
+		case PasswordResetNotifierLog:
+			resetNotifier = &logPasswordResetNotifier{}
+		default:
+			return fmt.Errorf("invalid password reset notifier: %s", kind)
+	}
+	return nil
+}
+
+// set the password of the given user and revoke all of its sessions, so whoever knew the previous password can't
+// keep using them
+func updatePassword(user *users.User, password, asUser string) error {
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	if err := db.Update(asUser, user); err != nil {
+		return err
+	}
+	_, err := session.RevokeAllOfUser(user.UserName)
+	return err
+}
+
+// change the password of the authenticated user, given his current password
+func handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(authenticatedUser).(*users.User)
+	var body struct {
+		OldPassword	string	`json:"old_password"`
+		NewPassword	string	`json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	// the current password can't be brute forced here either, so it's checked like a login attempt
+	now, ip := time.Now().UTC(), session.RemoteIp(r)
+	retryAfter, err := loginRetryAfter(user.UserName, ip, now)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if retryAfter > 0 {
+		writeTooManyAttempts(w, r, retryAfter)
+		return
+	}
+	if _, err := users.Authenticate(user.UserName, body.OldPassword); err != nil {
+		if _, ok := err.(*users.ErrAuthenticationFailure); ok {
+			if err := recordLoginFailure(user.UserName, ip, now); err != nil {
+				logger.WithError(err).Errorf("error recording failed login attempt of user \"%s\"", user.UserName)
+			}
+			writeStrErrResp(w, r, http.StatusForbidden, "incorrect password")
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if err := recordLoginSuccess(user.UserName); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := users.ValidatePasswordStrength(user.UserName, body.NewPassword); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := updatePassword(user, body.NewPassword, user.UserName); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// a password reset token issued before the change is no longer needed
+	if err := db.DeleteKeysFromBucket([]byte(db.PasswordResetTokens), user.Key()); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResponse(w, r, http.StatusAccepted, &Response{Message: "password changed successfully"})
+}
+
+// issue a password reset token for the given user and deliver it to him. The response is the same whether the user
+// exists or not, so it can't be used for finding which users exist
+func handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		UserName	string	`json:"user_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	// requests from an ip address are limited like failed login attempts, so tokens can't be requested in bulk
+	now, ip := time.Now().UTC(), session.RemoteIp(r)
+	retryAfter, err := subjectsRetryAfter(now, users.LoginAttemptsSubject(users.SubjectResetIp, ip))
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if retryAfter > 0 {
+		writeTooManyAttempts(w, r, retryAfter)
+		return
+	}
+	if _, _, err := recordSubjectFailure(users.SubjectResetIp, ip, loginProtection.MaxIpFailures, now); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	resp := &Response{Message: "if the user exists, a password reset token was delivered to it"}
+	user, err := users.Get(body.UserName)
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			writeResponse(w, r, http.StatusAccepted, resp)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	// requests for a user are limited too, so its mailbox can't be flooded. The response doesn't tell whether a token
+	// was delivered, so it can't be used for finding which users exist
+	retryAfter, err = subjectsRetryAfter(now, users.LoginAttemptsSubject(users.SubjectResetUser, user.UserName))
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if retryAfter > 0 {
+		writeResponse(w, r, http.StatusAccepted, resp)
+		return
+	}
+	if _, _, err := recordSubjectFailure(users.SubjectResetUser, user.UserName, loginProtection.MaxUserFailures, now); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	resetToken, token, err := users.NewPasswordResetToken(user.UserName, passwordResetTokenTtl, db.System, true)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := resetNotifier.notify(user, token, resetToken.ExpiresAt); err != nil {
+		logger.WithError(err).Errorf("error delivering password reset token to user \"%s\"", user.UserName)
+	}
+	writeResponse(w, r, http.StatusAccepted, resp)
+}
+
+// reset the password of the given user using a password reset token delivered to him
+func handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		UserName	string	`json:"user_name"`
+		Token		string	`json:"token"`
+		Password	string	`json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := users.ValidatePasswordStrength(body.UserName, body.Password); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := users.ConsumePasswordResetToken(body.UserName, body.Token); err != nil {
+		if _, ok := err.(*users.ErrInvalidResetToken); ok {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	user, err := users.Get(body.UserName)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := updatePassword(user, body.Password, user.UserName); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResponse(w, r, http.StatusAccepted, &Response{Message: "password reset successfully"})
+}
+
+func initPasswordResetRouter(r *mux.Router) {
+	basePath := "/password_reset"
+	router := r.PathPrefix(basePath).Subrouter()
+	router.HandleFunc("/request", handleRequestPasswordReset).Methods(http.MethodPost)
+	publicPaths[fmt.Sprintf("%s/request", basePath)] = true
+	router.HandleFunc("/confirm", handleConfirmPasswordReset).Methods(http.MethodPost)
+	publicPaths[fmt.Sprintf("%s/confirm", basePath)] = true
+}
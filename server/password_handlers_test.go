@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/session"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// a notifier keeping the tokens delivered to users
+type testPasswordResetNotifier struct {
+	tokens		map[string]string
+	delivered	int
+}
+
+func (n *testPasswordResetNotifier) notify(user *users.User, token string, _ time.Time) error {
+	n.tokens[user.UserName] = token
+	n.delivered++
+	return nil
+}
+
+func TestPasswordChangeAndReset(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	cleanupSess := session.InitSessionForTest()
+	defer cleanupSess()
+	if _, err := users.NewUserBuilder(db.System, true).WithUserName("student").WithPassword("student").WithRoles(users.StandardUser).Build(); err != nil {
+		t.Fatalf("error creating user for test: %v", err)
+	}
+	// failed attempts aren't delayed, so the failures of a test case don't affect the following ones
+	prevConf := loginProtection
+	defer SetLoginProtection(prevConf)
+	SetLoginProtection(&LoginProtectionConfig{MaxUserFailures: DefMaxUserLoginFailures, MaxIpFailures: DefMaxIpLoginFailures, LockoutDuration: DefLoginLockoutDuration})
+	notifier := &testPasswordResetNotifier{tokens: make(map[string]string)}
+	prevNotifier := resetNotifier
+	resetNotifier = notifier
+	defer func() {
+		resetNotifier = prevNotifier
+	}()
+	router := newTestRouter(t)
+	initUsersRouter(router.Router, router.am)
+	initPasswordResetRouter(router.Router)
+	// log in, keeping the session cookie
+	w := router.sendWith(http.MethodGet, "/", "", basicAuth("student", "student"))
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) == 0 {
+		t.Fatalf("login produced status code %d and no session cookie", w.Code)
+	}
+	withSession := withCookies(w.Result().Cookies())
+	passwordPath := fmt.Sprintf("/%s/student/password", db.Users)
+	testCases := []struct{
+		name	string
+		method	string
+		path	string
+		body	string
+		auth	func(r *http.Request)
+		status	int
+	}{
+		{"test change with wrong password", http.MethodPut, passwordPath, `{"old_password":"wrong","new_password":"Passw0rd123"}`, withSession, http.StatusForbidden},
+		{"test change to weak password", http.MethodPut, passwordPath, `{"old_password":"student","new_password":"weak"}`, withSession, http.StatusBadRequest},
+		{"test change password of other user", http.MethodPut, fmt.Sprintf("/%s/%s/password", db.Users, users.Admin), `{"old_password":"admin","new_password":"Passw0rd123"}`, withSession, http.StatusForbidden},
+		{"test change password", http.MethodPut, passwordPath, `{"old_password":"student","new_password":"Passw0rd123"}`, withSession, http.StatusAccepted},
+		{"test session invalidated by change", http.MethodGet, "/", "", withSession, http.StatusUnauthorized},
+		{"test old password after change", http.MethodGet, "/", "", basicAuth("student", "student"), http.StatusUnauthorized},
+		{"test new password after change", http.MethodGet, "/", "", basicAuth("student", "Passw0rd123"), http.StatusOK},
+		{"test request reset of unknown user", http.MethodPost, "/password_reset/request", `{"user_name":"unknown"}`, nil, http.StatusAccepted},
+		{"test request reset", http.MethodPost, "/password_reset/request", `{"user_name":"student"}`, nil, http.StatusAccepted},
+		{"test confirm reset with wrong token", http.MethodPost, "/password_reset/confirm", `{"user_name":"student","token":"wrong","password":"Reset1234"}`, nil, http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		if w := router.sendWith(tc.method, tc.path, tc.body, tc.auth); w.Code != tc.status {
+			t.Fatalf("test case [ %s ] produced status code %d instead of the expected %d status code", tc.name, w.Code, tc.status)
+		}
+	}
+	if _, ok := notifier.tokens["unknown"]; ok {
+		t.Fatal("expected no token to be delivered for an unknown user")
+	}
+	token, ok := notifier.tokens["student"]
+	if !ok {
+		t.Fatal("expected a token to be delivered to the user")
+	}
+	confirmBody := fmt.Sprintf(`{"user_name":"student","token":"%s","password":"Reset1234"}`, token)
+	if w := router.sendWith(http.MethodPost, "/password_reset/confirm", confirmBody, nil); w.Code != http.StatusAccepted {
+		t.Fatalf("confirming password reset produced status code %d instead of %d", w.Code, http.StatusAccepted)
+	}
+	if w := router.sendWith(http.MethodPost, "/password_reset/confirm", confirmBody, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("reusing a password reset token produced status code %d instead of %d", w.Code, http.StatusBadRequest)
+	}
+	if _, err := users.Authenticate("student", "Reset1234"); err != nil {
+		t.Fatalf("expected password reset to take effect: %v", err)
+	}
+}
+
+func TestPasswordProtection(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	cleanupSess := session.InitSessionForTest()
+	defer cleanupSess()
+	if _, err := users.NewUserBuilder(db.System, true).WithUserName("student").WithPassword("student").WithRoles(users.StandardUser).Build(); err != nil {
+		t.Fatalf("error creating user for test: %v", err)
+	}
+	prevConf := loginProtection
+	defer SetLoginProtection(prevConf)
+	SetLoginProtection(&LoginProtectionConfig{MaxUserFailures: 2, MaxIpFailures: 4, LockoutDuration: time.Hour})
+	notifier := &testPasswordResetNotifier{tokens: make(map[string]string)}
+	prevNotifier := resetNotifier
+	resetNotifier = notifier
+	defer func() {
+		resetNotifier = prevNotifier
+	}()
+	router := newTestRouter(t)
+	initUsersRouter(router.Router, router.am)
+	initPasswordResetRouter(router.Router)
+	w := router.sendWith(http.MethodGet, "/", "", basicAuth("student", "student"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("login produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	withSession := withCookies(w.Result().Cookies())
+	// wrong current passwords count as failed login attempts
+	passwordPath := fmt.Sprintf("/%s/student/password", db.Users)
+	for _, expected := range []int{http.StatusForbidden, http.StatusForbidden, http.StatusTooManyRequests} {
+		if w := router.sendWith(http.MethodPut, passwordPath, `{"old_password":"wrong","new_password":"Passw0rd123"}`, withSession); w.Code != expected {
+			t.Fatalf("changing password with wrong current password produced status code %d instead of %d", w.Code, expected)
+		}
+	}
+	if w := router.sendWith(http.MethodPut, passwordPath, `{"old_password":"student","new_password":"Passw0rd123"}`, withSession); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("changing password of locked out user produced status code %d instead of %d", w.Code, http.StatusTooManyRequests)
+	}
+	// tokens stop being delivered to a user silently, while an ip address is told to wait
+	for _, expected := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		if w := router.sendWith(http.MethodPost, "/password_reset/request", `{"user_name":"student"}`, nil); w.Code != expected {
+			t.Fatalf("requesting password reset produced status code %d instead of %d", w.Code, expected)
+		}
+	}
+	if notifier.delivered != 2 {
+		t.Fatalf("expected 2 password reset tokens to be delivered but got %d", notifier.delivered)
+	}
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/agents"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/tests"
+	"github.com/DAv10195/submit_server/elements/users"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// relations between the authenticated user and the resource of a request which authorization rules can require
+const (
+	relationAnyone				= "anyone"
+	relationAdmin				= "admin"
+	relationSecretary			= "secretary"
+	relationAgent				= "agent"
+	relationCourseStaff			= "staff of course"
+	relationCourseStudent		= "student of course"
+	relationCoursePermission	= "course permission"
+	relationOwner				= "owner"
+)
+
+// the resource a request refers to, as far as its authorization is concerned
+type authResource struct {
+	course	string
+	owner	string
+	elem	interface{}
+}
+
+// resolves the resource a request refers to. An error means the resource can't be resolved, in which case the request
+// is allowed so its handler can fail it with an appropriate error
+type resourceResolver func(*authRequest) (*authResource, error)
+
+// a named condition on a request and the resource it refers to
+type condition struct {
+	name	string
+	check	func(*authRequest, *authResource) bool
+}
+
+// a rule allowing requests with one of its methods (or any method if it has none) made by users having its relation to
+// the resource of the request, only if its condition holds when it has one
+type rule struct {
+	relation	string
+	permission	string
+	methods		[]string
+	condition	*condition
+}
+
+// a declarative authorization policy for requests to a resource type. A request is allowed if one of the rules of the
+// policy allows it
+type policy struct {
+	resource	string
+	resolve		resourceResolver
+	rules		[]*rule
+}
+
+// a request being authorized. Elements needed for authorizing the request are loaded through it, so each of them is
+// loaded from the db at most once per request
+type authRequest struct {
+	user		*users.User
+	request		*http.Request
+	body		[]byte
+	bodyErr		error
+	bodyRead	bool
+	elements	map[string]interface{}
+}
+
+// return a rule allowing requests with the given methods (or any method if none are given) made by users having the
+// given relation to the resource of the request
+func allow(relation string, methods ...string) *rule {
+	return &rule{relation: relation, methods: methods}
+}
+
+// return a rule allowing requests with the given methods (or any method if none are given) made by course staff
+// members having the given permission in the course of the resource of the request
+func allowWithPermission(permission string, methods ...string) *rule {
+	return &rule{relation: relationCoursePermission, permission: permission, methods: methods}
+}
+
+// allow requests only when the given condition holds
+func (r *rule) when(c *condition) *rule {
+	r.condition = c
+	return r
+}
+
+func (r *rule) String() string {
+	str := r.relation
+	if r.permission != "" {
+		str = fmt.Sprintf("%s '%s'", str, r.permission)
+	}
+	if len(r.methods) > 0 {
+		str = fmt.Sprintf("%s for %s", str, strings.Join(r.methods, ", "))
+	}
+	if r.condition != nil {
+		str = fmt.Sprintf("%s when %s", str, r.condition.name)
+	}
+	return str
+}
+
+// check if the rule allows the given request to the given resource
+func (r *rule) allows(ar *authRequest, res *authResource) bool {
+	if len(r.methods) > 0 {
+		methodMatches := false
+		for _, method := range r.methods {
+			if method == ar.request.Method {
+				methodMatches = true
+				break
+			}
+		}
+		if !methodMatches {
+			return false
+		}
+	}
+	return ar.hasRelation(res, r.relation, r.permission) && (r.condition == nil || r.condition.check(ar, res))
+}
+
+// return a new policy for the given resource type
+func newPolicy(resource string, resolve resourceResolver, rules ...*rule) *policy {
+	return &policy{resource: resource, resolve: resolve, rules: rules}
+}
+
+// evaluate the policy for the given request. Returns whether the request is allowed and the reason for it
+func (p *policy) evaluate(ar *authRequest) (bool, string) {
+	res := &authResource{}
+	if p.resolve != nil {
+		var err error
+		if res, err = p.resolve(ar); err != nil {
+			return true, fmt.Sprintf("%s can't be resolved (%v), leaving the request for its handler to fail", p.resource, err)
+		}
+	}
+	var ruleStrings []string
+	for _, r := range p.rules {
+		if r.allows(ar, res) {
+			return true, fmt.Sprintf("allowed by rule [ %s ]", r)
+		}
+		ruleStrings = append(ruleStrings, r.String())
+	}
+	return false, fmt.Sprintf("not allowed by any of the rules [ %s ]", strings.Join(ruleStrings, " | "))
+}
+
+// return a new request for authorizing the given request of the given user
+func newAuthRequest(user *users.User, r *http.Request) *authRequest {
+	return &authRequest{user: user, request: r, elements: make(map[string]interface{})}
+}
+
+// decode the body of the request into the given value, keeping the body readable for the handler of the request
+func (ar *authRequest) decodeBody(v interface{}) error {
+	if !ar.bodyRead {
+		ar.bodyRead = true
+		if ar.request.Body != nil {
+			ar.body, ar.bodyErr = ioutil.ReadAll(ar.request.Body)
+			ar.request.Body = ioutil.NopCloser(bytes.NewBuffer(ar.body))
+		}
+	}
+	if ar.bodyErr != nil {
+		return ar.bodyErr
+	}
+	return json.NewDecoder(bytes.NewBuffer(ar.body)).Decode(v)
+}
+
+// load the element with the given key from the given bucket into the given element, unless it was already loaded
+func (ar *authRequest) load(bucket, key string, elem interface{}) (interface{}, error) {
+	cacheKey := fmt.Sprintf("%s/%s", bucket, key)
+	if loaded, ok := ar.elements[cacheKey]; ok {
+		return loaded, nil
+	}
+	elemBytes, err := db.GetFromBucket([]byte(bucket), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(elemBytes, elem); err != nil {
+		return nil, err
+	}
+	ar.elements[cacheKey] = elem
+	return elem, nil
+}
+
+func (ar *authRequest) course(key string) (*courses.Course, error) {
+	elem, err := ar.load(db.Courses, key, &courses.Course{})
+	if err != nil {
+		return nil, err
+	}
+	return elem.(*courses.Course), nil
+}
+
+func (ar *authRequest) assDef(key string) (*assignments.AssignmentDef, error) {
+	elem, err := ar.load(db.AssignmentDefinitions, key, &assignments.AssignmentDef{})
+	if err != nil {
+		return nil, err
+	}
+	return elem.(*assignments.AssignmentDef), nil
+}
+
+func (ar *authRequest) assInst(key string) (*assignments.AssignmentInstance, error) {
+	elem, err := ar.load(db.AssignmentInstances, key, &assignments.AssignmentInstance{})
+	if err != nil {
+		return nil, err
+	}
+	return elem.(*assignments.AssignmentInstance), nil
+}
+
+func (ar *authRequest) test(key string) (*tests.Test, error) {
+	elem, err := ar.load(db.Tests, key, &tests.Test{})
+	if err != nil {
+		return nil, err
+	}
+	return elem.(*tests.Test), nil
+}
+
+func (ar *authRequest) task(id string) (*agents.Task, error) {
+	elem, err := ar.load(db.Tasks, id, &agents.Task{})
+	if err != nil {
+		return nil, err
+	}
+	return elem.(*agents.Task), nil
+}
+
+// check if the user of the request has the given relation to the given resource
+func (ar *authRequest) hasRelation(res *authResource, relation, permission string) bool {
+	switch relation {
+		case relationAnyone:
+			return true
+		case relationAdmin:
+			return ar.user.Roles.Contains(users.Admin)
+		case relationSecretary:
+			return ar.user.Roles.Contains(users.Secretary)
+		case relationAgent:
+			return ar.user.Roles.Contains(users.Agent)
+		case relationCourseStaff:
+			return res.course != "" && ar.user.CoursesAsStaff.Contains(res.course)
+		case relationCourseStudent:
+			return res.course != "" && ar.user.CoursesAsStudent.Contains(res.course)
+		case relationCoursePermission:
+			if res.course == "" || !ar.user.CoursesAsStaff.Contains(res.course) {
+				return false
+			}
+			course, err := ar.course(res.course)
+			if err != nil {
+				return false
+			}
+			return hasPermissionInCourse(ar.user, course, permission)
+		case relationOwner:
+			return res.owner != "" && res.owner == ar.user.UserName
+	}
+	return false
+}
+
+// resolve the course of the course number and year path params of the request
+func resolveCourseFromPath(ar *authRequest) (*authResource, error) {
+	courseKey, err := getCourseKeyFromRequest(ar.request)
+	if err != nil {
+		return nil, err
+	}
+	return &authResource{course: courseKey}, nil
+}
+
+// resolve the course of the course number and year path params of the request, which should exist
+func resolveExistingCourseFromPath(ar *authRequest) (*authResource, error) {
+	res, err := resolveCourseFromPath(ar)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ar.course(res.course); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// resolve the assignment instance of the course number and year, assignment def name and user name path params of the
+// request, which is owned by its user
+func resolveAssInstFromPath(ar *authRequest) (*authResource, error) {
+	res, err := resolveCourseFromPath(ar)
+	if err != nil {
+		return nil, err
+	}
+	assKey, err := getAssInstKey(ar.request)
+	if err != nil {
+		return nil, err
+	}
+	ass, err := ar.assInst(assKey)
+	if err != nil {
+		return nil, err
+	}
+	res.owner, res.elem = ass.UserName, ass
+	return res, nil
+}
+
+// resolve the test of the course number and year, assignment def name and test name path params of the request, which
+// is owned by its creator
+func resolveTestFromPath(ar *authRequest) (*authResource, error) {
+	res, err := resolveCourseFromPath(ar)
+	if err != nil {
+		return nil, err
+	}
+	testKey, err := getTestKey(ar.request)
+	if err != nil {
+		return nil, err
+	}
+	test, err := ar.test(testKey)
+	if err != nil {
+		return nil, err
+	}
+	res.owner, res.elem = test.CreatedBy, test
+	return res, nil
+}
+
+// resolve the course of the assignment def with the given key
+func resolveCourseOfAssDefKey(assDefKey string) (*authResource, error) {
+	split := strings.Split(assDefKey, db.KeySeparator)
+	if len(split) != 3 {
+		return nil, fmt.Errorf("invalid assignment def key ('%s')", assDefKey)
+	}
+	return &authResource{course: strings.Join(split[:2], db.KeySeparator)}, nil
+}
+
@@ -0,0 +1,465 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	submithttp "github.com/DAv10195/submit_commons/http"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/agents"
+	"github.com/DAv10195/submit_server/elements/appeals"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/tests"
+	"github.com/DAv10195/submit_server/elements/users"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// comparison operators of filter expressions
+const (
+	opEq	= "="
+	opNe	= "!="
+	opLt	= "<"
+	opLe	= "<="
+	opGt	= ">"
+	opGe	= ">="
+)
+
+// query params which aren't filter expressions
+var reservedQueryParams = map[string]bool{limitParam: true, afterIdParam: true, cursorParam: true, sortParam: true, fieldsParam: true}
+
+// names which can be used in filter expressions instead of the numeric values of fields, by bucket and field
+var namedQueryValues = map[string]map[string]map[string]int{
+	db.AssignmentDefinitions: {
+		"state":	{"draft": assignments.Draft, "published": assignments.Published},
+		"status":	{"none": assignments.AutoGradeNone, "scheduled": assignments.AutoGradeScheduled, "in_progress": assignments.AutoGradeInProgress, "done": assignments.AutoGradeDone},
+	},
+	db.AssignmentInstances: {
+		"state":	{"assigned": assignments.Assigned, "submitted": assignments.Submitted, "graded": assignments.Graded},
+	},
+	db.Tests: {
+		"state":	{"draft": tests.Draft, "in_review": tests.InReview, "published": tests.Published},
+		"runs_on":	{"on_submit": tests.OnSubmit, "on_demand": tests.OnDemand, "on_deadline": tests.OnDeadline},
+	},
+	db.Appeals: {
+		"state":	{"open": appeals.Open, "closed": appeals.Closed, "escalated": appeals.Escalated},
+	},
+	db.Agents: {
+		"status":	{"up": agents.Up, "down": agents.Down},
+		"state":	{"legacy": agents.Legacy, "pending": agents.Pending, "approved": agents.Approved, "draining": agents.Draining, "disabled": agents.Disabled, "revoked": agents.Revoked},
+	},
+	db.Tasks: {
+		"status":	{"ready": agents.TaskStatusReady, "done": agents.TaskStatusDone, "assigned": agents.TaskStatusAssigned, "in_progress": agents.TaskStatusInProgress,
+			"processing": agents.TaskStatusProcessing, "ok": agents.TaskStatusOk, "timeout": agents.TaskStatusTimeout, "error": agents.TaskStatusError},
+	},
+}
+
+// error indicating a list query which can't be run
+type ErrInvalidQuery struct {
+	Message	string
+}
+
+func (e *ErrInvalidQuery) Error() string {
+	return fmt.Sprintf("invalid query: %s", e.Message)
+}
+
+// a filter expression of a list request, such as "grade<60"
+type queryFilter struct {
+	field	string
+	op		string
+	value	string
+}
+
+// the position in a sorted list after which the next page starts. It's the sort value and key of the last element of
+// the previous page rather than an index, so it isn't shifted when elements are inserted or deleted
+type queryCursor struct {
+	value	interface{}
+	key		string
+}
+
+func (c *queryCursor) encode() string {
+	cursorBytes, _ := json.Marshal([]interface{}{c.value, c.key})
+	return base64.RawURLEncoding.EncodeToString(cursorBytes)
+}
+
+func decodeQueryCursor(encoded string) (*queryCursor, error) {
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor '%s'", encoded)
+	}
+	var decoded []interface{}
+	if err := json.Unmarshal(cursorBytes, &decoded); err != nil || len(decoded) != 2 {
+		return nil, fmt.Errorf("invalid cursor '%s'", encoded)
+	}
+	key, ok := decoded[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid cursor '%s'", encoded)
+	}
+	return &queryCursor{value: decoded[0], key: key}, nil
+}
+
+// the filtering, sorting and paging of a list request over the elements of a bucket. Elements are filtered and sorted
+// by the fields of their view for the user who requested them (nil if unauthenticated), so hidden fields can't be
+// guessed
+type listQuery struct {
+	viewer		*users.User
+	bucket		string
+	params		*submithttp.PagingParams
+	cursor		*queryCursor
+	sortField	string
+	descending	bool
+	filters		[]*queryFilter
+}
+
+// a page of elements returned by a list query
+type queryPage struct {
+	elements	[]db.IBucketElement
+	total		int
+	// the cursor of the next page (empty if this is the last page)
+	nextCursor	string
+}
+
+// return the json names of the fields of the given element, including fields of embedded structs
+func queryFields(t reflect.Type, fields map[string]bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			queryFields(field.Type, fields)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+}
+
+// parse a filter expression given as a query param. Since the operators aren't encoded as "key=value", "grade<60" is
+// parsed as a key with no value and "grade<=60" as the key "grade<" with the value "60"
+func parseQueryFilter(key, value string) *queryFilter {
+	if value == "" {
+		for _, op := range []string{opLe, opGe, opNe, opLt, opGt} {
+			if split := strings.SplitN(key, op, 2); len(split) == 2 {
+				return &queryFilter{field: split[0], op: op, value: split[1]}
+			}
+		}
+		return &queryFilter{field: key, op: opEq}
+	}
+	for _, op := range []string{opLt, opGt} {
+		if strings.HasSuffix(key, op) {
+			return &queryFilter{field: strings.TrimSuffix(key, op), op: op + opEq, value: value}
+		}
+	}
+	if strings.HasSuffix(key, "!") {
+		return &queryFilter{field: strings.TrimSuffix(key, "!"), op: opNe, value: value}
+	}
+	return &queryFilter{field: key, op: opEq, value: value}
+}
+
+// parse the list query of the given request over the given bucket, whose elements are of the type of the given element
+func newListQuery(r *http.Request, bucket string, elem db.IBucketElement) (*listQuery, error) {
+	params, err := submithttp.PagingParamsFromRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing query params: %v", err)
+	}
+	if params.Limit <= 0 {
+		return nil, fmt.Errorf("invalid limit %d", params.Limit)
+	}
+	viewer, _ := r.Context().Value(authenticatedUser).(*users.User)
+	q := &listQuery{viewer: viewer, bucket: bucket, params: params}
+	fields := make(map[string]bool)
+	queryFields(reflect.TypeOf(publicElem(elem, nil)), fields)
+	checkField := func(field string) error {
+		// secret fields can't be filtered or sorted by, so their values can't be guessed
+		if !fields[field] || secretFields[field] {
+			return fmt.Errorf("unknown field '%s'", field)
+		}
+		return nil
+	}
+	query := r.URL.Query()
+	if sortBy := query.Get(sortParam); sortBy != "" {
+		q.sortField, q.descending = strings.TrimPrefix(sortBy, "-"), strings.HasPrefix(sortBy, "-")
+		if err := checkField(q.sortField); err != nil {
+			return nil, err
+		}
+	}
+	if cursor := query.Get(cursorParam); cursor != "" {
+		if q.cursor, err = decodeQueryCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+	for key, values := range query {
+		if reservedQueryParams[key] {
+			continue
+		}
+		for _, value := range values {
+			filter := parseQueryFilter(key, value)
+			if err := checkField(filter.field); err != nil {
+				return nil, err
+			}
+			q.filters = append(q.filters, filter)
+		}
+	}
+	return q, nil
+}
+
+// compare two json values of the same field, returning -1, 0 or 1. Missing values come first, strings holding times are
+// compared as times and values which can't be ordered are considered equal
+func compareQueryValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+			case a == nil && b == nil:
+				return 0
+			case a == nil:
+				return -1
+			default:
+				return 1
+		}
+	}
+	switch aValue := a.(type) {
+		case float64:
+			if bValue, ok := b.(float64); ok {
+				switch {
+					case aValue < bValue:
+						return -1
+					case aValue > bValue:
+						return 1
+				}
+			}
+		case bool:
+			if bValue, ok := b.(bool); ok && aValue != bValue {
+				if bValue {
+					return -1
+				}
+				return 1
+			}
+		case string:
+			bValue, ok := b.(string)
+			if !ok {
+				return 0
+			}
+			aTime, aErr := time.Parse(time.RFC3339Nano, aValue)
+			bTime, bErr := time.Parse(time.RFC3339Nano, bValue)
+			if aErr == nil && bErr == nil {
+				switch {
+					case aTime.Before(bTime):
+						return -1
+					case aTime.After(bTime):
+						return 1
+				}
+				return 0
+			}
+			return strings.Compare(aValue, bValue)
+	}
+	return 0
+}
+
+// convert the value of a filter to the type of the given json value of the field it filters
+func (q *listQuery) filterValue(filter *queryFilter, like interface{}) (interface{}, error) {
+	switch like.(type) {
+		case float64:
+			if named, ok := namedQueryValues[q.bucket][filter.field][strings.ToLower(filter.value)]; ok {
+				return float64(named), nil
+			}
+			value, err := strconv.ParseFloat(filter.value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number '%s' for field '%s'", filter.value, filter.field)
+			}
+			return value, nil
+		case bool:
+			value, err := strconv.ParseBool(filter.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid boolean '%s' for field '%s'", filter.value, filter.field)
+			}
+			return value, nil
+	}
+	return filter.value, nil
+}
+
+// check if the given json value of a field matches the given filter. Filtering collections with '=' and '!=' checks if
+// they contain the value of the filter
+func (q *listQuery) matches(filter *queryFilter, value interface{}) (bool, error) {
+	var contained []interface{}
+	switch collection := value.(type) {
+		case []interface{}:
+			contained = collection
+		case map[string]interface{}:
+			// string sets are encoded as objects holding their elements as keys
+			if elements, ok := collection["elements"].(map[string]interface{}); ok && len(collection) == 1 {
+				collection = elements
+			}
+			for key := range collection {
+				contained = append(contained, key)
+			}
+		default:
+			if value == nil {
+				return filter.op == opNe, nil
+			}
+			filterValue, err := q.filterValue(filter, value)
+			if err != nil {
+				return false, err
+			}
+			cmp := compareQueryValues(value, filterValue)
+			switch filter.op {
+				case opEq:
+					return cmp == 0, nil
+				case opNe:
+					return cmp != 0, nil
+				case opLt:
+					return cmp < 0, nil
+				case opLe:
+					return cmp <= 0, nil
+				case opGt:
+					return cmp > 0, nil
+				default:
+					return cmp >= 0, nil
+			}
+	}
+	if filter.op != opEq && filter.op != opNe {
+		return false, fmt.Errorf("field '%s' can only be filtered using '%s' or '%s'", filter.field, opEq, opNe)
+	}
+	found := false
+	for _, c := range contained {
+		if c == filter.value {
+			found = true
+			break
+		}
+	}
+	return found == (filter.op == opEq), nil
+}
+
+// a listed element along with its key and sort value
+type queryItem struct {
+	elem	db.IBucketElement
+	key		string
+	value	interface{}
+}
+
+// check if the first item comes before the second in the order of the query. Ties are broken by key
+func (q *listQuery) less(a, b *queryItem) bool {
+	if cmp := compareQueryValues(a.value, b.value); cmp != 0 {
+		return (cmp < 0) != q.descending
+	}
+	return a.key < b.key
+}
+
+// return the json values of the fields of the view of the given element for the user who requested it
+func (q *listQuery) viewFieldValues(elem db.IBucketElement) (map[string]interface{}, error) {
+	projected, err := projectElem(publicElem(elem, q.viewer), nil)
+	if err != nil {
+		return nil, err
+	}
+	fieldValues := make(map[string]interface{}, len(projected))
+	for field, raw := range projected {
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		fieldValues[field] = value
+	}
+	return fieldValues, nil
+}
+
+// run the query over the bucket, decoding each element into the element returned by the given function. If given, the
+// include function can exclude elements before they are filtered
+func (q *listQuery) run(newElement func() db.IBucketElement, include func(db.IBucketElement) bool) (*queryPage, error) {
+	var items []*queryItem
+	var filterErr error
+	if err := db.QueryBucket([]byte(q.bucket), func (key, elementBytes []byte) error {
+		elem := newElement()
+		if err := json.Unmarshal(elementBytes, elem); err != nil {
+			return err
+		}
+		if include != nil && !include(elem) {
+			return nil
+		}
+		fieldValues, err := q.viewFieldValues(elem)
+		if err != nil {
+			return err
+		}
+		for _, filter := range q.filters {
+			ok, err := q.matches(filter, fieldValues[filter.field])
+			if err != nil {
+				filterErr = err
+				return &db.ErrStopQuery{}
+			}
+			if !ok {
+				return nil
+			}
+		}
+		item := &queryItem{elem: elem, key: string(key)}
+		if q.sortField != "" {
+			item.value = fieldValues[q.sortField]
+		}
+		items = append(items, item)
+		return nil
+	}); err != nil {
+		if _, ok := err.(*db.ErrElementsLeftToProcess); !ok {
+			return nil, err
+		}
+	}
+	if filterErr != nil {
+		return nil, &ErrInvalidQuery{filterErr.Error()}
+	}
+	if q.sortField != "" {
+		sort.SliceStable(items, func(i, j int) bool {
+			return q.less(items[i], items[j])
+		})
+	}
+	page := &queryPage{total: len(items)}
+	start := 0
+	if q.cursor != nil {
+		cursorItem := &queryItem{key: q.cursor.key, value: q.cursor.value}
+		start = sort.Search(len(items), func(i int) bool {
+			return q.less(cursorItem, items[i])
+		})
+	} else if q.params.AfterId > 0 {
+		start = int(q.params.AfterId)
+	}
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + int(q.params.Limit)
+	if end >= len(items) {
+		end = len(items)
+	} else {
+		last := items[end - 1]
+		page.nextCursor = (&queryCursor{value: last.value, key: last.key}).encode()
+	}
+	for _, item := range items[start:end] {
+		page.elements = append(page.elements, item.elem)
+	}
+	return page, nil
+}
+
+// write the elements of the given bucket matching the list query of the request. The headers of the response tell the
+// total number of matching elements and the cursor of the next page, if there is one
+func writeQueriedElements(w http.ResponseWriter, r *http.Request, bucket string, newElement func() db.IBucketElement, include func(db.IBucketElement) bool) {
+	q, err := newListQuery(r, bucket, newElement())
+	if err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	page, err := q.run(newElement, include)
+	if err != nil {
+		if _, ok := err.(*ErrInvalidQuery); ok {
+			writeErrResp(w, r, http.StatusBadRequest, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	w.Header().Set(totalCountHeader, strconv.Itoa(page.total))
+	if page.nextCursor != "" {
+		w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
+		w.Header().Set(nextCursorHeader, page.nextCursor)
+	}
+	writeElements(w, r, http.StatusOK, page.elements)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	submithttp "github.com/DAv10195/submit_commons/http"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/users"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListQueries(t *testing.T) {
+	_, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	courseKey := fmt.Sprintf("1:%d", time.Now().UTC().Year())
+	newInstance := func(user string, state, grade int) *assignments.AssignmentInstance {
+		assInst, err := assignments.NewInstance(courseKey, time.Now().Add(time.Hour).UTC(), "ass", user, db.System, false, false)
+		if err != nil {
+			t.Fatalf("error creating assignment instance for test: %v", err)
+		}
+		assInst.State = state
+		if state == assignments.Graded {
+			assInst.SetGrade(grade)
+		}
+		if err := db.Update(db.System, assInst); err != nil {
+			t.Fatalf("error creating assignment instance for test: %v", err)
+		}
+		return assInst
+	}
+	newInstance("s1", assignments.Graded, 50)
+	newInstance("s2", assignments.Graded, 90)
+	newInstance("s3", assignments.Graded, 30)
+	newInstance("s4", assignments.Submitted, 0)
+	s5 := newInstance("s5", assignments.Assigned, 0)
+	initUsersRouter(router.Router, router.am)
+	initAssInstsRouter(router.Router, router.am)
+	list := func(query string, expectedTotal int, expectedUsers ...string) string {
+		w := router.send(http.MethodGet, fmt.Sprintf("/%s/?%s", db.AssignmentInstances, query), "", users.Admin)
+		if w.Code != http.StatusOK {
+			t.Fatalf("listing with query '%s' produced status code %d instead of %d", query, w.Code, http.StatusOK)
+		}
+		if total := w.Header().Get(totalCountHeader); total != fmt.Sprint(expectedTotal) {
+			t.Fatalf("listing with query '%s' returned a total of %s instead of %d", query, total, expectedTotal)
+		}
+		var listed struct {
+			Elements	[]*assignments.AssignmentInstance	`json:"elements"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+			t.Fatalf("error parsing listed assignment instances: %v", err)
+		}
+		var listedUsers []string
+		for _, assInst := range listed.Elements {
+			listedUsers = append(listedUsers, assInst.UserName)
+		}
+		if fmt.Sprint(listedUsers) != fmt.Sprint(expectedUsers) {
+			t.Fatalf("listing with query '%s' returned %v instead of %v", query, listedUsers, expectedUsers)
+		}
+		if (w.Header().Get(nextCursorHeader) != "") != (w.Header().Get(submithttp.ElementsLeftToProcess) == trueStr) {
+			t.Fatalf("listing with query '%s' returned inconsistent paging headers", query)
+		}
+		return w.Header().Get(nextCursorHeader)
+	}
+	list("state=graded&grade<60&sort=-grade", 2, "s1", "s3")
+	list("state=submitted", 1, "s4")
+	list("grade>=50&state!=assigned", 2, "s1", "s2")
+	list("graded_on>2000-01-01T00:00:00Z&sort=user_name", 3, "s1", "s2", "s3")
+	cursor := list("sort=grade&limit=2", 5, "s4", "s5")
+	// the next page continues after the last listed instance even when instances are inserted and deleted
+	if err := db.Delete(s5); err != nil {
+		t.Fatalf("error deleting assignment instance for test: %v", err)
+	}
+	newInstance("s0", assignments.Graded, 40)
+	cursor = list(fmt.Sprintf("sort=grade&limit=2&cursor=%s", cursor), 5, "s3", "s0")
+	if cursor = list(fmt.Sprintf("sort=grade&limit=2&cursor=%s", cursor), 5, "s1", "s2"); cursor != "" {
+		t.Fatalf("last page returned a cursor")
+	}
+	list("limit=1&after_id=1", 5, "s1")
+	for _, query := range []string{"unknown=1", "grade<abc", "sort=missing", "cursor=invalid", "files<1", "limit=0"} {
+		if w := router.send(http.MethodGet, fmt.Sprintf("/%s/?%s", db.AssignmentInstances, query), "", users.Admin); w.Code != http.StatusBadRequest {
+			t.Fatalf("listing with query '%s' produced status code %d instead of %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+	for _, query := range []string{"password=x", "sort=password"} {
+		if w := router.send(http.MethodGet, fmt.Sprintf("/%s/?%s", db.Users, query), "", users.Admin); w.Code != http.StatusBadRequest {
+			t.Fatalf("listing users with query '%s' produced status code %d instead of %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+	w := router.send(http.MethodGet, fmt.Sprintf("/%s/?roles=%s", db.Users, users.Admin), "", users.Admin)
+	if w.Code != http.StatusOK || w.Header().Get(totalCountHeader) != "1" {
+		t.Fatalf("listing users by role produced status code %d and a total of %s", w.Code, w.Header().Get(totalCountHeader))
+	}
+}
@@ -3,8 +3,19 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
 	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/agents"
+	"github.com/DAv10195/submit_server/elements/appeals"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/forum"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/tests"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/session"
 	"net/http"
+	"strings"
+	"time"
 )
 
 const logHttpErrFormat = "error serving http request for %s"
@@ -23,6 +34,11 @@ func (e *Response) String() string {
 }
 
 func writeResponse(w http.ResponseWriter, r *http.Request, httpStatus int, stringer fmt.Stringer) {
+	// elements are always written through their view for the user who requested them
+	if e, ok := stringer.(db.IBucketElement); ok {
+		writeElem(w, r, httpStatus, e)
+		return
+	}
 	w.WriteHeader(httpStatus)
 	if _, err := w.Write([]byte(stringer.String())); err != nil {
 		logger.WithError(err).Errorf(logHttpErrFormat, r.URL.Path)
@@ -40,8 +56,187 @@ func writeStrErrResp(w http.ResponseWriter, r *http.Request, httpStatus int, str
 	writeResponse(w, r, httpStatus, &Response{Message: err.Error()})
 }
 
-func writeElem(w http.ResponseWriter, r *http.Request, httpStatus int, e db.IBucketElement) {
+// the public representations of elements hide internal fields by shadowing them with empty fields of the same name,
+// which are left out of responses. Fields of the element which aren't shadowed are written as is
+
+// the view of a user. Secretaries see the profile of the user, the user also sees its own settings, message box and
+// single sign-on identity and admins see everything except the password
+type PublicUser struct {
+	*users.User
+	Password			string		`json:"password,omitempty"`
+	MessageBox			string		`json:"message_box,omitempty"`
+	EmailPreference		string		`json:"email_preference,omitempty"`
+	PasswordChangedOn	*time.Time	`json:"password_changed_on,omitempty"`
+	SsoIssuer			string		`json:"sso_issuer,omitempty"`
+	SsoSubject			string		`json:"sso_subject,omitempty"`
+	CreatedBy			string		`json:"created_by,omitempty"`
+	UpdatedBy			string		`json:"updated_by,omitempty"`
+}
+
+func newPublicUser(user *users.User, viewer *users.User, isAdmin bool) *PublicUser {
+	public := &PublicUser{User: user}
+	if isAdmin || (viewer != nil && viewer.UserName == user.UserName) {
+		public.MessageBox, public.EmailPreference = user.MessageBox, user.EmailPreference
+		public.SsoIssuer, public.SsoSubject = user.SsoIssuer, user.SsoSubject
+		if !user.PasswordChangedOn.IsZero() {
+			public.PasswordChangedOn = &user.PasswordChangedOn
+		}
+	}
+	if isAdmin {
+		public.CreatedBy, public.UpdatedBy = user.CreatedBy, user.UpdatedBy
+	}
+	return public
+}
+
+// the view of an agent, which never includes its credential
+type PublicAgent struct {
+	*agents.Agent
+	Credential		string	`json:"credential,omitempty"`
+	CredentialSalt	string	`json:"credential_salt,omitempty"`
+}
+
+// the view of a course. Only admins and staff members of the course see the id of its announcements message box
+type PublicCourse struct {
+	*courses.Course
+	MessageBox	string	`json:"message_box,omitempty"`
+}
+
+// the view of a test. Only admins and staff members of its course see the id of its message box
+type PublicTest struct {
+	*tests.Test
+	MessageBox	string	`json:"message_box,omitempty"`
+}
+
+// the view of an appeal. Only admins see the id of its message box, which is accessed via the path of the appeal
+type PublicAppeal struct {
+	*appeals.Appeal
+	MessageBox	string	`json:"message_box,omitempty"`
+}
+
+// the view of a message. Only admins and the sender see who read the message and who it's targeted at, while others
+// only see if they read it
+type PublicMessage struct {
+	*messages.Message
+	ReadBy		*containers.StringSet	`json:"read_by,omitempty"`
+	Recipients	*containers.StringSet	`json:"recipients,omitempty"`
+	Unread		bool					`json:"unread"`
+}
+
+// the view of a forum post. The author of an anonymous post, who also created it, is only seen by himself, admins and
+// staff members of its course
+type PublicPost struct {
+	*forum.Post
+	Author		string	`json:"author"`
+	CreatedBy	string	`json:"created_by,omitempty"`
+	UpdatedBy	string	`json:"updated_by,omitempty"`
+}
+
+// the view of a session, which never includes its id, as the id is the secret held by the cookie of the session
+type PublicSession struct {
+	*session.Session
+	ID	string	`json:"id,omitempty"`
+}
+
+// return the public representation of the given element for the given viewer (nil if the request is unauthenticated)
+func publicElem(e db.IBucketElement, viewer *users.User) interface{} {
+	isAdmin := viewer != nil && viewer.Roles.Contains(users.Admin)
+	isStaff := func(courseKey string) bool {
+		return isAdmin || (viewer != nil && viewer.CoursesAsStaff.Contains(courseKey))
+	}
+	isAssStaff := func(assDefKey string) bool {
+		split := strings.Split(assDefKey, db.KeySeparator)
+		return len(split) == 3 && isStaff(strings.Join(split[:2], db.KeySeparator))
+	}
+	switch elem := e.(type) {
+		case *users.User:
+			return newPublicUser(elem, viewer, isAdmin)
+		case *agents.Agent:
+			return &PublicAgent{Agent: elem}
+		case *courses.Course:
+			public := &PublicCourse{Course: elem}
+			if isStaff(string(elem.Key())) {
+				public.MessageBox = elem.MessageBox
+			}
+			return public
+		case *tests.Test:
+			public := &PublicTest{Test: elem}
+			if isAssStaff(elem.AssignmentDef) {
+				public.MessageBox = elem.MessageBox
+			}
+			return public
+		case *appeals.Appeal:
+			public := &PublicAppeal{Appeal: elem}
+			if isAdmin {
+				public.MessageBox = elem.MessageBox
+			}
+			return public
+		case *messages.Message:
+			public := &PublicMessage{Message: elem}
+			if viewer != nil {
+				public.Unread = elem.IsUnreadBy(viewer.UserName)
+				if isAdmin || elem.From == viewer.UserName {
+					public.ReadBy, public.Recipients = elem.ReadBy, elem.Recipients
+				}
+			}
+			return public
+		case *session.Session:
+			return &PublicSession{Session: elem}
+		case *forum.Post:
+			public := &PublicPost{Post: elem}
+			if !elem.Anonymous || (viewer != nil && viewer.UserName == elem.Author) || isAssStaff(elem.AssignmentDef) {
+				public.Author, public.CreatedBy, public.UpdatedBy = elem.Author, elem.CreatedBy, elem.UpdatedBy
+			}
+			return public
+	}
+	// the rest of the elements have no view of their own, so all of their fields (except secret fields) are written to
+	// whoever is authorized to read them
+	return e
+}
+
+// fields which are never written in element responses, whatever fields are requested
+var secretFields = map[string]bool{"password": true, "credential": true, "credential_salt": true, "token_hash": true}
+
+// return the fields requested via the projection query param of the request, or nil if all fields are requested
+func projectionFromRequest(r *http.Request) map[string]bool {
+	projection := r.URL.Query().Get(fieldsParam)
+	if projection == "" {
+		return nil
+	}
+	fields := make(map[string]bool)
+	for _, field := range strings.Split(projection, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields[field] = true
+		}
+	}
+	return fields
+}
+
+// encode the given element as an object holding only the given fields (all fields if nil), without secret fields
+func projectElem(e interface{}, fields map[string]bool) (map[string]json.RawMessage, error) {
 	elemBytes, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	projected := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(elemBytes, &projected); err != nil {
+		return nil, err
+	}
+	for field := range projected {
+		if secretFields[field] || (fields != nil && !fields[field]) {
+			delete(projected, field)
+		}
+	}
+	return projected, nil
+}
+
+func writeElem(w http.ResponseWriter, r *http.Request, httpStatus int, e db.IBucketElement) {
+	viewer, _ := r.Context().Value(authenticatedUser).(*users.User)
+	projected, err := projectElem(publicElem(e, viewer), projectionFromRequest(r))
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	elemBytes, err := json.Marshal(projected)
 	if err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
@@ -54,9 +249,18 @@ func writeElem(w http.ResponseWriter, r *http.Request, httpStatus int, e db.IBuc
 
 func writeElements(w http.ResponseWriter, r *http.Request, httpStatus int, elements []db.IBucketElement) {
 	var elementsWrapper struct {
-		Elements []db.IBucketElement `json:"elements"`
+		Elements []map[string]json.RawMessage `json:"elements"`
+	}
+	fields := projectionFromRequest(r)
+	viewer, _ := r.Context().Value(authenticatedUser).(*users.User)
+	for _, e := range elements {
+		projected, err := projectElem(publicElem(e, viewer), fields)
+		if err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		elementsWrapper.Elements = append(elementsWrapper.Elements, projected)
 	}
-	elementsWrapper.Elements = elements
 	elementsBytes, err := json.Marshal(elementsWrapper)
 	if err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
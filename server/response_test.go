@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/agents"
+	"github.com/DAv10195/submit_server/elements/appeals"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/forum"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/users"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNoSecretsInResponses(t *testing.T) {
+	testUsers, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	secretary := newTestUser(t, "secretary", users.Secretary)
+	testUsers[secretary.UserName] = secretary
+	agent := &agents.Agent{ID: "agent1", User: "agent1", Hostname: "agent1", OsType: "linux", Architecture: "amd64", State: agents.Approved}
+	if _, err := agent.NewCredential(); err != nil {
+		t.Fatalf("error creating agent credential for test: %v", err)
+	}
+	if err := db.Update(db.System, agent); err != nil {
+		t.Fatalf("error creating agent for test: %v", err)
+	}
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	initUsersRouter(router.Router, router.am)
+	initCoursesRouter(router.Router, router.am)
+	initAgentsBackend(router.Router, router.am, ctx, wg)
+	initBatchRouter(router.Router, router.am)
+	send := func(method, path, body, user string) string {
+		w := router.send(method, path, body, user)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s request to %s by %s produced status code %d instead of %d", method, path, user, w.Code, http.StatusOK)
+		}
+		return w.Body.String()
+	}
+	var secrets []string
+	for _, user := range testUsers {
+		secrets = append(secrets, user.Password)
+	}
+	secrets = append(secrets, agent.Credential, agent.CredentialSalt)
+	assertNoSecrets := func(body string) {
+		for _, secret := range secrets {
+			if strings.Contains(body, secret) {
+				t.Fatalf("response contains a secret: %s", body)
+			}
+		}
+		if strings.Contains(body, `"password"`) || strings.Contains(body, `"credential"`) || strings.Contains(body, `"credential_salt"`) {
+			t.Fatalf("response contains a secret field: %s", body)
+		}
+	}
+	courseKey := fmt.Sprintf("1:%d", time.Now().UTC().Year())
+	paths := []string{"/users/", "/users/user2", "/users/admin?fields=password,user_name", "/users/?sort=user_name&fields=password",
+		"/agents/", "/agents/agent1", "/agents/?fields=credential", "/courses/", fmt.Sprintf("/courses/%s", strings.Replace(courseKey, db.KeySeparator, "/", 1))}
+	var batch BatchRequest
+	for _, path := range paths {
+		assertNoSecrets(send(http.MethodGet, path, "", users.Admin))
+		batch.Requests = append(batch.Requests, &BatchRequestItem{Path: path})
+	}
+	batchBytes, err := json.Marshal(&batch)
+	if err != nil {
+		t.Fatalf("error encoding batch for test: %v", err)
+	}
+	assertNoSecrets(send(http.MethodPost, "/batch", string(batchBytes), users.Admin))
+	assertNoSecrets(send(http.MethodGet, "/users/user2", "", "user2"))
+	assertNoSecrets(send(http.MethodGet, "/users/", "", secretary.UserName))
+	// each viewer gets its own view of the user
+	view := func(path, viewer string) map[string]interface{} {
+		v := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(send(http.MethodGet, path, "", viewer)), &v); err != nil {
+			t.Fatalf("error parsing response: %v", err)
+		}
+		return v
+	}
+	adminView, selfView, secretaryView := view("/users/user2", users.Admin), view("/users/user2", "user2"), view("/users/user2", secretary.UserName)
+	if adminView["message_box"] == nil || adminView["created_by"] == nil {
+		t.Fatalf("admin view of user lacks internal fields: %v", adminView)
+	}
+	if selfView["message_box"] == nil || selfView["email_preference"] == nil || selfView["created_by"] != nil {
+		t.Fatalf("self view of user is %v", selfView)
+	}
+	if secretaryView["user_name"] != "user2" || secretaryView["message_box"] != nil || secretaryView["email_preference"] != nil {
+		t.Fatalf("secretary view of user is %v", secretaryView)
+	}
+	coursePath := fmt.Sprintf("/courses/%s", strings.Replace(courseKey, db.KeySeparator, "/", 1))
+	if staffView := view(coursePath, "user1"); staffView["message_box"] == nil {
+		t.Fatalf("staff view of course lacks its message box: %v", staffView)
+	}
+	if studentView := view(coursePath, "user2"); studentView["name"] != "course" || studentView["message_box"] != nil {
+		t.Fatalf("student view of course is %v", studentView)
+	}
+	// fields hidden from a viewer can't be guessed by filtering or sorting by them either
+	var listed struct {
+		Elements	[]map[string]interface{}	`json:"elements"`
+	}
+	router.decode(router.send(http.MethodGet, "/users/?email_preference=immediate", "", secretary.UserName), http.StatusOK, &listed)
+	if len(listed.Elements) != 1 || listed.Elements[0]["user_name"] != secretary.UserName {
+		t.Fatalf("filtering users by a field hidden from the secretary except for its own returned %v", listed.Elements)
+	}
+	router.decode(router.send(http.MethodGet, "/users/?email_preference=immediate", "", users.Admin), http.StatusOK, &listed)
+	if len(listed.Elements) == 0 {
+		t.Fatal("filtering users by a field seen by the admin returned no users")
+	}
+	// anonymous forum posts, messages and appeals
+	assDefKey := courseKey + db.KeySeparator + "ass"
+	assDef, err := assignments.GetDef(assDefKey)
+	if err != nil {
+		t.Fatalf("error getting assignment def for test: %v", err)
+	}
+	assDef.State = assignments.Published
+	if err := db.Update(db.System, assDef); err != nil {
+		t.Fatalf("error publishing assignment def for test: %v", err)
+	}
+	question, err := forum.NewQuestion(assDefKey, "user2", "question", "text", true, true)
+	if err != nil {
+		t.Fatalf("error creating forum question for test: %v", err)
+	}
+	initForumRouter(router.Router, router.am)
+	questionPath := fmt.Sprintf("/forum/%s/%s", strings.Replace(assDefKey, db.KeySeparator, "/", -1), question.ID)
+	if body := send(http.MethodGet, questionPath, "", "user3"); strings.Contains(body, `"user2"`) {
+		t.Fatalf("student view of anonymous question names its author: %s", body)
+	}
+	msg, box, err := messages.NewReply("user2", "hello", testUsers["user1"].MessageBox, "", nil, false, false)
+	if err != nil {
+		t.Fatalf("error creating message for test: %v", err)
+	}
+	box.Messages.Add(msg.ID)
+	if err := db.Update("user2", msg, box); err != nil {
+		t.Fatalf("error creating message for test: %v", err)
+	}
+	initMessagesRouter(router.Router, router.am)
+	if body := send(http.MethodGet, "/messages/users/user1", "", "user1"); !strings.Contains(body, msg.ID) || strings.Contains(body, `"read_by"`) {
+		t.Fatalf("recipient view of message is %s", body)
+	}
+	assInst, err := assignments.NewInstance(courseKey, time.Now().Add(time.Hour).UTC(), "ass", "user2", db.System, true, false)
+	if err != nil {
+		t.Fatalf("error creating assignment instance for test: %v", err)
+	}
+	if _, err := appeals.New(string(assInst.Key()), "", "", "user2", true); err != nil {
+		t.Fatalf("error creating appeal for test: %v", err)
+	}
+	initAppealsRouter(router.Router, router.am)
+	appealPath := fmt.Sprintf("/appeals/%s", strings.Replace(string(assInst.Key()), db.KeySeparator, "/", -1))
+	if ownerView := view(appealPath, "user2"); ownerView["category"] == nil || ownerView["message_box"] != nil {
+		t.Fatalf("owner view of appeal is %v", ownerView)
+	}
+	if adminView := view(appealPath, users.Admin); adminView["message_box"] == nil {
+		t.Fatalf("admin view of appeal lacks its message box: %v", adminView)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/jobs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// a function running a scheduled job. Returns the time the job should run again at or nil if the job is done
+type jobHandler func(*jobs.Job) (*time.Time, error)
+
+var jobHandlers = make(map[string]jobHandler)
+
+// run the given job and reschedule or delete it according to the outcome. Failed jobs are retried later with an
+// increasing delay until they're given up on
+func runJob(now time.Time, job *jobs.Job) {
+	handler := jobHandlers[job.Type]
+	if handler == nil {
+		logger.Errorf("scheduler: no handler for job '%s', deleting it", string(job.Key()))
+		if err := db.Delete(job); err != nil {
+			logger.WithError(err).Errorf("scheduler: error deleting job '%s'", string(job.Key()))
+		}
+		return
+	}
+	logger.Debugf("scheduler: running job '%s'", string(job.Key()))
+	nextRunAt, err := handler(job)
+	if err == nil && nextRunAt == nil {
+		if err := db.Delete(job); err != nil {
+			logger.WithError(err).Errorf("scheduler: error deleting done job '%s'", string(job.Key()))
+		}
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Errorf("scheduler: error running job '%s'", string(job.Key()))
+		job.Attempts++
+		job.LastError = err.Error()
+		if job.Attempts >= maxJobAttempts {
+			logger.Errorf("scheduler: giving up on job '%s' after %d attempts", string(job.Key()), job.Attempts)
+			if err := db.Delete(job); err != nil {
+				logger.WithError(err).Errorf("scheduler: error deleting failed job '%s'", string(job.Key()))
+			}
+			return
+		}
+		job.RunAt = now.Add(time.Duration(job.Attempts * job.Attempts) * jobRetryDelay)
+	} else {
+		job.Attempts = 0
+		job.LastError = ""
+		job.RunAt = nextRunAt.UTC()
+	}
+	if err := db.Update(db.System, job); err != nil {
+		logger.WithError(err).Errorf("scheduler: error rescheduling job '%s'", string(job.Key()))
+	}
+}
+
+// run all jobs which are due, earliest first
+func processJobs() {
+	now := time.Now().UTC()
+	var dueJobs []*jobs.Job
+	if err := db.QueryBucket([]byte(db.Jobs), func(_, elemBytes []byte) error {
+		job := &jobs.Job{}
+		if err := json.Unmarshal(elemBytes, job); err != nil {
+			return err
+		}
+		if !job.RunAt.After(now) {
+			dueJobs = append(dueJobs, job)
+		}
+		return nil
+	}); err != nil {
+		logger.WithError(err).Error("scheduler: error querying for due jobs")
+		return
+	}
+	sort.Slice(dueJobs, func(i, j int) bool {
+		return dueJobs[i].RunAt.Before(dueJobs[j].RunAt)
+	})
+	for _, job := range dueJobs {
+		runJob(now, job)
+	}
+}
+
+// run due jobs each minute. Jobs are persisted, so jobs which were due while the server was down run on startup
+func scheduler(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	processJobs()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+			case <- ticker.C:
+				processJobs()
+			case <- ctx.Done():
+				logger.Info("stopping scheduler")
+				return
+		}
+	}
+}
+
+// make sure a periodic job of the given type for the given target is scheduled, running it now if it isn't
+func schedulePeriodicJob(jobType, target string) error {
+	exists, err := db.KeyExistsInBucket([]byte(db.Jobs), (&jobs.Job{Type: jobType, Target: target}).Key())
+	if err != nil || exists {
+		return err
+	}
+	_, err = jobs.New(jobType, target, time.Now().UTC(), db.System, true)
+	return err
+}
+
+func initScheduler(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go scheduler(ctx, wg)
+}
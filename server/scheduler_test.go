@@ -0,0 +1,306 @@
+package server
+
+import (
+	"errors"
+	"github.com/DAv10195/submit_commons/containers"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/agents"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/jobs"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/tests"
+	"github.com/DAv10195/submit_server/elements/users"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	// failed jobs are retried later
+	jobHandlers["failing"] = func(_ *jobs.Job) (*time.Time, error) {
+		return nil, errors.New("failure")
+	}
+	defer delete(jobHandlers, "failing")
+	if _, err := jobs.New("failing", "target", time.Now().UTC().Add(-time.Minute), db.System, true); err != nil {
+		t.Fatalf("error scheduling job for test: %v", err)
+	}
+	processJobs()
+	failedJob, err := jobs.Get("failing" + db.KeySeparator + "target")
+	if err != nil {
+		t.Fatalf("error getting failed job: %v", err)
+	}
+	if failedJob.Attempts != 1 || !failedJob.RunAt.After(time.Now().UTC()) {
+		t.Fatal("expected failed job to be scheduled for a retry")
+	}
+	// scheduled publication
+	course := &courses.Course{Number: 1, Year: 2020, Name: "course", Files: containers.NewStringSet()}
+	if err := db.Update(db.System, course); err != nil {
+		t.Fatalf("error creating course for test: %v", err)
+	}
+	students := []string{"s1", "s2", "s3"}
+	for _, student := range students {
+		if _, err := users.NewUserBuilder(db.System, true).WithUserName(student).WithPassword(student).WithRoles(users.StandardUser).
+			WithCoursesAsStudent(string(course.Key())).Build(); err != nil {
+			t.Fatalf("error creating user for test: %v", err)
+		}
+	}
+	assDef, err := assignments.NewDef(string(course.Key()), time.Now().UTC().Add(2 * time.Hour), "ass", db.System, true, false)
+	if err != nil {
+		t.Fatalf("error creating assignment def for test: %v", err)
+	}
+	assDef.ZeroGradeMissing = true
+	if err := db.Update(db.System, assDef); err != nil {
+		t.Fatalf("error updating assignment def for test: %v", err)
+	}
+	assDefKey := string(assDef.Key())
+	deadlineTest, err := tests.New(db.System, assDefKey, "deadline", "echo test", "linux", "amd64", 10, tests.OnDeadline, true, false)
+	if err != nil {
+		t.Fatalf("error creating test for test: %v", err)
+	}
+	deadlineTest.State = tests.Published
+	if err := db.Update(db.System, deadlineTest); err != nil {
+		t.Fatalf("error publishing test for test: %v", err)
+	}
+	if _, err := jobs.New(jobTypePublishAssignment, assDefKey, time.Now().UTC().Add(-time.Minute), db.System, true); err != nil {
+		t.Fatalf("error scheduling publication for test: %v", err)
+	}
+	processJobs()
+	if assDef, err = assignments.GetDef(assDefKey); err != nil || assDef.State != assignments.Published {
+		t.Fatal("expected assignment def to be published by the scheduler")
+	}
+	assInsts, err := getInstancesOfAssignmentDef(assDefKey)
+	if err != nil || len(assInsts) != len(students) {
+		t.Fatalf("expected %d instances to be created on publication", len(students))
+	}
+	// the reminder is due right away as the assignment is due in less than a day
+	processJobs()
+	user, err := users.Get("s1")
+	if err != nil {
+		t.Fatalf("error getting user for test: %v", err)
+	}
+	box, err := messages.Get(user.MessageBox)
+	if err != nil {
+		t.Fatalf("error getting message box for test: %v", err)
+	}
+	if box.Messages.NumberOfElements() != 1 {
+		t.Fatal("expected a due date reminder message to be sent")
+	}
+	if _, err := jobs.Get(jobTypeDueDateReminder + db.KeySeparator + assDefKey); err == nil {
+		t.Fatal("expected due date reminder job to be done")
+	}
+	// deadline: s1 didn't submit, s2 submitted and s3 got an extension
+	if assInsts, err = getInstancesOfAssignmentDef(assDefKey); err != nil {
+		t.Fatalf("error getting assignment instances for test: %v", err)
+	}
+	now := time.Now().UTC()
+	for _, assInst := range assInsts {
+		if !assInst.ReminderSent {
+			t.Fatalf("expected a reminder to be sent for '%s'", string(assInst.Key()))
+		}
+		switch assInst.UserName {
+			case "s1":
+				assInst.DueBy = now.Add(-time.Minute)
+			case "s2":
+				assInst.DueBy = now.Add(-time.Minute)
+				assInst.State = assignments.Submitted
+			case "s3":
+				assInst.DueBy = now.Add(3 * time.Hour)
+		}
+		if err := db.Update(db.System, assInst); err != nil {
+			t.Fatalf("error updating assignment instance for test: %v", err)
+		}
+	}
+	if _, err := jobs.New(jobTypeAssignmentDeadline, assDefKey, now.Add(-time.Minute), db.System, true); err != nil {
+		t.Fatalf("error rescheduling deadline for test: %v", err)
+	}
+	processJobs()
+	expectedStates := map[string]int{"s1": assignments.Graded, "s2": assignments.Submitted, "s3": assignments.Assigned}
+	for _, student := range students {
+		assInst, err := assignments.GetInstance(assDefKey + db.KeySeparator + student)
+		if err != nil {
+			t.Fatalf("error getting assignment instance for test: %v", err)
+		}
+		if assInst.State != expectedStates[student] {
+			t.Fatalf("expected assignment instance of %s to be in state %d but it's in state %d", student, expectedStates[student], assInst.State)
+		}
+	}
+	deadlineJob, err := jobs.Get(jobTypeAssignmentDeadline + db.KeySeparator + assDefKey)
+	if err != nil {
+		t.Fatalf("expected deadline job to be rescheduled for the extended instance: %v", err)
+	}
+	if !deadlineJob.RunAt.Equal(now.Add(3 * time.Hour)) {
+		t.Fatalf("expected deadline job to be rescheduled to %v but it is scheduled to %v", now.Add(3 * time.Hour), deadlineJob.RunAt)
+	}
+	// running the deadline job again doesn't close the same instances twice
+	countTasks := func() int {
+		count := 0
+		if err := db.QueryBucket([]byte(db.Tasks), func(_, _ []byte) error {
+			count++
+			return nil
+		}); err != nil {
+			t.Fatalf("error counting tasks for test: %v", err)
+		}
+		return count
+	}
+	if tasks := countTasks(); tasks != 1 {
+		t.Fatalf("expected 1 deadline task for the submitted instance but there are %d", tasks)
+	}
+	deadlineJob.RunAt = now.Add(-time.Minute)
+	if err := db.Update(db.System, deadlineJob); err != nil {
+		t.Fatalf("error rescheduling deadline for test: %v", err)
+	}
+	processJobs()
+	if tasks := countTasks(); tasks != 1 {
+		t.Fatalf("expected the deadline job to create no more tasks but there are %d", tasks)
+	}
+	// instances which weren't submitted aren't graded unless the def asks for it
+	assInst, err := assignments.GetInstance(assDefKey + db.KeySeparator + "s3")
+	if err != nil {
+		t.Fatalf("error getting assignment instance for test: %v", err)
+	}
+	assInst.DueBy = now.Add(-time.Minute)
+	assDef.ZeroGradeMissing = false
+	if err := db.Update(db.System, assInst, assDef); err != nil {
+		t.Fatalf("error updating assignment for test: %v", err)
+	}
+	if _, err := jobs.New(jobTypeAssignmentDeadline, assDefKey, now.Add(-time.Minute), db.System, true); err != nil {
+		t.Fatalf("error rescheduling deadline for test: %v", err)
+	}
+	processJobs()
+	if assInst, err = assignments.GetInstance(assDefKey + db.KeySeparator + "s3"); err != nil || assInst.State != assignments.Assigned {
+		t.Fatal("expected not submitted instance to stay assigned")
+	}
+}
+
+func TestAutoGrade(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	course := &courses.Course{Number: 1, Year: 2020, Name: "course", Files: containers.NewStringSet()}
+	if err := db.Update(db.System, course); err != nil {
+		t.Fatalf("error creating course for test: %v", err)
+	}
+	students := []string{"s1", "s2", "s3"}
+	for _, student := range students {
+		if _, err := users.NewUserBuilder(db.System, true).WithUserName(student).WithPassword(student).WithRoles(users.StandardUser).
+			WithCoursesAsStudent(string(course.Key())).Build(); err != nil {
+			t.Fatalf("error creating user for test: %v", err)
+		}
+	}
+	now := time.Now().UTC()
+	assDef, err := assignments.NewDef(string(course.Key()), now.Add(2 * time.Hour), "ass", db.System, false, false)
+	if err != nil {
+		t.Fatalf("error creating assignment def for test: %v", err)
+	}
+	if err := assDef.SetSchedule(now.Add(3 * time.Hour), now.Add(time.Hour)); err == nil {
+		t.Fatal("expected publication after the due date to be rejected")
+	}
+	if err := assDef.SetSchedule(now.Add(-time.Minute), now.Add(3 * time.Hour)); err != nil {
+		t.Fatalf("error setting assignment def schedule for test: %v", err)
+	}
+	if assDef.Status.State != assignments.AutoGradeScheduled {
+		t.Fatal("expected automatic grading to be scheduled")
+	}
+	if err := db.Update(db.System, assDef); err != nil {
+		t.Fatalf("error creating assignment def for test: %v", err)
+	}
+	if err := scheduleAssignmentPublication(assDef, db.System); err != nil {
+		t.Fatalf("error scheduling publication for test: %v", err)
+	}
+	if err := scheduleAssignmentAutoGrade(assDef, db.System); err != nil {
+		t.Fatalf("error scheduling automatic grading for test: %v", err)
+	}
+	assDefKey := string(assDef.Key())
+	// all published tests are executed, whenever they usually run
+	for _, name := range []string{"published", "draft", "on_submit"} {
+		runsOn := tests.OnDemand
+		if name == "on_submit" {
+			runsOn = tests.OnSubmit
+		}
+		test, err := tests.New(db.System, assDefKey, name, "echo test", "linux", "amd64", 10, runsOn, true, false)
+		if err != nil {
+			t.Fatalf("error creating test for test: %v", err)
+		}
+		if name != "draft" {
+			test.State = tests.Published
+			if err := db.Update(db.System, test); err != nil {
+				t.Fatalf("error publishing test for test: %v", err)
+			}
+		}
+	}
+	// publication is due right away
+	processJobs()
+	if assDef, err = assignments.GetDef(assDefKey); err != nil || assDef.State != assignments.Published {
+		t.Fatal("expected assignment def to be published by the scheduler")
+	}
+	assInsts, err := getInstancesOfAssignmentDef(assDefKey)
+	if err != nil || len(assInsts) != len(students) {
+		t.Fatalf("expected %d instances to be created on publication", len(students))
+	}
+	// s1 didn't submit
+	for _, assInst := range assInsts {
+		if assInst.UserName != "s1" {
+			assInst.State = assignments.Submitted
+			assInst.Files.Add("main.c")
+			if err := db.Update(db.System, assInst); err != nil {
+				t.Fatalf("error updating assignment instance for test: %v", err)
+			}
+		}
+	}
+	if _, err := jobs.New(jobTypeAutoGrade, assDefKey, now.Add(-time.Minute), db.System, true); err != nil {
+		t.Fatalf("error rescheduling automatic grading for test: %v", err)
+	}
+	processJobs()
+	if assDef, err = assignments.GetDef(assDefKey); err != nil {
+		t.Fatalf("error getting assignment def for test: %v", err)
+	}
+	expectedStatus := assignments.AutoGradeStatus{State: assignments.AutoGradeInProgress, Instances: 3, NotSubmitted: 1, TasksCreated: 4}
+	if assDef.Status != expectedStatus {
+		t.Fatalf("expected automatic grading status %+v but got %+v", expectedStatus, assDef.Status)
+	}
+	if assInst, err := assignments.GetInstance(assDefKey + db.KeySeparator + "s1"); err != nil || assInst.State != assignments.Assigned {
+		t.Fatal("expected not submitted instance to be left to the deadline job")
+	}
+	job, err := jobs.Get(jobTypeAutoGrade + db.KeySeparator + assDefKey)
+	if err != nil {
+		t.Fatalf("expected automatic grading job to keep running until all tasks are done: %v", err)
+	}
+	// starting again after an interrupted run doesn't create the tasks twice
+	if _, err := startAutoGrade(job, assDef); err != nil {
+		t.Fatalf("error restarting automatic grading for test: %v", err)
+	}
+	if assDef.Status != expectedStatus {
+		t.Fatalf("expected restarted automatic grading status %+v but got %+v", expectedStatus, assDef.Status)
+	}
+	// the first task succeeds and the others fail
+	for i, taskId := range job.Labels[autoGradeTasks].([]interface{}) {
+		task, err := agents.GetTask(taskId.(string))
+		if err != nil {
+			t.Fatalf("error getting task for test: %v", err)
+		}
+		if i == 0 {
+			task.Status = agents.TaskStatusOk
+		} else {
+			task.Status = agents.TaskStatusError
+		}
+		if err := db.Update(db.System, task); err != nil {
+			t.Fatalf("error updating task for test: %v", err)
+		}
+	}
+	job.RunAt = now.Add(-time.Minute)
+	if err := db.Update(db.System, job); err != nil {
+		t.Fatalf("error rescheduling automatic grading for test: %v", err)
+	}
+	processJobs()
+	if assDef, err = assignments.GetDef(assDefKey); err != nil {
+		t.Fatalf("error getting assignment def for test: %v", err)
+	}
+	expectedStatus.State, expectedStatus.TasksDone, expectedStatus.TasksFailed = assignments.AutoGradeDone, 1, 3
+	if assDef.Status != expectedStatus {
+		t.Fatalf("expected automatic grading status %+v but got %+v", expectedStatus, assDef.Status)
+	}
+	if _, err := jobs.Get(jobTypeAutoGrade + db.KeySeparator + assDefKey); err == nil {
+		t.Fatal("expected automatic grading job to be done")
+	}
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
+	submithttp "github.com/DAv10195/submit_commons/http"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/appeals"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/forum"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/tests"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+// max length of the title of a message hit
+const maxSearchTitleLength = 100
+
+// the buckets of the elements which can be searched, mapped to functions returning an empty element of each of them
+var searchableBuckets = map[string]func() db.ISearchable{
+	db.Users:					func() db.ISearchable { return &users.User{} },
+	db.Courses:					func() db.ISearchable { return &courses.Course{} },
+	db.AssignmentDefinitions:	func() db.ISearchable { return &assignments.AssignmentDef{} },
+	db.Messages:				func() db.ISearchable { return &messages.Message{} },
+	db.ForumPosts:				func() db.ISearchable { return &forum.Post{} },
+}
+
+// an element found by search. The type of the hit is the bucket of the element. Forum post hits also hold the
+// assignment and question (thread) they belong to
+type SearchHit struct {
+	Type		string	`json:"type"`
+	Key			string	`json:"key"`
+	Title		string	`json:"title"`
+	Course		string	`json:"course,omitempty"`
+	Box			string	`json:"box,omitempty"`
+	Assignment	string	`json:"assignment,omitempty"`
+	Thread		string	`json:"thread,omitempty"`
+}
+
+type SearchResults struct {
+	Query	string			`json:"query"`
+	Hits	[]*SearchHit	`json:"hits"`
+}
+
+func (s *SearchResults) String() string {
+	return _stringForResp(s)
+}
+
+// index the searchable elements written before search was introduced
+func BuildSearchIndex() error {
+	for bucket, newElement := range searchableBuckets {
+		if err := db.IndexBucket(bucket, newElement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decides which of the found elements can be seen by the searching user
+type searchScope struct {
+	user			*users.User
+	// the message boxes the user can read, loaded when the first message is found
+	readableBoxes	*containers.StringSet
+}
+
+func (s *searchScope) isAdmin() bool {
+	return s.user.Roles.Contains(users.Admin)
+}
+
+func (s *searchScope) isCourseMember(courseKey string) bool {
+	return s.user.CoursesAsStaff.Contains(courseKey) || s.user.CoursesAsStudent.Contains(courseKey)
+}
+
+// students see only published assignments of their courses
+func (s *searchScope) canSeeAssignment(ass *assignments.AssignmentDef) bool {
+	return s.isAdmin() || s.user.CoursesAsStaff.Contains(ass.Course) || (ass.State != assignments.Draft && s.user.CoursesAsStudent.Contains(ass.Course))
+}
+
+// collect the boxes of the user, of the courses the user is a member of and of the appeals and tests in these courses
+// which the user owns or is a staff member of their course. Appeals and tests are keyed by their course, so only those
+// of the courses of the user are read
+func (s *searchScope) loadReadableBoxes() error {
+	boxes := containers.NewStringSet()
+	boxes.Add(s.user.MessageBox)
+	for _, courseKey := range append(s.user.CoursesAsStaff.Slice(), s.user.CoursesAsStudent.Slice()...) {
+		course, err := courses.Get(courseKey)
+		if err != nil {
+			if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+				continue
+			}
+			return err
+		}
+		boxes.Add(course.MessageBox)
+		isStaff := s.user.CoursesAsStaff.Contains(courseKey)
+		prefix := []byte(courseKey + db.KeySeparator)
+		if err := db.QueryBucketWithPrefix([]byte(db.Appeals), prefix, func (_, appealBytes []byte) error {
+			appeal := &appeals.Appeal{}
+			if err := json.Unmarshal(appealBytes, appeal); err != nil {
+				return err
+			}
+			split := strings.Split(appeal.AssignmentInstance, db.KeySeparator)
+			if isStaff || split[len(split) - 1] == s.user.UserName {
+				boxes.Add(appeal.MessageBox)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := db.QueryBucketWithPrefix([]byte(db.Tests), prefix, func (_, testBytes []byte) error {
+			test := &tests.Test{}
+			if err := json.Unmarshal(testBytes, test); err != nil {
+				return err
+			}
+			if isStaff || test.CreatedBy == s.user.UserName {
+				boxes.Add(test.MessageBox)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	boxes.Remove("")
+	s.readableBoxes = boxes
+	return nil
+}
+
+// return the given text as the title of a hit, shortened if it's too long
+func searchTitle(text string) string {
+	if titleRunes := []rune(text); len(titleRunes) > maxSearchTitleLength {
+		return fmt.Sprintf("%s...", string(titleRunes[:maxSearchTitleLength]))
+	}
+	return text
+}
+
+// return the hit for the element with the given bucket and key if the user can see it, or nil if the user can't
+func (s *searchScope) hit(bucket, key string) (*SearchHit, error) {
+	elemBytes, err := db.GetFromBucket([]byte(bucket), []byte(key))
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	hit := &SearchHit{Type: bucket, Key: key}
+	switch bucket {
+		case db.Users:
+			user := &users.User{}
+			if err := json.Unmarshal(elemBytes, user); err != nil {
+				return nil, err
+			}
+			if !s.isAdmin() && !s.user.Roles.Contains(users.Secretary) && user.UserName != s.user.UserName {
+				return nil, nil
+			}
+			hit.Title = strings.TrimSpace(fmt.Sprintf("%s %s", user.FirstName, user.LastName))
+			if hit.Title == "" {
+				hit.Title = user.UserName
+			}
+		case db.Courses:
+			course := &courses.Course{}
+			if err := json.Unmarshal(elemBytes, course); err != nil {
+				return nil, err
+			}
+			if !s.isAdmin() && !s.user.Roles.Contains(users.Secretary) && !s.isCourseMember(key) {
+				return nil, nil
+			}
+			hit.Title, hit.Course = course.Name, key
+		case db.AssignmentDefinitions:
+			ass := &assignments.AssignmentDef{}
+			if err := json.Unmarshal(elemBytes, ass); err != nil {
+				return nil, err
+			}
+			if !s.canSeeAssignment(ass) {
+				return nil, nil
+			}
+			hit.Title, hit.Course = ass.Name, ass.Course
+		case db.Messages:
+			msg := &messages.Message{}
+			if err := json.Unmarshal(elemBytes, msg); err != nil {
+				return nil, err
+			}
+			if !s.isAdmin() {
+				if s.readableBoxes == nil {
+					if err := s.loadReadableBoxes(); err != nil {
+						return nil, err
+					}
+				}
+				if !s.readableBoxes.Contains(msg.Box) || !msg.VisibleTo(s.user.UserName) {
+					return nil, nil
+				}
+			}
+			hit.Title, hit.Box = searchTitle(msg.Text), msg.Box
+		case db.ForumPosts:
+			post := &forum.Post{}
+			if err := json.Unmarshal(elemBytes, post); err != nil {
+				return nil, err
+			}
+			// posts are found by those who can read the forum of their assignment
+			ass, err := assignments.GetDef(post.AssignmentDef)
+			if err != nil {
+				if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+					return nil, nil
+				}
+				return nil, err
+			}
+			if !s.canSeeAssignment(ass) {
+				return nil, nil
+			}
+			hit.Title, hit.Course, hit.Assignment, hit.Thread = post.Title, ass.Course, post.AssignmentDef, post.Question
+			if post.IsQuestion() {
+				hit.Thread = post.ID
+			} else {
+				hit.Title = searchTitle(post.Text)
+			}
+		default:
+			return nil, nil
+	}
+	return hit, nil
+}
+
+// search users, courses, assignment defs, forum posts and messages by the terms of the given query. Only elements the
+// authenticated user can see are returned. The types of elements to search can be limited using comma separated bucket
+// names. Assignment instances aren't searched, as they hold no text of their own: they're found by listing them with
+// filters
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	params, err := submithttp.PagingParamsFromRequest(r)
+	if err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
+		return
+	}
+	query := r.URL.Query().Get(searchQueryParam)
+	if len(db.Tokenize(query)) == 0 {
+		writeStrErrResp(w, r, http.StatusBadRequest, "a query containing letters or digits is required")
+		return
+	}
+	var buckets []string
+	if types := r.URL.Query().Get(searchTypeParam); types != "" {
+		for _, bucket := range strings.Split(types, ",") {
+			if searchableBuckets[bucket] == nil {
+				writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("'%s' can't be searched", bucket))
+				return
+			}
+			buckets = append(buckets, bucket)
+		}
+	} else {
+		for bucket := range searchableBuckets {
+			buckets = append(buckets, bucket)
+		}
+	}
+	found, err := db.Search(query, buckets...)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	scope := &searchScope{user: r.Context().Value(authenticatedUser).(*users.User)}
+	results := &SearchResults{Query: query, Hits: make([]*SearchHit, 0)}
+	var hitsIndex int64
+	for _, f := range found {
+		hit, err := scope.hit(f.Bucket, f.Key)
+		if err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if hit == nil {
+			continue
+		}
+		hitsIndex++
+		if hitsIndex <= params.AfterId {
+			continue
+		}
+		if int64(len(results.Hits)) == params.Limit {
+			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
+			break
+		}
+		results.Hits = append(results.Hits, hit)
+	}
+	writeResponse(w, r, http.StatusOK, results)
+}
+
+func initSearchRouter(r *mux.Router, manager *authManager) {
+	basePath := "/search"
+	r.HandleFunc(basePath, handleSearch).Methods(http.MethodGet)
+	// hits are filtered by the handler according to what the user can see
+	manager.addPathPolicy(basePath, newPolicy("search", nil, allow(relationAnyone)))
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	submithttp "github.com/DAv10195/submit_commons/http"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/forum"
+	"github.com/DAv10195/submit_server/elements/messages"
+	"github.com/DAv10195/submit_server/elements/users"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSearchHandlers(t *testing.T) {
+	testUsers, router, cleanup := initHandlersTest(t)
+	defer cleanup()
+	outsider := newTestUser(t, "user4", users.StandardUser)
+	year := time.Now().UTC().Year()
+	initSearchRouter(router.Router, router.am)
+	send := func(query, user string) *httptest.ResponseRecorder {
+		return router.send(http.MethodGet, fmt.Sprintf("/search?%s", query), "", user)
+	}
+	search := func(q, types, user string) []*SearchHit {
+		params := url.Values{}
+		params.Set(searchQueryParam, q)
+		if types != "" {
+			params.Set(searchTypeParam, types)
+		}
+		results := &SearchResults{}
+		router.decode(send(params.Encode(), user), http.StatusOK, results)
+		return results.Hits
+	}
+	if hits := search("user", db.Users, users.Admin); len(hits) != 4 {
+		t.Fatalf("admin found %d users instead of 4", len(hits))
+	}
+	if hits := search("USER2", db.Users, "user2"); len(hits) != 1 || hits[0].Key != "user2" || hits[0].Type != db.Users {
+		t.Fatalf("user didn't find only itself: %v", hits)
+	}
+	if hits := search("user3", db.Users, "user2"); len(hits) != 0 {
+		t.Fatalf("user found %d other users", len(hits))
+	}
+	courseKey := fmt.Sprintf("1:%d", year)
+	if hits := search("cour", "", "user2"); len(hits) != 1 || hits[0].Key != courseKey || hits[0].Title != "course" {
+		t.Fatalf("student didn't find the course: %v", hits)
+	}
+	if hits := search("course", "", "user4"); len(hits) != 0 {
+		t.Fatalf("outsider found %d hits in a course it isn't a member of", len(hits))
+	}
+	if hits := search(fmt.Sprintf("ass %d", year), db.AssignmentDefinitions, "user1"); len(hits) != 1 || hits[0].Course != courseKey {
+		t.Fatalf("staff member didn't find the assignment: %v", hits)
+	}
+	if hits := search("ass", db.AssignmentDefinitions, "user2"); len(hits) != 0 {
+		t.Fatalf("student found %d draft assignments", len(hits))
+	}
+	question, err := forum.NewQuestion(fmt.Sprintf("%s:ass", courseKey), "user3", "Deadline", "is the deadline flexible", true, true)
+	if err != nil {
+		t.Fatalf("error creating forum question for test: %v", err)
+	}
+	if _, err := forum.NewAnswer(question, "user1", "the deadline is final", false, true); err != nil {
+		t.Fatalf("error creating forum answer for test: %v", err)
+	}
+	if hits := search("deadline", db.ForumPosts, "user1"); len(hits) != 2 || hits[0].Thread != question.ID || hits[1].Thread != question.ID {
+		t.Fatalf("staff member didn't find the forum thread: %v", hits)
+	}
+	if hits := search("deadline", db.ForumPosts, "user2"); len(hits) != 0 {
+		t.Fatalf("student found %d forum posts of a draft assignment", len(hits))
+	}
+	assDef, err := assignments.GetDef(fmt.Sprintf("%s:ass", courseKey))
+	if err != nil {
+		t.Fatalf("error getting assignment def for test: %v", err)
+	}
+	assDef.State = assignments.Published
+	if err := db.Update(db.System, assDef); err != nil {
+		t.Fatalf("error publishing assignment def for test: %v", err)
+	}
+	if hits := search("ass", db.AssignmentDefinitions, "user2"); len(hits) != 1 {
+		t.Fatalf("student found %d published assignments instead of 1", len(hits))
+	}
+	if hits := search("flexible", db.ForumPosts, "user2"); len(hits) != 1 || hits[0].Key != question.ID || hits[0].Title != "Deadline" {
+		t.Fatalf("student didn't find the forum question: %v", hits)
+	}
+	if hits := search("deadline", db.ForumPosts, "user4"); len(hits) != 0 {
+		t.Fatalf("outsider found %d forum posts", len(hits))
+	}
+	msg, _, err := messages.NewMessage("user3", "a question about Recursion", testUsers["user2"].MessageBox, true)
+	if err != nil {
+		t.Fatalf("error creating message for test: %v", err)
+	}
+	if hits := search("recursion question", "", "user2"); len(hits) != 1 || hits[0].Key != msg.ID || hits[0].Box != msg.Box {
+		t.Fatalf("owner of message box didn't find the message: %v", hits)
+	}
+	if hits := search("recursion", "", "user3"); len(hits) != 0 {
+		t.Fatalf("user found %d messages in a box it can't read", len(hits))
+	}
+	if hits := search("recursion loops", "", users.Admin); len(hits) != 0 {
+		t.Fatalf("found %d messages not containing all terms", len(hits))
+	}
+	if err := messages.DeleteMessage(msg, users.Admin, true, false); err != nil {
+		t.Fatalf("error deleting message for test: %v", err)
+	}
+	if hits := search("recursion", "", users.Admin); len(hits) != 0 {
+		t.Fatalf("found %d deleted messages", len(hits))
+	}
+	if err := db.Delete(outsider); err != nil {
+		t.Fatalf("error deleting user for test: %v", err)
+	}
+	if hits := search("user4", db.Users, users.Admin); len(hits) != 0 {
+		t.Fatalf("found %d deleted users", len(hits))
+	}
+	w := send(fmt.Sprintf("%s=user&%s=%s&limit=1", searchQueryParam, searchTypeParam, db.Users), users.Admin)
+	if w.Code != http.StatusOK || w.Header().Get(submithttp.ElementsLeftToProcess) != trueStr {
+		t.Fatalf("limited search produced status code %d and no indication of more hits", w.Code)
+	}
+	if w := send(fmt.Sprintf("%s=+-", searchQueryParam), users.Admin); w.Code != http.StatusBadRequest {
+		t.Fatalf("searching without terms produced status code %d instead of %d", w.Code, http.StatusBadRequest)
+	}
+	if w := send(fmt.Sprintf("%s=user&%s=%s", searchQueryParam, searchTypeParam, db.Sessions), users.Admin); w.Code != http.StatusBadRequest {
+		t.Fatalf("searching sessions produced status code %d instead of %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -3,13 +3,16 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/DAv10195/submit_server/session"
 	"github.com/gorilla/mux"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 )
 
 func getDbForSessionTest() func() {
@@ -57,3 +60,91 @@ func TestSession(t *testing.T) {
 		t.Fatalf("expected student courses in login data to be nil but got %v", ld.StudentCourses)
 	}
 }
+
+func TestServerSideSessions(t *testing.T) {
+	cleanup := getDbForSessionTest()
+	defer cleanup()
+	if _, err := users.NewUserBuilder(db.System, true).WithUserName("student").WithPassword("student").WithRoles(users.StandardUser).Build(); err != nil {
+		t.Fatalf("error creating user for test: %v", err)
+	}
+	router := newTestRouter(t)
+	initUsersRouter(router.Router, router.am)
+	initSessionsRouter(router.Router, router.am)
+	send := func(method, path string, auth func(r *http.Request)) *httptest.ResponseRecorder {
+		return router.sendWith(method, path, "", auth)
+	}
+	login := func(user, userAgent string) func(r *http.Request) {
+		w := router.sendWith(http.MethodGet, "/", "", basicAuth(user, user), "User-Agent", userAgent)
+		if w.Code != http.StatusOK {
+			t.Fatalf("login of %s produced status code %d instead of %d", user, w.Code, http.StatusOK)
+		}
+		return withCookies(w.Result().Cookies())
+	}
+	laptop, phone, admin := login("student", "laptop"), login("student", "phone"), login(users.Admin, "admin")
+	w := send(http.MethodGet, "/sessions/", laptop)
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing sessions produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	var listed struct {
+		Elements	[]*session.Session	`json:"elements"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatalf("error parsing sessions: %v", err)
+	}
+	if len(listed.Elements) != 2 {
+		t.Fatalf("expected 2 sessions but got %d", len(listed.Elements))
+	}
+	// sessions are listed by their handles, without the ids held by their cookies
+	var phoneSessionHandle string
+	for _, sess := range listed.Elements {
+		if sess.UserName != "student" || sess.Current != (sess.UserAgent == "laptop") || sess.ID != "" || sess.Handle == "" {
+			t.Fatalf("unexpected session: %+v", sess)
+		}
+		if sess.UserAgent == "phone" {
+			phoneSessionHandle = sess.Handle
+		}
+	}
+	// sessions outlive restarts of the server, which reads the key signing the cookies from its file
+	if err := session.Init(os.TempDir()); err != nil {
+		t.Fatalf("error initializing sessions again: %v", err)
+	}
+	if w := send(http.MethodGet, "/", laptop); w.Code != http.StatusOK {
+		t.Fatalf("request with session after restart produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	adminSessions, err := session.ListOfUser(users.Admin)
+	if err != nil || len(adminSessions) != 1 {
+		t.Fatalf("expected a single session of admin (%v)", err)
+	}
+	testCases := []struct{
+		name	string
+		method	string
+		path	string
+		auth	func(r *http.Request)
+		status	int
+	}{
+		{"test revoke session of other user", http.MethodDelete, fmt.Sprintf("/sessions/%s", adminSessions[0].Handle), laptop, http.StatusForbidden},
+		{"test revoke session by its id", http.MethodDelete, fmt.Sprintf("/sessions/%s", adminSessions[0].ID), admin, http.StatusNotFound},
+		{"test revoke own session", http.MethodDelete, fmt.Sprintf("/sessions/%s", phoneSessionHandle), laptop, http.StatusOK},
+		{"test revoked session", http.MethodGet, "/", phone, http.StatusUnauthorized},
+		{"test list sessions of user with std_user", http.MethodGet, "/users/student/sessions", laptop, http.StatusForbidden},
+		{"test list sessions of user with admin", http.MethodGet, "/users/student/sessions", admin, http.StatusOK},
+		{"test revoke sessions of user with admin", http.MethodDelete, "/users/student/sessions", admin, http.StatusOK},
+		{"test session revoked by admin", http.MethodGet, "/", laptop, http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		if w := send(tc.method, tc.path, tc.auth); w.Code != tc.status {
+			t.Fatalf("test case [ %s ] produced status code %d instead of the expected %d status code", tc.name, w.Code, tc.status)
+		}
+	}
+	// expired sessions are deleted by the cleanup job
+	adminSessions[0].ExpiresAt = time.Now().UTC().Add(-time.Minute)
+	if err := db.Update(db.System, adminSessions[0]); err != nil {
+		t.Fatalf("error expiring session for test: %v", err)
+	}
+	if nextRunAt, err := handleSessionCleanupJob(nil); err != nil || nextRunAt == nil {
+		t.Fatalf("unexpected session cleanup outcome: %v", err)
+	}
+	if _, err := session.GetById(adminSessions[0].ID); err == nil {
+		t.Fatal("expected expired session to be deleted")
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/jobs"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/session"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// return the sessions of the given user, marking the session the request was made with
+func writeSessionsOfUser(w http.ResponseWriter, r *http.Request, userName string) {
+	userSessions, err := session.ListOfUser(userName)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	current, _ := r.Context().Value(currentSession).(*session.Session)
+	var elements []db.IBucketElement
+	for _, sess := range userSessions {
+		sess.Current = current != nil && sess.ID == current.ID
+		elements = append(elements, sess)
+	}
+	writeElements(w, r, http.StatusOK, elements)
+}
+
+// return the sessions of the authenticated user
+func handleGetOwnSessions(w http.ResponseWriter, r *http.Request) {
+	writeSessionsOfUser(w, r, r.Context().Value(authenticatedUser).(*users.User).UserName)
+}
+
+// revoke the session with the given handle
+func handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	sess, err := session.GetByHandle(mux.Vars(r)[sessionHandle])
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			writeErrResp(w, r, http.StatusNotFound, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if err := session.Revoke(sess.ID); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if current, ok := r.Context().Value(currentSession).(*session.Session); ok && current.ID == sess.ID {
+		if err := session.ClearCookie(w, r); err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeResponse(w, r, http.StatusOK, &Response{Message: "session revoked successfully"})
+}
+
+// return the sessions of the given user
+func handleGetUserSessions(w http.ResponseWriter, r *http.Request) {
+	writeSessionsOfUser(w, r, mux.Vars(r)[userName])
+}
+
+// revoke all sessions of the given user
+func handleRevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	requestedUserName := mux.Vars(r)[userName]
+	revoked, err := session.RevokeAllOfUser(requestedUserName)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, &Response{Message: fmt.Sprintf("%d sessions of user \"%s\" revoked successfully", revoked, requestedUserName)})
+}
+
+// delete expired sessions periodically
+func handleSessionCleanupJob(_ *jobs.Job) (*time.Time, error) {
+	deleted, err := session.DeleteExpired()
+	if err != nil {
+		return nil, err
+	}
+	if deleted > 0 {
+		logger.Debugf("deleted %d expired sessions", deleted)
+	}
+	nextRunAt := time.Now().UTC().Add(cleanupJobsInterval)
+	return &nextRunAt, nil
+}
+
+func initSessionsRouter(r *mux.Router, manager *authManager) {
+	basePath := "/sessions"
+	router := r.PathPrefix(basePath).Subrouter()
+	router.HandleFunc("/", handleGetOwnSessions).Methods(http.MethodGet)
+	manager.addPathPolicy(fmt.Sprintf("%s/", basePath), newPolicy(db.Sessions, nil, allow(relationAnyone)))
+	router.HandleFunc(fmt.Sprintf("/{%s}", sessionHandle), handleRevokeSession).Methods(http.MethodDelete)
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), newPolicy("session", func (ar *authRequest) (*authResource, error) {
+		sess, err := session.GetByHandle(mux.Vars(ar.request)[sessionHandle])
+		if err != nil {
+			return nil, err
+		}
+		return &authResource{owner: sess.UserName, elem: sess}, nil
+	}, allow(relationAdmin), allow(relationOwner)))
+	userSessionsPath := fmt.Sprintf("/%s/{%s}/sessions", db.Users, userName)
+	r.HandleFunc(userSessionsPath, handleGetUserSessions).Methods(http.MethodGet)
+	r.HandleFunc(userSessionsPath, handleRevokeUserSessions).Methods(http.MethodDelete)
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^/%s/[^/]+/sessions$", db.Users)), newPolicy("user sessions", nil, allow(relationAdmin)))
+}
+
+func init() {
+	jobHandlers[jobTypeSessionCleanup] = handleSessionCleanupJob
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/audit"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/oidc"
+	"github.com/DAv10195/submit_server/session"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// configuration of the mapping of users authenticated by an OpenID Connect provider to submit users
+type SsoConfig struct {
+	// create users who don't exist yet when they log in for the first time
+	AutoProvision		bool
+	// the claim holding the name of users provisioned by single sign-on. Users are identified by the issuer and subject
+	// of their id tokens, never by this claim
+	UserNameClaim		string
+	// the claim holding the groups of the user
+	GroupsClaim			string
+	// groups mapped to the roles of their members
+	GroupRoles			map[string]string
+	// groups mapped to the course their members are students in
+	GroupStudentCourses	map[string]string
+	// groups mapped to the course their members are staff members in
+	GroupStaffCourses	map[string]string
+}
+
+var ssoProvider *oidc.Provider
+var ssoConf *SsoConfig
+
+// enable single sign-on with the given OpenID Connect provider, mapping the users it authenticates according to the
+// given configuration. Setting a nil provider disables single sign-on
+func SetSso(provider *oidc.Provider, conf *SsoConfig) error {
+	if provider != nil {
+		if conf.UserNameClaim == "" {
+			conf.UserNameClaim = DefSsoUserNameClaim
+		}
+		for group, role := range conf.GroupRoles {
+			// admins and agents keep authenticating with their local passwords
+			if role != users.StandardUser && role != users.Secretary {
+				return fmt.Errorf("group '%s' can't be mapped to role '%s' as it can't be granted by single sign-on", group, role)
+			}
+		}
+	}
+	ssoProvider, ssoConf = provider, conf
+	return nil
+}
+
+// a single sign-on login of a user which is denied even though the user was authenticated by the provider
+type ErrSsoLoginDenied struct {
+	User	string
+	Message	string
+}
+
+func (e *ErrSsoLoginDenied) Error() string {
+	return fmt.Sprintf("single sign-on login of user \"%s\" denied: %s", e.User, e.Message)
+}
+
+// the roles and course enrollments the given claims are mapped to. Courses which don't exist are ignored
+func ssoGrants(claims oidc.Claims) (*containers.StringSet, *containers.StringSet, *containers.StringSet, error) {
+	roles, studentCourses, staffCourses := containers.NewStringSet(), containers.NewStringSet(), containers.NewStringSet()
+	for _, group := range claims.Strings(ssoConf.GroupsClaim) {
+		if role, ok := ssoConf.GroupRoles[group]; ok {
+			roles.Add(role)
+		}
+		for _, grant := range []struct{
+			mapping		map[string]string
+			courses		*containers.StringSet
+		}{{ssoConf.GroupStudentCourses, studentCourses}, {ssoConf.GroupStaffCourses, staffCourses}} {
+			course, ok := grant.mapping[group]
+			if !ok {
+				continue
+			}
+			exists, err := db.KeyExistsInBucket([]byte(db.Courses), []byte(course))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if !exists {
+				logger.Warnf("group '%s' is mapped to course '%s' which doesn't exist", group, course)
+				continue
+			}
+			grant.courses.Add(course)
+		}
+	}
+	return roles, studentCourses, staffCourses, nil
+}
+
+// return the user linked to the identity the provider authenticated with the given claims, creating the user if there
+// is none yet and auto provisioning is enabled. Local users are linked to identities explicitly by admins, so an
+// identity can't take over a local user by claiming its name. Roles and course enrollments granted by the groups of
+// the user are added to it, while roles and enrollments granted locally are kept
+func ssoUser(claims oidc.Claims, ip string) (*users.User, error) {
+	userName, issuer, subject := claims.String(ssoConf.UserNameClaim), claims.String("iss"), claims.String("sub")
+	if subject == "" {
+		return nil, &ErrSsoLoginDenied{userName, "no 'sub' claim in id token"}
+	}
+	roles, studentCourses, staffCourses, err := ssoGrants(claims)
+	if err != nil {
+		return nil, err
+	}
+	user, err := users.GetBySsoIdentity(issuer, subject)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if userName == "" {
+			return nil, &ErrSsoLoginDenied{userName, fmt.Sprintf("no '%s' claim in id token", ssoConf.UserNameClaim)}
+		}
+		exists, err := db.KeyExistsInBucket([]byte(db.Users), []byte(userName))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, &ErrSsoLoginDenied{userName, "user exists but isn't linked to the identity, which only an admin can do"}
+		}
+		if !ssoConf.AutoProvision {
+			return nil, &ErrSsoLoginDenied{userName, "user doesn't exist and auto provisioning is disabled"}
+		}
+		// the user can't log in with a password until it's reset
+		passwordBytes := make([]byte, ssoPasswordLength)
+		if _, err := rand.Read(passwordBytes); err != nil {
+			return nil, err
+		}
+		if roles.NumberOfElements() == 0 {
+			roles.Add(users.StandardUser)
+		}
+		builder := users.NewUserBuilder(db.System, true).WithUserName(userName).WithPassword(hex.EncodeToString(passwordBytes)).
+			WithFirstName(claims.String("given_name")).WithLastName(claims.String("family_name")).WithEmail(claims.String("email")).
+			WithRoles(roles.Slice()...).WithCoursesAsStaff(staffCourses.Slice()...).WithSsoIdentity(issuer, subject)
+		for _, course := range studentCourses.Slice() {
+			if !staffCourses.Contains(course) {
+				builder.WithCoursesAsStudent(course)
+			}
+		}
+		if user, err = builder.Build(); err != nil {
+			return nil, err
+		}
+		if err := reconcileEnrollmentChanges(containers.NewStringSet(), user.CoursesAsStudent, db.System); err != nil {
+			return nil, err
+		}
+		details := fmt.Sprintf("user \"%s\" provisioned by single sign-on with roles %v", userName, user.Roles.Slice())
+		logger.Info(details)
+		if _, err := audit.Log(audit.UserProvisioned, userName, ip, details, db.System); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	if user.Roles.Contains(users.Admin) || user.Roles.Contains(users.Agent) {
+		return nil, &ErrSsoLoginDenied{user.UserName, "local accounts must authenticate with a password"}
+	}
+	if user.CoursesAsStudent == nil {
+		user.CoursesAsStudent = containers.NewStringSet()
+	}
+	if user.CoursesAsStaff == nil {
+		user.CoursesAsStaff = containers.NewStringSet()
+	}
+	preUpdateStudentCourses := containers.StringSetUnion(user.CoursesAsStudent)
+	changed := false
+	for _, grant := range []struct{
+		granted, of, otherwise	*containers.StringSet
+	}{{roles, user.Roles, nil}, {staffCourses, user.CoursesAsStaff, user.CoursesAsStudent}, {studentCourses, user.CoursesAsStudent, user.CoursesAsStaff}} {
+		for _, elem := range grant.granted.Slice() {
+			// a user can't be a staff member and a student in the same course
+			if grant.of.Contains(elem) || (grant.otherwise != nil && grant.otherwise.Contains(elem)) {
+				continue
+			}
+			grant.of.Add(elem)
+			changed = true
+		}
+	}
+	if !changed {
+		return user, nil
+	}
+	if err := db.Update(db.System, user); err != nil {
+		return nil, err
+	}
+	if err := reconcileEnrollmentChanges(preUpdateStudentCourses, user.CoursesAsStudent, db.System); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// start a single sign-on login, redirecting the user to the provider
+func handleSsoLogin(w http.ResponseWriter, r *http.Request) {
+	if ssoProvider == nil {
+		writeStrErrResp(w, r, http.StatusNotFound, "single sign-on is not configured")
+		return
+	}
+	loginUrl, ls, err := ssoProvider.StartLogin()
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	lsBytes, err := json.Marshal(ls)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := session.SaveSsoLoginState(w, r, string(lsBytes)); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	http.Redirect(w, r, loginUrl, http.StatusFound)
+}
+
+// complete a single sign-on login when the provider redirects the user back, creating a session for the user
+func handleSsoCallback(w http.ResponseWriter, r *http.Request) {
+	if ssoProvider == nil {
+		writeStrErrResp(w, r, http.StatusNotFound, "single sign-on is not configured")
+		return
+	}
+	params := r.URL.Query()
+	lsStr, err := session.TakeSsoLoginState(w, r)
+	if err != nil {
+		if err == session.ErrNotFound {
+			writeStrErrResp(w, r, http.StatusBadRequest, "no single sign-on login was started")
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if providerErr := params.Get("error"); providerErr != "" {
+		writeStrErrResp(w, r, http.StatusUnauthorized, fmt.Sprintf("single sign-on login failed: %s %s", providerErr, params.Get("error_description")))
+		return
+	}
+	ls := &oidc.LoginState{}
+	if err := json.Unmarshal([]byte(lsStr), ls); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	claims, err := ssoProvider.CompleteLogin(ls, params.Get("state"), params.Get("code"))
+	if err != nil {
+		if _, ok := err.(*oidc.ErrInvalidLogin); ok {
+			writeErrResp(w, r, http.StatusUnauthorized, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	ip := session.RemoteIp(r)
+	user, err := ssoUser(claims, ip)
+	if err != nil {
+		if deniedErr, ok := err.(*ErrSsoLoginDenied); ok {
+			logger.Warn(deniedErr.Error())
+			if _, err := audit.Log(audit.SsoLoginDenied, deniedErr.User, ip, deniedErr.Error(), db.System); err != nil {
+				logger.WithError(err).Error("error recording denied single sign-on login")
+			}
+			writeErrResp(w, r, http.StatusForbidden, deniedErr)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	sess, err := session.New(w, r, user.UserName)
+	if err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	ctx := context.WithValue(context.WithValue(r.Context(), authenticatedUser, user), currentSession, sess)
+	session.LoginHandler(logger)(w, r.WithContext(ctx))
+}
+
+func initSsoRouter(r *mux.Router) {
+	basePath := "/sso/oidc"
+	router := r.PathPrefix(basePath).Subrouter()
+	router.HandleFunc("/login", handleSsoLogin).Methods(http.MethodGet)
+	publicPaths[fmt.Sprintf("%s/login", basePath)] = true
+	router.HandleFunc("/callback", handleSsoCallback).Methods(http.MethodGet)
+	publicPaths[fmt.Sprintf("%s/callback", basePath)] = true
+}
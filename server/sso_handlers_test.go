@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/courses"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/oidc"
+	"github.com/DAv10195/submit_server/oidc/oidctest"
+	"github.com/DAv10195/submit_server/session"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSsoLogin(t *testing.T) {
+	cleanup := getDbForSessionTest()
+	defer cleanup()
+	course, err := courses.NewCourse(1, "course", db.System, true, false)
+	if err != nil {
+		t.Fatalf("error creating course for test: %v", err)
+	}
+	courseKey := string(course.Key())
+	mock := oidctest.NewMockProvider("submit")
+	defer mock.Close()
+	provider, err := oidc.NewProvider(&oidc.Config{Issuer: mock.Issuer(), ClientId: "submit", RedirectUrl: "http://localhost/sso/oidc/callback"}, nil)
+	if err != nil {
+		t.Fatalf("error creating provider for test: %v", err)
+	}
+	if err := SetSso(provider, &SsoConfig{GroupRoles: map[string]string{"admins": users.Admin}}); err == nil {
+		t.Fatal("expected mapping a group to the admin role to be rejected")
+	}
+	conf := &SsoConfig{AutoProvision: true, GroupsClaim: "groups", GroupRoles: map[string]string{"office": users.Secretary},
+		GroupStudentCourses: map[string]string{"course-students": courseKey, "missing-students": "2:2020"}}
+	if err := SetSso(provider, conf); err != nil {
+		t.Fatalf("error enabling single sign-on for test: %v", err)
+	}
+	defer func() {
+		_ = SetSso(nil, nil)
+	}()
+	router := newTestRouter(t)
+	initSsoRouter(router.Router)
+	send := func(path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		return router.sendWith(http.MethodGet, path, "", withCookies(cookies))
+	}
+	// log in with the given claims, following the redirects to the provider and back
+	login := func(claims oidc.Claims) *httptest.ResponseRecorder {
+		mock.SetClaims(claims)
+		w := send("/sso/oidc/login", nil)
+		if w.Code != http.StatusFound {
+			t.Fatalf("starting login produced status code %d instead of %d", w.Code, http.StatusFound)
+		}
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		resp, err := client.Get(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("error sending authorization request: %v", err)
+		}
+		_ = resp.Body.Close()
+		callback, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatalf("error parsing redirect: %v", err)
+		}
+		return send(callback.RequestURI(), w.Result().Cookies())
+	}
+	// first login provisions the user
+	w := login(oidc.Claims{"sub": "id-1", "preferred_username": "student", "email": "student@uni.edu", "groups": []string{"course-students", "missing-students"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("first login produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	ld := &session.LoginData{}
+	if err := json.NewDecoder(w.Body).Decode(ld); err != nil {
+		t.Fatalf("error parsing login data: %v", err)
+	}
+	if ld.UserName != "student" || len(ld.Roles) != 1 || ld.Roles[0] != users.StandardUser || len(ld.StudentCourses) != 1 || ld.StudentCourses[0] != courseKey {
+		t.Fatalf("unexpected login data: %+v", ld)
+	}
+	if w := send("/", w.Result().Cookies()); w.Code != http.StatusOK {
+		t.Fatalf("request with session created by single sign-on produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	// groups add roles to existing users, keeping their enrollments
+	if w := login(oidc.Claims{"sub": "id-1", "preferred_username": "student", "groups": []string{"office"}}); w.Code != http.StatusOK {
+		t.Fatalf("second login produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	user, err := users.Get("student")
+	if err != nil {
+		t.Fatalf("error getting provisioned user: %v", err)
+	}
+	if !user.Roles.Contains(users.Secretary) || !user.CoursesAsStudent.Contains(courseKey) || user.Email != "student@uni.edu" {
+		t.Fatalf("unexpected provisioned user: %+v", user)
+	}
+	// users are identified by the subject of their id tokens rather than by their user name claim
+	w = login(oidc.Claims{"sub": "id-1", "preferred_username": "renamed"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login with a changed user name produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	if err := json.NewDecoder(w.Body).Decode(ld); err != nil || ld.UserName != "student" {
+		t.Fatalf("expected login with a changed user name to log in as the linked user, got: %+v", ld)
+	}
+	newTestUser(t, "local", users.StandardUser)
+	for name, claims := range map[string]oidc.Claims{
+		"login as another user":			{"sub": "id-2", "preferred_username": "student"},
+		"login as a local user":			{"sub": "id-2", "preferred_username": "local"},
+		"login as admin":					{"sub": "id-2", "preferred_username": users.Admin},
+		"login without a subject":			{"preferred_username": "nobody"},
+		"login without a user name":		{"sub": "id-2", "email": "nobody@uni.edu"},
+	} {
+		if w := login(claims); w.Code != http.StatusForbidden {
+			t.Fatalf("%s produced status code %d instead of %d", name, w.Code, http.StatusForbidden)
+		}
+	}
+	// admins link local users to identities
+	initUsersRouter(router.Router, router.am)
+	linkBody := fmt.Sprintf("{\"sso_issuer\":\"%s\",\"sso_subject\":\"%%s\"}", mock.Issuer())
+	if w := router.send(http.MethodPut, "/users/local", fmt.Sprintf(linkBody, "id-1"), users.Admin); w.Code != http.StatusBadRequest {
+		t.Fatalf("linking an identity which is already linked produced status code %d instead of %d", w.Code, http.StatusBadRequest)
+	}
+	if w := router.send(http.MethodPut, "/users/local", fmt.Sprintf(linkBody, "id-2"), "local"); w.Code != http.StatusAccepted {
+		t.Fatalf("update of user by itself produced status code %d instead of %d", w.Code, http.StatusAccepted)
+	}
+	if w := login(oidc.Claims{"sub": "id-2"}); w.Code != http.StatusForbidden {
+		t.Fatalf("login with an identity linked by the user itself produced status code %d instead of %d", w.Code, http.StatusForbidden)
+	}
+	if w := router.send(http.MethodPut, "/users/local", fmt.Sprintf(linkBody, "id-2"), users.Admin); w.Code != http.StatusAccepted {
+		t.Fatalf("linking an identity produced status code %d instead of %d", w.Code, http.StatusAccepted)
+	}
+	if w := login(oidc.Claims{"sub": "id-2"}); w.Code != http.StatusOK {
+		t.Fatalf("login with a linked identity produced status code %d instead of %d", w.Code, http.StatusOK)
+	}
+	conf.AutoProvision = false
+	if w := login(oidc.Claims{"sub": "id-3", "preferred_username": "other"}); w.Code != http.StatusForbidden {
+		t.Fatalf("login of unknown user without auto provisioning produced status code %d instead of %d", w.Code, http.StatusForbidden)
+	}
+	if w := send("/sso/oidc/callback?state=state&code=code", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("callback without a started login produced status code %d instead of %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/agents"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var taskOutputStreams *taskOutputStreamsManager
+
+// a chunk of output (stdout or stderr) of a running task, streamed by the agent running it
+type TaskOutputChunk struct {
+	Task		string		`json:"task"`
+	Stream		string		`json:"stream"`
+	Data		string		`json:"data"`
+}
+
+// the buffered output of a running task and the channels of the clients watching it
+type taskOutputStream struct {
+	chunks		[]*TaskOutputChunk
+	size		int
+	watchers	map[chan *TaskOutputChunk]bool
+}
+
+// task output streams manager
+type taskOutputStreamsManager struct {
+	streams		map[string]*taskOutputStream
+	mutex		*sync.Mutex
+}
+
+// create a task output streams manager
+func newTaskOutputStreamsManager() *taskOutputStreamsManager {
+	return &taskOutputStreamsManager{make(map[string]*taskOutputStream), &sync.Mutex{}}
+}
+
+// get the output stream of the task with the given id, creating it if needed. Should be called while holding the mutex
+func (m *taskOutputStreamsManager) _getStream(taskId string) *taskOutputStream {
+	stream := m.streams[taskId]
+	if stream == nil {
+		stream = &taskOutputStream{watchers: make(map[chan *TaskOutputChunk]bool)}
+		m.streams[taskId] = stream
+	}
+	return stream
+}
+
+// buffer the given chunk and pass it to all clients watching the task. If the buffer is full, then the oldest chunks
+// are dropped and clients which can't keep up with the output are disconnected
+func (m *taskOutputStreamsManager) append(chunk *TaskOutputChunk) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stream := m._getStream(chunk.Task)
+	stream.chunks = append(stream.chunks, chunk)
+	stream.size += len(chunk.Data)
+	for stream.size > maxTaskOutputBufferSize && len(stream.chunks) > 1 {
+		stream.size -= len(stream.chunks[0].Data)
+		stream.chunks = stream.chunks[1:]
+	}
+	for watcher := range stream.watchers {
+		select {
+			case watcher <- chunk:
+			default:
+				close(watcher)
+				delete(stream.watchers, watcher)
+		}
+	}
+}
+
+// start watching the output of the task with the given id. Returns the output buffered so far and a channel on which
+// any further output is received. The channel is closed when the task is finished
+func (m *taskOutputStreamsManager) watch(taskId string) ([]*TaskOutputChunk, chan *TaskOutputChunk) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stream := m._getStream(taskId)
+	chunks := make([]*TaskOutputChunk, len(stream.chunks))
+	copy(chunks, stream.chunks)
+	watcher := make(chan *TaskOutputChunk, taskOutputWatcherBufferSize)
+	stream.watchers[watcher] = true
+	return chunks, watcher
+}
+
+// stop watching the output of the task with the given id
+func (m *taskOutputStreamsManager) unwatch(taskId string, watcher chan *TaskOutputChunk) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if stream := m.streams[taskId]; stream != nil {
+		delete(stream.watchers, watcher)
+		// nothing buffered and no one watching, so no reason to keep it
+		if len(stream.watchers) == 0 && len(stream.chunks) == 0 {
+			delete(m.streams, taskId)
+		}
+	}
+}
+
+// drop the buffered output of the task with the given id and close the channels of all clients watching it
+func (m *taskOutputStreamsManager) finish(taskId string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if stream := m.streams[taskId]; stream != nil {
+		for watcher := range stream.watchers {
+			close(watcher)
+		}
+		delete(m.streams, taskId)
+	}
+}
+
+// handle task output chunks streamed by agents while running tasks
+func handleTaskOutput(agentId string, payload []byte) {
+	chunk := &TaskOutputChunk{}
+	if err := json.Unmarshal(payload, chunk); err != nil {
+		logger.WithError(err).Error("task output handler: error parsing task output message")
+		return
+	}
+	task, err := agents.GetTask(chunk.Task)
+	if err != nil {
+		logger.WithError(err).Errorf("task output handler: received output for task with id == %s but it doesn't exist", chunk.Task)
+		return
+	}
+	if task.Agent != agentId || task.Status != agents.TaskStatusInProgress {
+		logger.Warnf("task output handler: ignoring output for task with id == %s as it is not in progress by agent with id == %s", task.ID, agentId)
+		return
+	}
+	taskOutputStreams.append(chunk)
+}
+
+// stream the output of a running task to the client over a websocket until the task is finished
+func handleStreamTaskOutput(w http.ResponseWriter, r *http.Request) {
+	requestedTaskId := mux.Vars(r)[taskId]
+	// start watching before checking the task status so output finished after the check isn't missed
+	chunks, watcher := taskOutputStreams.watch(requestedTaskId)
+	defer taskOutputStreams.unwatch(requestedTaskId, watcher)
+	task, err := agents.GetTask(requestedTaskId)
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			writeErrResp(w, r, http.StatusNotFound, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if task.Status != agents.TaskStatusReady && task.Status != agents.TaskStatusAssigned && task.Status != agents.TaskStatusInProgress {
+		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("task with id == %s is not running", task.ID))
+		return
+	}
+	wsUpgrade := websocket.Upgrader{}
+	conn, err := wsUpgrade.Upgrade(w, r, nil)
+	if err != nil {
+		logger.WithError(err).Errorf("error upgrading connection from [ %s ] to websocket", r.RemoteAddr)
+		return
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logger.WithError(err).Errorf("error closing task (id == %s) output stream to [ %s ]", task.ID, r.RemoteAddr)
+		}
+	}()
+	// read (and discard) incoming messages so a client closing the connection is noticed
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	writeChunk := func(chunk *TaskOutputChunk) bool {
+		chunkBytes, err := json.Marshal(chunk)
+		if err != nil {
+			logger.WithError(err).Errorf("error formatting output of task with id == %s", task.ID)
+			return false
+		}
+		if err := conn.SetWriteDeadline(time.Now().Add(serverTimeout)); err != nil {
+			return false
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, chunkBytes); err != nil {
+			logger.WithError(err).Debugf("error streaming output of task with id == %s to [ %s ]", task.ID, r.RemoteAddr)
+			return false
+		}
+		return true
+	}
+	for _, chunk := range chunks {
+		if !writeChunk(chunk) {
+			return
+		}
+	}
+	for {
+		select {
+			case chunk, ok := <- watcher:
+				if !ok {
+					_ = conn.SetWriteDeadline(time.Now().Add(serverTimeout))
+					_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "task finished"))
+					return
+				}
+				if !writeChunk(chunk) {
+					return
+				}
+			case <- clientGone:
+				return
+		}
+	}
+}
+
+func init() {
+	taskOutputStreams = newTaskOutputStreamsManager()
+	agentMsgHandlers[messageTypeTaskOutput] = handleTaskOutput
+}
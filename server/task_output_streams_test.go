@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	commons "github.com/DAv10195/submit_commons"
+	"github.com/DAv10195/submit_commons/containers"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/agents"
+	"github.com/DAv10195/submit_server/elements/users"
+	"github.com/DAv10195/submit_server/session"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTaskOutputStream(t *testing.T) {
+	cleanup := db.InitDbForTest()
+	defer cleanup()
+	cleanupSess := session.InitSessionForTest()
+	defer cleanupSess()
+	for _, name := range []string{"owner", "other"} {
+		if _, err := users.NewUserBuilder(db.System, true).WithUserName(name).WithPassword(name).WithRoles(users.StandardUser).Build(); err != nil {
+			t.Fatalf("error creating user for task output stream test: %v", err)
+		}
+	}
+	agentId := commons.GenerateUniqueId()
+	task := &agents.Task{
+		ID:				commons.GenerateUniqueId(),
+		Command:		"mock",
+		ResponseHandler:testTask,
+		ExecTimeout:	60,
+		Status:			agents.TaskStatusInProgress,
+		Agent:			agentId,
+		Dependencies:	containers.NewStringSet(),
+		Labels:			map[string]interface{}{onDemandTask: true},
+	}
+	task.CreatedBy = "owner"
+	if err := db.Update("owner", task); err != nil {
+		t.Fatalf("error updating db with task for test: %v", err)
+	}
+	router := newTestRouter(t)
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	initAgentsBackend(router.Router, router.am, ctx, wg)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	streamUrl := fmt.Sprintf("ws%s/%s/%s/stream", strings.TrimPrefix(server.URL, "http"), db.Tasks, task.ID)
+	dial := func(user string) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		r := &http.Request{Header: header}
+		r.SetBasicAuth(user, user)
+		return websocket.DefaultDialer.Dial(streamUrl, header)
+	}
+	sendChunk := func(fromAgent, data string) {
+		chunkBytes, err := json.Marshal(&TaskOutputChunk{Task: task.ID, Stream: "stdout", Data: data})
+		if err != nil {
+			t.Fatalf("error formatting task output chunk for test: %v", err)
+		}
+		handleTaskOutput(fromAgent, chunkBytes)
+	}
+	if _, resp, err := dial("other"); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("expected streaming output of a task triggered by another user to be forbidden")
+	}
+	sendChunk(agentId, "first")
+	sendChunk(commons.GenerateUniqueId(), "ignored") // not the agent running the task
+	conn, _, err := dial("owner")
+	if err != nil {
+		t.Fatalf("error connecting to task output stream: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	readChunk := func(expected string) {
+		chunk := &TaskOutputChunk{}
+		if err := conn.ReadJSON(chunk); err != nil {
+			t.Fatalf("error reading task output chunk: %v", err)
+		}
+		if chunk.Data != expected {
+			t.Fatalf("expected task output chunk '%s' but got '%s'", expected, chunk.Data)
+		}
+	}
+	readChunk("first")
+	sendChunk(agentId, "second")
+	readChunk("second")
+	taskOutputStreams.finish(task.ID)
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected task output stream to be closed normally when the task finished but got: %v", err)
+	}
+}
@@ -1,18 +1,16 @@
 package server
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
-	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
 	"github.com/DAv10195/submit_server/elements/tests"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/DAv10195/submit_server/fs"
 	"github.com/gorilla/mux"
-	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -27,109 +25,30 @@ func getTestKey(r *http.Request) (string, error) {
 	return strings.Join([]string{strconv.Itoa(number), strconv.Itoa(year), mux.Vars(r)[assDefName], mux.Vars(r)[testName]}, db.KeySeparator), nil
 }
 
-func getTestsForUserAssignment(forUser, forAss string, w http.ResponseWriter, r *http.Request, params *submithttp.PagingParams) {
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Tests), func (_ []byte, testBytes []byte) error {
-		test := &tests.Test{}
-		if err := json.Unmarshal(testBytes, test); err != nil {
-			return err
-		}
-		if test.AssignmentDef == forAss && (test.CreatedBy == forUser || test.State == tests.Published) {
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, test)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+func getTestsForUserAssignment(forUser, forAss string, w http.ResponseWriter, r *http.Request) {
+	writeQueriedElements(w, r, db.Tests, func() db.IBucketElement { return &tests.Test{} }, func(elem db.IBucketElement) bool {
+		test := elem.(*tests.Test)
+		return test.AssignmentDef == forAss && (test.CreatedBy == forUser || test.State == tests.Published)
+	})
 }
 
-func getTestsForAssignmentDef(forAss string, w http.ResponseWriter, r *http.Request, params *submithttp.PagingParams) {
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Tests), func (_ []byte, testBytes []byte) error {
-		test := &tests.Test{}
-		if err := json.Unmarshal(testBytes, test); err != nil {
-			return err
-		}
-		if test.AssignmentDef == forAss {
-			elementsIndex++
-			if elementsIndex <= params.AfterId {
-				return nil
-			}
-			elements = append(elements, test)
-			elementsCount++
-			if elementsCount == params.Limit {
-				return &db.ErrStopQuery{}
-			}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+func getTestsForAssignmentDef(forAss string, w http.ResponseWriter, r *http.Request) {
+	writeQueriedElements(w, r, db.Tests, func() db.IBucketElement { return &tests.Test{} }, func(elem db.IBucketElement) bool {
+		return elem.(*tests.Test).AssignmentDef == forAss
+	})
 }
 
 func handleGetTests(w http.ResponseWriter, r *http.Request) {
-	params, err := submithttp.PagingParamsFromRequest(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
-		return
-	}
 	forAss, forUser := r.Header.Get(submithttp.ForSubmitAss), r.Header.Get(submithttp.ForSubmitUser)
 	if forAss != "" {
 		if forUser != "" {
-			getTestsForUserAssignment(forUser, forAss, w, r, params)
+			getTestsForUserAssignment(forUser, forAss, w, r)
 			return
 		}
-		getTestsForAssignmentDef(forAss, w, r, params)
+		getTestsForAssignmentDef(forAss, w, r)
 		return
 	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Tests), func (_ []byte, testBytes []byte) error {
-		elementsIndex++
-		if elementsIndex <= params.AfterId {
-			return nil
-		}
-		test := &tests.Test{}
-		if err := json.Unmarshal(testBytes, test); err != nil {
-			return err
-		}
-		elements = append(elements, test)
-		elementsCount++
-		if elementsCount == params.Limit {
-			return &db.ErrStopQuery{}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.Tests, func() db.IBucketElement { return &tests.Test{} }, nil)
 }
 
 func handleCreateTest(w http.ResponseWriter, r *http.Request) {
@@ -252,77 +171,63 @@ func handleUpdateTestState(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, r, http.StatusOK, &Response{Message: fmt.Sprintf("test '%s' state updated successfully", string(test.Key()))})
 }
 
+// conditions of test authorization rules
+var (
+	isOnDemandTest = &condition{"the test runs on demand", func(_ *authRequest, res *authResource) bool {
+		return res.elem.(*tests.Test).RunsOn == tests.OnDemand
+	}}
+	isPublishedTest = &condition{"the test is published", func(_ *authRequest, res *authResource) bool {
+		return res.elem.(*tests.Test).State == tests.Published
+	}}
+	isOwnTestNotInReview = &condition{"the test was created by the user and isn't patched while in review", func(ar *authRequest, res *authResource) bool {
+		test := res.elem.(*tests.Test)
+		return test.CreatedBy == ar.user.UserName && !(ar.request.Method == http.MethodPatch && test.State == tests.InReview)
+	}}
+)
+
 func initTestsRouter(r *mux.Router, m *authManager) {
 	basePath := fmt.Sprintf("/%s", db.Tests)
 	router := r.PathPrefix(basePath).Subrouter()
 	router.HandleFunc("/", handleGetTests).Methods(http.MethodGet)
 	router.HandleFunc("/", handleCreateTest).Methods(http.MethodPost)
-	m.addPathToMap(fmt.Sprintf("%s/", basePath), func(user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		if request.Method == http.MethodGet {
-			forAss := request.Header.Get(submithttp.ForSubmitAss)
-			forUser := request.Header.Get(submithttp.ForSubmitUser)
-			if forAss != "" {
-				ass, err := assignments.GetDef(forAss)
-				if err != nil {
-					return true // let actual handler send an appropriate error message
-				}
-				if user.CoursesAsStaff.Contains(ass.Course) {
-					return true
-				}
-				return forUser != "" && user.UserName == forUser
-			}
-		} else if request.Method == http.MethodPost {
-			buf, err := ioutil.ReadAll(request.Body)
-			if err != nil {
-				return true // let the creation handler fail this with bad request...
-			}
-			bodyCopy1, bodyCopy2 := ioutil.NopCloser(bytes.NewBuffer(buf)), ioutil.NopCloser(bytes.NewBuffer(buf))
-			request.Body = bodyCopy1
+	m.addPathPolicy(fmt.Sprintf("%s/", basePath), newPolicy(db.Tests, func (ar *authRequest) (*authResource, error) {
+		if ar.request.Method == http.MethodPost {
 			test := &tests.Test{}
-			if err := json.NewDecoder(bodyCopy2).Decode(test); err != nil {
-				return true // let the creation handler fail this with bad request...
+			if err := ar.decodeBody(test); err != nil {
+				return nil, err
 			}
-			ass, err := assignments.GetDef(test.AssignmentDef)
+			ass, err := ar.assDef(test.AssignmentDef)
 			if err != nil {
-				return true // let the creation handler fail this with bad request...
+				return nil, err
 			}
-			return user.CoursesAsStaff.Contains(ass.Course) || (user.CoursesAsStudent.Contains(ass.Course) && test.RunsOn != tests.OnSubmit)
+			return &authResource{course: ass.Course, elem: test}, nil
 		}
-		return false
-	})
+		forAss := ar.request.Header.Get(submithttp.ForSubmitAss)
+		if forAss == "" {
+			return &authResource{}, nil
+		}
+		ass, err := ar.assDef(forAss)
+		if err != nil {
+			return nil, err
+		}
+		return &authResource{course: ass.Course, owner: ar.request.Header.Get(submithttp.ForSubmitUser)}, nil
+	},
+		allow(relationAdmin),
+		allow(relationCourseStaff, http.MethodGet),
+		allow(relationOwner, http.MethodGet),
+		allowWithPermission(courses.EditTests, http.MethodPost),
+		allow(relationCourseStudent, http.MethodPost).when(isOnDemandTest),
+	))
 	specificPath := fmt.Sprintf("/{%s}/{%s}/{%s}/{%s}", courseNumber, courseYear, assDefName, testName)
 	router.HandleFunc(specificPath, handleGetTest).Methods(http.MethodGet)
 	router.HandleFunc(specificPath, handleDeleteTest).Methods(http.MethodDelete)
 	router.HandleFunc(specificPath, handleUpdateTest).Methods(http.MethodPut)
 	router.HandleFunc(specificPath, handleUpdateTestState).Methods(http.MethodPatch)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		testKey, err := getTestKey(request)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		test, err := tests.Get(testKey)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		cNumber, cYear, err := getCourseNumberAndYearFromRequest(request)
-		if err != nil {
-			return true // let the next handler send an appropriate error message
-		}
-		courseKey := fmt.Sprintf("%d%s%d", cNumber, db.KeySeparator, cYear)
-		if user.CoursesAsStaff.Contains(courseKey) {
-			return true
-		} else if user.CoursesAsStudent.Contains(courseKey) {
-			if request.Method == http.MethodPatch && test.State == tests.InReview {
-				return false
-			}
-			return test.CreatedBy == user.UserName || (test.State == tests.Published && request.Method == http.MethodGet)
-		}
-		return false
-	})
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), newPolicy("test", resolveTestFromPath,
+		allow(relationAdmin),
+		allow(relationCourseStaff, http.MethodGet),
+		allowWithPermission(courses.EditTests),
+		allow(relationCourseStudent).when(isOwnTestNotInReview),
+		allow(relationCourseStudent, http.MethodGet).when(isPublishedTest),
+	))
 }
@@ -1,17 +1,16 @@
 package server
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/DAv10195/submit_commons/containers"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/agents"
 	"github.com/DAv10195/submit_server/elements/assignments"
+	"github.com/DAv10195/submit_server/elements/courses"
 	"github.com/DAv10195/submit_server/elements/tests"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/gorilla/mux"
-	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strings"
@@ -147,8 +146,7 @@ func handlePostMultiTestRequest(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if assInst.State == assignments.Assigned {
-			assInst.Grade = 0
-			assInst.State = assignments.Graded
+			assInst.SetGrade(0)
 			notSubmittedAssInsts = append(notSubmittedAssInsts, assInst)
 			continue
 		}
@@ -175,84 +173,91 @@ func initTestRequestsRouter(r *mux.Router, m *authManager) {
 	basePath := "/test_requests"
 	router := r.PathPrefix(basePath).Subrouter()
 	router.HandleFunc("/single", handlePostTestRequest).Methods(http.MethodPost)
-	m.addPathToMap(fmt.Sprintf("%s/single", basePath), func(user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		buf, err := ioutil.ReadAll(request.Body)
-		if err != nil {
-			return true // let the next handler fail this with bad request...
-		}
-		bodyCopy1, bodyCopy2 := ioutil.NopCloser(bytes.NewBuffer(buf)), ioutil.NopCloser(bytes.NewBuffer(buf))
-		request.Body = bodyCopy1
+	m.addPathPolicy(fmt.Sprintf("%s/single", basePath), newPolicy("test request", func (ar *authRequest) (*authResource, error) {
 		tr := &TestRequest{}
-		if err := json.NewDecoder(bodyCopy2).Decode(tr); err != nil {
-			return true // let the next handler fail this with bad request...
+		if err := ar.decodeBody(tr); err != nil {
+			return nil, err
 		}
-		test, err := tests.Get(tr.Test)
+		test, err := ar.test(tr.Test)
 		if err != nil {
-			return true // let the next handler fail this request...
+			return nil, err
 		}
-		assDef, err := assignments.GetDef(test.AssignmentDef)
+		assDef, err := ar.assDef(test.AssignmentDef)
 		if err != nil {
-			return true // let the next handler fail this request...
+			return nil, err
 		}
+		res := &authResource{course: assDef.Course, elem: tr}
 		if tr.AssignmentInstance != "" {
-			assInst, err := assignments.GetInstance(tr.AssignmentInstance)
+			assInst, err := ar.assInst(tr.AssignmentInstance)
 			if err != nil {
-				return true // let the next handler fail this request...
+				return nil, err
 			}
-			if assInst.AssignmentDef != test.AssignmentDef {
-				 return false
-			}
-			if tr.OnDemand && assInst.UserName == user.UserName {
-				return true
+			if tr.OnDemand {
+				res.owner = assInst.UserName
 			}
 		}
-		return user.CoursesAsStaff.Contains(assDef.Course)
-	})
+		return res, nil
+	},
+		allow(relationAdmin),
+		allow(relationOwner).when(isTestOfInstance),
+		allowWithPermission(courses.Grade).when(isTestOfInstance),
+		allowWithPermission(courses.EditTests).when(isTestOfInstance),
+	))
 	router.HandleFunc("/multi", handlePostMultiTestRequest).Methods(http.MethodPost)
-	m.addPathToMap(fmt.Sprintf("%s/multi", basePath), func(user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
-			return true
-		}
-		buf, err := ioutil.ReadAll(request.Body)
-		if err != nil {
-			return true // let the next handler fail this with bad request...
-		}
-		bodyCopy1, bodyCopy2 := ioutil.NopCloser(bytes.NewBuffer(buf)), ioutil.NopCloser(bytes.NewBuffer(buf))
-		request.Body = bodyCopy1
+	m.addPathPolicy(fmt.Sprintf("%s/multi", basePath), newPolicy("multi test request", func (ar *authRequest) (*authResource, error) {
 		mtr := &MultiTestRequest{}
-		if err := json.NewDecoder(bodyCopy2).Decode(mtr); err != nil {
-			return true // let the next handler fail this with bad request...
+		if err := ar.decodeBody(mtr); err != nil {
+			return nil, err
 		}
-		test, err := tests.Get(mtr.Test)
+		test, err := ar.test(mtr.Test)
 		if err != nil {
-			return true // let the next handler fail this request...
+			return nil, err
 		}
-		assDef, err := assignments.GetDef(test.AssignmentDef)
+		assDef, err := ar.assDef(test.AssignmentDef)
 		if err != nil {
-			return true // let the next handler fail this request...
+			return nil, err
 		}
-		return user.CoursesAsStaff.Contains(assDef.Course)
-	})
+		return &authResource{course: assDef.Course}, nil
+	}, allow(relationAdmin), allowWithPermission(courses.Grade)))
 	router.HandleFunc(fmt.Sprintf("/{%s}", taskId), handleGetTestResponse).Methods(http.MethodGet)
-	m.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), func (user *users.User, request *http.Request) bool {
-		if user.Roles.Contains(users.Admin) {
+	m.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", basePath)), newTestTaskPolicy())
+}
+
+// conditions of test request authorization rules
+var (
+	isTestOfInstance = &condition{"the test is of the assignment of the instance", func(ar *authRequest, res *authResource) bool {
+		tr := res.elem.(*TestRequest)
+		if tr.AssignmentInstance == "" {
 			return true
 		}
-		task, err := agents.GetTask(mux.Vars(request)[taskId])
+		test, err := ar.test(tr.Test)
 		if err != nil {
-			return true // let the next handler fail this request...
+			return false
 		}
-		od, ok := task.Labels[onDemandTask]
-		if !ok {
+		assInst, err := ar.assInst(tr.AssignmentInstance)
+		if err != nil {
 			return false
 		}
-		onDemand, ok := od.(bool)
+		return assInst.AssignmentDef == test.AssignmentDef
+	}}
+	isOnDemandTestTask = &condition{"the task is an on demand test execution", func(_ *authRequest, res *authResource) bool {
+		od, ok := res.elem.(*agents.Task).Labels[onDemandTask]
 		if !ok {
 			return false
 		}
-		return onDemand && task.CreatedBy == user.UserName
-	})
+		onDemand, ok := od.(bool)
+		return ok && onDemand
+	}}
+)
+
+// return a policy for test execution tasks. Admins can access any task and other users can access only on demand test
+// executions they triggered
+func newTestTaskPolicy() *policy {
+	return newPolicy("test task", func (ar *authRequest) (*authResource, error) {
+		task, err := ar.task(mux.Vars(ar.request)[taskId])
+		if err != nil {
+			return nil, err
+		}
+		return &authResource{owner: task.CreatedBy, elem: task}, nil
+	}, allow(relationAdmin), allow(relationOwner).when(isOnDemandTestTask))
 }
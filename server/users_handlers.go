@@ -3,18 +3,54 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/DAv10195/submit_commons/containers"
 	"github.com/DAv10195/submit_commons/errors"
-	submithttp "github.com/DAv10195/submit_commons/http"
 	"github.com/DAv10195/submit_server/db"
 	"github.com/DAv10195/submit_server/elements/messages"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/DAv10195/submit_server/fs"
+	"github.com/DAv10195/submit_server/session"
 	"github.com/gorilla/mux"
 	"net/http"
 	"regexp"
-	"strings"
 )
 
+// check if the given user can manage users with the given roles. Admins can manage all users while secretaries can
+// manage only standard users
+func canManageUsersWithRoles(user *users.User, roles *containers.StringSet) bool {
+	if user.Roles.Contains(users.Admin) {
+		return true
+	}
+	if !user.Roles.Contains(users.Secretary) || roles == nil {
+		return false
+	}
+	for _, role := range roles.Slice() {
+		if role != users.StandardUser {
+			return false
+		}
+	}
+	return true
+}
+
+// check if the given string sets contain the same elements. A nil set is treated as an empty one
+func sameElements(a, b *containers.StringSet) bool {
+	if a == nil {
+		a = containers.NewStringSet()
+	}
+	if b == nil {
+		b = containers.NewStringSet()
+	}
+	if a.NumberOfElements() != b.NumberOfElements() {
+		return false
+	}
+	for _, elem := range a.Slice() {
+		if !b.Contains(elem) {
+			return false
+		}
+	}
+	return true
+}
+
 // return information about the requested user
 func handleGetUser(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(authenticatedUser).(*users.User)
@@ -39,37 +75,7 @@ func handleGetUser(w http.ResponseWriter, r *http.Request) {
 
 // return information about all users
 func handleGetAllUsers(w http.ResponseWriter, r *http.Request) {
-	params, err := submithttp.PagingParamsFromRequest(r)
-	if err != nil {
-		writeErrResp(w, r, http.StatusBadRequest, fmt.Errorf("error parsing query params: %v", err))
-		return
-	}
-	var elements []db.IBucketElement
-	var elementsCount, elementsIndex int64
-	if err := db.QueryBucket([]byte(db.Users), func(_, elementBytes []byte) error {
-		elementsIndex++
-		if elementsIndex <= params.AfterId {
-			return nil
-		}
-		user := &users.User{}
-		if err := json.Unmarshal(elementBytes, user); err != nil {
-			return err
-		}
-		elements = append(elements, user)
-		elementsCount++
-		if elementsCount == params.Limit {
-			return &db.ErrStopQuery{}
-		}
-		return nil
-	}); err != nil {
-		if _, ok := err.(*db.ErrElementsLeftToProcess); ok {
-			w.Header().Set(submithttp.ElementsLeftToProcess, trueStr)
-		} else {
-			writeErrResp(w, r, http.StatusInternalServerError, err)
-			return
-		}
-	}
-	writeElements(w, r, http.StatusOK, elements)
+	writeQueriedElements(w, r, db.Users, func() db.IBucketElement { return &users.User{} }, nil)
 }
 
 // register the given users with their given information
@@ -84,9 +90,13 @@ func handleRegisterUsers(w http.ResponseWriter, r *http.Request) {
 	}
 	var elementsToCreate []db.IBucketElement
 	for _, u := range body.Users {
+		if !canManageUsersWithRoles(requestUser, u.Roles) {
+			writeStrErrResp(w, r, http.StatusForbidden, fmt.Sprintf("registration of user \"%s\" with the given roles is forbidden", u.UserName))
+			return
+		}
 		builder := users.NewUserBuilder(requestUser.UserName, false)
 		user, err := builder.WithUserName(u.UserName).WithFirstName(u.FirstName).WithLastName(u.LastName).
-			WithPassword(u.Password).WithEmail(u.Email).WithRoles(u.Roles.Slice()...).
+			WithPassword(u.Password).WithEmail(u.Email).WithEmailPreference(u.EmailPreference).WithRoles(u.Roles.Slice()...).
 			WithCoursesAsStaff(u.CoursesAsStaff.Slice()...).WithCoursesAsStudent(u.CoursesAsStudent.Slice()...).Build()
 		if err != nil {
 			_, ok1 := err.(*db.ErrKeyExistsInBucket)
@@ -109,6 +119,14 @@ func handleRegisterUsers(w http.ResponseWriter, r *http.Request) {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	enrolledCourses := containers.NewStringSet()
+	for _, u := range body.Users {
+		enrolledCourses.Add(u.CoursesAsStudent.Slice()...)
+	}
+	if err := reconcileEnrollmentChanges(containers.NewStringSet(), enrolledCourses, requestUser.UserName); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
 	writeResponse(w, r, http.StatusAccepted, &Response{Message: "users created successfully"})
 }
 
@@ -133,10 +151,18 @@ func handleDelUser(w http.ResponseWriter, r *http.Request) {
 		writeStrErrResp(w, r, http.StatusForbidden, "deletion of admin user is forbidden")
 		return
 	}
+	if !canManageUsersWithRoles(authenticatedUser, requestedUser.Roles) {
+		writeStrErrResp(w, r, http.StatusForbidden, fmt.Sprintf("deletion of user \"%s\" is forbidden", requestedUser.UserName))
+		return
+	}
 	if err := users.Delete(requestedUser, fs.GetClient() != nil); err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	if _, err := session.RevokeAllOfUser(requestedUser.UserName); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
 	writeResponse(w, r, http.StatusOK, &Response{Message: fmt.Sprintf("user \"%s\" deleted successfully", requestedUser.UserName)})
 }
 
@@ -164,6 +190,7 @@ func handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	updatedUser.Password = preUpdateUser.Password
+	updatedUser.PasswordChangedOn = preUpdateUser.PasswordChangedOn
 	updatedUser.MessageBox = preUpdateUser.MessageBox
 	updatedUser.CreatedOn = preUpdateUser.CreatedOn
 	updatedUser.CreatedBy = preUpdateUser.CreatedBy
@@ -185,28 +212,111 @@ func handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 	if updatedUser.Email == "" {
 		updatedUser.Email = preUpdateUser.Email
 	}
-	if err := db.Update(r.Context().Value(authenticatedUser).(*users.User).UserName, updatedUser); err != nil {
+	if updatedUser.EmailPreference == "" {
+		updatedUser.EmailPreference = preUpdateUser.EmailPreference
+	} else if !users.EmailPreferences.Contains(updatedUser.EmailPreference) {
+		writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("invalid email preference: %s", updatedUser.EmailPreference))
+		return
+	}
+	requestUser := r.Context().Value(authenticatedUser).(*users.User)
+	// only admins link users to single sign-on identities
+	if updatedUser.SsoSubject == "" || !requestUser.Roles.Contains(users.Admin) {
+		updatedUser.SsoIssuer, updatedUser.SsoSubject = preUpdateUser.SsoIssuer, preUpdateUser.SsoSubject
+	} else if updatedUser.SsoIssuer != preUpdateUser.SsoIssuer || updatedUser.SsoSubject != preUpdateUser.SsoSubject {
+		linkedUser, err := users.GetBySsoIdentity(updatedUser.SsoIssuer, updatedUser.SsoSubject)
+		if err != nil {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if linkedUser != nil {
+			writeStrErrResp(w, r, http.StatusBadRequest, fmt.Sprintf("the single sign-on identity is already linked to user \"%s\"", linkedUser.UserName))
+			return
+		}
+	}
+	if requestUser.UserName != requestedUserName && !canManageUsersWithRoles(requestUser, preUpdateUser.Roles) {
+		writeStrErrResp(w, r, http.StatusForbidden, fmt.Sprintf("update of user \"%s\" is forbidden", requestedUserName))
+		return
+	}
+	rolesChanged := !sameElements(preUpdateUser.Roles, updatedUser.Roles)
+	if rolesChanged && !requestUser.Roles.Contains(users.Admin) && (requestUser.UserName == requestedUserName || !canManageUsersWithRoles(requestUser, updatedUser.Roles)) {
+		writeStrErrResp(w, r, http.StatusForbidden, "changing the roles of the user is forbidden")
+		return
+	}
+	enrollmentChanged := !sameElements(preUpdateUser.CoursesAsStudent, updatedUser.CoursesAsStudent) || !sameElements(preUpdateUser.CoursesAsStaff, updatedUser.CoursesAsStaff)
+	if enrollmentChanged && !canManageUsersWithRoles(requestUser, updatedUser.Roles) {
+		writeStrErrResp(w, r, http.StatusForbidden, "changing the courses of the user is forbidden")
+		return
+	}
+	asUser := requestUser.UserName
+	if err := db.Update(asUser, updatedUser); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := reconcileEnrollmentChanges(preUpdateUser.CoursesAsStudent, updatedUser.CoursesAsStudent, asUser); err != nil {
 		writeErrResp(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	writeResponse(w, r, http.StatusAccepted, &Response{Message: fmt.Sprintf("user \"%s\" updated successfully", requestedUserName)})
 }
 
+// reset the password of the user with the given name to the given password
+func handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	requestedUserName := mux.Vars(r)[userName]
+	requestUser := r.Context().Value(authenticatedUser).(*users.User)
+	var body struct {
+		Password	string	`json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if body.Password == "" {
+		writeStrErrResp(w, r, http.StatusBadRequest, "given password can't be empty")
+		return
+	}
+	user, err := users.Get(requestedUserName)
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			writeErrResp(w, r, http.StatusNotFound, err)
+		} else {
+			writeErrResp(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if !canManageUsersWithRoles(requestUser, user.Roles) {
+		writeStrErrResp(w, r, http.StatusForbidden, fmt.Sprintf("resetting the password of user \"%s\" is forbidden", requestedUserName))
+		return
+	}
+	if err := users.ValidatePasswordStrength(user.UserName, body.Password); err != nil {
+		writeErrResp(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := updatePassword(user, body.Password, requestUser.UserName); err != nil {
+		writeErrResp(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResponse(w, r, http.StatusAccepted, &Response{Message: fmt.Sprintf("password of user \"%s\" reset successfully", requestedUserName)})
+}
+
 // configure the users router
 func initUsersRouter(r *mux.Router, manager *authManager) {
 	usersBasePath := fmt.Sprintf("/%s", db.Users)
 	usersRouter := r.PathPrefix(usersBasePath).Subrouter()
 	usersRouter.HandleFunc("/", handleGetAllUsers).Methods(http.MethodGet)
 	usersRouter.HandleFunc("/", handleRegisterUsers).Methods(http.MethodPost)
-	manager.addPathToMap(fmt.Sprintf("%s/", usersBasePath), func (user *users.User, _ *http.Request) bool {
-		return user.Roles.Contains(users.Secretary) || user.Roles.Contains(users.Admin)
-	})
+	manager.addPathPolicy(fmt.Sprintf("%s/", usersBasePath), newPolicy(db.Users, nil, allow(relationAdmin), allow(relationSecretary)))
 	specificUserPath := fmt.Sprintf("/{%s}", userName)
 	usersRouter.HandleFunc(specificUserPath, handleGetUser).Methods(http.MethodGet)
 	usersRouter.HandleFunc(specificUserPath, handleDelUser).Methods(http.MethodDelete)
 	usersRouter.HandleFunc(specificUserPath, handleUpdateUser).Methods(http.MethodPut)
-	manager.addRegex(regexp.MustCompile(fmt.Sprintf("^%s/.", usersBasePath)), func (user *users.User, r *http.Request) bool {
-		isSelfRequest := user.UserName == r.URL.Path[strings.LastIndex(r.URL.Path, "/") + 1 : ] // if the user is accessing his own user data
-		return isSelfRequest || user.Roles.Contains(users.Secretary) || user.Roles.Contains(users.Admin)
-	})
+	usersRouter.HandleFunc(fmt.Sprintf("%s/password", specificUserPath), handleChangePassword).Methods(http.MethodPut)
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/[^/]+/password$", usersBasePath)), newPolicy("user password", func (ar *authRequest) (*authResource, error) {
+		return &authResource{owner: mux.Vars(ar.request)[userName]}, nil
+	}, allow(relationOwner)))
+	usersRouter.HandleFunc(fmt.Sprintf("%s/password_reset", specificUserPath), handleResetPassword).Methods(http.MethodPost)
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/[^/]+/password_reset$", usersBasePath)), newPolicy("user password reset", nil, allow(relationAdmin), allow(relationSecretary)))
+	manager.addRegexPolicy(regexp.MustCompile(fmt.Sprintf("^%s/.", usersBasePath)), newPolicy("user", func (ar *authRequest) (*authResource, error) {
+		// users own their own user data
+		return &authResource{owner: mux.Vars(ar.request)[userName]}, nil
+	}, allow(relationAdmin), allow(relationSecretary), allow(relationOwner)))
 }
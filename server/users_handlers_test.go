@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/courses"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/DAv10195/submit_server/session"
 	"github.com/gorilla/mux"
@@ -224,3 +225,82 @@ func TestUsersHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestSecretaryCapabilities(t *testing.T) {
+	_, cleanup := initDbForUsersHandlersTest()
+	defer cleanup()
+	cleanupSess := session.InitSessionForTest()
+	defer cleanupSess()
+	course, err := courses.NewCourse(1, "course", db.System, true, false)
+	if err != nil {
+		t.Fatalf("error creating course for test: %v", err)
+	}
+	courseKey := string(course.Key())
+	router := newTestRouter(t)
+	initUsersRouter(router.Router, router.am)
+	initCoursesRouter(router.Router, router.am)
+	initAssDefsRouter(router.Router, router.am)
+	rosterPath := fmt.Sprintf("/%s/%d/%d/roster", db.Courses, course.Number, course.Year)
+	testCases := []struct{
+		name	string
+		method	string
+		path	string
+		user	string
+		data	string
+		status	int
+	}{
+		{"test register admin with secretary", http.MethodPost, fmt.Sprintf("/%s/", db.Users), users.Secretary,
+			`{"users":[{"user_name":"new_admin","password":"test","roles":{"elements":{"admin":{}}}}]}`, http.StatusForbidden},
+		{"test update admin with secretary", http.MethodPut, fmt.Sprintf("/%s/%s", db.Users, users.Admin), users.Secretary,
+			`{"first_name":"name"}`, http.StatusForbidden},
+		{"test grant admin role with secretary", http.MethodPut, fmt.Sprintf("/%s/%s", db.Users, users.StandardUser), users.Secretary,
+			`{"roles":{"elements":{"admin":{}}}}`, http.StatusForbidden},
+		{"test grant admin role to self", http.MethodPut, fmt.Sprintf("/%s/%s", db.Users, users.StandardUser), users.StandardUser,
+			`{"roles":{"elements":{"admin":{}}}}`, http.StatusForbidden},
+		{"test enroll self", http.MethodPut, fmt.Sprintf("/%s/%s", db.Users, users.StandardUser), users.StandardUser,
+			fmt.Sprintf(`{"courses_as_student":{"elements":{"%s":{}}}}`, courseKey), http.StatusForbidden},
+		{"test enroll std_user with secretary", http.MethodPut, fmt.Sprintf("/%s/%s", db.Users, users.StandardUser), users.Secretary,
+			fmt.Sprintf(`{"courses_as_student":{"elements":{"%s":{}}}}`, courseKey), http.StatusAccepted},
+		{"test import roster with std_user", http.MethodPost, rosterPath, users.StandardUser,
+			`{"students":[{"user_name":"student","password":"student"}]}`, http.StatusForbidden},
+		{"test reset admin password with secretary", http.MethodPost, fmt.Sprintf("/%s/%s/password_reset", db.Users, users.Admin), users.Secretary,
+			`{"password":"NewPassw0rd"}`, http.StatusForbidden},
+		{"test reset password with std_user", http.MethodPost, fmt.Sprintf("/%s/%s/password_reset", db.Users, users.StandardUser), users.StandardUser,
+			`{"password":"NewPassw0rd"}`, http.StatusForbidden},
+		{"test reset std_user password with secretary", http.MethodPost, fmt.Sprintf("/%s/%s/password_reset", db.Users, users.StandardUser), users.Secretary,
+			`{"password":"NewPassw0rd"}`, http.StatusAccepted},
+		{"test import roster with admin enrolled", http.MethodPost, rosterPath, users.Secretary,
+			`{"staff":[{"user_name":"admin"}]}`, http.StatusBadRequest},
+		{"test create assignment def with secretary", http.MethodPost, fmt.Sprintf("/%s/", db.AssignmentDefinitions), users.Secretary,
+			fmt.Sprintf(`{"course":"%s","name":"ass"}`, courseKey), http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		if w := router.send(tc.method, tc.path, tc.data, tc.user); w.Code != tc.status {
+			t.Fatalf("test case [ %s ] produced status code %d instead of the expected %d status code", tc.name, w.Code, tc.status)
+		}
+	}
+	if _, err := users.Authenticate(users.StandardUser, "NewPassw0rd"); err != nil {
+		t.Fatalf("expected password reset by secretary to take effect: %v", err)
+	}
+	stdUser, err := users.Get(users.StandardUser)
+	if err != nil {
+		t.Fatalf("error getting user for test: %v", err)
+	}
+	if !stdUser.CoursesAsStudent.Contains(courseKey) || !stdUser.Roles.Contains(users.StandardUser) || stdUser.Roles.Contains(users.Admin) {
+		t.Fatalf("unexpected user after updates: %+v", stdUser)
+	}
+	ri := &RosterImport{}
+	router.decode(router.send(http.MethodPost, rosterPath,
+		`{"students":[{"user_name":"std_user"},{"user_name":"student","password":"student"}],"staff":[{"user_name":"lecturer","password":"lecturer"}]}`, users.Secretary), http.StatusAccepted, ri)
+	if len(ri.Created) != 2 || ri.Created[0] != "lecturer" || ri.Created[1] != "student" || len(ri.Enrolled) != 0 ||
+		len(ri.Unchanged) != 1 || ri.Unchanged[0] != users.StandardUser {
+		t.Fatalf("unexpected roster import response: %+v", ri)
+	}
+	lecturer, err := users.Get("lecturer")
+	if err != nil {
+		t.Fatalf("expected roster import to create user: %v", err)
+	}
+	if !lecturer.CoursesAsStaff.Contains(courseKey) || !lecturer.Roles.Contains(users.StandardUser) {
+		t.Fatalf("unexpected user created by roster import: %+v", lecturer)
+	}
+}
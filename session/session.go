@@ -2,40 +2,54 @@ package session
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/DAv10195/submit_server/db"
+	"github.com/DAv10195/submit_server/elements/courses"
 	"github.com/DAv10195/submit_server/elements/users"
 	"github.com/gorilla/sessions"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 )
 
 const (
-	submitCookie		= "submit-server-cookie"
+	SubmitCookie		= "submit-server-cookie"
 	sessionKeyFileName	= "submit_session.key"
 
 	keyLength          			= 32
 	keyFilePerms       			= 0600
 	SubmitMaxCookieAge 			= 10 * 60
-	SubmitSessionUser  			= "submit_session_user"
+	SubmitSessionId  			= "submit_session_id"
+	sessionIdLength				= 32
+	sessionRefreshInterval		= 30 * time.Second
 
 	authenticatedUser			= "authenticated_user"
+
+	ssoCookie					= "submit-server-sso"
+	ssoLoginState				= "sso_login_state"
+	SsoLoginMaxAge				= 10 * 60
 )
 
 var ErrNotFound = errors.New("session not found")
-var ErrAlreadyExists = errors.New("session already exists")
 
 // login data to be returned for clients about their existing session
 type LoginData struct {
-	UserName 		string		`json:"user_name"`
-	Roles 			[]string	`json:"roles"`
-	StaffCourses	[]string	`json:"staff_courses"`
-	StudentCourses	[]string	`json:"student_courses"`
+	UserName 		string				`json:"user_name"`
+	Roles 			[]string			`json:"roles"`
+	StaffCourses	[]string			`json:"staff_courses"`
+	StudentCourses	[]string			`json:"student_courses"`
+	CourseRoles		map[string]string	`json:"course_roles"`
+	Permissions		map[string][]string	`json:"permissions"`
 }
 
 var store *sessions.CookieStore
@@ -64,42 +78,269 @@ func Init(dir string) error {
 		}
 		decodedKey := make([]byte, keyLength)
 		numDecodedBytes, err := base64.StdEncoding.Decode(decodedKey, keyFromFile)
+		if err != nil {
+			return err
+		}
 		if numDecodedBytes != keyLength {
 			return fmt.Errorf("number of bytes in key file (%s) is not as expected (%d)", keyFileName, keyLength)
 		}
+		key = decodedKey
 	}
 	store = sessions.NewCookieStore(key)
 	return nil
 }
 
-// get a session from a http request
-func Get(r *http.Request) (*sessions.Session, error) {
-	sess, err := store.Get(r, submitCookie)
+// a server side session of a user. The cookie of the session holds only its id, which is the secret of the session, so
+// the session is referred to by its handle everywhere else
+type Session struct {
+	db.ABucketElement
+	ID			string		`json:"id"`
+	Handle		string		`json:"handle"`
+	UserName	string		`json:"user_name"`
+	LastSeen	time.Time	`json:"last_seen"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+	IP			string		`json:"ip"`
+	UserAgent	string		`json:"user_agent"`
+	// set only when returning the sessions of a user, marking the session the request was made with
+	Current		bool		`json:"current,omitempty"`
+}
+
+func (s *Session) Key() []byte {
+	return []byte(s.ID)
+}
+
+func (s *Session) Bucket() []byte {
+	return []byte(db.Sessions)
+}
+
+// return the handle of the session with the given id, which can't be used to recover the id
+func handleOf(id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(hash[:])
+}
+
+// parse the given stored session. Sessions created before handles were introduced get their handle here
+func unmarshalSession(sessBytes []byte) (*Session, error) {
+	sess := &Session{}
+	if err := json.Unmarshal(sessBytes, sess); err != nil {
+		return nil, err
+	}
+	if sess.Handle == "" {
+		sess.Handle = handleOf(sess.ID)
+	}
+	return sess, nil
+}
+
+// return the session with the given id
+func GetById(id string) (*Session, error) {
+	sessBytes, err := db.GetFromBucket([]byte(db.Sessions), []byte(id))
 	if err != nil {
 		return nil, err
 	}
-	if sess.IsNew {
-		// delete temporary
-		sess.Options.MaxAge = -1
+	return unmarshalSession(sessBytes)
+}
+
+// return the session with the given handle
+func GetByHandle(handle string) (*Session, error) {
+	var found *Session
+	if err := db.QueryBucket([]byte(db.Sessions), func(_, elemBytes []byte) error {
+		sess, err := unmarshalSession(elemBytes)
+		if err != nil {
+			return err
+		}
+		if sess.Handle == handle {
+			found = sess
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, &db.ErrKeyNotFoundInBucket{Bucket: db.Sessions, Key: handle}
+	}
+	return found, nil
+}
+
+// get the session of a http request. ErrNotFound is returned if the request has no session or if its session was
+// revoked or expired
+func Get(r *http.Request) (*Session, error) {
+	cookieSess, err := store.Get(r, SubmitCookie)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := cookieSess.Values[SubmitSessionId].(string)
+	if cookieSess.IsNew || !ok {
+		return nil, ErrNotFound
+	}
+	sess, err := GetById(id)
+	if err != nil {
+		if _, ok := err.(*db.ErrKeyNotFoundInBucket); ok {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if time.Now().UTC().After(sess.ExpiresAt) {
+		if err := db.Delete(sess); err != nil {
+			return nil, err
+		}
 		return nil, ErrNotFound
 	}
 	return sess, nil
 }
 
-// create new session for the given request and user
-func New(r *http.Request, userName string) (*sessions.Session, error) {
-	sess, err := store.Get(r, submitCookie)
-	if err != nil {
+// create a new session of the given user for the given request, setting its cookie in the given response
+func New(w http.ResponseWriter, r *http.Request, userName string) (*Session, error) {
+	idBytes := make([]byte, sessionIdLength)
+	if _, err := rand.Read(idBytes); err != nil {
 		return nil, err
 	}
-	if !sess.IsNew {
-		return nil, ErrAlreadyExists
+	now := time.Now().UTC()
+	id := hex.EncodeToString(idBytes)
+	sess := &Session{ID: id, Handle: handleOf(id), UserName: userName, LastSeen: now, ExpiresAt: now.Add(SubmitMaxCookieAge * time.Second),
+		IP: RemoteIp(r), UserAgent: r.UserAgent()}
+	if err := db.Update(userName, sess); err != nil {
+		return nil, err
+	}
+	if err := sess.saveCookie(w, r, SubmitMaxCookieAge); err != nil {
+		return nil, err
 	}
-	sess.Values[SubmitSessionUser] = userName
-	sess.Options.MaxAge = SubmitMaxCookieAge
 	return sess, nil
 }
 
+// extend the given session of the given request, as its user is still active
+func (s *Session) Refresh(w http.ResponseWriter, r *http.Request) error {
+	now := time.Now().UTC()
+	// avoid writing to the DB on each request of an active session, and don't notify watchers of the DB about refreshes
+	if now.Sub(s.LastSeen) >= sessionRefreshInterval {
+		s.LastSeen, s.ExpiresAt, s.IP, s.UserAgent = now, now.Add(SubmitMaxCookieAge * time.Second), RemoteIp(r), r.UserAgent()
+		if err := db.UpdateWithoutEvents(s.UserName, s); err != nil {
+			return err
+		}
+	}
+	return s.saveCookie(w, r, SubmitMaxCookieAge)
+}
+
+// remove the session cookie of the given request
+func ClearCookie(w http.ResponseWriter, r *http.Request) error {
+	return (&Session{}).saveCookie(w, r, -1)
+}
+
+func (s *Session) saveCookie(w http.ResponseWriter, r *http.Request, maxAge int) error {
+	cookieSess, err := store.New(r, SubmitCookie)
+	if cookieSess == nil {
+		return err
+	}
+	cookieSess.Values[SubmitSessionId] = s.ID
+	cookieSess.Options.MaxAge = maxAge
+	return cookieSess.Save(r, w)
+}
+
+// keep the given state of a single sign-on login started by the user of the given request in a cookie, until the
+// identity provider redirects the user back
+func SaveSsoLoginState(w http.ResponseWriter, r *http.Request, state string) error {
+	cookieSess, err := store.New(r, ssoCookie)
+	if cookieSess == nil {
+		return err
+	}
+	cookieSess.Values[ssoLoginState] = state
+	cookieSess.Options.MaxAge = SsoLoginMaxAge
+	return cookieSess.Save(r, w)
+}
+
+// return the state of the single sign-on login started by the user of the given request, removing its cookie so it
+// can be used only once. ErrNotFound is returned if no login was started or if its cookie is invalid or expired
+func TakeSsoLoginState(w http.ResponseWriter, r *http.Request) (string, error) {
+	cookieSess, err := store.Get(r, ssoCookie)
+	if err != nil {
+		return "", ErrNotFound
+	}
+	state, ok := cookieSess.Values[ssoLoginState].(string)
+	if cookieSess.IsNew || !ok {
+		return "", ErrNotFound
+	}
+	cookieSess.Options.MaxAge = -1
+	return state, cookieSess.Save(r, w)
+}
+
+// return the ip address the given request was made from
+func RemoteIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// return the sessions of the given user which didn't expire yet, most recently seen first
+func ListOfUser(userName string) ([]*Session, error) {
+	now := time.Now().UTC()
+	var userSessions []*Session
+	if err := db.QueryBucket([]byte(db.Sessions), func(_, elemBytes []byte) error {
+		sess, err := unmarshalSession(elemBytes)
+		if err != nil {
+			return err
+		}
+		if sess.UserName == userName && !now.After(sess.ExpiresAt) {
+			userSessions = append(userSessions, sess)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(userSessions, func(i, j int) bool {
+		return userSessions[i].LastSeen.After(userSessions[j].LastSeen)
+	})
+	return userSessions, nil
+}
+
+// revoke the session with the given id
+func Revoke(id string) error {
+	return db.DeleteKeysFromBucket([]byte(db.Sessions), []byte(id))
+}
+
+// revoke all sessions of the given user. Returns the number of revoked sessions
+func RevokeAllOfUser(userName string) (int, error) {
+	var ids [][]byte
+	if err := db.QueryBucket([]byte(db.Sessions), func(_, elemBytes []byte) error {
+		sess, err := unmarshalSession(elemBytes)
+		if err != nil {
+			return err
+		}
+		if sess.UserName == userName {
+			ids = append(ids, []byte(sess.ID))
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return len(ids), db.DeleteKeysFromBucket([]byte(db.Sessions), ids...)
+}
+
+// delete all expired sessions. Returns the number of deleted sessions
+func DeleteExpired() (int, error) {
+	now := time.Now().UTC()
+	var ids [][]byte
+	if err := db.QueryBucket([]byte(db.Sessions), func(_, elemBytes []byte) error {
+		sess, err := unmarshalSession(elemBytes)
+		if err != nil {
+			return err
+		}
+		if now.After(sess.ExpiresAt) {
+			ids = append(ids, []byte(sess.ID))
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return len(ids), db.DeleteKeysFromBucket([]byte(db.Sessions), ids...)
+}
+
 // write an error
 func writeErr(w http.ResponseWriter, errStr string, logger *logrus.Entry) {
 	w.WriteHeader(http.StatusInternalServerError)
@@ -125,7 +366,21 @@ func LoginHandler(logger *logrus.Entry) func (w http.ResponseWriter, r *http.Req
 			writeErr(w, errMsg, logger)
 			return
 		}
-		ld := &LoginData{UserName: user.UserName, Roles: user.Roles.Slice(), StaffCourses: user.CoursesAsStaff.Slice(), StudentCourses: user.CoursesAsStudent.Slice()}
+		ld := &LoginData{UserName: user.UserName, Roles: user.Roles.Slice(), StaffCourses: user.CoursesAsStaff.Slice(), StudentCourses: user.CoursesAsStudent.Slice(),
+			CourseRoles: make(map[string]string), Permissions: make(map[string][]string)}
+		// the role and permissions of the user in each course he is a staff member of
+		for _, courseKey := range ld.StaffCourses {
+			course, err := courses.Get(courseKey)
+			if err != nil {
+				if logger != nil {
+					logger.WithError(err).Errorf("error getting course '%s' for login data", courseKey)
+				}
+				continue
+			}
+			role := course.StaffRole(user.UserName)
+			ld.CourseRoles[courseKey] = role
+			ld.Permissions[courseKey] = courses.RolePermissions[role]
+		}
 		ldBytes, err := json.Marshal(ld)
 		if err != nil {
 			errMsg := "error formatting login data"